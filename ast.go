@@ -0,0 +1,1003 @@
+package goxpath
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Node is an element of the abstract syntax tree of an XPath expression, as
+// returned by ParseAST. String returns the node as XPath source text that
+// parses back into an equivalent tree. Pos returns the location of the node
+// in the parsed expression: the operator of binary expressions, the opening
+// bracket of predicates, lookups and dynamic calls, and the first token of
+// all other nodes. Nodes that have not been created by ParseAST have an
+// invalid position.
+type Node interface {
+	String() string
+	Pos() Position
+	node()
+}
+
+// position is embedded in all node types.
+type position struct {
+	pos Position
+}
+
+// Pos returns the location of the node in the source text.
+func (p position) Pos() Position {
+	return p.pos
+}
+
+func (p *position) setPos(pos Position) {
+	p.pos = pos
+}
+
+// setPos sets the position of n and returns n.
+func setPos[T interface{ setPos(Position) }](n T, pos Position) T {
+	n.setPos(pos)
+	return n
+}
+
+// ParseAST parses an XPath expression and returns its abstract syntax tree.
+// The tree can be inspected or rewritten and then turned into an evaluation
+// function with CompileAST.
+func ParseAST(expr string) (Node, error) {
+	tl, err := stringToTokenlist(expr)
+	if err != nil {
+		return nil, errorIn(err, expr)
+	}
+	n, err := parseTokens(tl)
+	return n, errorIn(err, expr)
+}
+
+// Binding is a variable binding of a for, let or quantified expression.
+type Binding struct {
+	Name string // variable name without "$"
+	Expr Node
+	lazy bool // moved out of a loop by the optimizer, evaluated on first use
+}
+
+// Param is a parameter of an inline function.
+type Param struct {
+	Name string // variable name without "$"
+	Type string // declared sequence type as written, empty if omitted
+}
+
+// MapConstructorEntry is a key/value pair of a map constructor.
+type MapConstructorEntry struct {
+	Key   Node
+	Value Node
+}
+
+type (
+	// SequenceExpr is a comma separated list of expressions: a, b, c.
+	SequenceExpr struct {
+		position
+		Items []Node
+	}
+
+	// ParenExpr is a parenthesized expression. Expr is nil for the empty
+	// sequence ().
+	ParenExpr struct {
+		position
+		Expr Node
+	}
+
+	// ForExpr is for $x in X, $y in Y return R.
+	ForExpr struct {
+		position
+		Bindings []*Binding
+		Return   Node
+	}
+
+	// LetExpr is let $x := X, $y := Y return R.
+	LetExpr struct {
+		position
+		Bindings []*Binding
+		Return   Node
+	}
+
+	// QuantifiedExpr is some/every $x in X satisfies S.
+	QuantifiedExpr struct {
+		position
+		Quantifier string // "some" or "every"
+		Bindings   []*Binding
+		Satisfies  Node
+	}
+
+	// IfExpr is if (Cond) then Then else Else.
+	IfExpr struct {
+		position
+		Cond Node
+		Then Node
+		Else Node
+	}
+
+	// LogicalExpr is a chain of "or" or "and" operands.
+	LogicalExpr struct {
+		position
+		Op       string // "or" or "and"
+		Operands []Node
+	}
+
+	// ComparisonExpr is a value, general or node comparison.
+	ComparisonExpr struct {
+		position
+		Op    string // =, !=, <, <=, >, >=, eq, ne, lt, le, gt, ge, is, <<, >>
+		Left  Node
+		Right Node
+	}
+
+	// StringConcatExpr is a chain of operands joined with ||.
+	StringConcatExpr struct {
+		position
+		Operands []Node
+	}
+
+	// RangeExpr is From to To.
+	RangeExpr struct {
+		position
+		From Node
+		To   Node
+	}
+
+	// AdditiveExpr is a chain of operands joined with + and -.
+	AdditiveExpr struct {
+		position
+		Operands []Node
+		Ops      []string // len(Ops) == len(Operands)-1
+	}
+
+	// MultiplicativeExpr is a chain of operands joined with *, div, idiv
+	// and mod.
+	MultiplicativeExpr struct {
+		position
+		Operands []Node
+		Ops      []string // len(Ops) == len(Operands)-1
+	}
+
+	// UnionExpr is a chain of operands joined with union or |.
+	UnionExpr struct {
+		position
+		Operands []Node
+	}
+
+	// IntersectExceptExpr is a chain of operands joined with intersect and
+	// except.
+	IntersectExceptExpr struct {
+		position
+		Operands []Node
+		Ops      []string // len(Ops) == len(Operands)-1
+	}
+
+	// InstanceOfExpr is Expr instance of Type.
+	InstanceOfExpr struct {
+		position
+		Expr Node
+		Type *SequenceType
+	}
+
+	// TreatExpr is Expr treat as Type.
+	TreatExpr struct {
+		position
+		Expr Node
+		Type *SequenceType
+	}
+
+	// CastableExpr is Expr castable as Type?.
+	CastableExpr struct {
+		position
+		Expr     Node
+		Type     string // atomic type name such as "xs:integer"
+		Optional bool
+	}
+
+	// CastExpr is Expr cast as Type?.
+	CastExpr struct {
+		position
+		Expr     Node
+		Type     string // atomic type name such as "xs:integer"
+		Optional bool
+	}
+
+	// ArrowExpr is Expr => Function(Args).
+	ArrowExpr struct {
+		position
+		Expr     Node
+		Function string // function name as written
+		Args     []Node
+	}
+
+	// UnaryExpr is a signed expression. A sequence of signs is folded into
+	// a single Op.
+	UnaryExpr struct {
+		position
+		Op   string // "+" or "-"
+		Expr Node
+	}
+
+	// SimpleMapExpr is a chain of operands joined with !.
+	SimpleMapExpr struct {
+		position
+		Operands []Node
+	}
+
+	// PathExpr is a path expression. Root is "/", "//" or "" for relative
+	// paths. Seps holds the separators ("/" or "//") between the steps.
+	PathExpr struct {
+		position
+		Root  string
+		Steps []Node
+		Seps  []string // len(Seps) == len(Steps)-1
+	}
+
+	// AxisStep is a step along an axis with an optional list of predicates.
+	// Abbrev is set for the abbreviated forms ".." and "@".
+	AxisStep struct {
+		position
+		Axis       string // "child", "attribute", "parent", ...
+		Test       Node   // *NameTest, *WildcardTest or *KindTest
+		Predicates []Node
+		Abbrev     bool
+	}
+
+	// FilterExpr is Expr[Predicate].
+	FilterExpr struct {
+		position
+		Expr      Node
+		Predicate Node
+	}
+
+	// LookupExpr is Expr?Key. Expr is nil for the unary lookup ?Key.
+	LookupExpr struct {
+		position
+		Expr     Node
+		Wildcard bool // ?*
+		Key      Node // *Literal for NCName and integer keys
+	}
+
+	// DynamicCallExpr is Func(Args) where Func evaluates to a function,
+	// map or array.
+	DynamicCallExpr struct {
+		position
+		Func Node
+		Args []Node
+	}
+
+	// Literal is a string or numeric literal. Constant folding may produce
+	// literals of other atomic types.
+	Literal struct {
+		position
+		Value Item
+		from  Node // the expression with function calls the literal was folded from
+	}
+
+	// VarRef is a variable reference $Name.
+	VarRef struct {
+		position
+		Name string
+	}
+
+	// ContextItemExpr is the context item ".".
+	ContextItemExpr struct {
+		position
+	}
+
+	// FunctionCall is a static function call. Name is the function name as
+	// written: "local", "prefix:local" or "Q{uri}local".
+	FunctionCall struct {
+		position
+		Name string
+		Args []Node
+	}
+
+	// NamedFunctionRef is Name#Arity.
+	NamedFunctionRef struct {
+		position
+		Name  string
+		Arity int
+	}
+
+	// InlineFunctionExpr is function($a as T, ...) as R { Body }.
+	InlineFunctionExpr struct {
+		position
+		Params     []*Param
+		ReturnType string
+		Body       Node
+	}
+
+	// MapConstructor is map { k: v, ... }.
+	MapConstructor struct {
+		position
+		Entries []*MapConstructorEntry
+	}
+
+	// ArrayConstructor is [a, b] or, if Curly is set, array { Expr }. A
+	// curly array has at most one member.
+	ArrayConstructor struct {
+		position
+		Curly   bool
+		Members []Node
+	}
+
+	// NameTest matches elements or attributes by name ("local",
+	// "prefix:local" or "Q{uri}local").
+	NameTest struct {
+		position
+		Name      string
+		Attribute bool
+	}
+
+	// WildcardTest is "*", "prefix:*", "*:local" or "Q{uri}*".
+	WildcardTest struct {
+		position
+		Name      string
+		Attribute bool
+	}
+
+	// KindTest is a node kind test such as element(name) or text(). Name is
+	// the argument as written, empty if there is none.
+	KindTest struct {
+		position
+		Kind string // "element", "attribute", "node", "text", ...
+		Name string
+	}
+
+	// SequenceType is an item type with an occurrence indicator or
+	// empty-sequence(). ItemType is nil for item types that are not
+	// supported.
+	SequenceType struct {
+		position
+		Empty      bool
+		ItemType   Node // *KindTest, *AtomicType, *AnyItemTest, *MapTest, *ArrayTest or *FunctionTest
+		Occurrence string
+	}
+
+	// AtomicType is an atomic type name such as xs:integer.
+	AtomicType struct {
+		position
+		Name string
+	}
+
+	// AnyItemTest is item().
+	AnyItemTest struct {
+		position
+	}
+
+	// MapTest is map(*).
+	MapTest struct {
+		position
+	}
+
+	// ArrayTest is array(*).
+	ArrayTest struct {
+		position
+	}
+
+	// FunctionTest is function(*).
+	FunctionTest struct {
+		position
+	}
+)
+
+func (*SequenceExpr) node()        {}
+func (*ParenExpr) node()           {}
+func (*ForExpr) node()             {}
+func (*LetExpr) node()             {}
+func (*QuantifiedExpr) node()      {}
+func (*IfExpr) node()              {}
+func (*LogicalExpr) node()         {}
+func (*ComparisonExpr) node()      {}
+func (*StringConcatExpr) node()    {}
+func (*RangeExpr) node()           {}
+func (*AdditiveExpr) node()        {}
+func (*MultiplicativeExpr) node()  {}
+func (*UnionExpr) node()           {}
+func (*IntersectExceptExpr) node() {}
+func (*InstanceOfExpr) node()      {}
+func (*TreatExpr) node()           {}
+func (*CastableExpr) node()        {}
+func (*CastExpr) node()            {}
+func (*ArrowExpr) node()           {}
+func (*UnaryExpr) node()           {}
+func (*SimpleMapExpr) node()       {}
+func (*PathExpr) node()            {}
+func (*AxisStep) node()            {}
+func (*FilterExpr) node()          {}
+func (*LookupExpr) node()          {}
+func (*DynamicCallExpr) node()     {}
+func (*Literal) node()             {}
+func (*VarRef) node()              {}
+func (*ContextItemExpr) node()     {}
+func (*FunctionCall) node()        {}
+func (*NamedFunctionRef) node()    {}
+func (*InlineFunctionExpr) node()  {}
+func (*MapConstructor) node()      {}
+func (*ArrayConstructor) node()    {}
+func (*NameTest) node()            {}
+func (*WildcardTest) node()        {}
+func (*KindTest) node()            {}
+func (*SequenceType) node()        {}
+func (*AtomicType) node()          {}
+func (*AnyItemTest) node()         {}
+func (*MapTest) node()             {}
+func (*ArrayTest) node()           {}
+func (*FunctionTest) node()        {}
+
+// Operator precedence levels used to decide where String must insert
+// parentheses.
+const (
+	precSequence = iota
+	precExprSingle
+	precOr
+	precAnd
+	precComparison
+	precConcat
+	precRange
+	precAdditive
+	precMultiplicative
+	precUnion
+	precIntersect
+	precInstanceOf
+	precTreat
+	precCastable
+	precCast
+	precArrow
+	precUnary
+	precSimpleMap
+	precPath
+	precStep
+	precPostfix
+)
+
+func precedence(n Node) int {
+	switch t := n.(type) {
+	case *SequenceExpr:
+		return precSequence
+	case *ForExpr, *LetExpr, *QuantifiedExpr, *IfExpr:
+		return precExprSingle
+	case *LogicalExpr:
+		if t.Op == "or" {
+			return precOr
+		}
+		return precAnd
+	case *ComparisonExpr:
+		return precComparison
+	case *StringConcatExpr:
+		return precConcat
+	case *RangeExpr:
+		return precRange
+	case *AdditiveExpr:
+		return precAdditive
+	case *MultiplicativeExpr:
+		return precMultiplicative
+	case *UnionExpr:
+		return precUnion
+	case *IntersectExceptExpr:
+		return precIntersect
+	case *InstanceOfExpr:
+		return precInstanceOf
+	case *TreatExpr:
+		return precTreat
+	case *CastableExpr:
+		return precCastable
+	case *CastExpr:
+		return precCast
+	case *ArrowExpr:
+		return precArrow
+	case *UnaryExpr:
+		return precUnary
+	case *SimpleMapExpr:
+		return precSimpleMap
+	case *PathExpr:
+		return precPath
+	case *AxisStep:
+		return precStep
+	}
+	return precPostfix
+}
+
+// operand renders n as an operand of an operator with precedence prec.
+func operand(n Node, prec int) string {
+	if n == nil {
+		return "()"
+	}
+	if precedence(n) < prec {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+func joinOperands(operands []Node, sep string, prec int) string {
+	parts := make([]string, len(operands))
+	for i, o := range operands {
+		p := prec
+		if i > 0 {
+			// operators are left associative
+			p = prec + 1
+		}
+		parts[i] = operand(o, p)
+	}
+	return strings.Join(parts, sep)
+}
+
+func joinOperandsOps(operands []Node, ops []string, prec int) string {
+	var sb strings.Builder
+	for i, o := range operands {
+		p := prec
+		if i > 0 {
+			sb.WriteString(" " + ops[i-1] + " ")
+			p = prec + 1
+		}
+		sb.WriteString(operand(o, p))
+	}
+	return sb.String()
+}
+
+func joinArgs(args []Node) string {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		parts[i] = operand(a, precExprSingle)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func bindingsString(bindings []*Binding, sep string) string {
+	parts := make([]string, len(bindings))
+	for i, b := range bindings {
+		parts[i] = "$" + b.Name + sep + operand(b.Expr, precExprSingle)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (n *SequenceExpr) String() string {
+	return joinArgs(n.Items)
+}
+
+func (n *ParenExpr) String() string {
+	if n.Expr == nil {
+		return "()"
+	}
+	return "(" + n.Expr.String() + ")"
+}
+
+func (n *ForExpr) String() string {
+	return "for " + bindingsString(n.Bindings, " in ") + " return " + operand(n.Return, precExprSingle)
+}
+
+func (n *LetExpr) String() string {
+	return "let " + bindingsString(n.Bindings, " := ") + " return " + operand(n.Return, precExprSingle)
+}
+
+func (n *QuantifiedExpr) String() string {
+	return n.Quantifier + " " + bindingsString(n.Bindings, " in ") + " satisfies " + operand(n.Satisfies, precExprSingle)
+}
+
+func (n *IfExpr) String() string {
+	return "if (" + n.Cond.String() + ") then " + operand(n.Then, precExprSingle) + " else " + operand(n.Else, precExprSingle)
+}
+
+func (n *LogicalExpr) String() string {
+	return joinOperands(n.Operands, " "+n.Op+" ", precedence(n))
+}
+
+func (n *ComparisonExpr) String() string {
+	return operand(n.Left, precConcat) + " " + n.Op + " " + operand(n.Right, precConcat)
+}
+
+func (n *StringConcatExpr) String() string {
+	return joinOperands(n.Operands, " || ", precConcat)
+}
+
+func (n *RangeExpr) String() string {
+	return operand(n.From, precAdditive) + " to " + operand(n.To, precAdditive)
+}
+
+func (n *AdditiveExpr) String() string {
+	return joinOperandsOps(n.Operands, n.Ops, precAdditive)
+}
+
+func (n *MultiplicativeExpr) String() string {
+	return joinOperandsOps(n.Operands, n.Ops, precMultiplicative)
+}
+
+func (n *UnionExpr) String() string {
+	return joinOperands(n.Operands, " | ", precUnion)
+}
+
+func (n *IntersectExceptExpr) String() string {
+	return joinOperandsOps(n.Operands, n.Ops, precIntersect)
+}
+
+func (n *InstanceOfExpr) String() string {
+	return operand(n.Expr, precTreat) + " instance of " + n.Type.String()
+}
+
+func (n *TreatExpr) String() string {
+	return operand(n.Expr, precCastable) + " treat as " + n.Type.String()
+}
+
+func (n *CastableExpr) String() string {
+	s := operand(n.Expr, precCast) + " castable as " + n.Type
+	if n.Optional {
+		s += "?"
+	}
+	return s
+}
+
+func (n *CastExpr) String() string {
+	s := operand(n.Expr, precArrow) + " cast as " + n.Type
+	if n.Optional {
+		s += "?"
+	}
+	return s
+}
+
+func (n *ArrowExpr) String() string {
+	return operand(n.Expr, precArrow) + " => " + n.Function + "(" + joinArgs(n.Args) + ")"
+}
+
+func (n *UnaryExpr) String() string {
+	return n.Op + operand(n.Expr, precSimpleMap)
+}
+
+func (n *SimpleMapExpr) String() string {
+	return joinOperands(n.Operands, " ! ", precPath)
+}
+
+func (n *PathExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(n.Root)
+	for i, step := range n.Steps {
+		if i > 0 {
+			sb.WriteString(n.Seps[i-1])
+		}
+		sb.WriteString(operand(step, precStep))
+	}
+	return sb.String()
+}
+
+func (n *AxisStep) String() string {
+	var sb strings.Builder
+	switch {
+	case n.Abbrev && n.Axis == "parent":
+		sb.WriteString("..")
+	case n.Abbrev && n.Axis == "attribute":
+		sb.WriteString("@" + n.Test.String())
+	default:
+		sb.WriteString(n.Axis + "::" + n.Test.String())
+	}
+	for _, p := range n.Predicates {
+		sb.WriteString("[" + p.String() + "]")
+	}
+	return sb.String()
+}
+
+func (n *FilterExpr) String() string {
+	return operand(n.Expr, precPostfix) + "[" + n.Predicate.String() + "]"
+}
+
+func (n *LookupExpr) String() string {
+	var key string
+	switch {
+	case n.Wildcard:
+		key = "*"
+	case n.Key == nil:
+		key = "()"
+	default:
+		key = "(" + n.Key.String() + ")"
+		if lit, ok := n.Key.(*Literal); ok {
+			switch v := lit.Value.(type) {
+			case int:
+				if v >= 0 {
+					key = strconv.Itoa(v)
+				}
+			case string:
+				if isNCName(v) {
+					key = v
+				}
+			}
+		}
+	}
+	if n.Expr == nil {
+		return "?" + key
+	}
+	return operand(n.Expr, precPostfix) + "?" + key
+}
+
+func (n *DynamicCallExpr) String() string {
+	return operand(n.Func, precPostfix) + "(" + joinArgs(n.Args) + ")"
+}
+
+func (n *Literal) String() string {
+	switch v := n.Value.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case int:
+		if v < 0 {
+			return "(" + strconv.Itoa(v) + ")"
+		}
+		return strconv.Itoa(v)
+	case XSInteger:
+		if v.Subtype == IntInteger {
+			return (&Literal{Value: v.V}).String()
+		}
+	case XSDecimal:
+		f := float64(v)
+		if f >= 0 && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			s := strconv.FormatFloat(f, 'f', -1, 64)
+			if !strings.Contains(s, ".") {
+				s += ".0"
+			}
+			return s
+		}
+	case XSDouble:
+		f := float64(v)
+		if f >= 0 && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			mant, exp, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+			e, _ := strconv.Atoi(exp)
+			return mant + "e" + strconv.Itoa(e)
+		}
+	case bool:
+		return fmt.Sprintf("%t()", v)
+	}
+	return TypeIDOf(n.Value) + "('" + strings.ReplaceAll(itemStringvalue(n.Value), "'", "''") + "')"
+}
+
+func (n *VarRef) String() string {
+	return "$" + n.Name
+}
+
+func (n *ContextItemExpr) String() string {
+	return "."
+}
+
+func (n *FunctionCall) String() string {
+	return n.Name + "(" + joinArgs(n.Args) + ")"
+}
+
+func (n *NamedFunctionRef) String() string {
+	return n.Name + "#" + strconv.Itoa(n.Arity)
+}
+
+func (n *InlineFunctionExpr) String() string {
+	parts := make([]string, len(n.Params))
+	for i, p := range n.Params {
+		parts[i] = "$" + p.Name
+		if p.Type != "" {
+			parts[i] += " as " + p.Type
+		}
+	}
+	s := "function(" + strings.Join(parts, ", ") + ")"
+	if n.ReturnType != "" {
+		s += " as " + n.ReturnType
+	}
+	body := ""
+	if n.Body != nil {
+		body = n.Body.String()
+	}
+	return s + " { " + body + " }"
+}
+
+func (n *MapConstructor) String() string {
+	if len(n.Entries) == 0 {
+		return "map { }"
+	}
+	parts := make([]string, len(n.Entries))
+	for i, e := range n.Entries {
+		parts[i] = operand(e.Key, precExprSingle) + ": " + operand(e.Value, precExprSingle)
+	}
+	return "map { " + strings.Join(parts, ", ") + " }"
+}
+
+func (n *ArrayConstructor) String() string {
+	if n.Curly {
+		if len(n.Members) == 0 || n.Members[0] == nil {
+			return "array { }"
+		}
+		return "array { " + n.Members[0].String() + " }"
+	}
+	return "[" + joinArgs(n.Members) + "]"
+}
+
+func (n *NameTest) String() string {
+	return n.Name
+}
+
+func (n *WildcardTest) String() string {
+	return n.Name
+}
+
+func (n *KindTest) String() string {
+	return n.Kind + "(" + n.Name + ")"
+}
+
+func (n *SequenceType) String() string {
+	if n.Empty {
+		return "empty-sequence()"
+	}
+	if n.ItemType == nil {
+		return "item()" + n.Occurrence
+	}
+	return n.ItemType.String() + n.Occurrence
+}
+
+func (n *AtomicType) String() string {
+	return n.Name
+}
+
+func (*AnyItemTest) String() string {
+	return "item()"
+}
+
+func (*MapTest) String() string {
+	return "map(*)"
+}
+
+func (*ArrayTest) String() string {
+	return "array(*)"
+}
+
+func (*FunctionTest) String() string {
+	return "function(*)"
+}
+
+func isNCName(s string) bool {
+	if s == "" || strings.ContainsRune(s, ':') {
+		return false
+	}
+	for i, r := range s {
+		if i == 0 && !(r == '_' || isLetter(r)) {
+			return false
+		}
+		if !(r == '_' || r == '-' || r == '.' || isLetter(r) || isDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r > 0x7f
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+// A Visitor's Visit method is invoked for each node encountered by Walk. If
+// the result visitor w is not nil, Walk visits each of the children of node
+// with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(node); node must not be nil. If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor w for
+// each of the non-nil children of node, followed by a call of w.Visit(nil).
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	walkList := func(nodes []Node) {
+		for _, n := range nodes {
+			if n != nil {
+				Walk(v, n)
+			}
+		}
+	}
+	walk := func(nodes ...Node) {
+		walkList(nodes)
+	}
+	walkBindings := func(bindings []*Binding) {
+		for _, b := range bindings {
+			walk(b.Expr)
+		}
+	}
+
+	switch n := node.(type) {
+	case *SequenceExpr:
+		walkList(n.Items)
+	case *ParenExpr:
+		walk(n.Expr)
+	case *ForExpr:
+		walkBindings(n.Bindings)
+		walk(n.Return)
+	case *LetExpr:
+		walkBindings(n.Bindings)
+		walk(n.Return)
+	case *QuantifiedExpr:
+		walkBindings(n.Bindings)
+		walk(n.Satisfies)
+	case *IfExpr:
+		walk(n.Cond, n.Then, n.Else)
+	case *LogicalExpr:
+		walkList(n.Operands)
+	case *ComparisonExpr:
+		walk(n.Left, n.Right)
+	case *StringConcatExpr:
+		walkList(n.Operands)
+	case *RangeExpr:
+		walk(n.From, n.To)
+	case *AdditiveExpr:
+		walkList(n.Operands)
+	case *MultiplicativeExpr:
+		walkList(n.Operands)
+	case *UnionExpr:
+		walkList(n.Operands)
+	case *IntersectExceptExpr:
+		walkList(n.Operands)
+	case *InstanceOfExpr:
+		walk(n.Expr)
+		if n.Type != nil {
+			walk(n.Type)
+		}
+	case *TreatExpr:
+		walk(n.Expr)
+		if n.Type != nil {
+			walk(n.Type)
+		}
+	case *CastableExpr:
+		walk(n.Expr)
+	case *CastExpr:
+		walk(n.Expr)
+	case *ArrowExpr:
+		walk(n.Expr)
+		walkList(n.Args)
+	case *UnaryExpr:
+		walk(n.Expr)
+	case *SimpleMapExpr:
+		walkList(n.Operands)
+	case *PathExpr:
+		walkList(n.Steps)
+	case *AxisStep:
+		walk(n.Test)
+		walkList(n.Predicates)
+	case *FilterExpr:
+		walk(n.Expr, n.Predicate)
+	case *LookupExpr:
+		walk(n.Expr, n.Key)
+	case *DynamicCallExpr:
+		walk(n.Func)
+		walkList(n.Args)
+	case *FunctionCall:
+		walkList(n.Args)
+	case *InlineFunctionExpr:
+		walk(n.Body)
+	case *MapConstructor:
+		for _, e := range n.Entries {
+			walk(e.Key, e.Value)
+		}
+	case *ArrayConstructor:
+		walkList(n.Members)
+	case *SequenceType:
+		walk(n.ItemType)
+	case *Literal, *VarRef, *ContextItemExpr, *NamedFunctionRef,
+		*NameTest, *WildcardTest, *KindTest, *AtomicType,
+		*AnyItemTest, *MapTest, *ArrayTest, *FunctionTest:
+		// leaf nodes
+	default:
+		panic(fmt.Sprintf("goxpath.Walk: unexpected node type %T", n))
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a call
+// of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
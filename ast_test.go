@@ -0,0 +1,154 @@
+package goxpath
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseASTString(t *testing.T) {
+	testdata := []struct {
+		input  string
+		output string
+	}{
+		{`/root/sub[1]`, `/child::root/child::sub[1]`},
+		{`//sub/@foo`, `//child::sub/@foo`},
+		{`../text()`, `../child::text()`},
+		{`1 + 2 * 3`, `1 + 2 * 3`},
+		{`(1 + 2) * 3`, `(1 + 2) * 3`},
+		{`- - 3`, `+3`},
+		{`"say ""hi"""`, `'say "hi"'`},
+		{`2.0e3`, `2e3`},
+		{`for $a in (1,2) return $a*2`, `for $a in (1, 2) return $a * 2`},
+		{`let $x := 1, $y := 2 return $x+$y`, `let $x := 1, $y := 2 return $x + $y`},
+		{`some $x in (1,2) satisfies $x>1`, `some $x in (1, 2) satisfies $x > 1`},
+		{`if(true())then 'a' else 'b'`, `if (true()) then 'a' else 'b'`},
+		{`map{'a':1}?a`, `map { 'a': 1 }?a`},
+		{`[1,2]?*`, `[1, 2]?*`},
+		{`'abc' => upper-case()`, `'abc' => upper-case()`},
+		{`'5' cast as xs:integer?`, `'5' cast as xs:integer?`},
+		{`. instance of element()*`, `. instance of element()*`},
+		{`Q{urn:x}f#2`, `Q{urn:x}f#2`},
+		{`function($a as xs:integer) { $a }`, `function($a as xs:integer) { $a }`},
+		{`(1,2,3) ! (. * 2)`, `(1, 2, 3) ! (. * 2)`},
+		{`*:a/b:*`, `child::*:a/child::b:*`},
+		{`Q{urn:x}a/@Q{urn:y}b`, `child::Q{urn:x}a/@Q{urn:y}b`},
+		{`Q{urn:x}*/@*:b`, `child::Q{urn:x}*/@*:b`},
+		{`* * *`, `child::* * child::*`},
+	}
+	for _, td := range testdata {
+		n, err := ParseAST(td.input)
+		if err != nil {
+			t.Errorf("ParseAST(%q): %s", td.input, err)
+			continue
+		}
+		if got := n.String(); got != td.output {
+			t.Errorf("ParseAST(%q).String() = %q, want %q", td.input, got, td.output)
+		}
+	}
+}
+
+func TestASTRoundTrip(t *testing.T) {
+	for _, expr := range []string{
+		`count(/root/sub | /root/other)`,
+		`/root/sub[@foo='bar'][2]/@self`,
+		`count(/root/(sub|other))`,
+		`count(/root/sub except /root/sub[1])`,
+		`string-join((1 to 3) ! string(), '-')`,
+		`every $x in (1,2), $y in (3) satisfies $x < $y`,
+		`let $m := map{1:'a'} return $m(1)`,
+		`function($x) { $x + 1 }(2)`,
+		`10 idiv 3 mod 2`,
+		`(1 = 1 or false()) and false()`,
+		`-(1 + 2)`,
+	} {
+		n, err := ParseAST(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := n.String()
+		var results [2]Sequence
+		for i, e := range []string{expr, src} {
+			np, err := NewParser(strings.NewReader(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[i], err = np.EvaluateUncached(e); err != nil {
+				t.Fatalf("%s: %s", e, err)
+			}
+		}
+		if results[0].String() != results[1].String() {
+			t.Errorf("%s = %v, but %s = %v", expr, results[0], src, results[1])
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	n, err := ParseAST(`for $x in /root/sub return concat($x/@foo, $y, count($x/*))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var functions, vars []string
+	Inspect(n, func(n Node) bool {
+		switch t := n.(type) {
+		case *FunctionCall:
+			functions = append(functions, t.Name)
+		case *VarRef:
+			vars = append(vars, t.Name)
+		}
+		return true
+	})
+	if got := strings.Join(functions, " "); got != "concat count" {
+		t.Errorf("functions = %q, want %q", got, "concat count")
+	}
+	if got := strings.Join(vars, " "); got != "x y x" {
+		t.Errorf("variables = %q, want %q", got, "x y x")
+	}
+}
+
+func TestCompileAST(t *testing.T) {
+	n, err := ParseAST(`count(/root/sub) * 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rewrite the factor
+	Inspect(n, func(n Node) bool {
+		if lit, ok := n.(*Literal); ok {
+			lit.Value = 10
+		}
+		return true
+	})
+	ef, err := CompileAST(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := ef(np.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || !itemsEqual(seq[0], 30) {
+		t.Errorf("got %v, want [30]", seq)
+	}
+}
+
+func TestNodePos(t *testing.T) {
+	n, err := ParseAST("1 +\n  count($a[2])")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Inspect(n, func(n Node) bool {
+		if n != nil {
+			got = append(got, fmt.Sprintf("%T@%s", n, n.Pos()))
+		}
+		return true
+	})
+	expected := "*goxpath.AdditiveExpr@1:3 *goxpath.Literal@1:1 *goxpath.FunctionCall@2:3 *goxpath.FilterExpr@2:11 *goxpath.VarRef@2:9 *goxpath.Literal@2:12"
+	if s := strings.Join(got, " "); s != expected {
+		t.Errorf("positions = %s, want %s", s, expected)
+	}
+}
@@ -0,0 +1,92 @@
+package goxpath
+
+import (
+	"fmt"
+
+	"github.com/speedata/goxml"
+)
+
+const nsXML = "http://www.w3.org/XML/1998/namespace"
+
+// nodeBaseURI returns the base URI of n: the URI of its document, or the
+// static base URI for the context document and parentless elements, with the
+// xml:base attributes of n and its ancestors applied. Nodes without a parent
+// element, such as text nodes, have no base URI.
+func (ctx *Context) nodeBaseURI(n goxml.XMLNode) (string, bool) {
+	var elt *goxml.Element
+	switch t := n.(type) {
+	case *goxml.XMLDocument:
+		uri := ctx.documentURI(t)
+		return uri, uri != ""
+	case *goxml.Element:
+		elt = t
+	case *goxml.Attribute:
+		elt, _ = t.Parent.(*goxml.Element)
+	case goxml.Attribute:
+		elt, _ = t.Parent.(*goxml.Element)
+	}
+	if elt == nil {
+		return "", false
+	}
+	// collect the xml:base attributes from the innermost element outward
+	var bases []string
+	base := ctx.staticBaseURI()
+	for cur := goxml.XMLNode(elt); cur != nil; {
+		e, ok := cur.(*goxml.Element)
+		if !ok {
+			if d, ok := cur.(*goxml.XMLDocument); ok {
+				base = ctx.documentURI(d)
+			}
+			break
+		}
+		for _, attr := range attributes(e) {
+			if attr.Name == "base" && attr.Namespace == nsXML {
+				bases = append(bases, attr.Value)
+				break
+			}
+		}
+		cur = e.Parent
+	}
+	for i := len(bases) - 1; i >= 0; i-- {
+		base = resolveReference(base, bases[i])
+	}
+	return base, base != ""
+}
+
+// resolveArgURI resolves ref, the string value of arg, against the base URI
+// of the node in arg or, if arg is not a node, against the static base URI.
+// This way doc(@href) finds the file relative to the element with the href
+// attribute.
+func (ctx *Context) resolveArgURI(arg Sequence, ref string) string {
+	if len(arg) > 0 {
+		if n, ok := arg[0].(goxml.XMLNode); ok {
+			if base, ok := ctx.nodeBaseURI(n); ok {
+				return resolveReference(base, ref)
+			}
+		}
+	}
+	return ctx.resolveURI(ref)
+}
+
+func fnBaseURI(ctx *Context, args []Sequence) (Sequence, error) {
+	var arg Sequence
+	if len(args) == 0 {
+		if len(ctx.sequence) == 0 {
+			return nil, NewXPathError("XPDY0002", "context item is absent")
+		}
+		arg = ctx.sequence[:1]
+	} else {
+		arg = args[0]
+	}
+	if len(arg) == 0 {
+		return Sequence{}, nil
+	}
+	n, ok := arg[0].(goxml.XMLNode)
+	if !ok {
+		return nil, NewXPathError("XPTY0004", fmt.Sprintf("base-uri: expected a node, got %T", arg[0]))
+	}
+	if base, ok := ctx.nodeBaseURI(n); ok {
+		return Sequence{XSAnyURI(base)}, nil
+	}
+	return Sequence{}, nil
+}
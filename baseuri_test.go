@@ -0,0 +1,65 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestBaseURI(t *testing.T) {
+	main := `<book xml:base="chapters/">
+	<include href="one.xml"/>
+	<part xml:base="part2/"><include href="two.xml"/><abs xml:base="http://example.org/x/"/></part>
+</book>`
+	mapfs := fstest.MapFS{
+		"docs/main.xml":               {Data: []byte(main)},
+		"docs/chapters/one.xml":       {Data: []byte(`<chapter xml:base="sub/">one<ref href="note.txt"/></chapter>`)},
+		"docs/chapters/part2/two.xml": {Data: []byte(`<chapter>two</chapter>`)},
+		"docs/chapters/sub/note.txt":  {Data: []byte(`note`)},
+	}
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`base-uri(/)`, "docs/main.xml", ""},
+		{`base-uri(/book)`, "docs/chapters/", ""},
+		{`base-uri(/book/include)`, "docs/chapters/", ""},
+		{`base-uri(/book/part/include)`, "docs/chapters/part2/", ""},
+		{`base-uri(/book/part/include/@href)`, "docs/chapters/part2/", ""},
+		{`base-uri(/book/part/abs)`, "http://example.org/x/", ""},
+		{`/book/part/include/base-uri()`, "docs/chapters/part2/", ""},
+		{`base-uri(())`, "", ""},
+		{`string(doc(/book/include/@href))`, "one", ""},
+		{`string(doc(/book/part/include/@href))`, "two", ""},
+		{`string(doc(string(/book/include/@href)))`, "", "FODC0002"},
+		{`base-uri(doc(/book/include/@href))`, "docs/chapters/one.xml", ""},
+		{`base-uri(doc(/book/include/@href)/chapter)`, "docs/chapters/sub/", ""},
+		{`doc(/book/include/@href)/chapter/ref/unparsed-text(@href)`, "note", ""},
+		{`doc-available(/book/part/include/@href)`, "true", ""},
+		{`doc-available(string(/book/part/include/@href))`, "false", ""},
+		{`base-uri(1)`, "", "XPTY0004"},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(main))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.BaseURI = "docs/main.xml"
+		np.Ctx.Resolver = FSResolver{mapfs}
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+}
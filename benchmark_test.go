@@ -2,6 +2,7 @@ package goxpath
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -189,3 +190,21 @@ func BenchmarkResetFrom(b *testing.B) {
 		reused.ResetFrom(np.Ctx)
 	}
 }
+
+func BenchmarkParallel(b *testing.B) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		b.Fatal(err)
+	}
+	const expr = `sum((1 to 64) ! sum(for $i in 1 to 2000 return $i mod 7))`
+	for _, parallelism := range []int{0, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			np.Ctx.Parallelism = parallelism
+			for i := 0; i < b.N; i++ {
+				if _, err := np.Evaluate(expr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package goxpath
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCacheSize is the number of parsed expressions kept by DefaultCache.
+const DefaultCacheSize = 1024
+
+// DefaultCache is used by Parser.Evaluate when the parser has no cache of its
+// own. It is bounded, so evaluating an unlimited number of different
+// expressions does not grow memory without limit.
+var DefaultCache ExpressionCache = NewLRUCache(DefaultCacheSize)
+
+// NoCache is an ExpressionCache that never stores anything. Assign it to
+// Parser.Cache to parse every expression anew.
+var NoCache ExpressionCache = noCache{}
+
+// ExpressionCache stores parsed XPath expressions keyed by their source text.
+// Implementations must be safe for concurrent use.
+type ExpressionCache interface {
+	// Get returns the parsed expression for expr and whether it was found.
+	Get(expr string) (EvalFunc, bool)
+	// Put stores the parsed expression for expr.
+	Put(expr string, ef EvalFunc)
+	// Purge removes all entries from the cache.
+	Purge()
+	// Stats returns usage statistics of the cache.
+	Stats() CacheStats
+}
+
+// CacheStats contains usage statistics of an ExpressionCache.
+type CacheStats struct {
+	Hits      uint64 // number of successful lookups
+	Misses    uint64 // number of failed lookups
+	Evictions uint64 // number of entries removed to make room for new ones
+	Len       int    // current number of entries
+}
+
+// LRUCache is an ExpressionCache with a fixed capacity that evicts the least
+// recently used expression when it is full.
+type LRUCache struct {
+	mu        sync.Mutex
+	capacity  int
+	ll        *list.List // front is most recently used
+	items     map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type lruEntry struct {
+	expr string
+	ef   EvalFunc
+}
+
+// NewLRUCache returns a cache that holds at most capacity expressions. A
+// capacity less than one disables caching.
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the parsed expression for expr and marks it as recently used.
+func (c *LRUCache) Get(expr string) (EvalFunc, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.items[expr]; ok {
+		c.hits++
+		c.ll.MoveToFront(elt)
+		return elt.Value.(*lruEntry).ef, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Put stores the parsed expression, evicting the least recently used entry if
+// the cache is full.
+func (c *LRUCache) Put(expr string, ef EvalFunc) {
+	if c.capacity < 1 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.items[expr]; ok {
+		elt.Value.(*lruEntry).ef = ef
+		c.ll.MoveToFront(elt)
+		return
+	}
+	c.items[expr] = c.ll.PushFront(&lruEntry{expr: expr, ef: ef})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).expr)
+		c.evictions++
+	}
+}
+
+// Purge removes all entries. The statistics are kept.
+func (c *LRUCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+}
+
+// Stats returns the usage statistics of the cache.
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       c.ll.Len(),
+	}
+}
+
+type noCache struct{}
+
+func (noCache) Get(string) (EvalFunc, bool) { return nil, false }
+func (noCache) Put(string, EvalFunc)        {}
+func (noCache) Purge()                      {}
+func (noCache) Stats() CacheStats           { return CacheStats{} }
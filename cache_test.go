@@ -0,0 +1,75 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := NewLRUCache(2)
+	ef := func(ctx *Context) (Sequence, error) { return nil, nil }
+	c.Put("a", ef)
+	c.Put("b", ef)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	// b is now the least recently used entry
+	c.Put("c", ef)
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("expected a to be cached")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("expected c to be cached")
+	}
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.Evictions != 1 || stats.Len != 2 {
+		t.Errorf("Stats() = %+v, want 3 hits, 1 miss, 1 eviction, len 2", stats)
+	}
+	c.Purge()
+	if got := c.Stats().Len; got != 0 {
+		t.Errorf("Len after Purge() = %d, want 0", got)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected empty cache after Purge()")
+	}
+}
+
+func TestParserCache(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewLRUCache(10)
+	np.Cache = cache
+	for i := 0; i < 3; i++ {
+		seq, err := np.Evaluate(`count(/root/sub)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seq) != 1 || !itemsEqual(seq[0], 3) {
+			t.Errorf("count(/root/sub) = %v, want 3", seq)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Len != 1 {
+		t.Errorf("Stats() = %+v, want 2 hits, 1 miss, len 1", stats)
+	}
+
+	if _, err = np.EvaluateUncached(`count(/root/other)`); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Len != 1 {
+		t.Errorf("EvaluateUncached must not touch the cache, Stats() = %+v", stats)
+	}
+
+	np.Cache = NoCache
+	seq, err := np.Evaluate(`count(/root/sub)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || !itemsEqual(seq[0], 3) {
+		t.Errorf("count(/root/sub) = %v, want 3", seq)
+	}
+}
@@ -517,6 +517,39 @@ func ToXSInteger(itm Item) (int, error) {
 	}
 }
 
+// noTimezone is the location of dates and times without a timezone. It has
+// a zero offset like time.UTC, but it is a different location, so a value
+// without a timezone can be told apart from one in UTC.
+var noTimezone = time.FixedZone("", 0)
+
+// hasTimezone reports whether t has a timezone.
+func hasTimezone(t time.Time) bool {
+	_, offset := t.Zone()
+	return t.Location() == time.UTC || offset != 0
+}
+
+// parseTemporal parses value with the given layout. Values without a
+// timezone get noTimezone, all others a fixed offset.
+func parseTemporal(layout, value string) (time.Time, error) {
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return t, err
+	}
+	if !strings.HasSuffix(layout, "Z") && !strings.HasSuffix(layout, "07:00") {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), noTimezone), nil
+	}
+	return t.In(fixedZone(t)), nil
+}
+
+// fixedZone returns the fixed offset of t, time.UTC for a zero offset.
+func fixedZone(t time.Time) *time.Location {
+	_, offset := t.Zone()
+	if offset == 0 {
+		return time.UTC
+	}
+	return time.FixedZone("", offset)
+}
+
 func xsTime(ctx *Context, args []Sequence) (Sequence, error) {
 	firstarg, err := StringValue(args[0])
 	if err != nil {
@@ -533,7 +566,7 @@ func xsTime(ctx *Context, args []Sequence) (Sequence, error) {
 		"15:04:05",
 	}
 	for _, format := range formats {
-		t, err := time.Parse(format, firstarg)
+		t, err := parseTemporal(format, firstarg)
 		if err == nil {
 			return Sequence{XSTime(t)}, nil
 		}
@@ -595,7 +628,7 @@ func xsDate(ctx *Context, args []Sequence) (Sequence, error) {
 	}
 
 	for _, format := range formats {
-		t, err := time.Parse(format, firstarg)
+		t, err := parseTemporal(format, firstarg)
 		if err == nil {
 			return Sequence{XSDate(t)}, nil
 		}
@@ -754,7 +787,7 @@ func xsDateTime(ctx *Context, args []Sequence) (Sequence, error) {
 	}
 
 	for _, format := range formats {
-		t, err := time.Parse(format, firstarg)
+		t, err := parseTemporal(format, firstarg)
 		if err == nil {
 			return Sequence{XSDateTime(t)}, nil
 		}
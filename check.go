@@ -0,0 +1,207 @@
+package goxpath
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checker is a Visitor that reports the static errors of an expression:
+// undeclared variables (XPST0008), unknown functions and wrong arities
+// (XPST0017), unbound namespace prefixes (XPST0081) and unknown type names
+// (XPST0051).
+type checker struct {
+	sc        *StaticContext
+	functions map[string][]*Function
+	vars      map[string]int // number of bindings in scope per variable name
+	err       error
+}
+
+// check runs the static checks for the expression tree n and returns the
+// first error in document order.
+func (sc *StaticContext) check(n Node) error {
+	c := &checker{
+		sc:        sc,
+		functions: functionMap(sc.Functions),
+		vars:      make(map[string]int, len(sc.Variables)),
+	}
+	for name := range sc.Variables {
+		c.vars[name]++
+	}
+	Walk(c, n)
+	return c.err
+}
+
+func (c *checker) Visit(n Node) Visitor {
+	if c.err != nil || n == nil {
+		return nil
+	}
+	switch t := n.(type) {
+	case *ForExpr:
+		c.checkScope(t.Bindings, nil, t.Return)
+		return nil
+	case *LetExpr:
+		c.checkScope(t.Bindings, nil, t.Return)
+		return nil
+	case *QuantifiedExpr:
+		c.checkScope(t.Bindings, nil, t.Satisfies)
+		return nil
+	case *InlineFunctionExpr:
+		for _, p := range t.Params {
+			c.checkDeclaredType(t, p.Type)
+		}
+		c.checkDeclaredType(t, t.ReturnType)
+		c.checkScope(nil, t.Params, t.Body)
+		return nil
+	case *CastExpr:
+		c.checkType(t, t.Type)
+	case *CastableExpr:
+		c.checkType(t, t.Type)
+	case *AtomicType:
+		c.checkType(t, t.Name)
+	case *VarRef:
+		if c.vars[t.Name] == 0 {
+			c.fail(t, "XPST0008", fmt.Sprintf("variable $%s is not declared", t.Name))
+		}
+	case *FunctionCall:
+		c.checkFunction(t, t.Name, len(t.Args))
+	case *ArrowExpr:
+		c.checkFunction(t, t.Function, len(t.Args)+1)
+	case *NamedFunctionRef:
+		c.checkFunction(t, t.Name, t.Arity)
+	case *NameTest:
+		c.checkPrefix(t, t.Name)
+	case *WildcardTest:
+		c.checkPrefix(t, t.Name)
+	case *KindTest:
+		c.checkPrefix(t, t.Name)
+	}
+	return c
+}
+
+// checkScope checks the bindings one after another, each one seeing the
+// variables bound before, and then body with all variables in scope.
+func (c *checker) checkScope(bindings []*Binding, params []*Param, body Node) {
+	var bound []string
+	for _, b := range bindings {
+		if b.Expr != nil {
+			Walk(c, b.Expr)
+		}
+		c.vars[b.Name]++
+		bound = append(bound, b.Name)
+	}
+	for _, p := range params {
+		c.vars[p.Name]++
+		bound = append(bound, p.Name)
+	}
+	if body != nil {
+		Walk(c, body)
+	}
+	for _, name := range bound {
+		c.vars[name]--
+	}
+}
+
+func (c *checker) fail(n Node, code, description string) {
+	if c.err == nil {
+		c.err = &XPathError{Code: code, Description: description, Pos: n.Pos()}
+	}
+}
+
+// checkPrefix reports an error if the prefix of the QName is not bound.
+func (c *checker) checkPrefix(n Node, qname string) bool {
+	if strings.HasPrefix(qname, "Q{") {
+		return true
+	}
+	prefix, _, ok := strings.Cut(qname, ":")
+	if !ok || prefix == "*" || prefix == "xml" {
+		return true
+	}
+	if _, ok := c.sc.Namespaces[prefix]; !ok {
+		c.fail(n, "XPST0081", fmt.Sprintf("namespace prefix %q is not declared", prefix))
+		return false
+	}
+	return true
+}
+
+// expand returns the namespace and the local name of a QName or EQName.
+// Names without a prefix are in the namespace defaultNS.
+func (c *checker) expand(name, defaultNS string) (string, string) {
+	if eqname, ok := strings.CutPrefix(name, "Q{"); ok {
+		ns, local, _ := strings.Cut(eqname, "}")
+		return ns, local
+	}
+	if prefix, local, ok := strings.Cut(name, ":"); ok {
+		return c.sc.Namespaces[prefix], local
+	}
+	return defaultNS, name
+}
+
+// checkType reports an error if name is not a built-in atomic type.
+func (c *checker) checkType(n Node, name string) {
+	if !c.checkPrefix(n, name) {
+		return
+	}
+	ns, local := c.expand(name, "")
+	if ns != nsXS || !isAtomicTypeName(local) {
+		c.fail(n, "XPST0051", fmt.Sprintf("unknown atomic type %s", name))
+	}
+}
+
+// checkDeclaredType checks the type of a parameter or the result of an
+// inline function, which is stored as written. Errors are reported at n.
+func (c *checker) checkDeclaredType(n Node, typ string) {
+	if typ == "" {
+		return
+	}
+	tl, err := stringToTokenlist(typ)
+	if err != nil {
+		c.fail(n, "XPST0003", fmt.Sprintf("invalid sequence type %s", typ))
+		return
+	}
+	st, err := parseSequenceType(tl)
+	if _, more := tl.peek(); err != nil || more == nil || (!st.Empty && st.ItemType == nil) {
+		c.fail(n, "XPST0003", fmt.Sprintf("invalid sequence type %s", typ))
+		return
+	}
+	Inspect(st, func(m Node) bool {
+		switch t := m.(type) {
+		case *AtomicType:
+			c.checkType(n, t.Name)
+		case *KindTest:
+			c.checkPrefix(n, t.Name)
+		}
+		return c.err == nil
+	})
+}
+
+// checkFunction reports an error if there is no function with the name that
+// accepts arity arguments.
+func (c *checker) checkFunction(n Node, name string, arity int) {
+	if !c.checkPrefix(n, name) {
+		return
+	}
+	ns, local := c.expand(name, nsFN)
+	if c.lookup(ns, local, arity) != nil {
+		return
+	}
+	if c.lookup(ns, local, -1) == nil {
+		c.fail(n, "XPST0017", fmt.Sprintf("unknown function %s#%d", name, arity))
+	} else {
+		c.fail(n, "XPST0017", fmt.Sprintf("function %s called with %d arguments", name, arity))
+	}
+}
+
+// lookup returns the function of the static context that accepts arity
+// arguments, see Context.lookupFunction. Without a library in the static
+// context the globally registered functions are used; the library of the
+// dynamic context is not known yet.
+func (c *checker) lookup(ns, local string, arity int) *Function {
+	key := ns + " " + local
+	if fn := selectOverload(c.functions[key], arity); fn != nil {
+		return fn
+	}
+	if c.sc.Library != nil {
+		return c.sc.Library.lookup(key, arity)
+	}
+	return selectOverload(xpathfunctions[key], arity)
+}
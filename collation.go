@@ -435,8 +435,7 @@ var _ = strconv.Itoa
 
 // collationFromArg picks the collation referred to by an optional URI argument.
 // If the argument sequence is empty or absent, the static default collation is
-// returned. Relative URIs are resolved against the static base URI from
-// ctx.Store["baseURI"] if present.
+// returned. Relative URIs are resolved against the static base URI of ctx.
 func collationFromArg(ctx *Context, arg Sequence) (Collation, error) {
 	if len(arg) == 0 {
 		return ctx.Collation(), nil
@@ -450,15 +449,7 @@ func collationFromArg(ctx *Context, arg Sequence) (Collation, error) {
 	}
 	// Resolve relative URI against the static base URI.
 	if !strings.Contains(uri, ":") {
-		if ctx.Store != nil {
-			if base, ok := ctx.Store["baseURI"].(string); ok && base != "" {
-				if bu, err := url.Parse(base); err == nil {
-					if ru, err := url.Parse(uri); err == nil {
-						uri = bu.ResolveReference(ru).String()
-					}
-				}
-			}
-		}
+		uri = ctx.resolveURI(uri)
 	}
 	return ResolveCollation(uri)
 }
@@ -0,0 +1,332 @@
+package goxpath
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/speedata/goxml"
+)
+
+// Collection is a list of documents that fn:collection returns and whose
+// URIs fn:uri-collection returns. Register collections with
+// Context.SetCollection.
+type Collection struct {
+	uris     func() ([]string, error)
+	resolver ResourceResolver // nil: the resolver of the context
+	docs     map[string]*goxml.XMLDocument
+}
+
+// GlobCollection returns a collection of the files matching the pattern (see
+// filepath.Glob) in lexical order. The URIs are the file: URIs of the files,
+// which are read with the resolver of the context when fn:collection is
+// called.
+func GlobCollection(pattern string) *Collection {
+	return &Collection{uris: func() ([]string, error) {
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		uris := make([]string, len(names))
+		for i, name := range names {
+			if uris[i], err = fileURI(name); err != nil {
+				return nil, err
+			}
+		}
+		return uris, nil
+	}}
+}
+
+// FSCollection returns a collection of all files in the directory dir of
+// fsys and its subdirectories in lexical order. The URI of a file is its
+// slash separated path in fsys appended to base, an absolute URI such as
+// "https://example.com/templates/" that stands for the root of fsys. The
+// files are read from fsys, the policy of the context is applied to their
+// URIs.
+func FSCollection(fsys fs.FS, dir, base string) *Collection {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return &Collection{
+		resolver: fsCollectionResolver{fsys: fsys, base: base},
+		uris: func() ([]string, error) {
+			var uris []string
+			err := fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.Type().IsRegular() {
+					uris = append(uris, base+(&url.URL{Path: name}).EscapedPath())
+				}
+				return nil
+			})
+			return uris, err
+		},
+	}
+}
+
+// fsCollectionResolver reads the files of an FSCollection, whose URIs start
+// with base.
+type fsCollectionResolver struct {
+	fsys fs.FS
+	base string
+}
+
+func (r fsCollectionResolver) Resolve(uri string) (io.ReadCloser, string, error) {
+	rest, ok := strings.CutPrefix(uri, r.base)
+	if !ok {
+		return nil, "", notExist(uri)
+	}
+	name, err := url.PathUnescape(rest)
+	if err != nil {
+		return nil, "", notExist(uri)
+	}
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mediaTypeByName(name), nil
+}
+
+// URICollection returns a collection of the resources at the given URIs in
+// the given order. Relative URIs are resolved against the static base URI of
+// the context and file names become file: URIs. The resources are read with
+// the resolver of the context.
+func URICollection(uris ...string) *Collection {
+	uris = slices.Clone(uris)
+	return &Collection{uris: func() ([]string, error) {
+		return uris, nil
+	}}
+}
+
+// DocumentCollection returns a collection of parsed documents, keyed by
+// their URIs. The documents are ordered by URI. Relative URIs are resolved
+// like those of URICollection. fn:doc returns the same document for a URI
+// once the collection has been read.
+func DocumentCollection(docs map[string]*goxml.XMLDocument) *Collection {
+	docs = maps.Clone(docs)
+	return &Collection{
+		docs: docs,
+		uris: func() ([]string, error) {
+			return slices.Sorted(maps.Keys(docs)), nil
+		},
+	}
+}
+
+// SetCollection registers the collection c under the URI uri. The empty URI
+// sets the default collection, which fn:collection#0 returns. A nil c removes
+// the collection. Collections set on a copy of the context are not visible in
+// ctx and the other copies.
+func (ctx *Context) SetCollection(uri string, c *Collection) {
+	// the copies of the context share the map, so it is replaced, not changed
+	collections := maps.Clone(ctx.collections)
+	if c == nil {
+		delete(collections, uri)
+	} else {
+		if collections == nil {
+			collections = make(map[string]*Collection)
+		}
+		collections[uri] = c
+	}
+	ctx.collections = collections
+}
+
+// collection returns the collection named by the first argument of
+// fn:collection or fn:uri-collection.
+func (ctx *Context) collection(args []Sequence) (*Collection, error) {
+	uri := ""
+	if len(args) > 0 && len(args[0]) > 0 {
+		var err error
+		if uri, err = StringValue(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	if p := ctx.Policy; p != nil && p.DenyResources {
+		return nil, NewXPathError("FODC0002", fmt.Sprintf("access to collection %q denied by policy", uri))
+	}
+	c, ok := ctx.collections[uri]
+	if !ok && uri != "" {
+		c, ok = ctx.collections[ctx.resolveURI(uri)]
+	}
+	if !ok {
+		if uri == "" {
+			return nil, NewXPathError("FODC0002", "no default collection")
+		}
+		return nil, NewXPathError("FODC0002", fmt.Sprintf("unknown collection %q", uri))
+	}
+	return c, nil
+}
+
+// resourceURIs returns the references to the resources of c as given by the
+// collection.
+func (c *Collection) resourceURIs() ([]string, error) {
+	uris, err := c.uris()
+	if err != nil {
+		return nil, NewXPathError("FODC0002", fmt.Sprintf("cannot list collection: %v", err))
+	}
+	return uris, nil
+}
+
+// absoluteURI returns the absolute URI of the resource ref of a collection.
+// ref is resolved against the static base URI of ctx, a file name becomes a
+// file: URI.
+func (ctx *Context) absoluteURI(ref string) (string, error) {
+	uri := ctx.resolveURI(ref)
+	if hasScheme(uri) {
+		return uri, nil
+	}
+	uri, err := fileURI(uri)
+	if err != nil {
+		return "", NewXPathError("FODC0002", fmt.Sprintf("cannot resolve %q: %v", ref, err))
+	}
+	return uri, nil
+}
+
+// fileURI returns the file: URI of the file name.
+func fileURI(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.ToSlash(abs)
+	if !strings.HasPrefix(p, "/") {
+		// a Windows drive letter
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String(), nil
+}
+
+func fnCollection(ctx *Context, args []Sequence) (Sequence, error) {
+	c, err := ctx.collection(args)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := c.resourceURIs()
+	if err != nil {
+		return nil, err
+	}
+	resolver := c.resolver
+	if resolver == nil {
+		resolver = ctx.resolver()
+	}
+	seq := make(Sequence, 0, len(refs))
+	for _, ref := range refs {
+		uri, err := ctx.absoluteURI(ref)
+		if err != nil {
+			return nil, err
+		}
+		if doc, ok := c.docs[ref]; ok {
+			seq = append(seq, ctx.docCache().put(uri, doc))
+			continue
+		}
+		doc, err := ctx.loadDocument(resolver, uri)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, doc)
+	}
+	return seq, nil
+}
+
+func fnURICollection(ctx *Context, args []Sequence) (Sequence, error) {
+	c, err := ctx.collection(args)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := c.resourceURIs()
+	if err != nil {
+		return nil, err
+	}
+	seq := make(Sequence, len(refs))
+	for i, ref := range refs {
+		uri, err := ctx.absoluteURI(ref)
+		if err != nil {
+			return nil, err
+		}
+		seq[i] = XSAnyURI(uri)
+	}
+	return seq, nil
+}
+
+// documentCache holds the documents read by fn:doc and fn:collection, keyed
+// by their resolved URIs. It is shared by the copies of a context and safe
+// for concurrent evaluations.
+type documentCache struct {
+	mu   sync.Mutex
+	docs map[string]*goxml.XMLDocument
+}
+
+func newDocumentCache() *documentCache {
+	return &documentCache{docs: make(map[string]*goxml.XMLDocument)}
+}
+
+func (c *documentCache) get(uri string) (*goxml.XMLDocument, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc, ok := c.docs[uri]
+	return doc, ok
+}
+
+// put stores doc unless another evaluation has stored a document for uri in
+// the meantime and returns the stored document.
+func (c *documentCache) put(uri string, doc *goxml.XMLDocument) *goxml.XMLDocument {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.docs[uri]; ok {
+		return cached
+	}
+	c.docs[uri] = doc
+	return doc
+}
+
+// uri returns the URI of doc.
+func (c *documentCache) uri(doc *goxml.XMLDocument) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uri, d := range c.docs {
+		if d == doc {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// docCache returns the document cache of ctx.
+func (ctx *Context) docCache() *documentCache {
+	if ctx.docs == nil {
+		ctx.docs = newDocumentCache()
+	}
+	return ctx.docs
+}
+
+// loadDocument returns the document at the resolved uri from the available
+// documents or the document cache or reads it with r. The policy of ctx is
+// checked first, since the cache is shared by the copies of the context.
+func (ctx *Context) loadDocument(r ResourceResolver, uri string) (*goxml.XMLDocument, error) {
+	if err := ctx.checkResource("FODC0002", uri); err != nil {
+		return nil, err
+	}
+	if doc, ok := ctx.Documents[uri]; ok {
+		return doc, nil
+	}
+	cache := ctx.docCache()
+	if doc, ok := cache.get(uri); ok {
+		return doc, nil
+	}
+	f, _, err := ctx.openResourceWith(r, "FODC0002", uri)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	doc, err := goxml.Parse(f)
+	if err != nil {
+		return nil, NewXPathError("FODC0002", fmt.Sprintf("error parsing %q: %v", uri, err))
+	}
+	return cache.put(uri, doc), nil
+}
@@ -0,0 +1,143 @@
+package goxpath
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/speedata/goxml"
+)
+
+func TestCollection(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"b.xml": `<b/>`, "a.xml": `<a/>`, "c.txt": `text`} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mapfs := fstest.MapFS{
+		"docs/2.xml":     {Data: []byte(`<two/>`)},
+		"docs/1.xml":     {Data: []byte(`<one/>`)},
+		"docs/sub/3.xml": {Data: []byte(`<three/>`)},
+		"other/x.xml":    {Data: []byte(`<x/>`)},
+	}
+	memDoc, err := goxml.Parse(strings.NewReader(`<mem/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirURI, err := fileURI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`string-join(collection() ! local-name(*), ' ')`, "a b", ""},
+		{`string-join(uri-collection() ! substring-after(., '` + dirURI + `/'), ' ')`, "a.xml b.xml", ""},
+		{`uri-collection()[1] instance of xs:anyURI`, "true", ""},
+		{`string-join(collection('urn:fs') ! local-name(*), ' ')`, "one two three", ""},
+		{`string-join(uri-collection('urn:fs'), ' ')`, "https://example.com/fs/docs/1.xml https://example.com/fs/docs/2.xml https://example.com/fs/docs/sub/3.xml", ""},
+		{`collection('urn:fs')[1] is doc('https://example.com/fs/docs/1.xml')`, "true", ""},
+		{`string-join(collection('urn:list') ! local-name(*), ' ')`, "b a", ""},
+		{`local-name(collection('urn:mem')/*)`, "mem", ""},
+		{`collection('urn:mem') is doc('urn:mem/doc.xml')`, "true", ""},
+		{`collection()[1] is doc(uri-collection()[1])`, "true", ""},
+		{`uri-collection('urn:list')[1] = '` + dirURI + `/b.xml'`, "true", ""},
+		{`uri-collection('urn:relative')`, "https://example.com/base/x.xml", ""},
+		{`collection('urn:unknown')`, "", "FODC0002"},
+		{`collection('urn:broken')`, "", "FODC0002"},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.SetCollection("", GlobCollection(filepath.Join(dir, "*.xml")))
+		np.Ctx.SetCollection("urn:fs", FSCollection(mapfs, "docs", "https://example.com/fs"))
+		np.Ctx.SetCollection("urn:list", URICollection(filepath.Join(dir, "b.xml"), filepath.Join(dir, "a.xml")))
+		np.Ctx.SetCollection("urn:mem", DocumentCollection(map[string]*goxml.XMLDocument{"urn:mem/doc.xml": memDoc}))
+		np.Ctx.SetCollection("urn:broken", URICollection(filepath.Join(dir, "missing.xml")))
+		np.Ctx.SetCollection("urn:relative", URICollection("x.xml"))
+		if strings.Contains(td.input, "urn:relative") {
+			np.Ctx.BaseURI = "https://example.com/base/main.xml"
+		}
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = np.Evaluate(`collection()`); err == nil {
+		t.Errorf("collection() without a default collection succeeded")
+	}
+	np.Ctx.SetCollection("", URICollection(filepath.Join(dir, "a.xml")))
+	np.Ctx.Policy = StrictPolicy()
+	if _, err = np.Evaluate(`uri-collection()`); err == nil {
+		t.Errorf("uri-collection() with StrictPolicy succeeded")
+	}
+	np.Ctx.Policy = nil
+
+	// the URIs are absolute, so they are independent of the base URI
+	for _, uri := range []string{"", "urn:fs", "urn:list", "urn:mem"} {
+		np.Ctx.SetCollection("urn:fs", FSCollection(mapfs, "docs", "https://example.com/fs"))
+		np.Ctx.SetCollection("urn:list", URICollection("b.xml", filepath.Join(dir, "a.xml")))
+		np.Ctx.SetCollection("urn:mem", DocumentCollection(map[string]*goxml.XMLDocument{"doc.xml": memDoc}))
+		seq, err := np.Evaluate(`uri-collection('` + uri + `')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, itm := range seq {
+			if u, err := url.Parse(string(itm.(XSAnyURI))); err != nil || !u.IsAbs() {
+				t.Errorf("uri-collection(%q) returns the relative URI %v", uri, itm)
+			}
+		}
+	}
+	// the files of an FSCollection are checked by their URIs, not as local files
+	np.Ctx.Policy = &Policy{AllowedSchemes: []string{"file"}}
+	if _, err = np.Evaluate(`collection('urn:fs')`); err == nil {
+		t.Errorf("collection of an fs.FS with a denied scheme succeeded")
+	}
+	np.Ctx.Policy = &Policy{AllowedRoots: []string{dir}}
+	if _, err = np.Evaluate(`collection('urn:fs')`); err != nil {
+		t.Errorf("collection of an fs.FS outside of the allowed directories: %s", err)
+	}
+	np.Ctx.Policy = &Policy{AllowedSchemes: []string{"file"}}
+	if _, err = np.Evaluate(`collection()`); err != nil {
+		t.Errorf("collection of local files with the file scheme allowed: %s", err)
+	}
+	np.Ctx.Policy = nil
+	// collections set or removed on a copy are not visible in the original
+	cp := CopyContext(np.Ctx)
+	cp.SetCollection("urn:copy", URICollection(filepath.Join(dir, "b.xml")))
+	cp.SetCollection("", nil)
+	if _, ok := np.Ctx.collections["urn:copy"]; ok {
+		t.Errorf("collection set on a copy is visible in the original")
+	}
+	if _, ok := np.Ctx.collections[""]; !ok {
+		t.Errorf("collection removed on a copy is removed from the original")
+	}
+	np.Ctx.SetCollection("", nil)
+	if _, err = np.Evaluate(`collection()`); err == nil {
+		t.Errorf("collection() after removing the default collection succeeded")
+	}
+}
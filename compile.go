@@ -0,0 +1,2393 @@
+package goxpath
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/speedata/goxml"
+)
+
+// CompileAST turns a syntax tree as returned by ParseAST into a function
+// that evaluates the expression.
+func CompileAST(n Node) (EvalFunc, error) {
+	return compile(n)
+}
+
+// compile compiles n. Errors raised while compiling or evaluating n are
+// reported at the position of n unless a nested node has already claimed
+// them.
+func compile(n Node) (EvalFunc, error) {
+	if n == nil {
+		return nil, nil
+	}
+	pos := n.Pos()
+	ef, err := compileNode(n)
+	if err != nil {
+		return nil, staticError(err, pos)
+	}
+	if ef == nil {
+		return ef, nil
+	}
+	// only the expressions that create items count towards MaxItems,
+	// the others pass on what they get
+	creates := false
+	switch n.(type) {
+	case *Literal, *ContextItemExpr, *ParenExpr:
+		// these never raise errors of their own
+		return ef, nil
+	case *AxisStep, *RangeExpr, *ForExpr, *SequenceExpr:
+		creates = true
+	}
+	return func(ctx *Context) (Sequence, error) {
+		if ctx.eval != nil {
+			if err := ctx.eval.check(); err != nil {
+				return nil, errorAt(err, pos)
+			}
+		}
+		seq, err := ef(ctx)
+		if err != nil {
+			return seq, errorAt(err, pos)
+		}
+		if ctx.eval != nil {
+			if creates {
+				err = ctx.eval.produced(len(seq))
+			} else {
+				err = ctx.eval.checkSequenceLength(len(seq))
+			}
+			if err != nil {
+				return nil, errorAt(err, pos)
+			}
+		}
+		return seq, nil
+	}, nil
+}
+
+func compileNode(n Node) (EvalFunc, error) {
+	switch t := n.(type) {
+	case *SequenceExpr:
+		return compileSequenceExpr(t)
+	case *ParenExpr:
+		return compileParenExpr(t)
+	case *ForExpr:
+		return compileForExpr(t)
+	case *LetExpr:
+		return compileLetExpr(t)
+	case *QuantifiedExpr:
+		return compileQuantifiedExpr(t)
+	case *IfExpr:
+		return compileIfExpr(t)
+	case *LogicalExpr:
+		return compileLogicalExpr(t)
+	case *ComparisonExpr:
+		return compileComparisonExpr(t)
+	case *StringConcatExpr:
+		return compileStringConcatExpr(t)
+	case *RangeExpr:
+		return compileRangeExpr(t)
+	case *AdditiveExpr:
+		return compileAdditiveExpr(t)
+	case *MultiplicativeExpr:
+		return compileMultiplicativeExpr(t)
+	case *UnionExpr:
+		return compileUnionExpr(t)
+	case *IntersectExceptExpr:
+		return compileIntersectExceptExpr(t)
+	case *InstanceOfExpr:
+		return compileInstanceOfExpr(t)
+	case *TreatExpr:
+		return compileTreatExpr(t)
+	case *CastableExpr:
+		return compileCastableExpr(t)
+	case *CastExpr:
+		return compileCastExpr(t)
+	case *ArrowExpr:
+		return compileArrowExpr(t)
+	case *UnaryExpr:
+		return compileUnaryExpr(t)
+	case *SimpleMapExpr:
+		return compileSimpleMapExpr(t)
+	case *PathExpr:
+		return compilePathExpr(t)
+	case *AxisStep:
+		return compileAxisStep(t)
+	case *FilterExpr:
+		return compileFilterExpr(t)
+	case *LookupExpr:
+		return compileLookupExpr(t)
+	case *DynamicCallExpr:
+		return compileDynamicCallExpr(t)
+	case *Literal:
+		if t.from != nil {
+			return compileFoldedLiteral(t)
+		}
+		val := t.Value
+		return func(ctx *Context) (Sequence, error) {
+			return Sequence{val}, nil
+		}, nil
+	case *VarRef:
+		varname := t.Name
+		return func(ctx *Context) (Sequence, error) {
+			return ctx.varValue(varname)
+		}, nil
+	case *ContextItemExpr:
+		return func(ctx *Context) (Sequence, error) {
+			return ctx.sequence, nil
+		}, nil
+	case *FunctionCall:
+		return compileFunctionCall(t)
+	case *NamedFunctionRef:
+		return compileNamedFunctionRef(t)
+	case *InlineFunctionExpr:
+		return compileInlineFunctionExpr(t)
+	case *MapConstructor:
+		return compileMapConstructor(t)
+	case *ArrayConstructor:
+		return compileArrayConstructor(t)
+	}
+	return nil, fmt.Errorf("cannot compile %T", n)
+}
+
+// compileList compiles each node of the list.
+func compileList(nodes []Node) ([]EvalFunc, error) {
+	efs := make([]EvalFunc, len(nodes))
+	for i, n := range nodes {
+		ef, err := compile(n)
+		if err != nil {
+			return nil, err
+		}
+		efs[i] = ef
+	}
+	return efs, nil
+}
+
+func compileSequenceExpr(n *SequenceExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Items)
+	if err != nil {
+		return nil, err
+	}
+	f := func(ctx *Context) (Sequence, error) {
+		var ret Sequence
+		saveContext := ctx.sequence
+		for _, ef := range efs {
+			ctx.sequence = saveContext
+			seq, err := ef(ctx)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, seq...)
+		}
+
+		return ret, nil
+	}
+	return f, nil
+}
+
+func compileParenExpr(n *ParenExpr) (EvalFunc, error) {
+	if n.Expr == nil {
+		// Empty parenthesized expression () = empty sequence
+		return func(ctx *Context) (Sequence, error) {
+			return Sequence{}, nil
+		}, nil
+	}
+	exp, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		seq, err := exp(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return seq, nil
+	}
+	return ef, nil
+}
+
+// compileBindings compiles the expressions of the bindings and returns them
+// together with the variable names.
+func compileBindings(bindings []*Binding) ([]string, []EvalFunc, error) {
+	varnames := make([]string, len(bindings))
+	efs := make([]EvalFunc, len(bindings))
+	for i, b := range bindings {
+		ef, err := compile(b.Expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		varnames[i] = b.Name
+		efs[i] = ef
+	}
+	return varnames, efs, nil
+}
+
+// compileBinding compiles the expression of a let binding. The value of a
+// lazy binding is a lazyValue that is computed when the variable is read.
+func compileBinding(b *Binding) (EvalFunc, error) {
+	ef, err := compile(b.Expr)
+	if err != nil || !b.lazy {
+		return ef, err
+	}
+	refs := slices.Collect(maps.Keys(varRefs(b.Expr, make(map[string]bool))))
+	return func(ctx *Context) (Sequence, error) {
+		lv := &lazyValue{ef: ef, vars: make(map[string]Sequence, len(refs))}
+		for _, name := range refs {
+			if v, ok := ctx.vars[name]; ok {
+				lv.vars[name] = v
+			}
+		}
+		return Sequence{lv}, nil
+	}, nil
+}
+
+// lazyValue is the value of a let binding that the optimizer has moved out
+// of a loop. It is computed once, when the variable is first read, with the
+// variables in scope of the binding.
+type lazyValue struct {
+	ef   EvalFunc
+	vars map[string]Sequence
+	once sync.Once
+	seq  Sequence
+	err  error
+}
+
+// value returns the value of lv and computes it in ctx if necessary.
+func (lv *lazyValue) value(ctx *Context) (Sequence, error) {
+	lv.once.Do(func() {
+		saved := make(map[string]Sequence, len(lv.vars))
+		for name, v := range lv.vars {
+			saved[name] = ctx.vars[name]
+			ctx.vars[name] = v
+		}
+		saveSeq := ctx.sequence
+		savePos, saveSize := ctx.Pos, ctx.size
+		savePositions, saveLengths := ctx.ctxPositions, ctx.ctxLengths
+		lv.seq, lv.err = lv.ef(ctx)
+		ctx.sequence = saveSeq
+		ctx.Pos, ctx.size = savePos, saveSize
+		ctx.ctxPositions, ctx.ctxLengths = savePositions, saveLengths
+		maps.Copy(ctx.vars, saved)
+		lv.ef, lv.vars = nil, nil
+	})
+	return lv.seq, lv.err
+}
+
+// varValue returns the value of the variable name in ctx.
+func (ctx *Context) varValue(name string) (Sequence, error) {
+	seq := ctx.vars[name]
+	if len(seq) == 1 {
+		if lv, ok := seq[0].(*lazyValue); ok {
+			return lv.value(ctx)
+		}
+	}
+	return seq, nil
+}
+
+func compileForExpr(n *ForExpr) (EvalFunc, error) {
+	varnames, efs, err := compileBindings(n.Bindings)
+	if err != nil {
+		return nil, err
+	}
+	evalseq, err := compile(n.Return)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := func(ctx *Context) (Sequence, error) {
+		var s Sequence
+		var err error
+
+		sequences := []Sequence{}
+		for _, ef := range efs {
+			newcontext := CopyContext(ctx)
+			s, err = ef(newcontext)
+			if err != nil {
+				return nil, err
+			}
+			sequences = append(sequences, s)
+		}
+		// go recursively through all variable combinations
+		var f func([]string, []Sequence, *Context) (Sequence, error)
+		f = func(varnames []string, sequences []Sequence, ctx *Context) (Sequence, error) {
+			seq := Sequence{}
+			varname := varnames[0]
+			sequence := sequences[0]
+
+			for _, itm := range sequence {
+				if err := ctx.checkEval(); err != nil {
+					return nil, err
+				}
+				ctx.vars[varname] = Sequence{itm}
+				ctx.sequence = Sequence{itm}
+
+				if len(varnames) > 1 {
+					s, err := f(varnames[1:], sequences[1:], ctx)
+					if err != nil {
+						return nil, err
+					}
+					for _, sitm := range s {
+						seq = append(seq, sitm)
+					}
+				} else {
+					s, err := evalseq(ctx)
+					if err != nil {
+						return nil, err
+					}
+					for _, sitm := range s {
+						seq = append(seq, sitm)
+					}
+				}
+			}
+			return seq, nil
+		}
+		if ctx.parallel(len(sequences[0])) {
+			// the iterations of the first binding run in parallel
+			results, err := ctx.parallelEach(len(sequences[0]), func(frame *Context, i int) (Sequence, error) {
+				itm := sequences[0][i]
+				frame.vars[varnames[0]] = Sequence{itm}
+				frame.sequence = Sequence{itm}
+				if len(varnames) > 1 {
+					return f(varnames[1:], sequences[1:], frame)
+				}
+				return evalseq(frame)
+			})
+			if err != nil {
+				return nil, err
+			}
+			seq := Sequence{}
+			for _, s := range results {
+				seq = append(seq, s...)
+			}
+			ctx.sequence = seq
+			return seq, nil
+		}
+		var oldValues []Sequence
+		for _, vn := range varnames {
+			oldValues = append(oldValues, ctx.vars[vn])
+		}
+		seq, err := f(varnames, sequences, ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i, vn := range varnames {
+			ctx.vars[vn] = oldValues[i]
+		}
+		ctx.sequence = seq
+		return seq, nil
+	}
+	return ret, nil
+}
+
+func compileLetExpr(n *LetExpr) (EvalFunc, error) {
+	type letBinding struct {
+		varname string
+		expr    EvalFunc
+	}
+	var bindings []letBinding
+	for _, b := range n.Bindings {
+		valEf, err := compileBinding(b)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, letBinding{varname: b.Name, expr: valEf})
+	}
+	returnEf, err := compile(n.Return)
+	if err != nil {
+		return nil, err
+	}
+
+	ef := func(ctx *Context) (Sequence, error) {
+		// Save old variable values
+		oldValues := make(map[string]Sequence, len(bindings))
+		for _, b := range bindings {
+			oldValues[b.varname] = ctx.vars[b.varname]
+		}
+		// Bind new values
+		for _, b := range bindings {
+			val, err := b.expr(ctx)
+			if err != nil {
+				// Restore
+				for _, b2 := range bindings {
+					ctx.vars[b2.varname] = oldValues[b2.varname]
+				}
+				return nil, err
+			}
+			ctx.vars[b.varname] = val
+		}
+		// Evaluate return expression
+		result, err := returnEf(ctx)
+		// Restore old values
+		for _, b := range bindings {
+			ctx.vars[b.varname] = oldValues[b.varname]
+		}
+		return result, err
+	}
+	return ef, nil
+}
+
+func compileQuantifiedExpr(n *QuantifiedExpr) (EvalFunc, error) {
+	if len(n.Bindings) == 1 {
+		return compileLazyQuantified(n)
+	}
+	varnames, efs, err := compileBindings(n.Bindings)
+	if err != nil {
+		return nil, err
+	}
+	lastEf, err := compile(n.Satisfies)
+	if err != nil {
+		return nil, err
+	}
+	someEvery := n.Quantifier
+
+	evaler := func(ctx *Context) (Sequence, error) {
+		var s Sequence
+		var err error
+		sequences := []Sequence{}
+		for _, ef := range efs {
+			newcontext := CopyContext(ctx)
+			s, err = ef(newcontext)
+			if err != nil {
+				return nil, err
+			}
+			sequences = append(sequences, s)
+		}
+		// go recursively through all variable combinations
+		var f func([]string, []Sequence, *Context) (Sequence, error)
+		f = func(varnames []string, sequences []Sequence, ctx *Context) (Sequence, error) {
+			seq := Sequence{}
+			varname := varnames[0]
+			sequence := sequences[0]
+
+			for _, itm := range sequence {
+				if err := ctx.checkEval(); err != nil {
+					return nil, err
+				}
+				ctx.vars[varname] = Sequence{itm}
+				ctx.sequence = Sequence{itm}
+				if len(varnames) > 1 {
+					s, err := f(varnames[1:], sequences[1:], ctx)
+					if err != nil {
+						return nil, err
+					}
+					for _, sitm := range s {
+						seq = append(seq, sitm)
+					}
+				} else {
+					s, err := lastEf(ctx)
+					if err != nil {
+						return nil, err
+					}
+					for _, sitm := range s {
+						seq = append(seq, sitm)
+					}
+				}
+			}
+			return seq, nil
+		}
+		var oldValues []Sequence
+		for _, vn := range varnames {
+			oldValues = append(oldValues, ctx.vars[vn])
+		}
+		seq, err := f(varnames, sequences, ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i, vn := range varnames {
+			ctx.vars[vn] = oldValues[i]
+		}
+
+		if someEvery == "some" {
+			for _, itm := range seq {
+				bv, err := BooleanValue(Sequence{itm})
+				if err != nil {
+					return nil, err
+				}
+				if bv {
+					ctx.sequence = Sequence{true}
+					goto done
+				}
+			}
+			ctx.sequence = Sequence{false}
+		} else {
+			for _, itm := range seq {
+				bv, err := BooleanValue(Sequence{itm})
+				if err != nil {
+					return nil, err
+				}
+				if !bv {
+					ctx.sequence = Sequence{false}
+					goto done
+				}
+			}
+			ctx.sequence = Sequence{true}
+		}
+	done:
+		return ctx.sequence, nil
+	}
+	return evaler, nil
+}
+
+func compileIfExpr(n *IfExpr) (EvalFunc, error) {
+	efs, err := compileList([]Node{n.Cond, n.Then, n.Else})
+	if err != nil {
+		return nil, err
+	}
+	boolEval, thenpart, elsepart := efs[0], efs[1], efs[2]
+	f := func(ctx *Context) (Sequence, error) {
+		res, err := boolEval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		bv, err := BooleanValue(res)
+		if err != nil {
+			return nil, err
+		}
+		if bv {
+			return thenpart(ctx)
+		}
+		return elsepart(ctx)
+	}
+	return f, nil
+}
+
+func compileLogicalExpr(n *LogicalExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op == "or" {
+		ef := func(ctx *Context) (Sequence, error) {
+			for _, ef := range efs {
+				s, err := ef(ctx)
+				if err != nil {
+					return nil, err
+				}
+
+				b, err := BooleanValue(s)
+				if err != nil {
+					return nil, err
+				}
+				if b {
+					return Sequence{true}, nil
+				}
+
+			}
+			return Sequence{false}, nil
+		}
+		return ef, nil
+	}
+
+	ef := func(ctx *Context) (Sequence, error) {
+		for _, ef := range efs {
+			s, err := ef(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			b, err := BooleanValue(s)
+			if err != nil {
+				return nil, err
+			}
+			if !b {
+				return Sequence{false}, nil
+			}
+
+		}
+		return Sequence{true}, nil
+	}
+	return ef, nil
+}
+
+func compileComparisonExpr(n *ComparisonExpr) (EvalFunc, error) {
+	lhs, err := compile(n.Left)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := compile(n.Right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Op {
+	case "is", "<<", ">>":
+		return doCompareNode(n.Op, lhs, rhs)
+	}
+	return doCompare(n.Op, lhs, rhs)
+}
+
+func compileStringConcatExpr(n *StringConcatExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		var sb strings.Builder
+		for _, ef := range efs {
+			s, err := ef(ctx)
+			if err != nil {
+				return nil, err
+			}
+			sv, err := StringValue(s)
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteString(sv)
+		}
+		return Sequence{sb.String()}, nil
+	}
+	return ef, nil
+}
+
+func compileRangeExpr(n *RangeExpr) (EvalFunc, error) {
+	efs, err := compileList([]Node{n.From, n.To})
+	if err != nil {
+		return nil, err
+	}
+	retf := func(ctx *Context) (Sequence, error) {
+		startF, endF, ok, err := rangeBounds(ctx, efs[0], efs[1])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return Sequence{}, nil
+		}
+		// Guard against extremely large ranges
+		if endF-startF > 10_000_000 {
+			return nil, fmt.Errorf("range too large: %v to %v", startF, endF)
+		}
+		start := int(startF)
+		end := int(endF)
+		// Guard against int overflow: if start or end is at MaxInt64,
+		// the loop increment would overflow
+		if start == math.MaxInt64 || end == math.MaxInt64 {
+			if start == end {
+				return Sequence{start}, nil
+			}
+			return nil, fmt.Errorf("range too large: integer overflow")
+		}
+		count := end - start + 1
+		if err := ctx.checkLength(count); err != nil {
+			return nil, err
+		}
+		seq := make(Sequence, 0, count)
+		for i := start; i <= end; i++ {
+			if err := ctx.checkEvery(i - start); err != nil {
+				return nil, err
+			}
+			seq = append(seq, i)
+		}
+		return seq, nil
+	}
+	return retf, nil
+}
+
+// rangeBounds evaluates the operands of a range expression and returns the
+// rounded bounds. ok is false if the range is empty.
+func rangeBounds(ctx *Context, from, to EvalFunc) (float64, float64, bool, error) {
+	lhs, err := from(ctx)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	rhs, err := to(ctx)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	lhsNum, err := NumberValue(lhs)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	rhsNum, err := NumberValue(rhs)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	// Per XPath spec: if either is NaN or Inf, or lhs > rhs, return empty
+	if math.IsNaN(lhsNum) || math.IsNaN(rhsNum) || math.IsInf(lhsNum, 0) || math.IsInf(rhsNum, 0) {
+		return 0, 0, false, nil
+	}
+	startF := math.Round(lhsNum)
+	endF := math.Round(rhsNum)
+	return startF, endF, startF <= endF, nil
+}
+
+func compileAdditiveExpr(n *AdditiveExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	operator := n.Ops
+	ef := func(ctx *Context) (Sequence, error) {
+		savedSeq := ctx.sequence
+		s, err := efs[0](ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) == 0 {
+			return Sequence{}, nil
+		}
+
+		// Check if we're dealing with durations or date/time types
+		result := s[0]
+		for i := 1; i < len(efs); i++ {
+			ctx.sequence = savedSeq
+			s2, err := efs[i](ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(s2) == 0 {
+				return Sequence{}, nil
+			}
+			op := operator[i-1]
+			a, b := result, s2[0]
+			if _, ok := b.(XSDuration); !ok {
+				// the difference of two dates or times uses the implicit timezone
+				a, b = ctx.withImplicitTimezone(a), ctx.withImplicitTimezone(b)
+			}
+			res, err := addItems(a, b, op)
+			if err != nil {
+				return nil, err
+			}
+			result = res
+		}
+		return Sequence{result}, nil
+	}
+	return ef, nil
+}
+
+func compileMultiplicativeExpr(n *MultiplicativeExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	operator := n.Ops
+	ef := func(ctx *Context) (Sequence, error) {
+		savedSeq := ctx.sequence
+		s, err := efs[0](ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) == 0 {
+			return Sequence{}, nil
+		}
+
+		// Check for duration types in first operand
+		if dur, ok := s[0].(XSDuration); ok {
+			result := dur
+			for i := 1; i < len(efs); i++ {
+				ctx.sequence = savedSeq
+				s2, err := efs[i](ctx)
+				if err != nil {
+					return nil, err
+				}
+				if len(s2) == 0 {
+					return Sequence{}, nil
+				}
+				op := operator[i-1]
+				// Duration * number, Duration div number, Duration div Duration
+				if dur2, ok := s2[0].(XSDuration); ok && op == "div" {
+					// Duration div Duration = number
+					a := durationToSeconds(result)
+					b := durationToSeconds(dur2)
+					if b == 0 {
+						return nil, NewXPathError("FODT0002", "division by zero-duration")
+					}
+					return Sequence{a / b}, nil
+				}
+				flt, err := NumberValue(Sequence{s2[0]})
+				if err != nil {
+					return nil, err
+				}
+				ms := durationToMonthsAndSeconds(result)
+				switch op {
+				case "*":
+					ms.months = int(math.Round(float64(ms.months) * flt))
+					ms.seconds = ms.seconds * flt
+				case "div":
+					if flt == 0 {
+						return nil, NewXPathError("FODT0002", "division by zero")
+					}
+					ms.months = int(math.Round(float64(ms.months) / flt))
+					ms.seconds = ms.seconds / flt
+				}
+				result = monthsAndSecondsToDuration(ms.months, ms.seconds)
+			}
+			return Sequence{result}, nil
+		}
+
+		// Check if second operand is duration (number * Duration)
+		if len(efs) == 2 && operator[0] == "*" {
+			ctx.sequence = savedSeq
+			s2, err := efs[1](ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(s2) > 0 {
+				if dur, ok := s2[0].(XSDuration); ok {
+					flt, err := NumberValue(s)
+					if err != nil {
+						return nil, err
+					}
+					ms := durationToMonthsAndSeconds(dur)
+					ms.months = int(math.Round(float64(ms.months) * flt))
+					ms.seconds = ms.seconds * flt
+					return Sequence{monthsAndSecondsToDuration(ms.months, ms.seconds)}, nil
+				}
+			}
+		}
+
+		sum, err := NumberValue(s)
+		if err != nil {
+			return nil, err
+		}
+		resultType := NumericType(s[0])
+		for i := 1; i < len(efs); i++ {
+			ctx.sequence = savedSeq
+			s2, err := efs[i](ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(s2) == 0 {
+				return Sequence{}, nil
+			}
+			flt, err := NumberValue(s2)
+			opType := PromoteNumeric(resultType, NumericType(s2[0]))
+			switch operator[i-1] {
+			case "*":
+				sum *= flt
+				resultType = opType
+			case "div":
+				// div always produces at least decimal
+				if opType < NumDecimal {
+					opType = NumDecimal
+				}
+				// Division by zero raises FOAR0001 for integer/decimal operands.
+				// For float/double, Go produces ±Inf which is correct per spec.
+				if flt == 0 && opType <= NumDecimal {
+					return nil, NewXPathError("FOAR0001", "division by zero")
+				}
+				sum /= flt
+				resultType = opType
+			case "idiv":
+				if flt == 0 {
+					return nil, NewXPathError("FOAR0002", "integer division by zero")
+				}
+				if math.IsNaN(sum) || math.IsInf(sum, 0) {
+					return nil, NewXPathError("FOAR0002", "integer division with NaN or Inf")
+				}
+				sum = math.Trunc(sum / flt)
+				resultType = NumInteger
+			case "mod":
+				sum = math.Mod(sum, flt)
+				resultType = opType
+			}
+		}
+		if resultType == NumInteger {
+			return Sequence{int(sum)}, nil
+		}
+		return Sequence{WrapNumeric(sum, resultType)}, nil
+	}
+	return ef, nil
+}
+
+func compileUnionExpr(n *UnionExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	ret := func(ctx *Context) (Sequence, error) {
+		if len(efs) == 1 {
+			return efs[0](ctx)
+		}
+		// Save and restore ctx.sequence so each union branch
+		// evaluates against the original context sequence.
+		savedSeq := ctx.sequence
+		var seq Sequence
+		for _, ef := range efs {
+			ctx.sequence = savedSeq
+			efSeq, err := ef(ctx)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, efSeq...)
+		}
+		var nodes goxml.SortByDocumentOrder
+		for _, itm := range seq {
+			if n, ok := itm.(goxml.XMLNode); ok {
+				nodes = append(nodes, n)
+			}
+		}
+		// document order
+		nodes = nodes.SortAndEliminateDuplicates()
+		var retSeq Sequence
+		for _, itm := range nodes {
+			retSeq = append(retSeq, itm)
+		}
+		return retSeq, nil
+	}
+	return ret, nil
+}
+
+func compileIntersectExceptExpr(n *IntersectExceptExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	intersectExcepts := n.Ops
+	evaler := func(ctx *Context) (Sequence, error) {
+		ret := Sequence{}
+		var left Sequence
+		for i, ef := range efs {
+			newcontext := CopyContext(ctx)
+			right, err := ef(newcontext)
+			if err != nil {
+				return nil, err
+			}
+
+			var lelt, relt *goxml.Element
+			var ok, inRight bool
+			if i > 0 {
+				shouldBeInRight := intersectExcepts[i-1] == "intersect"
+				ids := map[int]bool{}
+				for _, rItem := range right {
+					if relt, ok = rItem.(*goxml.Element); !ok {
+						return nil, fmt.Errorf("FIXME: not an element")
+					}
+					ids[relt.ID] = true
+				}
+				for _, lItem := range left {
+					if lelt, ok = lItem.(*goxml.Element); !ok {
+						return nil, fmt.Errorf("FIXME: not an element")
+					}
+					if _, inRight = ids[lelt.ID]; inRight == shouldBeInRight {
+						ret = append(ret, lelt)
+					}
+				}
+			}
+			left = right
+		}
+		ctx.sequence = ret
+		return ret, nil
+	}
+	return evaler, nil
+}
+
+// compileSequenceType returns the item type test of st. It returns nil if
+// the item type is unknown.
+// checkAtomicType returns an error if the item type of st is an atomic type
+// that the evaluator does not know.
+func checkAtomicType(st *SequenceType) error {
+	if at, ok := st.ItemType.(*AtomicType); ok && resolveAtomicType(at.Name) == "" {
+		return NewXPathError("XPST0051", fmt.Sprintf("unknown atomic type %s", at.Name))
+	}
+	return nil
+}
+
+func compileSequenceType(st *SequenceType) testFunc {
+	if st.ItemType == nil {
+		return nil
+	}
+	return compileItemType(st.ItemType)
+}
+
+func compileItemType(n Node) testFunc {
+	switch t := n.(type) {
+	case *KindTest:
+		return compileNodeTest(t)
+	case *AnyItemTest:
+		return func(ctx *Context, itm Item) bool {
+			return true
+		}
+	case *MapTest:
+		return func(ctx *Context, itm Item) bool {
+			_, ok := itm.(*XPathMap)
+			return ok
+		}
+	case *ArrayTest:
+		return func(ctx *Context, itm Item) bool {
+			_, ok := itm.(*XPathArray)
+			return ok
+		}
+	case *FunctionTest:
+		return func(ctx *Context, itm Item) bool {
+			_, ok := itm.(*XPathFunction)
+			return ok
+		}
+	case *AtomicType:
+		return makeAtomicTypeTest(resolveAtomicType(t.Name))
+	}
+	return nil
+}
+
+func compileInstanceOfExpr(n *InstanceOfExpr) (EvalFunc, error) {
+	ef, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if n.Type.Empty {
+		evaler := func(ctx *Context) (Sequence, error) {
+			seq, err := ef(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return Sequence{len(seq) == 0}, nil
+		}
+		return evaler, nil
+	}
+	if err := checkAtomicType(n.Type); err != nil {
+		return nil, err
+	}
+	tf := compileSequenceType(n.Type)
+	oi := n.Type.Occurrence
+	inOfExpr := func(ctx *Context) (Sequence, error) {
+		seq, err := ef(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if oi == "" && len(seq) != 1 {
+			return Sequence{false}, nil
+		}
+		if oi == "+" && len(seq) < 1 {
+			return Sequence{false}, nil
+		}
+		if oi == "?" && len(seq) > 1 {
+			return Sequence{false}, nil
+		}
+
+		if tf == nil {
+			// No type test parsed — unknown type, always false
+			return Sequence{false}, nil
+		}
+		for _, itm := range seq {
+			if !tf(ctx, itm) {
+				return Sequence{false}, nil
+			}
+		}
+
+		return Sequence{true}, nil
+	}
+	return inOfExpr, nil
+}
+
+func compileTreatExpr(n *TreatExpr) (EvalFunc, error) {
+	ef, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if n.Type.Empty {
+		evaler := func(ctx *Context) (Sequence, error) {
+			seq, err := ef(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return Sequence{len(seq) == 0}, nil
+		}
+		return evaler, nil
+	}
+	if err := checkAtomicType(n.Type); err != nil {
+		return nil, err
+	}
+	tf := compileSequenceType(n.Type)
+	oi := n.Type.Occurrence
+	baseEf := ef
+	ef = func(ctx *Context) (Sequence, error) {
+		seq, err := baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Check cardinality
+		switch oi {
+		case "":
+			if len(seq) != 1 {
+				return nil, NewXPathError("XPDY0050", fmt.Sprintf("treat as requires exactly one item, got %d", len(seq)))
+			}
+		case "+":
+			if len(seq) < 1 {
+				return nil, NewXPathError("XPDY0050", "treat as requires at least one item, got empty")
+			}
+		case "?":
+			if len(seq) > 1 {
+				return nil, NewXPathError("XPDY0050", fmt.Sprintf("treat as requires at most one item, got %d", len(seq)))
+			}
+		}
+		// Check type if tf is available
+		if tf != nil {
+			for _, itm := range seq {
+				if !tf(ctx, itm) {
+					return nil, NewXPathError("XPDY0050", "item does not match required type")
+				}
+			}
+		}
+		return seq, nil
+	}
+	return ef, nil
+}
+
+func compileCastableExpr(n *CastableExpr) (EvalFunc, error) {
+	baseEf, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	typName := n.Type
+	optional := n.Optional
+	ef := func(ctx *Context) (Sequence, error) {
+		seq, err := baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(seq) == 0 {
+			return Sequence{optional}, nil
+		}
+		if len(seq) > 1 {
+			return Sequence{false}, nil
+		}
+		item := seq[0]
+		// Check type compatibility
+		sourceType := TypeIDOf(item)
+		if !castAllowed(sourceType, typName) {
+			return Sequence{false}, nil
+		}
+		// XPST0080: cannot cast to abstract types
+		switch typName {
+		case "xs:NOTATION", "xs:anyAtomicType", "xs:anySimpleType":
+			return Sequence{false}, nil
+		}
+		// Try the actual cast — if it succeeds, castable is true
+		castPrefix := ""
+		castLocal := typName
+		if before, after, ok0 := strings.Cut(typName, ":"); ok0 {
+			castPrefix = before
+			castLocal = after
+		}
+		castNS := nsFN
+		if castPrefix != "" {
+			if ns, nsOk := ctx.Namespaces[castPrefix]; nsOk {
+				castNS = ns
+			}
+		}
+		fn := getfunction(castNS, castLocal)
+		if fn != nil {
+			_, castErr := fn.F(ctx, []Sequence{{item}})
+			return Sequence{castErr == nil}, nil
+		}
+		return Sequence{false}, nil
+	}
+	return ef, nil
+}
+
+func compileCastExpr(n *CastExpr) (EvalFunc, error) {
+	baseEf, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	typName := n.Type
+	optional := n.Optional
+	ef := func(ctx *Context) (Sequence, error) {
+		seq, err := baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(seq) == 0 {
+			if optional {
+				return Sequence{}, nil
+			}
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("empty sequence cannot be cast to %s", typName))
+		}
+		// Reject invalid cast target types
+		switch typName {
+		case "xs:NOTATION", "xs:anyAtomicType", "xs:anySimpleType":
+			return nil, NewXPathError("XPST0080", fmt.Sprintf("cannot cast to %s", typName))
+		}
+		item := seq[0]
+		// Validate cast compatibility
+		sourceType := TypeIDOf(item)
+		if !castAllowed(sourceType, typName) {
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("cannot cast %s to %s", sourceType, typName))
+		}
+		switch typName {
+		case "xs:integer", "xs:int",
+			"xs:long", "xs:short", "xs:byte",
+			"xs:unsignedLong", "xs:unsignedInt", "xs:unsignedShort", "xs:unsignedByte",
+			"xs:nonPositiveInteger", "xs:nonNegativeInteger",
+			"xs:negativeInteger", "xs:positiveInteger":
+			// Route through registered constructor to get correct subtype tag
+			castLocal := typName[3:] // strip "xs:"
+			fn := getfunction(nsXS, castLocal)
+			if fn != nil {
+				return fn.F(ctx, []Sequence{{item}})
+			}
+			return xsInteger(ctx, []Sequence{{item}})
+		case "xs:double":
+			return xsDouble(ctx, []Sequence{{item}})
+		case "xs:float":
+			return xsFloat(ctx, []Sequence{{item}})
+		case "xs:decimal":
+			return xsDecimal(ctx, []Sequence{{item}})
+		case "xs:string", "xs:normalizedString", "xs:token",
+			"xs:language", "xs:NMTOKEN", "xs:Name", "xs:NCName",
+			"xs:ID", "xs:IDREF", "xs:ENTITY",
+			"xs:anyURI", "xs:untypedAtomic",
+			"xs:hexBinary", "xs:base64Binary":
+			// Route through registered constructor for correct type tag
+			castLocal := typName[3:] // strip "xs:"
+			fn := getfunction(nsXS, castLocal)
+			if fn != nil {
+				return fn.F(ctx, []Sequence{{item}})
+			}
+			sv, err := StringValue(Sequence{item})
+			if err != nil {
+				return nil, err
+			}
+			return Sequence{sv}, nil
+		case "xs:boolean":
+			// Handle numeric → boolean: 0/NaN → false, other → true
+			if f, ok := ToFloat64(item); ok {
+				return Sequence{f != 0 && !math.IsNaN(f)}, nil
+			}
+			if b, ok := item.(bool); ok {
+				return Sequence{b}, nil
+			}
+			// xs:boolean cast uses XML Schema lexical rules
+			sv, err := StringValue(Sequence{item})
+			if err != nil {
+				return nil, err
+			}
+			sv = strings.TrimSpace(sv)
+			switch sv {
+			case "true", "1":
+				return Sequence{true}, nil
+			case "false", "0":
+				return Sequence{false}, nil
+			default:
+				return nil, NewXPathError("FORG0001", fmt.Sprintf("cannot cast %q to xs:boolean", sv))
+			}
+		default:
+			// Try calling the XSD constructor function
+			castPrefix := ""
+			castLocal := typName
+			if before, after, ok := strings.Cut(typName, ":"); ok {
+				castPrefix = before
+				castLocal = after
+			}
+			castNS := nsFN
+			if castPrefix != "" {
+				if ns, ok := ctx.Namespaces[castPrefix]; ok {
+					castNS = ns
+				}
+			}
+			fn := getfunction(castNS, castLocal)
+			if fn != nil {
+				return fn.F(ctx, []Sequence{{item}})
+			}
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("unsupported cast type %s", typName))
+		}
+	}
+	return ef, nil
+}
+
+func compileArrowExpr(n *ArrowExpr) (EvalFunc, error) {
+	baseEf, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	capturedArgEfs, err := compileList(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	capturedName := n.Function
+	ef := func(ctx *Context) (Sequence, error) {
+		// Evaluate the left-hand side (becomes first argument)
+		leftSeq, err := baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Evaluate additional arguments
+		allArgs := make([]Sequence, 1+len(capturedArgEfs))
+		allArgs[0] = leftSeq
+		for i, argEf := range capturedArgEfs {
+			argSeq, err := argEf(ctx)
+			if err != nil {
+				return nil, err
+			}
+			allArgs[i+1] = argSeq
+		}
+		// Resolve function name and call
+		fnPrefix := ""
+		fnLocalName := capturedName
+		if before, after, ok := strings.Cut(capturedName, ":"); ok {
+			fnPrefix = before
+			fnLocalName = after
+		}
+		return callFunctionResolved(fnPrefix, fnLocalName, allArgs, ctx)
+	}
+	return ef, nil
+}
+
+func compileUnaryExpr(n *UnaryExpr) (EvalFunc, error) {
+	pv, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	mult := 1
+	if n.Op == "-" {
+		mult = -1
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		if mult == -1 {
+			seq, err := pv(ctx)
+			if err != nil {
+				return nil, err
+			}
+			flt, err := NumberValue(seq)
+			if err != nil {
+				return nil, err
+			}
+			return Sequence{flt * -1}, nil
+		}
+		return pv(ctx)
+	}
+	return ef, nil
+}
+
+func compileSimpleMapExpr(n *SimpleMapExpr) (EvalFunc, error) {
+	efs, err := compileList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	mapEf := func(ctx *Context) (Sequence, error) {
+		result, err := efs[0](ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, stepEf := range efs[1:] {
+			var newResult Sequence
+			if ctx.parallel(len(result)) {
+				results, err := ctx.parallelEach(len(result), func(frame *Context, pos int) (Sequence, error) {
+					frame.Pos = pos
+					frame.SetSize(len(result))
+					frame.SetContextSequence(Sequence{result[pos]})
+					return stepEf(frame)
+				})
+				if err != nil {
+					return nil, err
+				}
+				for _, seq := range results {
+					newResult = append(newResult, seq...)
+				}
+				result = newResult
+				continue
+			}
+			saveSeq := ctx.SetContextSequence(result)
+			savePos := ctx.Pos
+			saveSize := ctx.Size()
+			ctx.SetSize(len(result))
+			for pos, item := range result {
+				ctx.Pos = pos
+				ctx.SetContextSequence(Sequence{item})
+				seq, err := stepEf(ctx)
+				if err == nil {
+					err = ctx.checkEval()
+				}
+				if err != nil {
+					ctx.SetContextSequence(saveSeq)
+					ctx.Pos = savePos
+					ctx.SetSize(saveSize)
+					return nil, err
+				}
+				newResult = append(newResult, seq...)
+			}
+			ctx.SetContextSequence(saveSeq)
+			ctx.Pos = savePos
+			ctx.SetSize(saveSize)
+			result = newResult
+		}
+		return result, nil
+	}
+	return mapEf, nil
+}
+
+func compilePathExpr(n *PathExpr) (EvalFunc, error) {
+	rpe, err := compileRelativePath(n.Steps, n.Seps)
+	if err != nil {
+		return nil, err
+	}
+	if n.Root == "" {
+		return rpe, nil
+	}
+	op := n.Root
+	// //@name can use the attribute index
+	var attrTest testFunc
+	var attrName string
+	var rest EvalFunc
+	if nt := rootAttributeTest(n); nt != nil {
+		attrTest, attrName = compileNodeTest(nt), nt.Name
+		if len(n.Steps) > 1 {
+			if rest, err = compileRelativePath(n.Steps[1:], n.Seps[1:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	fn := func(ctx *Context) (Sequence, error) {
+		ctx.Document()
+		var seq Sequence
+		var err error
+		indexed := false
+		if attrTest != nil {
+			if seq, indexed = ctx.indexedAttributes(ctx.xmldoc, attrName, attrTest); indexed && rest != nil {
+				// the remaining steps are evaluated for each attribute like
+				// in the path loop
+				attrs := seq
+				seq = nil
+				ctx.size = len(attrs)
+				for j, attr := range attrs {
+					ctx.sequence = Sequence{attr}
+					ctx.Pos = j + 1
+					r, err := rest(ctx)
+					if err != nil {
+						return nil, err
+					}
+					seq = append(seq, r...)
+				}
+			}
+		}
+		if !indexed {
+			if op == "//" {
+				ctx.descendantOrSelfAxis(isNode)
+			}
+			if rpe == nil {
+				if op == "/" {
+					return Sequence{ctx.Document()}, nil
+				}
+				return nil, fmt.Errorf("unexpected end of path expression after '//'")
+			}
+			if seq, err = rpe(ctx); err != nil {
+				return nil, err
+			}
+		}
+		// For "//" paths, sort result in document order and
+		// eliminate duplicates (XPath spec §3.3.2).
+		// Only sort when all items are XMLNodes with unique non-zero
+		// IDs (elements/documents from parsing have those;
+		// attributes created on the fly have ID=0).
+		if op == "//" && len(seq) > 1 {
+			var nodes goxml.SortByDocumentOrder
+			canSort := true
+			for _, itm := range seq {
+				n, ok := itm.(goxml.XMLNode)
+				if !ok || n.GetID() == 0 {
+					canSort = false
+					break
+				}
+				nodes = append(nodes, n)
+			}
+			if canSort {
+				nodes = nodes.SortAndEliminateDuplicates()
+				seq = make(Sequence, len(nodes))
+				for i, n := range nodes {
+					seq[i] = n
+				}
+			}
+		}
+		return seq, nil
+	}
+	return fn, nil
+}
+
+// compileRelativePath compiles the steps of a relative path expression. It
+// returns nil if there are no steps.
+func compileRelativePath(steps []Node, ops []string) (EvalFunc, error) {
+	efs, err := compileList(steps)
+	if err != nil {
+		return nil, err
+	}
+	switch len(efs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return efs[0], nil // just a simple StepExpr
+	}
+
+	ef := func(ctx *Context) (Sequence, error) {
+		var retseq Sequence
+		var seq Sequence
+		var err error
+		for i := 0; i < len(efs); i++ {
+			ef := efs[i]
+			retseq = retseq[:0]
+			if len(ctx.sequence) == 0 {
+				if seq, err = ef(ctx); err != nil {
+					return nil, err
+				}
+				retseq = append(retseq, seq...)
+			} else {
+				copyContext := ctx.sequence
+				ctx.size = len(copyContext)
+				for j, itm := range copyContext {
+					ctx.sequence = Sequence{itm}
+					ctx.Pos = j + 1
+					if seq, err = ef(ctx); err != nil {
+						return nil, err
+					}
+					retseq = append(retseq, seq...)
+				}
+			}
+			ctx.sequence = ctx.sequence[:0]
+			for _, itm := range retseq {
+				ctx.sequence = append(ctx.sequence, itm)
+			}
+
+			if i < len(ops) && ops[i] == "//" {
+				ctx.descendantOrSelfAxis(isElement)
+				retseq = append(retseq, ctx.sequence...)
+			}
+		}
+
+		return retseq, nil
+	}
+	return ef, nil
+}
+
+func compileAxisStep(n *AxisStep) (EvalFunc, error) {
+	ef, err := compileForwardStep(n)
+	if err != nil {
+		return nil, err
+	}
+	predicates, err := compileList(n.Predicates)
+	if err != nil {
+		return nil, err
+	}
+	if len(predicates) == 0 {
+		return ef, nil
+	}
+	sel := compileSelection(n, n.Predicates[0])
+	ff := func(ctx *Context) (Sequence, error) {
+		rest := predicates
+		if seq, ok := sel.apply(ctx); ok {
+			ctx.sequence = seq
+			rest = predicates[1:]
+		} else if _, err := ef(ctx); err != nil {
+			return nil, err
+		}
+		for _, predicate := range rest {
+			if _, err := ctx.Filter(predicate); err != nil {
+				return nil, err
+			}
+			ctx.size = len(ctx.sequence)
+		}
+		return ctx.sequence, nil
+	}
+	return ff, nil
+}
+
+// selection evaluates a step with the predicate [1] or [last()] without
+// computing the whole axis. A nil selection is valid and never applies.
+type selection func(ctx *Context) (Sequence, bool)
+
+// apply returns the selected node and true, or false if the selection cannot
+// handle the context. The caller has to evaluate the step then.
+func (sel selection) apply(ctx *Context) (Sequence, bool) {
+	if sel == nil || ctx.ctxPositions != nil {
+		return nil, false
+	}
+	return sel(ctx)
+}
+
+// compileSelection returns the selection for the step n with the first
+// predicate pred, or nil if pred is not [1] or [last()] or if n is not an
+// element step on the child, descendant or descendant-or-self axis.
+func compileSelection(n *AxisStep, pred Node) selection {
+	last, ok := positionalPredicate(pred)
+	if !ok || n.Abbrev {
+		return nil
+	}
+	switch n.Axis {
+	case "child", "descendant", "descendant-or-self":
+	default:
+		return nil
+	}
+	switch t := n.Test.(type) {
+	case *NameTest:
+		ok = !t.Attribute
+	case *WildcardTest:
+		ok = !t.Attribute
+	case *KindTest:
+		ok = t.Kind == "element"
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil
+	}
+	tf := compileNodeTest(n.Test)
+	axis := n.Axis
+	return func(ctx *Context) (Sequence, bool) {
+		itm, ok := ctx.selectOnAxis(axis, tf, last)
+		if !ok {
+			return nil, false
+		}
+		ctx.size = 0
+		if itm == nil {
+			return nil, true
+		}
+		ctx.size = 1
+		return Sequence{itm}, true
+	}
+}
+
+func compileForwardStep(n *AxisStep) (EvalFunc, error) {
+	if n.Abbrev && n.Axis == "parent" {
+		ef := func(ctx *Context) (Sequence, error) {
+			return ctx.parentAxis(isNode)
+		}
+		return ef, nil
+	}
+	tf := compileNodeTest(n.Test)
+	if tf == nil {
+		return nil, fmt.Errorf("unknown node test %s", n.Test)
+	}
+	stepAxis := n.Axis
+	local, indexed := indexedName(n.Test)
+	ret := func(ctx *Context) (Sequence, error) {
+		var ret Sequence
+		var err error
+		switch stepAxis {
+		case "self":
+			// nothing
+		case "child", "attribute":
+			_, err = ctx.childAxis(tf)
+		case "descendant":
+			if indexed {
+				if _, ok := ctx.indexedDescendantAxis(false, local, tf); ok {
+					break
+				}
+			}
+			_, err = ctx.descendantAxis(tf)
+		case "descendant-or-self":
+			if indexed {
+				if _, ok := ctx.indexedDescendantAxis(true, local, tf); ok {
+					break
+				}
+			}
+			_, err = ctx.descendantOrSelfAxis(tf)
+		case "following":
+			_, err = ctx.followingAxis(tf)
+		case "following-sibling":
+			_, err = ctx.followingSiblingAxis(tf)
+		case "parent":
+			_, err = ctx.parentAxis(tf)
+		case "ancestor":
+			_, err = ctx.ancestorAxis(tf)
+		case "ancestor-or-self":
+			_, err = ctx.ancestorOrSelfAxis(tf)
+		case "preceding-sibling":
+			_, err = ctx.precedingSiblingAxis(tf)
+		case "preceding":
+			_, err = ctx.precedingAxis(tf)
+		default:
+			return nil, fmt.Errorf("unknown axis %s", stepAxis)
+		}
+		if err != nil {
+			return nil, err
+		}
+		copyContext := ctx.sequence
+		for _, itm := range copyContext {
+			ret = append(ret, itm)
+		}
+		ctx.sequence = ret
+		ctx.size = len(ret)
+		return ret, nil
+	}
+	return ret, nil
+}
+
+// unparen returns the expression inside of parentheses.
+func unparen(n Node) Node {
+	for {
+		p, ok := n.(*ParenExpr)
+		if !ok || p.Expr == nil {
+			return n
+		}
+		n = p.Expr
+	}
+}
+
+func compileFilterExpr(n *FilterExpr) (EvalFunc, error) {
+	if !containsLast(n.Predicate) {
+		// The base is filtered while its items are produced, so (expr)[1]
+		// stops after the first item.
+		it, err := iterFilterExpr(n)
+		if err != nil {
+			return nil, err
+		}
+		ef := func(ctx *Context) (Sequence, error) {
+			seq, err := it.collect(ctx)
+			if err != nil {
+				return nil, err
+			}
+			ctx.sequence = seq
+			ctx.ctxPositions = nil
+			ctx.ctxLengths = nil
+			return seq, nil
+		}
+		return ef, nil
+	}
+	baseEf, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	predicate, err := compile(n.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	// (step)[1] and (/step)[1] select from the axis directly, other
+	// expressions with [1] or [last()] skip the evaluation of the predicate.
+	last, positional := positionalPredicate(n.Predicate)
+	var sel selection
+	switch base := unparen(n.Expr).(type) {
+	case *AxisStep:
+		if len(base.Predicates) == 0 {
+			sel = compileSelection(base, n.Predicate)
+		}
+	case *PathExpr:
+		if step, ok := base.Steps[0].(*AxisStep); ok && base.Root == "/" && len(base.Steps) == 1 && len(step.Predicates) == 0 {
+			if stepSel := compileSelection(step, n.Predicate); stepSel != nil {
+				sel = func(ctx *Context) (Sequence, bool) {
+					ctx.Document()
+					return stepSel(ctx)
+				}
+			}
+		}
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		if seq, ok := sel.apply(ctx); ok {
+			ctx.sequence = seq
+			return seq, nil
+		}
+		var err error
+		ctx.sequence, err = baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if positional && ctx.ctxPositions == nil {
+			switch {
+			case len(ctx.sequence) == 0:
+				ctx.sequence = Sequence{}
+			case last:
+				ctx.sequence = Sequence{ctx.sequence[len(ctx.sequence)-1]}
+			default:
+				ctx.sequence = Sequence{ctx.sequence[0]}
+			}
+			return ctx.sequence, nil
+		}
+		_, err = ctx.Filter(predicate)
+		if err != nil {
+			return nil, err
+		}
+		ctx.ctxPositions = nil
+		ctx.ctxLengths = nil
+		return ctx.sequence, nil
+	}
+	return ef, nil
+}
+
+// lookupSpec is a compiled KeySpecifier. ef produces the key(s) to look up,
+// it is nil for the wildcard (*).
+type lookupSpec struct {
+	wildcard bool
+	ef       EvalFunc
+}
+
+func compileLookupExpr(n *LookupExpr) (EvalFunc, error) {
+	lookupEf := &lookupSpec{wildcard: n.Wildcard}
+	if !n.Wildcard {
+		var err error
+		if lookupEf.ef, err = compile(n.Key); err != nil {
+			return nil, err
+		}
+	}
+	if n.Expr == nil {
+		// Unary Lookup: ?key (operates on context item)
+		ef := func(ctx *Context) (Sequence, error) {
+			return evalLookup(ctx, ctx.sequence, lookupEf)
+		}
+		return ef, nil
+	}
+	baseEf, err := compile(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		base, err := baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return evalLookup(ctx, base, lookupEf)
+	}
+	return ef, nil
+}
+
+// evalLookup applies a lookup operation to each item in the base sequence.
+func evalLookup(ctx *Context, base Sequence, spec *lookupSpec) (Sequence, error) {
+	var result Sequence
+	for _, item := range base {
+		switch v := item.(type) {
+		case *XPathMap:
+			if spec.wildcard {
+				for _, entry := range v.Entries {
+					result = append(result, entry.Value...)
+				}
+			} else {
+				keys, err := spec.ef(ctx)
+				if err != nil {
+					return nil, err
+				}
+				for _, key := range keys {
+					if val, ok := v.Get(key); ok {
+						result = append(result, val...)
+					}
+				}
+			}
+		case *XPathArray:
+			if spec.wildcard {
+				for _, member := range v.Members {
+					result = append(result, member...)
+				}
+			} else {
+				keys, err := spec.ef(ctx)
+				if err != nil {
+					return nil, err
+				}
+				for _, key := range keys {
+					idx, err := NumberValue(Sequence{key})
+					if err != nil {
+						return nil, err
+					}
+					member, err := v.Get(int(idx))
+					if err != nil {
+						return nil, err
+					}
+					result = append(result, member...)
+				}
+			}
+		default:
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("lookup operator requires a map or array, got %T", item))
+		}
+	}
+	return result, nil
+}
+
+func compileDynamicCallExpr(n *DynamicCallExpr) (EvalFunc, error) {
+	capturedArgEfs, err := compileList(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := n.Func.(*VarRef); ok {
+		// $var(args) — dynamic function call / map lookup / array lookup
+		varname := v.Name
+		argEfs := capturedArgEfs
+		ef := func(ctx *Context) (Sequence, error) {
+			varVal, err := ctx.varValue(varname)
+			if err != nil {
+				return nil, err
+			}
+			// Evaluate arguments
+			args := make([]Sequence, len(argEfs))
+			for i, aef := range argEfs {
+				seq, err := aef(ctx)
+				if err != nil {
+					return nil, err
+				}
+				args[i] = seq
+			}
+			if len(varVal) == 1 {
+				switch v := varVal[0].(type) {
+				case *XPathMap:
+					if len(args) == 1 && len(args[0]) > 0 {
+						val, _ := v.Get(args[0][0])
+						return val, nil
+					}
+				case *XPathArray:
+					if len(args) == 1 {
+						idx, err := NumberValue(args[0])
+						if err != nil {
+							return nil, err
+						}
+						return v.Get(int(idx))
+					}
+				case *XPathFunction:
+					return v.Call(ctx, args)
+				}
+			}
+			return nil, fmt.Errorf("$%s is not a callable function, map, or array", varname)
+		}
+		return ef, nil
+	}
+	baseEf, err := compile(n.Func)
+	if err != nil {
+		return nil, err
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		base, err := baseEf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(base) != 1 {
+			return nil, NewXPathError("XPTY0004", "dynamic function call requires single function item")
+		}
+		fn, ok := base[0].(*XPathFunction)
+		if !ok {
+			// Could be a map or array lookup
+			if m, ok := base[0].(*XPathMap); ok && len(capturedArgEfs) == 1 {
+				keySeq, err := capturedArgEfs[0](ctx)
+				if err != nil {
+					return nil, err
+				}
+				if len(keySeq) > 0 {
+					val, _ := m.Get(keySeq[0])
+					return val, nil
+				}
+				return Sequence{}, nil
+			}
+			if arr, ok := base[0].(*XPathArray); ok && len(capturedArgEfs) == 1 {
+				idxSeq, err := capturedArgEfs[0](ctx)
+				if err != nil {
+					return nil, err
+				}
+				idx, err := NumberValue(idxSeq)
+				if err != nil {
+					return nil, err
+				}
+				return arr.Get(int(idx))
+			}
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("cannot call %T as function", base[0]))
+		}
+		args := make([]Sequence, len(capturedArgEfs))
+		for i, argEf := range capturedArgEfs {
+			args[i], err = argEf(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return fn.Call(ctx, args)
+	}
+	return ef, nil
+}
+
+func compileFunctionCall(n *FunctionCall) (EvalFunc, error) {
+	// Pre-split function name to avoid splitting on every call.
+	var fnPrefix, fnLocalName string
+	var fnDirectNS string // set for EQName (Q{ns}local)
+	if eqname, ok := strings.CutPrefix(n.Name, "Q{"); ok {
+		if before, after, ok0 := strings.Cut(eqname, "}"); ok0 {
+			fnDirectNS = before
+			fnLocalName = after
+		}
+	} else if before, after, ok0 := strings.Cut(n.Name, ":"); ok0 {
+		fnPrefix = before
+		fnLocalName = after
+	} else {
+		fnLocalName = n.Name
+	}
+
+	// callFn resolves the function by direct namespace or prefix
+	callFn := func(ctx *Context, arguments []Sequence) (Sequence, error) {
+		if fnDirectNS != "" {
+			fnObj, err := ctx.resolveFunction(fnDirectNS, fnLocalName, len(arguments))
+			if err != nil {
+				return nil, err
+			}
+			return fnObj.call(ctx, arguments)
+		}
+		return callFunctionResolved(fnPrefix, fnLocalName, arguments, ctx)
+	}
+
+	if len(n.Args) == 1 && fnDirectNS == "" && firstItemFunctions[fnLocalName] {
+		return compileFirstItemCall(n.Args[0], fnPrefix, fnLocalName, callFn)
+	}
+
+	efs, err := compileList(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(efs) == 0 {
+		ef := func(ctx *Context) (Sequence, error) {
+			return callFn(ctx, []Sequence{})
+		}
+		return ef, nil
+	}
+
+	// get expr single *
+	ef := func(ctx *Context) (Sequence, error) {
+		var arguments []Sequence
+		saveContext := ctx.GetContextSequence()
+		for i, es := range efs {
+			if es == nil {
+				return nil, fmt.Errorf("internal error: nil EvalFunc for argument %d of function %s:%s", i, fnPrefix, fnLocalName)
+			}
+			seq, err := es(ctx)
+			if err != nil {
+				return nil, err
+			}
+			arguments = append(arguments, seq)
+			ctx.SetContextSequence(saveContext)
+		}
+
+		return callFn(ctx, arguments)
+	}
+	return ef, nil
+}
+
+func compileNamedFunctionRef(n *NamedFunctionRef) (EvalFunc, error) {
+	var capturedNS, capturedLocal, capturedPrefix string
+	if eqname, ok := strings.CutPrefix(n.Name, "Q{"); ok {
+		// URIQualifiedName: "namespace}localname"
+		if before, after, ok := strings.Cut(eqname, "}"); ok {
+			capturedNS = before
+			capturedLocal = after
+		}
+	} else {
+		capturedLocal = n.Name
+		if before, after, ok := strings.Cut(n.Name, ":"); ok {
+			capturedPrefix = before
+			capturedLocal = after
+		}
+	}
+	capturedArity := n.Arity
+	ef := func(ctx *Context) (Sequence, error) {
+		ns := capturedNS
+		if ns == "" {
+			ns = nsFN
+			if capturedPrefix != "" {
+				var ok bool
+				if ns, ok = ctx.Namespaces[capturedPrefix]; !ok {
+					return nil, NewXPathError("XPST0081", fmt.Sprintf("could not find namespace for prefix %q", capturedPrefix))
+				}
+			}
+		}
+		fn := ctx.lookupFunction(ns, capturedLocal, capturedArity)
+		if fn == nil {
+			return nil, NewXPathError("XPST0017", fmt.Sprintf("unknown function %s#%d", capturedLocal, capturedArity))
+		}
+		return Sequence{&XPathFunction{
+			Name:             capturedLocal,
+			Namespace:        ns,
+			Arity:            capturedArity,
+			Fn:               fn.call,
+			DynamicCallError: fn.DynamicCallError,
+			Signature:        fn.Signature,
+		}}, nil
+	}
+	return ef, nil
+}
+
+func compileInlineFunctionExpr(n *InlineFunctionExpr) (EvalFunc, error) {
+	bodyEf, err := compile(n.Body)
+	if err != nil {
+		return nil, err
+	}
+	capturedParams := make([]string, len(n.Params))
+	for i, p := range n.Params {
+		capturedParams[i] = p.Name
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		// Capture current variable scope for closure
+		closureVars := make(map[string]Sequence, len(ctx.vars))
+		maps.Copy(closureVars, ctx.vars)
+		fnRef := &XPathFunction{
+			Name:  "(anonymous)",
+			Arity: len(capturedParams),
+			Fn: func(callCtx *Context, args []Sequence) (Sequence, error) {
+				if err := callCtx.enterCall(); err != nil {
+					return nil, err
+				}
+				defer callCtx.leaveCall()
+				// Save current vars
+				savedVars := make(map[string]Sequence, len(callCtx.vars))
+				maps.Copy(savedVars, callCtx.vars)
+				// Apply closure vars
+				maps.Copy(callCtx.vars, closureVars)
+				// Bind parameters
+				for i, name := range capturedParams {
+					if i < len(args) {
+						callCtx.vars[name] = args[i]
+					}
+				}
+				result, err := bodyEf(callCtx)
+				// Restore vars
+				clear(callCtx.vars)
+				maps.Copy(callCtx.vars, savedVars)
+				return result, err
+			},
+		}
+		return Sequence{fnRef}, nil
+	}
+	return ef, nil
+}
+
+func compileMapConstructor(n *MapConstructor) (EvalFunc, error) {
+	if len(n.Entries) == 0 {
+		ef := func(ctx *Context) (Sequence, error) {
+			return Sequence{&XPathMap{}}, nil
+		}
+		return ef, nil
+	}
+	type kvPair struct {
+		key   EvalFunc
+		value EvalFunc
+	}
+	var pairs []kvPair
+	for _, e := range n.Entries {
+		keyEf, err := compile(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		valueEf, err := compile(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, kvPair{key: keyEf, value: valueEf})
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		m := &XPathMap{}
+		for _, pair := range pairs {
+			keySeq, err := pair.key(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(keySeq) != 1 {
+				return nil, fmt.Errorf("map key must be a single item")
+			}
+			valueSeq, err := pair.value(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if m.Contains(keySeq[0]) {
+				return nil, NewXPathError("XQDY0137", fmt.Sprintf("duplicate key %s in map constructor", itemStringvalue(keySeq[0])))
+			}
+			m = m.Put(keySeq[0], valueSeq)
+		}
+		return Sequence{m}, nil
+	}
+	return ef, nil
+}
+
+func compileArrayConstructor(n *ArrayConstructor) (EvalFunc, error) {
+	if len(n.Members) == 0 {
+		ef := func(ctx *Context) (Sequence, error) {
+			return Sequence{&XPathArray{}}, nil
+		}
+		return ef, nil
+	}
+	if n.Curly {
+		contentEf, err := compile(n.Members[0])
+		if err != nil {
+			return nil, err
+		}
+		ef := func(ctx *Context) (Sequence, error) {
+			seq, err := contentEf(ctx)
+			if err != nil {
+				return nil, err
+			}
+			arr := &XPathArray{Members: make([]Sequence, len(seq))}
+			for i, item := range seq {
+				arr.Members[i] = Sequence{item}
+			}
+			return Sequence{arr}, nil
+		}
+		return ef, nil
+	}
+	memberEfs, err := compileList(n.Members)
+	if err != nil {
+		return nil, err
+	}
+	ef := func(ctx *Context) (Sequence, error) {
+		arr := &XPathArray{Members: make([]Sequence, len(memberEfs))}
+		for i, mef := range memberEfs {
+			seq, err := mef(ctx)
+			if err != nil {
+				return nil, err
+			}
+			arr.Members[i] = seq
+		}
+		return Sequence{arr}, nil
+	}
+	return ef, nil
+}
+
+// compileNodeTest returns the test function for a node test or kind test.
+// It returns nil for unknown tests.
+func compileNodeTest(n Node) testFunc {
+	switch t := n.(type) {
+	case *NameTest:
+		if t.Attribute {
+			return returnAttributeNameTest(t.Name)
+		}
+		if eqname, ok := strings.CutPrefix(t.Name, "Q{"); ok {
+			return returnElementEQNameTest(eqname)
+		}
+		return returnElementNameTest(t.Name)
+	case *WildcardTest:
+		if t.Name == "*" {
+			if t.Attribute {
+				return isAttribute
+			}
+			return isElement
+		}
+		return returnWildcardTest(t.Name, t.Attribute)
+	case *KindTest:
+		switch t.Kind {
+		case "element":
+			if eqname, ok := strings.CutPrefix(t.Name, "Q{"); ok {
+				return returnElementEQNameTest(eqname)
+			}
+			if t.Name == "" || t.Name == "*" {
+				return isElement
+			}
+			return returnElementNameTest(t.Name)
+		case "node":
+			return func(ctx *Context, itm Item) bool {
+				return true
+			}
+		case "text":
+			return func(ctx *Context, itm Item) bool {
+				if _, ok := itm.(goxml.CharData); ok {
+					return true
+				}
+				return false
+			}
+		case "attribute":
+			if t.Name == "" || t.Name == "*" {
+				return isAttribute
+			}
+			return returnAttributeNameTest(t.Name)
+		case "comment":
+			return isComment
+		case "processing-instruction":
+			if t.Name == "" {
+				return isProcessingInstruction
+			}
+			return returnProcessingInstructionNameTest(t.Name)
+		}
+	}
+	return nil
+}
+
+// makeAtomicTypeTest creates a testFunc for an atomic type check.
+func makeAtomicTypeTest(atomicType string) testFunc {
+	// Map atomicType name to IntSubtype for integer hierarchy checks
+	intSubtypeByName := map[string]IntSubtype{
+		"integer": IntInteger, "long": IntLong, "int": IntInt,
+		"short": IntShort, "byte": IntByte,
+		"nonNegativeInteger": IntNonNegativeInteger, "unsignedLong": IntUnsignedLong,
+		"unsignedInt": IntUnsignedInt, "unsignedShort": IntUnsignedShort,
+		"unsignedByte": IntUnsignedByte, "positiveInteger": IntPositiveInteger,
+		"nonPositiveInteger": IntNonPositiveInteger, "negativeInteger": IntNegativeInteger,
+	}
+	strSubtypeByName := map[string]StrSubtype{
+		"string": StrString, "normalizedString": StrNormalizedString,
+		"token": StrToken, "language": StrLanguage, "NMTOKEN": StrNMTOKEN,
+		"Name": StrName, "NCName": StrNCName, "ID": StrID,
+		"IDREF": StrIDREF, "ENTITY": StrENTITY,
+	}
+
+	return func(ctx *Context, itm Item) bool {
+		// Integer subtype hierarchy check
+		if targetInt, ok := intSubtypeByName[atomicType]; ok {
+			if v, ok := itm.(XSInteger); ok {
+				return IntIsSubtypeOf(v.Subtype, targetInt)
+			}
+			// Bare int (from tokenizer) is xs:integer
+			if _, ok := itm.(int); ok {
+				return targetInt == IntInteger
+			}
+			return false
+		}
+
+		// String subtype hierarchy check
+		if targetStr, ok := strSubtypeByName[atomicType]; ok {
+			if v, ok := itm.(XSString); ok {
+				return StrIsSubtypeOf(v.Subtype, targetStr)
+			}
+			// Bare string (from tokenizer/literals) is xs:string
+			if _, ok := itm.(string); ok {
+				return targetStr == StrString
+			}
+			return false
+		}
+
+		switch atomicType {
+		case "double":
+			switch itm.(type) {
+			case XSDouble, float64:
+				return true
+			}
+			return false
+		case "float":
+			_, ok := itm.(XSFloat)
+			return ok
+		case "decimal":
+			// xs:decimal: XSDecimal, int, or XSInteger (integer is subtype of decimal)
+			switch itm.(type) {
+			case XSDecimal, int, XSInteger:
+				return true
+			}
+			return false
+		case "anyURI":
+			_, ok := itm.(XSAnyURI)
+			return ok
+		case "untypedAtomic":
+			_, ok := itm.(XSUntypedAtomic)
+			return ok
+		case "hexBinary":
+			_, ok := itm.(XSHexBinary)
+			return ok
+		case "base64Binary":
+			_, ok := itm.(XSBase64Binary)
+			return ok
+		case "boolean":
+			_, ok := itm.(bool)
+			return ok
+		case "numeric":
+			_, ok := ToFloat64(itm)
+			return ok
+		case "anyAtomicType":
+			switch itm.(type) {
+			case goxml.XMLNode, *XPathMap, *XPathArray, *XPathFunction:
+				return false
+			}
+			return true
+		case "qname":
+			_, ok := itm.(XSQName)
+			return ok
+		case "dateTime":
+			_, ok := itm.(XSDateTime)
+			return ok
+		case "date":
+			_, ok := itm.(XSDate)
+			return ok
+		case "time":
+			_, ok := itm.(XSTime)
+			return ok
+		case "duration":
+			_, ok := itm.(XSDuration)
+			return ok
+		case "gYear":
+			_, ok := itm.(XSGYear)
+			return ok
+		case "gMonth":
+			_, ok := itm.(XSGMonth)
+			return ok
+		case "gDay":
+			_, ok := itm.(XSGDay)
+			return ok
+		case "gYearMonth":
+			_, ok := itm.(XSGYearMonth)
+			return ok
+		case "gMonthDay":
+			_, ok := itm.(XSGMonthDay)
+			return ok
+		}
+		return false
+	}
+}
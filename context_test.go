@@ -0,0 +1,92 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+func TestContextDefaults(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	other, err := goxml.Parse(strings.NewReader(`<other>available</other>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup := func(ctx *Context) {
+		ctx.BaseURI = "http://example.com/dir/main.xml"
+		ctx.ImplicitTimezone = time.FixedZone("", -5*3600)
+		ctx.CurrentDateTime = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+		ctx.DefaultLanguage = "de"
+		ctx.DefaultCalendar = "AD"
+		ctx.DefaultPlace = "Europe/Berlin"
+		ctx.Documents = map[string]*goxml.XMLDocument{"http://example.com/dir/other.xml": other}
+	}
+	testdata := []struct {
+		input  string
+		output string
+	}{
+		{`static-base-uri()`, "http://example.com/dir/main.xml"},
+		{`resolve-uri('x.xml')`, "http://example.com/dir/x.xml"},
+		{`string(implicit-timezone())`, "-PT5H"},
+		{`string(current-dateTime())`, "2024-03-01T07:30:00-05:00"},
+		{`hours-from-dateTime(current-dateTime()) = 7`, "true"},
+		{`string(adjust-dateTime-to-timezone(xs:dateTime('2024-03-01T12:00:00Z')))`, "2024-03-01T07:00:00-05:00"},
+		{`string(adjust-dateTime-to-timezone(xs:dateTime('2024-03-01T12:00:00')))`, "2024-03-01T12:00:00-05:00"},
+		{`string(xs:dateTime('2020-01-01T00:00:00'))`, "2020-01-01T00:00:00"},
+		{`xs:dateTime('2020-01-01T00:00:00') eq xs:dateTime('2020-01-01T00:00:00Z')`, "false"},
+		{`xs:dateTime('2020-01-01T00:00:00') eq xs:dateTime('2020-01-01T05:00:00Z')`, "true"},
+		{`xs:time('10:00:00') lt xs:time('14:00:00Z')`, "false"},
+		{`xs:date('2020-01-01') = xs:date('2020-01-01-05:00')`, "true"},
+		{`string(xs:dateTime('2020-01-01T00:00:00') - xs:dateTime('2020-01-01T00:00:00Z'))`, "PT5H"},
+		{`string(xs:dateTime('2020-01-01T00:00:00') + xs:dayTimeDuration('PT1H'))`, "2020-01-01T01:00:00"},
+		{`count(distinct-values((xs:dateTime('2020-01-01T00:00:00'), xs:dateTime('2020-01-01T05:00:00Z'))))`, "1"},
+		{`default-language()`, "de"},
+		{`format-date(xs:date('2024-03-01'), '[C]')`, "AD"},
+		{`format-date(xs:date('2024-03-01'), '[C]', (), 'ISO', ())`, "ISO"},
+		{`format-dateTime(xs:dateTime('2024-03-01T12:00:00Z'), '[H01]')`, "13"},
+		{`format-dateTime(xs:dateTime('2024-03-01T12:00:00Z'), '[H01]', (), (), 'America/New_York')`, "07"},
+		{`string(doc('other.xml'))`, "available"},
+		{`doc-available('other.xml')`, "true"},
+		{`document-uri(doc('other.xml'))`, "http://example.com/dir/other.xml"},
+		{`document-uri(/)`, "http://example.com/dir/main.xml"},
+		{`document-uri(/root)`, ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		setup(np.Ctx)
+		s, err := np.EvaluateString(td.input)
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.Ctx.ImplicitTimezone = berlin
+	np.Ctx.CurrentDateTime = time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	if s, err := np.EvaluateString(`string(implicit-timezone())`); err != nil || s != "PT2H" {
+		t.Errorf("implicit-timezone() in summer = %q, %v, want PT2H", s, err)
+	}
+	np.Ctx.ImplicitTimezone = nil
+	if s, err := np.EvaluateString(`default-language()`); err != nil || s != "en" {
+		t.Errorf("default-language() = %q, %v, want en", s, err)
+	}
+	np.Ctx.Store = map[any]any{"baseURI": "http://example.com/store.xml"}
+	if s, err := np.EvaluateString(`static-base-uri()`); err != nil || s != "http://example.com/store.xml" {
+		t.Errorf("static-base-uri() from Store = %q, %v", s, err)
+	}
+}
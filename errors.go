@@ -1,6 +1,33 @@
 package goxpath
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Position is a location in the source text of an XPath expression. Line and
+// Column start at 1, Column counts characters. The zero Position is invalid
+// and used when the location is unknown.
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int
+	Column int
+}
+
+// IsValid reports whether the position is known.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns the position in the form line:column, or "-" if the
+// position is not valid.
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
 
 // XPathError represents a structured XPath error with an error code,
 // description, and optional error value. This implements the error interface
@@ -9,14 +36,20 @@ type XPathError struct {
 	Code        string   // e.g. "XPTY0004", "FORG0001", "FOER0000"
 	Description string   // human-readable description
 	Value       Sequence // optional error value (for fn:error)
+	Pos         Position // location of the failing part of Expr, if known
+	Expr        string   // the expression that raised the error, if known
 }
 
 // Error implements the error interface.
 func (e *XPathError) Error() string {
+	msg := e.Code
 	if e.Description != "" {
-		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+		msg = fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	if e.Pos.IsValid() {
+		msg = fmt.Sprintf("%s (line %d, column %d)", msg, e.Pos.Line, e.Pos.Column)
 	}
-	return e.Code
+	return msg
 }
 
 // NewXPathError creates a new XPathError with the given code and description.
@@ -46,6 +79,96 @@ func XPathErrorCode(err error) (string, bool) {
 	return "", false
 }
 
+// FormatError returns the message of err. If err is an XPathError that knows
+// its expression and position, the line of the expression is appended with
+// a caret under the failing part:
+//
+//	XPTY0004: cannot compare xs:string and xs:integer (line 1, column 12)
+//	count(a) + 'x' = 1
+//	           ^
+func FormatError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var xe *XPathError
+	if !errorAs(err, &xe) || xe.Expr == "" || !xe.Pos.IsValid() {
+		return err.Error()
+	}
+	offset := min(xe.Pos.Offset, len(xe.Expr))
+	start := strings.LastIndexByte(xe.Expr[:offset], '\n') + 1
+	end := len(xe.Expr)
+	if i := strings.IndexByte(xe.Expr[offset:], '\n'); i >= 0 {
+		end = offset + i
+	}
+	var sb strings.Builder
+	sb.WriteString(err.Error())
+	sb.WriteByte('\n')
+	sb.WriteString(strings.TrimSuffix(xe.Expr[start:end], "\r"))
+	sb.WriteByte('\n')
+	// keep tabs so that the caret lines up with the source
+	for _, r := range xe.Expr[start:offset] {
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+	sb.WriteByte('^')
+	return sb.String()
+}
+
+// errorAt records pos in err if err is an XPathError without a position.
+// Plain errors whose message starts with an error code are turned into an
+// XPathError first. Other errors are returned unchanged.
+func errorAt(err error, pos Position) error {
+	if err == nil || !pos.IsValid() {
+		return err
+	}
+	switch e := err.(type) {
+	case *XPathError:
+		if e.Pos.IsValid() {
+			return err
+		}
+		cp := *e
+		cp.Pos = pos
+		return &cp
+	default:
+		code, desc, ok := strings.Cut(err.Error(), ": ")
+		if !ok || !isErrorCode(code) {
+			return err
+		}
+		return &XPathError{Code: code, Description: desc, Pos: pos}
+	}
+}
+
+// errorIn records the source text of the expression in err if err is an
+// XPathError with a position.
+func errorIn(err error, expr string) error {
+	if xe, ok := err.(*XPathError); ok && xe.Pos.IsValid() && xe.Expr == "" {
+		cp := *xe
+		cp.Expr = expr
+		return &cp
+	}
+	return err
+}
+
+// staticError turns an error of the tokenizer, the parser or the compiler
+// into an XPathError at pos. Errors without an error code become XPST0003
+// syntax errors.
+func staticError(err error, pos Position) error {
+	if err == io.EOF {
+		err = &XPathError{Code: "XPST0003", Description: "unexpected end of expression"}
+	}
+	if _, ok := err.(*XPathError); !ok {
+		code, desc, ok := strings.Cut(err.Error(), ": ")
+		if !ok || !isErrorCode(code) {
+			code, desc = "XPST0003", err.Error()
+		}
+		err = &XPathError{Code: code, Description: desc}
+	}
+	return errorAt(err, pos)
+}
+
 // errorAs is a wrapper for errors.As to keep the import clean.
 func errorAs(err error, target any) bool {
 	// Use type assertion since we know the target type
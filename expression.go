@@ -0,0 +1,241 @@
+package goxpath
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"maps"
+	"sync"
+)
+
+// StaticContext holds the compile time environment of an XPath expression.
+// It is copied by Compile, so changing a StaticContext afterwards does not
+// affect expressions that have already been compiled.
+type StaticContext struct {
+	// Namespaces maps prefixes to namespace URIs. The bindings take
+	// precedence over the namespaces of the dynamic context. All prefixes
+	// used in an expression must be declared here.
+	Namespaces map[string]string
+	// Variables declares the external variables of the expression. A nil
+	// value means that the variable must be supplied by the dynamic
+	// context, otherwise the value is used as the default. Referencing a
+	// variable that is neither declared nor bound in the expression is an
+	// error.
+	Variables map[string]Sequence
+	// DefaultCollation is used by string operators and functions when no
+	// explicit collation is given. If nil, the collation of the dynamic
+	// context is used.
+	DefaultCollation Collation
+	// Functions are only visible to expressions compiled with this static
+	// context. They take precedence over globally registered functions.
+	Functions []*Function
+	// Library contains the functions that can be called in addition to
+	// Functions. If nil, Compile checks the function calls against the
+	// globally registered functions, so a function that only the library
+	// of the dynamic context provides is a static error (XPST0017). When
+	// the expression is evaluated, the library of the dynamic context or
+	// the globally registered functions are used.
+	Library *FunctionLibrary
+}
+
+// NewStaticContext returns a static context with the predefined namespace
+// prefixes fn, xs, math, map and array.
+func NewStaticContext() *StaticContext {
+	return &StaticContext{
+		Namespaces: map[string]string{
+			"fn":    nsFN,
+			"xs":    nsXS,
+			"math":  nsMath,
+			"map":   nsMap,
+			"array": nsArray,
+		},
+		Variables: make(map[string]Sequence),
+	}
+}
+
+// DeclareVariable declares an external variable. If value is nil, the
+// variable must be bound in the dynamic context at evaluation time.
+func (sc *StaticContext) DeclareVariable(name string, value Sequence) {
+	if sc.Variables == nil {
+		sc.Variables = make(map[string]Sequence)
+	}
+	sc.Variables[name] = value
+}
+
+// Expression is a compiled XPath expression. It can be evaluated any number
+// of times against different contexts and is safe for concurrent use as long
+// as each goroutine uses its own Context.
+type Expression struct {
+	source     string
+	namespaces map[string]string
+	variables  map[string]Sequence
+	collation  Collation
+	functions  map[string][]*Function
+	library    *FunctionLibrary
+	tree       Node
+	optimized  Node
+	types      map[Node]*SequenceType
+	eval       EvalFunc
+	iterOnce   sync.Once
+	iter       iterFunc
+	iterErr    error
+}
+
+// Compile parses the XPath expression with the given static context and
+// returns a reusable Expression. If sc is nil, NewStaticContext is used.
+//
+// Compile checks the whole expression against the static context and
+// reports references to undeclared variables (XPST0008), unknown functions
+// or calls with the wrong number of arguments (XPST0017) and namespace
+// prefixes that are not declared in sc (XPST0081), even if they are on a
+// code path that would never be evaluated.
+func Compile(expr string, sc *StaticContext) (*Expression, error) {
+	if sc == nil {
+		sc = NewStaticContext()
+	}
+	tree, err := ParseAST(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err = sc.check(tree); err != nil {
+		return nil, errorIn(err, expr)
+	}
+	optimized := optimize(tree, sc)
+	ef, err := CompileAST(optimized)
+	if err != nil {
+		return nil, errorIn(err, expr)
+	}
+	e := &Expression{
+		source:     expr,
+		namespaces: maps.Clone(sc.Namespaces),
+		variables:  maps.Clone(sc.Variables),
+		collation:  sc.DefaultCollation,
+		library:    sc.Library,
+		tree:       tree,
+		optimized:  optimized,
+		types:      sc.inferTypes(tree),
+		eval:       ef,
+	}
+	if len(sc.Functions) > 0 {
+		e.functions = functionMap(sc.Functions)
+	}
+	return e, nil
+}
+
+// MustCompile is like Compile but panics if the expression cannot be parsed.
+func MustCompile(expr string, sc *StaticContext) *Expression {
+	e, err := Compile(expr, sc)
+	if err != nil {
+		panic(fmt.Sprintf("goxpath: Compile(%q): %s", expr, err))
+	}
+	return e
+}
+
+// String returns the source text of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// AST returns the syntax tree of the expression. The tree must not be
+// modified.
+func (e *Expression) AST() Node {
+	return e.tree
+}
+
+// StaticType returns the type of the expression as inferred at compile time:
+// an item type and an occurrence indicator that every result of Evaluate
+// conforms to. The inferred type is conservative, item()* is returned if
+// nothing more specific is known.
+func (e *Expression) StaticType() *SequenceType {
+	return e.types[e.tree]
+}
+
+// StaticTypeOf returns the inferred type of the subexpression n of the tree
+// returned by AST, or nil if n is not an expression of that tree.
+func (e *Expression) StaticTypeOf(n Node) *SequenceType {
+	return e.types[n]
+}
+
+// Evaluate runs the expression in the given context. The static context of
+// the expression is layered on top of ctx for the duration of the call; ctx
+// itself is not changed, so it can be shared by concurrent evaluations.
+func (e *Expression) Evaluate(ctx *Context) (Sequence, error) {
+	return e.EvaluateContext(context.Background(), ctx)
+}
+
+// EvaluateContext is like Evaluate but aborts the evaluation with the error
+// code GOXP0001 when c is cancelled or its deadline passes. The resource
+// limits in ctx.Limits apply to Evaluate and EvaluateContext.
+func (e *Expression) EvaluateContext(c context.Context, ctx *Context) (Sequence, error) {
+	frame, err := e.enter(c, ctx)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := e.eval(frame)
+	return seq, errorIn(err, e.source)
+}
+
+// EvaluateIter runs the expression in the given context and returns its
+// result as an iterator. The items are computed while the iterator is
+// consumed, so path expressions, ranges, filters and for expressions stop as
+// soon as the loop over the iterator ends. The function returned with the
+// iterator reports the error that ended the last iteration.
+func (e *Expression) EvaluateIter(ctx *Context) (iter.Seq[Item], func() error) {
+	e.iterOnce.Do(func() {
+		var err error
+		e.iter, err = compileIter(e.optimized)
+		e.iterErr = errorIn(err, e.source)
+	})
+	var iterErr error
+	seq := func(yield func(Item) bool) {
+		if iterErr = e.iterErr; iterErr != nil {
+			return
+		}
+		frame, err := e.enter(context.Background(), ctx)
+		if err != nil {
+			iterErr = err
+			return
+		}
+		iterErr = errorIn(e.iter(frame, yield), e.source)
+	}
+	return seq, func() error { return iterErr }
+}
+
+// enter returns the frame for an evaluation of the expression in ctx: the
+// static context of the expression is layered on top of ctx and the
+// evaluation is started with c.
+func (e *Expression) enter(c context.Context, ctx *Context) (*Context, error) {
+	frame := ctx.newFrame()
+	if err := frame.beginEval(c); err != nil {
+		return nil, err
+	}
+
+	for name, value := range e.variables {
+		if _, ok := frame.vars[name]; ok {
+			continue
+		}
+		if value == nil {
+			return nil, NewXPathError("XPDY0002", fmt.Sprintf("external variable $%s is not bound", name))
+		}
+		frame.vars[name] = value
+	}
+
+	if len(e.namespaces) > 0 {
+		frame.Namespaces = maps.Clone(ctx.Namespaces)
+		if frame.Namespaces == nil {
+			frame.Namespaces = make(map[string]string)
+		}
+		maps.Copy(frame.Namespaces, e.namespaces)
+	}
+
+	if e.collation != nil {
+		frame.DefaultCollation = e.collation
+	}
+	if e.functions != nil {
+		frame.functions = e.functions
+	}
+	if e.library != nil {
+		frame.Library = e.library
+	}
+	return frame, nil
+}
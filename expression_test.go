@@ -0,0 +1,345 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileReuse(t *testing.T) {
+	e, err := Compile(`count(//item)`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, td := range []struct {
+		doc  string
+		want int
+	}{
+		{`<root><item/></root>`, 1},
+		{`<root><item/><item/><item/></root>`, 3},
+		{`<root/>`, 0},
+	} {
+		np, err := NewParser(strings.NewReader(td.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, err := e.Evaluate(np.Ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seq) != 1 || !itemsEqual(seq[0], td.want) {
+			t.Errorf("count(//item) = %v, want %d", seq, td.want)
+		}
+	}
+}
+
+func TestCompileStaticNamespaces(t *testing.T) {
+	sc := NewStaticContext()
+	sc.Namespaces["a"] = "anamespace"
+	e, err := Compile(`string(/a:root/a:sub)`, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := NewParser(strings.NewReader(nsDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := e.Evaluate(np.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || seq[0] != "text" {
+		t.Errorf("got %v, want [text]", seq)
+	}
+	if _, ok := np.Ctx.Namespaces["a"]; ok {
+		t.Error("static namespace leaked into the dynamic context")
+	}
+}
+
+func TestCompileExternalVariables(t *testing.T) {
+	sc := NewStaticContext()
+	sc.DeclareVariable("greeting", Sequence{"hello"})
+	sc.DeclareVariable("name", nil)
+	e, err := Compile(`$greeting || ' ' || $name`, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := NewParser(strings.NewReader(`<root/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.Evaluate(np.Ctx)
+	if code, _ := XPathErrorCode(err); code != "XPDY0002" {
+		t.Fatalf("unbound external variable: got %v, want XPDY0002", err)
+	}
+
+	np.SetVariable("name", Sequence{"world"})
+	seq, err := e.Evaluate(np.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || seq[0] != "hello world" {
+		t.Errorf("got %v, want [hello world]", seq)
+	}
+	if _, ok := np.Ctx.vars["greeting"]; ok {
+		t.Error("default value of external variable leaked into the dynamic context")
+	}
+
+	np.SetVariable("greeting", Sequence{"hi"})
+	seq, err = e.Evaluate(np.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || seq[0] != "hi world" {
+		t.Errorf("got %v, want [hi world]", seq)
+	}
+}
+
+func TestCompileFunctions(t *testing.T) {
+	const ns = "urn:test"
+	sc := NewStaticContext()
+	sc.Namespaces["t"] = ns
+	sc.Functions = []*Function{{
+		Name:      "double",
+		Namespace: ns,
+		MinArg:    1,
+		MaxArg:    1,
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			n, err := NumberValue(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return Sequence{n * 2}, nil
+		},
+	}}
+	e, err := Compile(`t:double(21), t:double#1(2)`, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := NewParser(strings.NewReader(`<root/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := e.Evaluate(np.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 2 || !itemsEqual(seq[0], 42) || !itemsEqual(seq[1], 4) {
+		t.Errorf("got %v, want [42 4]", seq)
+	}
+
+	// The function is not visible outside of the compiled expression.
+	np.Ctx.Namespaces["t"] = ns
+	if _, err = np.Evaluate(`t:double(21)`); err == nil {
+		t.Error("expected error, function must not be registered globally")
+	}
+}
+
+func TestCompileDefaultCollation(t *testing.T) {
+	sc := NewStaticContext()
+	coll, err := ResolveCollation(HTMLAsciiCaseInsensitiveURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.DefaultCollation = coll
+	e, err := Compile(`compare('ABC', 'abc') eq 0`, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := NewParser(strings.NewReader(`<root/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := e.Evaluate(np.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || seq[0] != true {
+		t.Errorf("got %v, want [true]", seq)
+	}
+	if np.Ctx.DefaultCollation != nil {
+		t.Error("static collation leaked into the dynamic context")
+	}
+}
+
+func TestCompileStaticErrors(t *testing.T) {
+	sc := NewStaticContext()
+	sc.Namespaces["a"] = "anamespace"
+	sc.DeclareVariable("ext", nil)
+	for _, td := range []struct {
+		input string
+		code  string
+		pos   string
+	}{
+		{`if (true()) then 1 else nofn(2)`, "XPST0017", "1:25"},
+		{`false() and substring()`, "XPST0017", "1:13"},
+		{`count#3`, "XPST0017", "1:1"},
+		{`'a' => upper-case('b')`, "XPST0017", "1:5"},
+		{`for $x in 1 to 3 return $y`, "XPST0008", "1:25"},
+		{`let $x := $x return 1`, "XPST0008", "1:11"},
+		{`(for $x in 1 return $x), $x`, "XPST0008", "1:26"},
+		{`function($p) { $p + $q }`, "XPST0008", "1:21"},
+		{`/root/b:sub`, "XPST0081", "1:7"},
+		{`//b:*`, "XPST0081", "1:3"},
+		{`b:f()`, "XPST0081", "1:1"},
+		{`//element(b:x)`, "XPST0081", "1:3"},
+		{`1 cast as b:t`, "XPST0081", "1:3"},
+		{`1 instance of b:t`, "XPST0081", "1:15"},
+		{`1 treat as b:t+`, "XPST0081", "1:12"},
+		{`function($x as b:t) { 1 }`, "XPST0081", "1:1"},
+		{`1 castable as xs:nosuch`, "XPST0051", "1:3"},
+		{`1 instance of xs:nosuch*`, "XPST0051", "1:15"},
+		{`1 cast as a:integer`, "XPST0051", "1:3"},
+		{`1 cast as integer`, "XPST0051", "1:3"},
+		{`function($x) as xs:nosuch { 1 }`, "XPST0051", "1:1"},
+		{`function($x as element(b:x)) { 1 }`, "XPST0081", "1:1"},
+		{`1 2`, "XPST0003", "1:3"},
+		{`(1))`, "XPST0003", "1:4"},
+		{`1 + 2 3`, "XPST0003", "1:7"},
+		{`//*:sub b`, "XPST0003", "1:9"},
+	} {
+		_, err := Compile(td.input, sc)
+		xe, ok := err.(*XPathError)
+		if !ok {
+			t.Errorf("%s: got error %v, want an XPathError", td.input, err)
+			continue
+		}
+		if xe.Code != td.code || xe.Pos.String() != td.pos || xe.Expr != td.input {
+			t.Errorf("%s: got %s at %s in %q, want %s at %s", td.input, xe.Code, xe.Pos, xe.Expr, td.code, td.pos)
+		}
+	}
+
+	for _, expr := range []string{
+		`for $x in 1 to 3, $y in $x return $x + $y + $ext`,
+		`some $x in (1, 2) satisfies $x = $ext`,
+		`function($p) { $p + $ext }(1)`,
+		`concat('a', 'b', 'c', 'd'), fn:true(), xs:integer('1'), math:pi()`,
+		`map:get(map { 'a': 1 }, 'a'), array:size([1])`,
+		`//a:sub/@xml:lang, //*:sub, //a:*, //element(a:sub)`,
+		`Q{http://www.w3.org/2005/xpath-functions}count(())`,
+		`'a' => upper-case(), count#1`,
+		`1 cast as Q{http://www.w3.org/2001/XMLSchema}integer, '1' castable as xs:double?`,
+		`1 instance of xs:anyAtomicType, . treat as item()*, function($x as xs:string?) as xs:integer* { 1 }`,
+		`function($x as element()*, $y as xs:string) { $y }`,
+	} {
+		if _, err := Compile(expr, sc); err != nil {
+			t.Errorf("%s: %s", expr, err)
+		}
+	}
+}
+
+func TestStaticType(t *testing.T) {
+	sc := NewStaticContext()
+	sc.DeclareVariable("n", Sequence{1, 2})
+	for _, td := range []struct {
+		input string
+		want  string
+	}{
+		{`1`, "xs:integer"},
+		{`'a', 'b'`, "xs:string+"},
+		{`((), 'a')`, "xs:string"},
+		{`()`, "empty-sequence()"},
+		{`/root/sub`, "element()*"},
+		{`//sub/@foo`, "attribute()*"},
+		{`/root/sub/string()`, "xs:string*"},
+		{`/root/sub/text()`, "item()*"},
+		{`//sub | //sub/@foo`, "node()*"},
+		{`(/root/sub)[1]`, "element()?"},
+		{`/`, "document-node()"},
+		{`count(//a) + 1`, "xs:integer"},
+		{`for $x in 1 to 3 return $x div 2`, "xs:decimal*"},
+		{`let $a := 'x' return $a || 'y'`, "xs:string"},
+		{`if (true()) then 1 else ()`, "xs:integer?"},
+		{`if (true()) then 1 else 2.5`, "xs:anyAtomicType"},
+		{`2.0 * 1e3`, "xs:double"},
+		{`-$n`, "xs:double"},
+		{`+$n`, "xs:integer+"},
+		{`xs:integer('3')`, "xs:integer?"},
+		{`'1' cast as xs:integer?`, "xs:integer?"},
+		{`. treat as xs:string+`, "xs:string+"},
+		{`function($x as xs:integer) { $x }`, "function(*)"},
+		{`map { }, [1]`, "item()+"},
+		{`$n`, "xs:integer+"},
+		{`$n ! string()`, "xs:string+"},
+	} {
+		e, err := Compile(td.input, sc)
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if got := e.StaticType().String(); got != td.want {
+			t.Errorf("static type of %s = %s, want %s", td.input, got, td.want)
+		}
+	}
+}
+
+func TestStaticTypeMatchesResult(t *testing.T) {
+	for _, input := range []string{
+		`1`,
+		`-1`,
+		`-(1)`,
+		`- $x`,
+		`+$x`,
+		`-xs:float(1.5)`,
+		`-()`,
+		`-(/root/@one)`,
+		`count(//a) + 1`,
+		`for $y in 1 to 3 return $y div 2`,
+		`if (true()) then 1 else ()`,
+		`2.0 * 1e3`,
+		`'1' cast as xs:integer?`,
+		`/root/sub/string()`,
+		`/root/sub/text()`,
+		`/root/node()`,
+		`//node()`,
+		`/root//.`,
+		`/root/sub/self::text()`,
+		`/comment()`,
+		`/processing-instruction()`,
+		`/root/@*`,
+		`/root/sub/text() | /root/other`,
+		`/root/sub//text()/string-length()`,
+	} {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.SetVariable("x", Sequence{1})
+		sc := NewStaticContext()
+		sc.DeclareVariable("x", Sequence{1})
+		e, err := Compile(input, sc)
+		if err != nil {
+			t.Errorf("%s: %s", input, err)
+			continue
+		}
+		st := e.StaticType().String()
+		seq, err := np.Evaluate("(" + input + ") instance of " + st)
+		if err != nil {
+			t.Errorf("%s: %s", input, err)
+			continue
+		}
+		if len(seq) != 1 || seq[0] != true {
+			t.Errorf("result of %s is not an instance of its static type %s", input, st)
+		}
+	}
+}
+
+func TestStaticTypeOf(t *testing.T) {
+	e, err := Compile(`for $s in //sub return let $v := $s/@foo return string($v)`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Inspect(e.AST(), func(n Node) bool {
+		if v, ok := n.(*VarRef); ok {
+			got = append(got, "$"+v.Name+" as "+e.StaticTypeOf(v).String())
+		}
+		return true
+	})
+	if s := strings.Join(got, ", "); s != "$s as element(), $v as attribute()*" {
+		t.Errorf("got %s", s)
+	}
+	if st := e.StaticType().String(); st != "xs:string*" {
+		t.Errorf("StaticType() = %s, want xs:string*", st)
+	}
+}
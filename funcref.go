@@ -9,7 +9,8 @@ type XPathFunction struct {
 	Namespace        string
 	Arity            int
 	Fn               func(*Context, []Sequence) (Sequence, error)
-	DynamicCallError string // if non-empty, calling this function reference raises this error
+	DynamicCallError string     // if non-empty, calling this function reference raises this error
+	Signature        *Signature // the declared types of a named function, if any
 }
 
 // Call invokes the function with the given arguments.
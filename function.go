@@ -6,7 +6,6 @@ import (
 	"math"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"slices"
 	"sort"
@@ -21,7 +20,7 @@ import (
 )
 
 var (
-	xpathfunctions   = make(map[string]*Function)
+	xpathfunctions   = make(map[string][]*Function)
 	multipleWSRegexp *regexp.Regexp
 
 	// xpathRegexCache memoizes compileXPathRegex results so that
@@ -345,6 +344,9 @@ func fnDistinctValues(ctx *Context, args []Sequence) (Sequence, error) {
 					continue
 				}
 				key = f
+			} else if k, ok := mapKey(ctx.withImplicitTimezone(itm)).(temporalKey); ok {
+				// dates and times are distinct if they are not eq
+				key = k
 			} else {
 				key = itm
 			}
@@ -544,14 +546,10 @@ func getTime(args []Sequence) (time.Time, error) {
 }
 
 func timezoneSequence(t time.Time) Sequence {
-	_, offset := t.Zone()
-	if t.Location() == time.UTC && offset == 0 {
-		return Sequence{XSDuration{Hours: 0}}
-	}
-	if offset == 0 {
-		// No explicit timezone
+	if !hasTimezone(t) {
 		return Sequence{}
 	}
+	_, offset := t.Zone()
 	d := XSDuration{}
 	if offset < 0 {
 		d.Negative = true
@@ -579,14 +577,14 @@ func signedInt(val int, negative bool) int {
 	return val
 }
 
-func adjustToTimezone(t time.Time, args []Sequence) (time.Time, error) {
+func adjustToTimezone(ctx *Context, t time.Time, args []Sequence) (time.Time, error) {
 	if len(args) < 2 {
-		// No timezone argument: adjust to implicit timezone (local)
-		return t.In(time.Local), nil
+		// No timezone argument: adjust to implicit timezone
+		return inTimezone(t, ctx.implicitTimezone()), nil
 	}
 	if len(args[1]) == 0 {
 		// Empty sequence: strip timezone (keep local time values)
-		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone("", 0)), nil
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), noTimezone), nil
 	}
 	dur, ok := args[1][0].(XSDuration)
 	if !ok {
@@ -605,7 +603,16 @@ func adjustToTimezone(t time.Time, args []Sequence) (time.Time, error) {
 	} else {
 		loc = time.FixedZone("", offset)
 	}
-	return t.In(loc), nil
+	return inTimezone(t, loc), nil
+}
+
+// inTimezone returns t in loc. A value without a timezone keeps its local
+// time and gets loc as its timezone.
+func inTimezone(t time.Time, loc *time.Location) time.Time {
+	if !hasTimezone(t) {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+	}
+	return t.In(loc)
 }
 
 func fnAdjustDateTimeToTimezone(ctx *Context, args []Sequence) (Sequence, error) {
@@ -616,7 +623,7 @@ func fnAdjustDateTimeToTimezone(ctx *Context, args []Sequence) (Sequence, error)
 	if !ok {
 		return nil, NewXPathError("XPTY0004", "expected xs:dateTime")
 	}
-	t, err := adjustToTimezone(time.Time(dt), args)
+	t, err := adjustToTimezone(ctx, time.Time(dt), args)
 	if err != nil {
 		return nil, err
 	}
@@ -631,7 +638,7 @@ func fnAdjustDateToTimezone(ctx *Context, args []Sequence) (Sequence, error) {
 	if !ok {
 		return nil, NewXPathError("XPTY0004", "expected xs:date")
 	}
-	t, err := adjustToTimezone(time.Time(d), args)
+	t, err := adjustToTimezone(ctx, time.Time(d), args)
 	if err != nil {
 		return nil, err
 	}
@@ -646,7 +653,7 @@ func fnAdjustTimeToTimezone(ctx *Context, args []Sequence) (Sequence, error) {
 	if !ok {
 		return nil, NewXPathError("XPTY0004", "expected xs:time")
 	}
-	t, err := adjustToTimezone(time.Time(tv), args)
+	t, err := adjustToTimezone(ctx, time.Time(tv), args)
 	if err != nil {
 		return nil, err
 	}
@@ -840,8 +847,8 @@ func deepEqualItemsColl(a, b Item, coll Collation) bool {
 		if av.Name != bv.Name || av.Prefix != bv.Prefix {
 			return false
 		}
-		aAttrs := av.Attributes()
-		bAttrs := bv.Attributes()
+		aAttrs := attributes(av)
+		bAttrs := attributes(bv)
 		if len(aAttrs) != len(bAttrs) {
 			return false
 		}
@@ -891,8 +898,8 @@ func deepEqualItems(a, b Item) bool {
 		if av.Name != bv.Name || av.Prefix != bv.Prefix {
 			return false
 		}
-		aAttrs := av.Attributes()
-		bAttrs := bv.Attributes()
+		aAttrs := attributes(av)
+		bAttrs := attributes(bv)
 		if len(aAttrs) != len(bAttrs) {
 			return false
 		}
@@ -1027,45 +1034,10 @@ func fnDoc(ctx *Context, args []Sequence) (Sequence, error) {
 	}
 
 	// Resolve the URI against the base URI
-	resolvedPath := uri
-	if !filepath.IsAbs(uri) {
-		if ctx.Store != nil {
-			if baseURI, ok := ctx.Store["baseURI"].(string); ok && baseURI != "" {
-				resolvedPath = filepath.Join(filepath.Dir(baseURI), uri)
-			}
-		}
-	}
-
-	// Initialize Store and doc-cache if needed
-	if ctx.Store == nil {
-		ctx.Store = make(map[any]any)
-	}
-	cache, ok := ctx.Store["doc-cache"].(map[string]*goxml.XMLDocument)
-	if !ok {
-		cache = make(map[string]*goxml.XMLDocument)
-		ctx.Store["doc-cache"] = cache
-	}
-
-	// Check cache
-	if doc, ok := cache[resolvedPath]; ok {
-		return Sequence{doc}, nil
-	}
-
-	// Parse the XML file
-	f, err := os.Open(resolvedPath)
+	doc, err := ctx.loadDocument(ctx.resolver(), ctx.resolveArgURI(args[0], uri))
 	if err != nil {
-		return nil, fmt.Errorf("fn:doc: %w", err)
-	}
-	defer f.Close()
-
-	doc, err := goxml.Parse(f)
-	if err != nil {
-		return nil, fmt.Errorf("fn:doc: error parsing %q: %w", resolvedPath, err)
+		return nil, err
 	}
-
-	// Cache the document
-	cache[resolvedPath] = doc
-
 	return Sequence{doc}, nil
 }
 
@@ -1080,20 +1052,14 @@ func fnDocAvailable(ctx *Context, args []Sequence) (Sequence, error) {
 	if uri == "" {
 		return Sequence{false}, nil
 	}
-	resolvedPath := uri
-	if !filepath.IsAbs(uri) {
-		if ctx.Store != nil {
-			if baseURI, ok := ctx.Store["baseURI"].(string); ok && baseURI != "" {
-				resolvedPath = filepath.Join(filepath.Dir(baseURI), uri)
-			}
-		}
-	}
-	f, err := os.Open(resolvedPath)
-	if err != nil {
+	uri = ctx.resolveArgURI(args[0], uri)
+	if ctx.checkResource("FODC0002", uri) != nil {
 		return Sequence{false}, nil
 	}
-	f.Close()
-	return Sequence{true}, nil
+	if _, ok := ctx.Documents[uri]; ok {
+		return Sequence{true}, nil
+	}
+	return Sequence{ctx.resourceAvailable(uri)}, nil
 }
 
 func fnEmpty(ctx *Context, args []Sequence) (Sequence, error) {
@@ -2368,10 +2334,8 @@ func fnResolveURI(ctx *Context, args []Sequence) (Sequence, error) {
 		if err != nil {
 			return nil, err
 		}
-	} else if ctx.Store != nil {
-		if baseURI, ok := ctx.Store["baseURI"].(string); ok {
-			base = baseURI
-		}
+	} else {
+		base = ctx.staticBaseURI()
 	}
 	if base == "" {
 		return nil, NewXPathError("FORG0002", "no base URI available")
@@ -2427,7 +2391,7 @@ func fnLang(ctx *Context, args []Sequence) (Sequence, error) {
 	}
 	testLang = strings.ToLower(testLang)
 	for cur := node; cur != nil; {
-		for _, attr := range cur.Attributes() {
+		for _, attr := range attributes(cur) {
 			if attr.Name == "lang" && attr.Namespace == "http://www.w3.org/XML/1998/namespace" {
 				lang := strings.ToLower(attr.Value)
 				if lang == testLang || strings.HasPrefix(lang, testLang+"-") {
@@ -3151,6 +3115,9 @@ func fnReverse(ctx *Context, args []Sequence) (Sequence, error) {
 	i := 0
 	l := len(inputSeq)
 	for {
+		if err := ctx.checkEvery(i); err != nil {
+			return nil, err
+		}
 		retSeq[i] = inputSeq[l-i-1]
 		i++
 		if i >= l {
@@ -3617,7 +3584,8 @@ func fnFormatDate(ctx *Context, args []Sequence) (Sequence, error) {
 	if err != nil {
 		return nil, err
 	}
-	result, err := formatDateTimePicture(time.Time(dateVal), picture, "date")
+	t, calendar := ctx.dateFormatOptions(time.Time(dateVal), args)
+	result, err := formatDateTimePicture(t, picture, "date", calendar)
 	if err != nil {
 		return nil, err
 	}
@@ -3636,7 +3604,8 @@ func fnFormatDateTime(ctx *Context, args []Sequence) (Sequence, error) {
 	if err != nil {
 		return nil, err
 	}
-	result, err := formatDateTimePicture(time.Time(dtVal), picture, "dateTime")
+	t, calendar := ctx.dateFormatOptions(time.Time(dtVal), args)
+	result, err := formatDateTimePicture(t, picture, "dateTime", calendar)
 	if err != nil {
 		return nil, err
 	}
@@ -3655,7 +3624,8 @@ func fnFormatTime(ctx *Context, args []Sequence) (Sequence, error) {
 	if err != nil {
 		return nil, err
 	}
-	result, err := formatDateTimePicture(time.Time(tVal), picture, "time")
+	t, calendar := ctx.dateFormatOptions(time.Time(tVal), args)
+	result, err := formatDateTimePicture(t, picture, "time", calendar)
 	if err != nil {
 		return nil, err
 	}
@@ -3671,7 +3641,27 @@ var dateComponents = map[string]string{
 	"dateTime": "YMDdFWwHhmsffPECZz",
 }
 
-func formatDateTimePicture(t time.Time, picture string, typ string) (string, error) {
+// dateFormatOptions applies the $calendar and $place arguments of
+// format-date, format-dateTime and format-time, falling back to the default
+// calendar and place of ctx. A place that is an IANA time zone name adjusts
+// t to that zone.
+func (ctx *Context) dateFormatOptions(t time.Time, args []Sequence) (time.Time, string) {
+	calendar, place := ctx.DefaultCalendar, ctx.DefaultPlace
+	if len(args) > 3 && len(args[3]) > 0 {
+		calendar, _ = StringValue(args[3])
+	}
+	if len(args) > 4 && len(args[4]) > 0 {
+		place, _ = StringValue(args[4])
+	}
+	if strings.Contains(place, "/") {
+		if loc, err := time.LoadLocation(place); err == nil {
+			t = t.In(loc)
+		}
+	}
+	return t, calendar
+}
+
+func formatDateTimePicture(t time.Time, picture string, typ string, calendar string) (string, error) {
 	validComponents := dateComponents[typ]
 	var result strings.Builder
 	runes := []rune(picture)
@@ -3728,6 +3718,9 @@ func formatDateTimePicture(t time.Time, picture string, typ string) (string, err
 			presentation, minWidth, maxWidth := parseComponentModifier(rawModifier)
 
 			val := formatDateTimeComponent(t, specifier, presentation, minWidth, maxWidth)
+			if specifier == 'C' && calendar != "" {
+				val = calendar
+			}
 			if isOrdinal && len(val) > 0 {
 				// Add ordinal suffix to numeric output
 				if n, err := strconv.Atoi(val); err == nil {
@@ -4047,7 +4040,7 @@ func jsonValueToXPath(v any) (Item, error) {
 			}
 			entries = append(entries, MapEntry{Key: k, Value: value})
 		}
-		return &XPathMap{Entries: entries}, nil
+		return NewXPathMap(entries...), nil
 	}
 	return nil, fmt.Errorf("unsupported JSON type: %T", v)
 }
@@ -4064,19 +4057,19 @@ func makeRNGMap() *XPathMap {
 	nextFn = &XPathFunction{
 		Name: "next", Namespace: nsFN, Arity: 0,
 		Fn: func(ctx *Context, args []Sequence) (Sequence, error) {
-			m := &XPathMap{Entries: []MapEntry{
-				{Key: "number", Value: Sequence{XSDouble(0.5)}},
-				{Key: "next", Value: Sequence{nextFn}},
-				{Key: "permute", Value: Sequence{permuteFn}},
-			}}
+			m := NewXPathMap(
+				MapEntry{Key: "number", Value: Sequence{XSDouble(0.5)}},
+				MapEntry{Key: "next", Value: Sequence{nextFn}},
+				MapEntry{Key: "permute", Value: Sequence{permuteFn}},
+			)
 			return Sequence{m}, nil
 		},
 	}
-	return &XPathMap{Entries: []MapEntry{
-		{Key: "number", Value: Sequence{XSDouble(0.5)}},
-		{Key: "next", Value: Sequence{nextFn}},
-		{Key: "permute", Value: Sequence{permuteFn}},
-	}}
+	return NewXPathMap(
+		MapEntry{Key: "number", Value: Sequence{XSDouble(0.5)}},
+		MapEntry{Key: "next", Value: Sequence{nextFn}},
+		MapEntry{Key: "permute", Value: Sequence{permuteFn}},
+	)
 }
 
 // isStringLike returns true if the item is a string-like type for comparison purposes.
@@ -4180,6 +4173,9 @@ func fnSort(ctx *Context, args []Sequence) (Sequence, error) {
 	}
 	entries := make([]sortEntry, len(seq))
 	for i, itm := range seq {
+		if err := ctx.checkEvery(i); err != nil {
+			return nil, err
+		}
 		var key Sequence
 		if keyFn != nil {
 			var err error
@@ -4193,8 +4189,18 @@ func fnSort(ctx *Context, args []Sequence) (Sequence, error) {
 		entries[i] = sortEntry{key: key, itm: itm}
 	}
 
-	// Stable sort using comparison
+	// Stable sort using comparison. After a cancellation all entries
+	// compare equal, so the sort finishes quickly.
+	var cancelled error
+	comparisons := 0
 	sort.SliceStable(entries, func(i, j int) bool {
+		if cancelled != nil {
+			return false
+		}
+		if cancelled = ctx.checkEvery(comparisons); cancelled != nil {
+			return false
+		}
+		comparisons++
 		a, b := entries[i].key, entries[j].key
 		if len(a) == 0 {
 			return true
@@ -4213,6 +4219,9 @@ func fnSort(ctx *Context, args []Sequence) (Sequence, error) {
 		sb := itemStringvalue(b[0])
 		return coll.Compare(sa, sb) < 0
 	})
+	if cancelled != nil {
+		return nil, cancelled
+	}
 
 	result := make(Sequence, len(entries))
 	for i, e := range entries {
@@ -4418,8 +4427,11 @@ func init() {
 	RegisterFunction(&Function{Name: "data", Namespace: nsFN, F: fnData, MaxArg: 1})
 	RegisterFunction(&Function{Name: "deep-equal", Namespace: nsFN, F: fnDeepEqual, MinArg: 2, MaxArg: 3})
 	RegisterFunction(&Function{Name: "distinct-values", Namespace: nsFN, F: fnDistinctValues, MinArg: 1, MaxArg: 2})
+	RegisterFunction(&Function{Name: "base-uri", Namespace: nsFN, F: fnBaseURI, MaxArg: 1})
 	RegisterFunction(&Function{Name: "doc", Namespace: nsFN, F: fnDoc, MinArg: 1, MaxArg: 1})
 	RegisterFunction(&Function{Name: "doc-available", Namespace: nsFN, F: fnDocAvailable, MinArg: 1, MaxArg: 1})
+	RegisterFunction(&Function{Name: "collection", Namespace: nsFN, F: fnCollection, MaxArg: 1})
+	RegisterFunction(&Function{Name: "uri-collection", Namespace: nsFN, F: fnURICollection, MaxArg: 1})
 	RegisterFunction(&Function{Name: "encode-for-uri", Namespace: nsFN, F: fnEncodeForURI, MinArg: 1, MaxArg: 1})
 	RegisterFunction(&Function{Name: "escape-html-uri", Namespace: nsFN, F: fnEscapeHTMLURI, MinArg: 1, MaxArg: 1})
 	RegisterFunction(&Function{Name: "empty", Namespace: nsFN, F: fnEmpty, MinArg: 1, MaxArg: 1})
@@ -4519,15 +4531,17 @@ func init() {
 		}
 		ns := qname.Namespace
 		name := qname.Localname
-		fn := getfunction(ns, name)
-		if fn == nil {
+		fn := ctx.lookupFunction(ns, name, int(arity))
+		if fn == nil || arity < 0 {
 			return Sequence{}, nil
 		}
 		return Sequence{&XPathFunction{
-			Name:      name,
-			Namespace: ns,
-			Arity:     int(arity),
-			Fn:        fn.F,
+			Name:             name,
+			Namespace:        ns,
+			Arity:            int(arity),
+			Fn:               fn.call,
+			DynamicCallError: fn.DynamicCallError,
+			Signature:        fn.Signature,
 		}}, nil
 	}, MinArg: 2, MaxArg: 2})
 	RegisterFunction(&Function{Name: "format-date", Namespace: nsFN, F: fnFormatDate, MinArg: 2, MaxArg: 5})
@@ -4555,6 +4569,7 @@ func init() {
 	RegisterFunction(&Function{Name: "in-scope-prefixes", Namespace: nsFN, F: fnInScopePrefixes, MinArg: 1, MaxArg: 1})
 	RegisterFunction(&Function{Name: "insert-before", Namespace: nsFN, F: fnInsertBefore, MinArg: 3, MaxArg: 3})
 	RegisterFunction(&Function{Name: "iri-to-uri", Namespace: nsFN, F: fnIRIToURI, MinArg: 1, MaxArg: 1})
+	RegisterFunction(&Function{Name: "key", Namespace: nsFN, F: fnKey, MinArg: 2, MaxArg: 3})
 	RegisterFunction(&Function{Name: "lang", Namespace: nsFN, F: fnLang, MinArg: 1, MaxArg: 2})
 	RegisterFunction(&Function{Name: "minutes-from-dateTime", Namespace: nsFN, F: fnMinutesFromDateTime, MinArg: 1, MaxArg: 1})
 	RegisterFunction(&Function{Name: "minutes-from-duration", Namespace: nsFN, F: fnMinutesFromDuration, MinArg: 1, MaxArg: 1})
@@ -4647,9 +4662,9 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		data, err := os.ReadFile(href)
+		data, err := ctx.readResource("FOUT1170", ctx.resolveArgURI(args[0], href))
 		if err != nil {
-			return nil, NewXPathError("FOUT1170", fmt.Sprintf("cannot read %q: %v", href, err))
+			return nil, err
 		}
 		return Sequence{string(data)}, nil
 	}, MinArg: 1, MaxArg: 2})
@@ -4658,17 +4673,16 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		_, err = os.Stat(href)
-		return Sequence{err == nil}, nil
+		return Sequence{ctx.resourceAvailable(ctx.resolveArgURI(args[0], href))}, nil
 	}, MinArg: 1, MaxArg: 2})
 	RegisterFunction(&Function{Name: "unparsed-text-lines", Namespace: nsFN, F: func(ctx *Context, args []Sequence) (Sequence, error) {
 		href, err := StringValue(args[0])
 		if err != nil {
 			return nil, err
 		}
-		data, err := os.ReadFile(href)
+		data, err := ctx.readResource("FOUT1170", ctx.resolveArgURI(args[0], href))
 		if err != nil {
-			return nil, NewXPathError("FOUT1170", fmt.Sprintf("cannot read %q: %v", href, err))
+			return nil, err
 		}
 		lines := strings.Split(string(data), "\n")
 		var result Sequence
@@ -4701,24 +4715,34 @@ func init() {
 		return Sequence{doc}, nil
 	}, MinArg: 1, MaxArg: 1})
 	RegisterFunction(&Function{Name: "document-uri", Namespace: nsFN, F: func(ctx *Context, args []Sequence) (Sequence, error) {
-		if len(args) == 0 || len(args[0]) == 0 {
+		var item Item
+		if len(args) == 0 {
+			if len(ctx.sequence) == 0 {
+				return nil, NewXPathError("XPDY0002", "context item is absent")
+			}
+			item = ctx.sequence[0]
+		} else if len(args[0]) > 0 {
+			item = args[0][0]
+		}
+		d, ok := item.(*goxml.XMLDocument)
+		if !ok {
 			return Sequence{}, nil
 		}
-		// document-uri returns empty for most cases in our implementation
-		if _, ok := args[0][0].(*goxml.XMLDocument); ok {
-			if baseURI, ok := ctx.Store["baseURI"]; ok {
-				return Sequence{XSAnyURI(baseURI.(string))}, nil
-			}
+		if uri := ctx.documentURI(d); uri != "" {
+			return Sequence{XSAnyURI(uri)}, nil
 		}
 		return Sequence{}, nil
 	}, MaxArg: 1})
 	RegisterFunction(&Function{Name: "static-base-uri", Namespace: nsFN, F: func(ctx *Context, args []Sequence) (Sequence, error) {
-		if baseURI, ok := ctx.Store["baseURI"]; ok {
-			return Sequence{XSAnyURI(baseURI.(string))}, nil
+		if baseURI := ctx.staticBaseURI(); baseURI != "" {
+			return Sequence{XSAnyURI(baseURI)}, nil
 		}
 		return Sequence{}, nil
 	}})
 	RegisterFunction(&Function{Name: "default-language", Namespace: nsFN, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		if ctx.DefaultLanguage != "" {
+			return Sequence{ctx.DefaultLanguage}, nil
+		}
 		return Sequence{"en"}, nil
 	}})
 	RegisterFunction(&Function{Name: "parse-ietf-date", Namespace: nsFN, F: func(ctx *Context, args []Sequence) (Sequence, error) {
@@ -4816,9 +4840,9 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		data, err := os.ReadFile(href)
+		data, err := ctx.readResource("FOUT1170", ctx.resolveArgURI(args[0], href))
 		if err != nil {
-			return nil, NewXPathError("FOJS0001", fmt.Sprintf("cannot read JSON: %v", err))
+			return nil, err
 		}
 		result, err := jsonToXPath(string(data))
 		if err != nil {
@@ -4933,7 +4957,7 @@ func init() {
 			return nil, err
 		}
 		val, ok := os.LookupEnv(name)
-		if !ok {
+		if !ok || !ctx.environmentAllowed(name) {
 			return Sequence{}, nil
 		}
 		return Sequence{val}, nil
@@ -4942,7 +4966,9 @@ func init() {
 		var result Sequence
 		for _, e := range os.Environ() {
 			parts := strings.SplitN(e, "=", 2)
-			result = append(result, parts[0])
+			if ctx.environmentAllowed(parts[0]) {
+				result = append(result, parts[0])
+			}
 		}
 		return result, nil
 	}})
@@ -5115,20 +5141,60 @@ type Function struct {
 	MinArg           int
 	MaxArg           int
 	DynamicCallError string // if non-empty, dynamic calls (via function reference) raise this error
+	// Signature optionally declares the parameter and result types. The
+	// arguments are converted and checked before F is called. If MinArg
+	// and MaxArg are both 0, the function takes as many arguments as there
+	// are parameters.
+	Signature *Signature
 }
 
-// RegisterFunction registers an XPath function
+// RegisterFunction registers an XPath function in DefaultFunctions, which
+// makes it available to all contexts without a library of their own.
 func RegisterFunction(f *Function) {
-	xpathfunctions[f.Namespace+" "+f.Name] = f
+	defaultLibrary.Register(f)
 }
 
 func getfunction(namespace, name string) *Function {
-	return xpathfunctions[namespace+" "+name]
+	return selectOverload(xpathfunctions[namespace+" "+name], -1)
+}
+
+// lookupFunction returns the function that accepts arity arguments from the
+// static context of the expression being evaluated, falling back to the
+// library of the context or the registered functions. A negative arity
+// accepts any overload.
+func (ctx *Context) lookupFunction(namespace, name string, arity int) *Function {
+	key := namespace + " " + name
+	if fn := selectOverload(ctx.functions[key], arity); fn != nil {
+		return fn
+	}
+	if ctx.Library != nil {
+		return ctx.Library.lookup(key, arity)
+	}
+	return selectOverload(xpathfunctions[key], arity)
 }
 
 // FunctionExists returns true if a function with the given namespace and local name is registered.
 func FunctionExists(namespace, name string) bool {
-	return xpathfunctions[namespace+" "+name] != nil
+	return len(xpathfunctions[namespace+" "+name]) > 0
+}
+
+// resolveFunction returns the function namespace:name that accepts arity
+// arguments or an XPST0017 error.
+func (ctx *Context) resolveFunction(namespace, name string, arity int) (*Function, error) {
+	if fn := ctx.lookupFunction(namespace, name, arity); fn != nil {
+		return fn, nil
+	}
+	fn := ctx.lookupFunction(namespace, name, -1)
+	if fn == nil {
+		return nil, NewXPathError("XPST0017", fmt.Sprintf("Could not find function %q in namespace %q", name, namespace))
+	}
+	if fn.MinArg > 0 && arity < fn.MinArg {
+		return nil, NewXPathError("XPST0017", fmt.Sprintf("too few arguments in function call (%q), min: %d", fn.Name, fn.MinArg))
+	}
+	if fn.MaxArg > -1 && arity > fn.MaxArg {
+		return nil, NewXPathError("XPST0017", fmt.Sprintf("too many arguments in function call (%q), max: %d, got %d", fn.Name, fn.MaxArg, arity))
+	}
+	return nil, NewXPathError("XPST0017", fmt.Sprintf("no overload of function %q accepts %d arguments", name, arity))
 }
 
 func callFunctionResolved(prefix, localName string, arguments []Sequence, ctx *Context) (Sequence, error) {
@@ -5136,25 +5202,15 @@ func callFunctionResolved(prefix, localName string, arguments []Sequence, ctx *C
 	if prefix != "" {
 		var ok bool
 		if ns, ok = ctx.Namespaces[prefix]; !ok {
-			return nil, fmt.Errorf("Could not find namespace for prefix %q", prefix)
+			return nil, NewXPathError("XPST0081", fmt.Sprintf("Could not find namespace for prefix %q", prefix))
 		}
 	} else {
 		ns = nsFN
 	}
 
-	fn := getfunction(ns, localName)
-	if fn == nil {
-		return nil, fmt.Errorf("Could not find function %q in namespace %q", localName, ns)
-	}
-	if min := fn.MinArg; min > 0 {
-		if len(arguments) < min {
-			return nil, fmt.Errorf("too few arguments in function call (%q), min: %d", fn.Name, fn.MinArg)
-		}
-	}
-	if max := fn.MaxArg; max > -1 {
-		if len(arguments) > max {
-			return nil, fmt.Errorf("too many arguments in function call (%q), max: %d, got %d (%#v)", fn.Name, fn.MaxArg, len(arguments), arguments)
-		}
+	fn, err := ctx.resolveFunction(ns, localName, len(arguments))
+	if err != nil {
+		return nil, err
 	}
-	return fn.F(ctx, arguments)
+	return fn.call(ctx, arguments)
 }
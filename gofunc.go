@@ -0,0 +1,287 @@
+package goxpath
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+// RegisterGoFunc registers the Go function fn as the XPath function name in
+// the namespace ns. See GoFunction for the supported signatures.
+func RegisterGoFunc(ns, name string, fn any) error {
+	f, err := GoFunction(ns, name, fn)
+	if err != nil {
+		return err
+	}
+	RegisterFunction(f)
+	return nil
+}
+
+// GoFunction wraps the Go function fn as an XPath function, for example for
+// StaticContext.Functions. The arguments are converted according to the
+// types of the parameters of fn, following the function conversion rules of
+// XPath: nodes are atomized, xs:untypedAtomic values are cast to the
+// parameter type and integers are promoted to floating point numbers.
+//
+// The parameter types are
+//
+//   - string, bool, the integer and floating point types, time.Time and
+//     time.Duration, which take exactly one item
+//   - Sequence, which takes the argument unchanged, and Item or any, which
+//     take exactly one item without atomizing it
+//   - goxml.XMLNode or a pointer to a goxml node type such as
+//     *goxml.Element, which take exactly one node
+//   - a pointer to one of the above, which is nil for an empty argument
+//   - a slice of one of the above, which takes any number of items
+//
+// An optional first parameter of type *Context receives the dynamic context.
+// A variadic fn accepts any number of trailing arguments of the element
+// type. fn may return nothing, a value, an error or a value and an error;
+// the value is converted with ToXDM.
+//
+// A wrong number of items in an argument or an item that can't be converted
+// is an error (XPTY0004) when the function is called.
+func GoFunction(ns, name string, fn any) (*Function, error) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s: expected a function, got %T", name, fn)
+	}
+	withContext := ft.NumIn() > 0 && ft.In(0) == contextType
+	first := 0
+	if withContext {
+		first = 1
+	}
+	var convs []argConverter
+	for i := first; i < ft.NumIn(); i++ {
+		t := ft.In(i)
+		if ft.IsVariadic() && i == ft.NumIn()-1 {
+			t = t.Elem()
+		}
+		conv, err := newArgConverter(t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: parameter %d: %w", name, i-first+1, err)
+		}
+		convs = append(convs, conv)
+	}
+	returnsError := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+	numValues := ft.NumOut()
+	if returnsError {
+		numValues--
+	}
+	if numValues > 1 {
+		return nil, fmt.Errorf("%s: a function may return at most a value and an error", name)
+	}
+	minArg, maxArg := len(convs), len(convs)
+	if ft.IsVariadic() {
+		minArg, maxArg = len(convs)-1, -1
+	}
+
+	f := &Function{Name: name, Namespace: ns, MinArg: minArg, MaxArg: maxArg}
+	f.F = func(ctx *Context, args []Sequence) (Sequence, error) {
+		in := make([]reflect.Value, 0, first+len(args))
+		if withContext {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		if len(args) < minArg || maxArg >= 0 && len(args) > maxArg {
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("%s() called with %d arguments", name, len(args)))
+		}
+		for i, arg := range args {
+			conv := convs[min(i, len(convs)-1)]
+			v, err := conv(arg)
+			if err != nil {
+				if _, ok := err.(*XPathError); !ok {
+					err = NewXPathError("XPTY0004", err.Error())
+				}
+				return nil, fieldError(fmt.Sprintf("argument %d of %s()", i+1, name), err)
+			}
+			in = append(in, v)
+		}
+		out := fv.Call(in)
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+		}
+		if numValues == 0 {
+			return Sequence{}, nil
+		}
+		return ToXDM(out[0].Interface())
+	}
+	return f, nil
+}
+
+var (
+	contextType  = reflect.TypeFor[*Context]()
+	errorType    = reflect.TypeFor[error]()
+	itemType     = reflect.TypeFor[Item]()
+	durationType = reflect.TypeFor[time.Duration]()
+	xmlNodeType  = reflect.TypeFor[goxml.XMLNode]()
+)
+
+// argConverter converts an argument of a function call to a parameter of a
+// Go function.
+type argConverter func(Sequence) (reflect.Value, error)
+
+func newArgConverter(t reflect.Type) (argConverter, error) {
+	switch {
+	case t == sequenceType:
+		return func(arg Sequence) (reflect.Value, error) {
+			return reflect.ValueOf(arg), nil
+		}, nil
+	case t == itemType:
+		return func(arg Sequence) (reflect.Value, error) {
+			if len(arg) != 1 {
+				return reflect.Value{}, fmt.Errorf("expected exactly one item, got %d", len(arg))
+			}
+			return reflect.ValueOf(&arg[0]).Elem(), nil
+		}, nil
+	case t == xmlNodeType || (t.Kind() == reflect.Pointer && t.Implements(xmlNodeType)):
+		return func(arg Sequence) (reflect.Value, error) {
+			if len(arg) != 1 {
+				return reflect.Value{}, fmt.Errorf("expected exactly one node, got %d items", len(arg))
+			}
+			v := reflect.ValueOf(arg[0])
+			if !v.IsValid() || !v.Type().AssignableTo(t) {
+				return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, describeItem(arg[0]))
+			}
+			r := reflect.New(t).Elem()
+			r.Set(v)
+			return r, nil
+		}, nil
+	case t.Kind() == reflect.Pointer:
+		elem, err := newArgConverter(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return func(arg Sequence) (reflect.Value, error) {
+			if len(arg) == 0 {
+				return reflect.Zero(t), nil
+			}
+			v, err := elem(arg)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			p := reflect.New(t.Elem())
+			p.Elem().Set(v)
+			return p, nil
+		}, nil
+	case t.Kind() == reflect.Slice:
+		elem, err := newArgConverter(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return func(arg Sequence) (reflect.Value, error) {
+			s := reflect.MakeSlice(t, len(arg), len(arg))
+			for i, itm := range arg {
+				v, err := elem(Sequence{itm})
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("item %d: %w", i+1, err)
+				}
+				s.Index(i).Set(v)
+			}
+			return s, nil
+		}, nil
+	}
+	conv, err := newAtomicConverter(t)
+	if err != nil {
+		return nil, err
+	}
+	return func(arg Sequence) (reflect.Value, error) {
+		if len(arg) != 1 {
+			return reflect.Value{}, fmt.Errorf("expected exactly one item, got %d", len(arg))
+		}
+		v, err := conv(atomizeSequence(arg)[0])
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return v.Convert(t), nil
+	}, nil
+}
+
+// newAtomicConverter returns a function that converts an atomic value to a
+// value of the kind of t.
+func newAtomicConverter(t reflect.Type) (func(Item) (reflect.Value, error), error) {
+	switch {
+	case t == timeType:
+		return func(itm Item) (reflect.Value, error) {
+			switch itm.(type) {
+			case XSDateTime, XSDate, XSTime, XSUntypedAtomic:
+				tm, err := timeValue(itm)
+				return reflect.ValueOf(tm), err
+			}
+			return reflect.Value{}, fmt.Errorf("expected a date or time, got %s", describeItem(itm))
+		}, nil
+	case t == durationType:
+		return func(itm Item) (reflect.Value, error) {
+			if u, ok := itm.(XSUntypedAtomic); ok {
+				d, err := ParseXSDuration(string(u))
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				itm = d
+			}
+			d, ok := itm.(XSDuration)
+			if !ok || d.Years != 0 || d.Months != 0 {
+				return reflect.Value{}, fmt.Errorf("expected xs:dayTimeDuration, got %s", describeItem(itm))
+			}
+			return reflect.ValueOf(time.Duration(math.Round(durationToSeconds(d) * float64(time.Second)))), nil
+		}, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return func(itm Item) (reflect.Value, error) {
+			switch s := itm.(type) {
+			case string:
+				return reflect.ValueOf(s), nil
+			case XSString, XSAnyURI, XSUntypedAtomic:
+				return reflect.ValueOf(itemStringvalue(s)), nil
+			}
+			return reflect.Value{}, fmt.Errorf("expected xs:string, got %s", describeItem(itm))
+		}, nil
+	case reflect.Bool:
+		return func(itm Item) (reflect.Value, error) {
+			switch itm.(type) {
+			case bool, XSUntypedAtomic:
+				b, err := xsBoolean(nil, []Sequence{{itm}})
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				return reflect.ValueOf(b[0]), nil
+			}
+			return reflect.Value{}, fmt.Errorf("expected xs:boolean, got %s", describeItem(itm))
+		}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(itm Item) (reflect.Value, error) {
+			switch itm.(type) {
+			case int, XSInteger, XSUntypedAtomic:
+				i, err := intValue(itm)
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				v := reflect.New(t).Elem()
+				if v.CanInt() && v.OverflowInt(int64(i)) || v.CanUint() && (i < 0 || v.OverflowUint(uint64(i))) {
+					return reflect.Value{}, fmt.Errorf("%d does not fit into %s", i, t)
+				}
+				return reflect.ValueOf(i), nil
+			}
+			return reflect.Value{}, fmt.Errorf("expected xs:integer, got %s", describeItem(itm))
+		}, nil
+	case reflect.Float32, reflect.Float64:
+		return func(itm Item) (reflect.Value, error) {
+			if _, ok := itm.(XSUntypedAtomic); ok {
+				f, err := floatValue(itm)
+				return reflect.ValueOf(f), err
+			}
+			if f, ok := ToFloat64(itm); ok {
+				return reflect.ValueOf(f), nil
+			}
+			return reflect.Value{}, fmt.Errorf("expected a number, got %s", describeItem(itm))
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
@@ -0,0 +1,110 @@
+package goxpath
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+func TestRegisterGoFunc(t *testing.T) {
+	const ns = "urn:goxpath:test:gofunc"
+	for name, fn := range map[string]any{
+		"repeat": strings.Repeat,
+		"half":   func(f float64) float64 { return f / 2 },
+		"sum": func(values ...int) int {
+			s := 0
+			for _, v := range values {
+				s += v
+			}
+			return s
+		},
+		"join": func(sep string, parts []string) string { return strings.Join(parts, sep) },
+		"opt": func(s *string) string {
+			if s == nil {
+				return "none"
+			}
+			return *s
+		},
+		"fail":  func() (string, error) { return "", errors.New("failed") },
+		"name":  func(e *goxml.Element) string { return e.Name },
+		"ctx":   func(ctx *Context, s string) string { return s + ctx.Namespaces["g"] },
+		"later": func(t time.Time, d time.Duration) time.Time { return t.Add(d) },
+		"small": func(i int8) int8 { return i },
+		"pair":  func(a, b int) []int { return []int{a, b} },
+	} {
+		if err := RegisterGoFunc(ns, name, fn); err != nil {
+			t.Fatalf("RegisterGoFunc(%s): %s", name, err)
+		}
+	}
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`g:repeat('ab', 3)`, "ababab", ""},
+		{`g:repeat(/root/sub[2], /root/@one)`, "sub2", ""},
+		{`g:half(5)`, "2.5", ""},
+		{`g:half(xs:float(1))`, "0.5", ""},
+		{`g:sum()`, "0", ""},
+		{`g:sum(1, 2, 3)`, "6", ""},
+		{`g:join('-', ('a', 'b'))`, "a-b", ""},
+		{`g:join('-', ())`, "", ""},
+		{`g:opt(())`, "none", ""},
+		{`g:opt('x')`, "x", ""},
+		{`g:name(/root)`, "root", ""},
+		{`g:ctx('ns=')`, "ns=urn:goxpath:test:gofunc", ""},
+		{`year-from-dateTime(g:later(xs:dateTime('2000-12-31T12:00:00Z'), xs:dayTimeDuration('P1D')))`, "2001", ""},
+		{`string-join(g:pair(1, 2)?*, ',')`, "1,2", ""},
+		{`g:repeat(1, 2)`, "", "XPTY0004"},
+		{`g:repeat(('a', 'b'), 2)`, "", "XPTY0004"},
+		{`g:half('1')`, "", "XPTY0004"},
+		{`g:repeat('a', 1.5)`, "", "XPTY0004"},
+		{`g:repeat('a', /root/sub[2])`, "", "FORG0001"},
+		{`g:small(300)`, "", "XPTY0004"},
+		{`g:name(/root/@one)`, "", "XPTY0004"},
+		{`g:repeat('a')`, "", "XPST0017"},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Namespaces["g"] = ns
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.Ctx.Namespaces["g"] = ns
+	if _, err = np.Evaluate(`g:fail()`); err == nil || err.Error() != "failed" {
+		t.Errorf("g:fail() = %v, want the error of the Go function", err)
+	}
+
+	for _, fn := range []any{
+		42,
+		func(c chan int) {},
+		func() (int, int) { return 0, 0 },
+	} {
+		if err := RegisterGoFunc(ns, "bad", fn); err == nil {
+			t.Errorf("RegisterGoFunc(%T) succeeded", fn)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package goxpath
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+// The keys of an XPathMap are indexed in a hash array mapped trie (HAMT).
+// Each node uses five bits of the 64 bit hash of a key to select one of 32
+// slots, and only the occupied slots are allocated. Updates copy the nodes on
+// the path to the changed slot, the rest of the trie is shared with the
+// previous version of the map.
+
+const (
+	hamtBits = 5
+	hamtMask = 1<<hamtBits - 1
+)
+
+var mapKeySeed = maphash.MakeSeed()
+
+// hamtEntry is the normalized key of a map entry and its insertion number,
+// which finds the entry in Entries.
+type hamtEntry struct {
+	key   any
+	order uint64
+}
+
+// hamtLeaf holds the entries whose keys have the same hash.
+type hamtLeaf struct {
+	hash    uint64
+	entries []*hamtEntry
+}
+
+// hamtNode is an inner node of the trie. A child is a *hamtNode or a
+// *hamtLeaf.
+type hamtNode struct {
+	bitmap   uint32
+	children []any
+}
+
+// slot returns the bit of the slot for hash at the level given by shift and
+// the index of the slot in children.
+func (n *hamtNode) slot(hash uint64, shift uint) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & hamtMask)
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hamtNode) get(hash uint64, key any, shift uint) *hamtEntry {
+	for n != nil {
+		bit, i := n.slot(hash, shift)
+		if n.bitmap&bit == 0 {
+			return nil
+		}
+		switch c := n.children[i].(type) {
+		case *hamtNode:
+			n = c
+			shift += hamtBits
+		case *hamtLeaf:
+			if c.hash != hash {
+				return nil
+			}
+			for _, e := range c.entries {
+				if e.key == key {
+					return e
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// put returns a copy of n with e added. If there is an entry with the same
+// key, it is replaced and returned.
+func (n *hamtNode) put(hash uint64, e *hamtEntry, shift uint) (*hamtNode, *hamtEntry) {
+	if n == nil {
+		n = &hamtNode{}
+	}
+	bit, i := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		children := make([]any, len(n.children)+1)
+		copy(children, n.children[:i])
+		children[i] = &hamtLeaf{hash: hash, entries: []*hamtEntry{e}}
+		copy(children[i+1:], n.children[i:])
+		return &hamtNode{bitmap: n.bitmap | bit, children: children}, nil
+	}
+	var child any
+	var old *hamtEntry
+	switch c := n.children[i].(type) {
+	case *hamtNode:
+		child, old = c.put(hash, e, shift+hamtBits)
+	case *hamtLeaf:
+		if c.hash == hash {
+			entries := make([]*hamtEntry, 0, len(c.entries)+1)
+			for _, cur := range c.entries {
+				if cur.key == e.key {
+					old = cur
+				} else {
+					entries = append(entries, cur)
+				}
+			}
+			child = &hamtLeaf{hash: hash, entries: append(entries, e)}
+		} else {
+			// move the leaf one level down and add e next to it
+			child, _ = leafNode(c, shift+hamtBits).put(hash, e, shift+hamtBits)
+		}
+	}
+	children := make([]any, len(n.children))
+	copy(children, n.children)
+	children[i] = child
+	return &hamtNode{bitmap: n.bitmap, children: children}, old
+}
+
+// leafNode returns a node at the level given by shift that contains leaf.
+func leafNode(leaf *hamtLeaf, shift uint) *hamtNode {
+	return &hamtNode{bitmap: 1 << ((leaf.hash >> shift) & hamtMask), children: []any{leaf}}
+}
+
+// remove returns a copy of n without the entry with the key and whether
+// there was one. The result is nil if the node is empty afterwards.
+func (n *hamtNode) remove(hash uint64, key any, shift uint) (*hamtNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	bit, i := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	var child any
+	switch c := n.children[i].(type) {
+	case *hamtNode:
+		sub, ok := c.remove(hash, key, shift+hamtBits)
+		if !ok {
+			return n, false
+		}
+		if sub != nil {
+			child = sub
+			// a node with a single leaf is replaced by the leaf
+			if len(sub.children) == 1 {
+				if leaf, ok := sub.children[0].(*hamtLeaf); ok {
+					child = leaf
+				}
+			}
+		}
+	case *hamtLeaf:
+		if c.hash != hash {
+			return n, false
+		}
+		var entries []*hamtEntry
+		found := false
+		for _, cur := range c.entries {
+			if cur.key == key {
+				found = true
+			} else {
+				entries = append(entries, cur)
+			}
+		}
+		if !found {
+			return n, false
+		}
+		if len(entries) > 0 {
+			child = &hamtLeaf{hash: hash, entries: entries}
+		}
+	}
+	if child != nil {
+		children := make([]any, len(n.children))
+		copy(children, n.children)
+		children[i] = child
+		return &hamtNode{bitmap: n.bitmap, children: children}, true
+	}
+	if len(n.children) == 1 {
+		return nil, true
+	}
+	children := make([]any, 0, len(n.children)-1)
+	children = append(children, n.children[:i]...)
+	children = append(children, n.children[i+1:]...)
+	return &hamtNode{bitmap: n.bitmap &^ bit, children: children}, true
+}
+
+// Normalized map keys. Two atomic values are the same key by op:same-key
+// if their normalized keys are equal.
+type (
+	stringKey   string // xs:string, xs:anyURI and xs:untypedAtomic
+	nanKey      struct{}
+	temporalKey struct {
+		typ  string
+		tz   bool  // the value has a timezone
+		sec  int64 // the instant, the local time as UTC if tz is false
+		nsec int
+	}
+	otherKey struct {
+		typ   string
+		value string
+	}
+)
+
+// mapKey returns the normalized form of a map key. Numbers are equal if their
+// values are, regardless of the type, NaN is the same key as NaN, and dates
+// and times with a timezone are equal if they denote the same instant. A
+// value with a timezone is never the same key as one without.
+func mapKey(itm Item) any {
+	switch v := itm.(type) {
+	case string:
+		return stringKey(v)
+	case XSString:
+		return stringKey(v.V)
+	case XSAnyURI:
+		return stringKey(v)
+	case XSUntypedAtomic:
+		return stringKey(v)
+	case bool:
+		return v
+	case int:
+		return int64(v)
+	case XSInteger:
+		return int64(v.V)
+	case XSDateTime:
+		return newTemporalKey("dateTime", time.Time(v))
+	case XSDate:
+		return newTemporalKey("date", time.Time(v))
+	case XSTime:
+		return newTemporalKey("time", time.Time(v))
+	case *goxml.Attribute:
+		return stringKey(v.Value)
+	case goxml.XMLNode:
+		return stringKey(itemStringvalue(v))
+	}
+	if f, ok := ToFloat64(itm); ok {
+		switch {
+		case math.IsNaN(f):
+			return nanKey{}
+		case f == math.Trunc(f) && math.Abs(f) < 1<<63:
+			// integral values share the key with the integer, -0 is 0
+			return int64(f)
+		}
+		return f
+	}
+	return otherKey{fmt.Sprintf("%T", itm), itemStringvalue(itm)}
+}
+
+// newTemporalKey returns the key of a date or time. Values with a timezone
+// are keyed by their instant, values without one by their local time.
+func newTemporalKey(typ string, t time.Time) temporalKey {
+	if hasTimezone(t) {
+		return temporalKey{typ: typ, tz: true, sec: t.Unix(), nsec: t.Nanosecond()}
+	}
+	local := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return temporalKey{typ: typ, sec: local.Unix(), nsec: local.Nanosecond()}
+}
+
+func hashMapKey(key any) uint64 {
+	return maphash.Comparable(mapKeySeed, key)
+}
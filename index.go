@@ -0,0 +1,252 @@
+package goxpath
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/speedata/goxml"
+)
+
+// nameIndex lists the elements and attributes of a document by local name
+// in document order. The descendants of an element are found by their
+// position in the document (rank), so the descendant axes with a name test
+// need not walk the subtree.
+type nameIndex struct {
+	spans      map[goxml.XMLNode]span
+	elements   map[string][]rankedElement
+	attributes map[string][]*goxml.Attribute
+}
+
+// span is the rank of a node and the rank of its last descendant.
+type span struct {
+	start, end int
+}
+
+type rankedElement struct {
+	rank int
+	elt  *goxml.Element
+}
+
+// indexes holds the name indexes of the documents of a context. It is shared
+// by the copies of the context.
+type indexes struct {
+	mu   sync.Mutex
+	used atomic.Bool // BuildIndex has been called
+	docs map[*goxml.XMLDocument]*nameIndex
+}
+
+func newIndexes() *indexes {
+	return &indexes{docs: make(map[*goxml.XMLDocument]*nameIndex)}
+}
+
+func buildNameIndex(doc *goxml.XMLDocument) *nameIndex {
+	idx := &nameIndex{
+		spans:      make(map[goxml.XMLNode]span),
+		elements:   make(map[string][]rankedElement),
+		attributes: make(map[string][]*goxml.Attribute),
+	}
+	rank := 0
+	var walk func(n goxml.XMLNode)
+	walk = func(n goxml.XMLNode) {
+		start := rank
+		rank++
+		if elt, ok := n.(*goxml.Element); ok {
+			idx.elements[elt.Name] = append(idx.elements[elt.Name], rankedElement{start, elt})
+			for _, attr := range attributes(elt) {
+				idx.attributes[attr.Name] = append(idx.attributes[attr.Name], attr)
+			}
+		}
+		for _, cld := range n.Children() {
+			switch cld.(type) {
+			case *goxml.Element:
+				walk(cld)
+			default:
+				rank++
+			}
+		}
+		idx.spans[n] = span{start, rank - 1}
+	}
+	walk(doc)
+	return idx
+}
+
+// BuildIndex builds an index of the element and attribute names of the
+// document of ctx. The descendant axes with a name test, such as //item or
+// $chapter//title, and //@name look the nodes up in the index instead of
+// walking the document. The document must not be changed afterwards; call
+// BuildIndex again if it has been. Set IndexDocuments to index all
+// documents on first use.
+func (ctx *Context) BuildIndex() {
+	if ctx.xmldoc == nil {
+		return
+	}
+	store := ctx.indexStore()
+	store.mu.Lock()
+	store.docs[ctx.xmldoc] = buildNameIndex(ctx.xmldoc)
+	store.mu.Unlock()
+	store.used.Store(true)
+}
+
+// indexStore returns the index store of ctx.
+func (ctx *Context) indexStore() *indexes {
+	if ctx.indexes == nil {
+		ctx.indexes = newIndexes()
+	}
+	return ctx.indexes
+}
+
+// nameIndex returns the index of the document that contains n, building it
+// if IndexDocuments is set. It returns nil if there is no index.
+func (ctx *Context) nameIndex(n goxml.XMLNode) *nameIndex {
+	if !ctx.IndexDocuments && (ctx.indexes == nil || !ctx.indexes.used.Load()) {
+		return nil
+	}
+	doc := documentOf(n)
+	if doc == nil {
+		return nil
+	}
+	store := ctx.indexStore()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	idx, ok := store.docs[doc]
+	if !ok && ctx.IndexDocuments {
+		idx = buildNameIndex(doc)
+		store.docs[doc] = idx
+	}
+	return idx
+}
+
+// documentOf returns the document that contains n or nil.
+func documentOf(n goxml.XMLNode) *goxml.XMLDocument {
+	for n != nil {
+		switch t := n.(type) {
+		case *goxml.XMLDocument:
+			return t
+		case *goxml.Element:
+			n = t.Parent
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// indexedName returns the local name of an element name test whose matches
+// can be looked up in the index.
+func indexedName(test Node) (string, bool) {
+	var name string
+	switch t := test.(type) {
+	case *NameTest:
+		if t.Attribute {
+			return "", false
+		}
+		name = t.Name
+	case *KindTest:
+		if t.Kind != "element" || t.Name == "" || t.Name == "*" {
+			return "", false
+		}
+		name = t.Name
+		if _, local, ok := strings.Cut(name, "}"); ok {
+			return local, true
+		}
+	default:
+		return "", false
+	}
+	if _, local, ok := strings.Cut(name, ":"); ok {
+		return local, true
+	}
+	return name, true
+}
+
+// rootAttributeTest returns the name test of a path //@name/... whose first
+// step can be looked up in the attribute index, or nil.
+func rootAttributeTest(n *PathExpr) *NameTest {
+	if n.Root != "//" || len(n.Steps) == 0 || len(n.Seps) > 0 && n.Seps[0] != "/" {
+		return nil
+	}
+	as, ok := n.Steps[0].(*AxisStep)
+	if !ok || as.Axis != "attribute" || len(as.Predicates) > 0 {
+		return nil
+	}
+	nt, ok := as.Test.(*NameTest)
+	if !ok || !nt.Attribute || strings.Contains(nt.Name, ":") {
+		return nil
+	}
+	return nt
+}
+
+// indexedDescendants returns the elements named local on the descendant or
+// descendant-or-self axis of n that pass tf, in document order. It returns
+// false if n is not in an indexed document.
+func (ctx *Context) indexedDescendants(n Item, orSelf bool, local string, tf testFunc) ([]*goxml.Element, bool) {
+	node, ok := n.(goxml.XMLNode)
+	if !ok {
+		return nil, false
+	}
+	switch node.(type) {
+	case *goxml.XMLDocument, *goxml.Element:
+	default:
+		return nil, false
+	}
+	idx := ctx.nameIndex(node)
+	if idx == nil {
+		return nil, false
+	}
+	sp, ok := idx.spans[node]
+	if !ok {
+		return nil, false
+	}
+	first := sp.start + 1
+	if orSelf {
+		first = sp.start
+	}
+	candidates := idx.elements[local]
+	lo, _ := slices.BinarySearchFunc(candidates, first, func(e rankedElement, rank int) int { return e.rank - rank })
+	var elts []*goxml.Element
+	for _, c := range candidates[lo:] {
+		if c.rank > sp.end {
+			break
+		}
+		if tf(ctx, c.elt) {
+			elts = append(elts, c.elt)
+		}
+	}
+	return elts, true
+}
+
+// indexedDescendantAxis is descendantAxis or descendantOrSelfAxis for a name
+// test that uses the index. It returns false if a context item is not in an
+// indexed document; ctx is unchanged then.
+func (ctx *Context) indexedDescendantAxis(orSelf bool, local string, tf testFunc) (Sequence, bool) {
+	var seq Sequence
+	for _, itm := range ctx.sequence {
+		elts, ok := ctx.indexedDescendants(itm, orSelf, local, tf)
+		if !ok {
+			return nil, false
+		}
+		for _, elt := range elts {
+			seq = append(seq, elt)
+		}
+	}
+	ctx.sequence = seq
+	return seq, true
+}
+
+// indexedAttributes returns the attributes named local in the document that
+// pass tf, in document order. It returns false if the document is not
+// indexed.
+func (ctx *Context) indexedAttributes(doc *goxml.XMLDocument, local string, tf testFunc) (Sequence, bool) {
+	idx := ctx.nameIndex(doc)
+	if idx == nil {
+		return nil, false
+	}
+	var seq Sequence
+	for _, attr := range idx.attributes[local] {
+		if tf(ctx, attr) {
+			seq = append(seq, attr)
+		}
+	}
+	return seq, true
+}
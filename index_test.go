@@ -0,0 +1,98 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/speedata/goxml"
+)
+
+func TestNameIndex(t *testing.T) {
+	nsXML := `<r xmlns:x="urn:x" xmlns:y="urn:y"><x:item id="1"/><y:item id="2"><x:item id="3"/></y:item><item id="4"/></r>`
+	other, err := goxml.Parse(strings.NewReader(`<o><sub id="o1"/><p><sub id="o2"/></p></o>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		xml    string
+		input  string
+		output string
+	}{
+		{doc, `count(//sub)`, "7"},
+		{doc, `string-join(//subsub, ',')`, "subsub,contents subsub other,contents subsub other2"},
+		{doc, `string-join(/root/a//sub/@p, ',')`, "a1/1,a1/2,a2/1,a2/2"},
+		{doc, `string-join(/root/a[2]/descendant::sub/@p, ',')`, "a2/1,a2/2"},
+		{doc, `count(/root/sub[3]/descendant-or-self::subsub)`, "1"},
+		{doc, `count(/root/a/descendant-or-self::a)`, "2"},
+		{doc, `count(/root/a/descendant::a)`, "0"},
+		{doc, `count(//element(sub))`, "7"},
+		{doc, `string((//sub)[last()]/@p)`, "a2/2"},
+		{doc, `string-join(//sub[2]/@p, ',')`, "a1/2,a2/2"},
+		{doc, `exists(//nothing)`, "false"},
+		{doc, `for $a in /root/a[2] return string-join($a//sub/@p, ',')`, "a2/1,a2/2"},
+		{doc, `string-join(//@foo, ',')`, "no,baz,bar,bar,bar,barbaz,oof,other2,oof"},
+		{doc, `count(//@p)`, "4"},
+		{doc, `string-join(//@p/../name(), ',')`, "sub,sub,sub,sub"},
+		{doc, `string-join(//@self/../@foo, ',')`, "bar"},
+		{doc, `count(//@nothing)`, "0"},
+		{doc, `string-join(//@p/string(), ',')`, "a1/1,a1/2,a2/1,a2/2"},
+		{doc, `string-join(//@p/(. || 'x'), ',')`, "a1/1x,a1/2x,a2/1x,a2/2x"},
+		{doc, `string-join(//@p/../@p/string(), ',')`, "a1/1,a1/2,a2/1,a2/2"},
+		{doc, `string-join(doc('urn:other')//sub/@id, ',')`, "o1,o2"},
+		{nsXML, `string-join(//x:item/@id, ',')`, "1,3"},
+		{nsXML, `string-join(//item/@id, ',')`, "1,2,3,4"},
+		{nsXML, `string-join(//element(Q{urn:y}item)/@id, ',')`, "2"},
+		{nsXML, `string-join(/r/y:item//x:item/@id, ',')`, "3"},
+	}
+	for _, td := range testdata {
+		for _, mode := range []string{"walk", "BuildIndex", "IndexDocuments"} {
+			np, err := NewParser(strings.NewReader(td.xml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			np.Ctx.Namespaces["x"] = "urn:x"
+			np.Ctx.Namespaces["y"] = "urn:y"
+			np.Ctx.Documents = map[string]*goxml.XMLDocument{"urn:other": other}
+			switch mode {
+			case "BuildIndex":
+				np.Ctx.BuildIndex()
+			case "IndexDocuments":
+				np.Ctx.IndexDocuments = true
+			}
+			s, err := np.EvaluateString(td.input)
+			if err != nil {
+				t.Errorf("%s (%s): %s", td.input, mode, err)
+				continue
+			}
+			if s != td.output {
+				t.Errorf("%s (%s) = %q, want %q", td.input, mode, s, td.output)
+			}
+			var items []string
+			seq, errf := np.EvaluateIter(td.input)
+			for itm := range seq {
+				items = append(items, itemStringvalue(itm))
+			}
+			if err := errf(); err != nil {
+				t.Errorf("%s (%s, iterator): %s", td.input, mode, err)
+			} else if got := strings.Join(items, " "); got != s {
+				t.Errorf("%s (%s, iterator) = %q, want %q", td.input, mode, got, s)
+			}
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.Ctx.IndexDocuments = true
+	np.Ctx.Documents = map[string]*goxml.XMLDocument{"urn:other": other}
+	if _, err = np.Evaluate(`doc('urn:other')//sub`); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := np.Ctx.indexes.docs[other]; !ok {
+		t.Errorf("IndexDocuments did not keep the index of doc('urn:other')")
+	}
+	if _, ok := np.Ctx.indexes.docs[np.XMLDocument()]; ok {
+		t.Errorf("the context document was indexed without a descendant step")
+	}
+}
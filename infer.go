@@ -0,0 +1,549 @@
+package goxpath
+
+import (
+	"strings"
+)
+
+// cardinality is the number of items an expression can return: at least min
+// and at most max, where max 2 stands for "more than one".
+type cardinality struct {
+	min, max int
+}
+
+var (
+	cardEmpty      = cardinality{0, 0}
+	cardOne        = cardinality{1, 1}
+	cardZeroOrOne  = cardinality{0, 1}
+	cardZeroOrMore = cardinality{0, 2}
+	cardOneOrMore  = cardinality{1, 2}
+)
+
+func cardinalityOf(st *SequenceType) cardinality {
+	if st.Empty {
+		return cardEmpty
+	}
+	switch st.Occurrence {
+	case "?":
+		return cardZeroOrOne
+	case "*":
+		return cardZeroOrMore
+	case "+":
+		return cardOneOrMore
+	}
+	return cardOne
+}
+
+// product is the cardinality of evaluating b once for each item of a.
+func (a cardinality) product(b cardinality) cardinality {
+	return cardinality{a.min * b.min, min(a.max*b.max, 2)}
+}
+
+// sum is the cardinality of the concatenation of a and b.
+func (a cardinality) sum(b cardinality) cardinality {
+	return cardinality{min(a.min+b.min, 1), min(a.max+b.max, 2)}
+}
+
+// choice is the cardinality of either a or b.
+func (a cardinality) choice(b cardinality) cardinality {
+	return cardinality{min(a.min, b.min), max(a.max, b.max)}
+}
+
+// optional allows the empty sequence in addition to a.
+func (a cardinality) optional() cardinality {
+	return cardinality{0, a.max}
+}
+
+func (a cardinality) occurrence() string {
+	switch a {
+	case cardZeroOrOne:
+		return "?"
+	case cardZeroOrMore:
+		return "*"
+	case cardOneOrMore:
+		return "+"
+	}
+	return ""
+}
+
+// staticType is the inferred type of an expression. A nil item type means
+// item().
+type staticType struct {
+	item Node
+	card cardinality
+}
+
+func (t staticType) sequenceType() *SequenceType {
+	if t.card == cardEmpty {
+		return &SequenceType{Empty: true}
+	}
+	item := t.item
+	if item == nil {
+		item = &AnyItemTest{}
+	}
+	return &SequenceType{ItemType: item, Occurrence: t.card.occurrence()}
+}
+
+func typeOf(st *SequenceType) staticType {
+	t := staticType{card: cardinalityOf(st)}
+	if _, ok := st.ItemType.(*AnyItemTest); !ok {
+		t.item = st.ItemType
+	}
+	return t
+}
+
+func atomicType(name string, card cardinality) staticType {
+	return staticType{&AtomicType{Name: name}, card}
+}
+
+func kindType(kind string, card cardinality) staticType {
+	return staticType{&KindTest{Kind: kind}, card}
+}
+
+var anyType = staticType{nil, cardZeroOrMore}
+
+// concat is the type of the sequence of t followed by u.
+func (t staticType) concat(u staticType) staticType {
+	switch {
+	case t.card == cardEmpty:
+		return u
+	case u.card == cardEmpty:
+		return t
+	}
+	return staticType{joinItemTypes(t.item, u.item), t.card.sum(u.card)}
+}
+
+// joinItemTypes returns the most specific item type that covers a and b.
+func joinItemTypes(a, b Node) Node {
+	switch {
+	case a == nil || b == nil:
+		return nil
+	case a.String() == b.String():
+		return a
+	}
+	switch a.(type) {
+	case *AtomicType:
+		if _, ok := b.(*AtomicType); ok {
+			return &AtomicType{Name: "xs:anyAtomicType"}
+		}
+	case *KindTest:
+		if _, ok := b.(*KindTest); ok {
+			return &KindTest{Kind: "node"}
+		}
+	}
+	return nil
+}
+
+// numericRank orders the numeric types by type promotion.
+var numericRank = map[string]int{
+	"xs:integer": 1,
+	"xs:decimal": 2,
+	"xs:float":   3,
+	"xs:double":  4,
+}
+
+// fnReturnTypes holds the result types of frequently used functions in the
+// fn namespace. Functions not listed here are typed item()*.
+var fnReturnTypes = map[string]staticType{
+	"string":           atomicType("xs:string", cardOne),
+	"concat":           atomicType("xs:string", cardOne),
+	"string-join":      atomicType("xs:string", cardOne),
+	"normalize-space":  atomicType("xs:string", cardOne),
+	"upper-case":       atomicType("xs:string", cardOne),
+	"lower-case":       atomicType("xs:string", cardOne),
+	"substring":        atomicType("xs:string", cardOne),
+	"substring-before": atomicType("xs:string", cardOne),
+	"substring-after":  atomicType("xs:string", cardOne),
+	"translate":        atomicType("xs:string", cardOne),
+	"replace":          atomicType("xs:string", cardOne),
+	"name":             atomicType("xs:string", cardOne),
+	"local-name":       atomicType("xs:string", cardOne),
+	"namespace-uri":    atomicType("xs:anyURI", cardOne),
+	"tokenize":         atomicType("xs:string", cardZeroOrMore),
+	"count":            atomicType("xs:integer", cardOne),
+	"string-length":    atomicType("xs:integer", cardOne),
+	"position":         atomicType("xs:integer", cardOne),
+	"last":             atomicType("xs:integer", cardOne),
+	"boolean":          atomicType("xs:boolean", cardOne),
+	"not":              atomicType("xs:boolean", cardOne),
+	"true":             atomicType("xs:boolean", cardOne),
+	"false":            atomicType("xs:boolean", cardOne),
+	"exists":           atomicType("xs:boolean", cardOne),
+	"empty":            atomicType("xs:boolean", cardOne),
+	"contains":         atomicType("xs:boolean", cardOne),
+	"starts-with":      atomicType("xs:boolean", cardOne),
+	"ends-with":        atomicType("xs:boolean", cardOne),
+	"matches":          atomicType("xs:boolean", cardOne),
+	"number":           atomicType("xs:double", cardOne),
+	"current-dateTime": atomicType("xs:dateTime", cardOne),
+	"current-date":     atomicType("xs:date", cardOne),
+	"current-time":     atomicType("xs:time", cardOne),
+	"root":             kindType("node", cardZeroOrOne),
+	"data":             atomicType("xs:anyAtomicType", cardZeroOrMore),
+}
+
+// inferer computes the static types of all subexpressions of a tree.
+type inferer struct {
+	sc      *StaticContext
+	types   map[Node]*SequenceType
+	vars    map[string][]staticType // innermost binding last
+	context staticType              // type of the context item
+}
+
+// inferTypes returns the static type of every expression node of the tree.
+func (sc *StaticContext) inferTypes(n Node) map[Node]*SequenceType {
+	inf := &inferer{
+		sc:      sc,
+		types:   make(map[Node]*SequenceType),
+		vars:    make(map[string][]staticType),
+		context: staticType{nil, cardOne},
+	}
+	inf.infer(n)
+	return inf.types
+}
+
+func (inf *inferer) bind(name string, t staticType) {
+	inf.vars[name] = append(inf.vars[name], t)
+}
+
+func (inf *inferer) unbind(name string) {
+	inf.vars[name] = inf.vars[name][:len(inf.vars[name])-1]
+}
+
+// withContext infers n with a context item of the given item type.
+func (inf *inferer) withContext(item Node, n Node) staticType {
+	save := inf.context
+	inf.context = staticType{item, cardOne}
+	t := inf.infer(n)
+	inf.context = save
+	return t
+}
+
+func (inf *inferer) infer(n Node) staticType {
+	if n == nil {
+		return staticType{card: cardEmpty}
+	}
+	t := inf.inferNode(n)
+	inf.types[n] = t.sequenceType()
+	return t
+}
+
+func (inf *inferer) inferList(nodes []Node) []staticType {
+	ts := make([]staticType, len(nodes))
+	for i, n := range nodes {
+		ts[i] = inf.infer(n)
+	}
+	return ts
+}
+
+func (inf *inferer) inferNode(n Node) staticType {
+	switch t := n.(type) {
+	case *Literal:
+		return atomicType(TypeIDOf(t.Value), cardOne)
+	case *ContextItemExpr:
+		return inf.context
+	case *VarRef:
+		if bindings := inf.vars[t.Name]; len(bindings) > 0 {
+			return bindings[len(bindings)-1]
+		}
+		if v := inf.sc.Variables[t.Name]; v != nil {
+			return typeOfSequence(v)
+		}
+		return anyType
+	case *SequenceExpr:
+		ret := staticType{card: cardEmpty}
+		for _, it := range inf.inferList(t.Items) {
+			ret = ret.concat(it)
+		}
+		return ret
+	case *ParenExpr:
+		return inf.infer(t.Expr)
+	case *ForExpr:
+		card := cardOne
+		for _, b := range t.Bindings {
+			bt := inf.infer(b.Expr)
+			card = card.product(bt.card)
+			inf.bind(b.Name, staticType{bt.item, cardOne})
+		}
+		ret := inf.infer(t.Return)
+		for _, b := range t.Bindings {
+			inf.unbind(b.Name)
+		}
+		return staticType{ret.item, card.product(ret.card)}
+	case *LetExpr:
+		for _, b := range t.Bindings {
+			inf.bind(b.Name, inf.infer(b.Expr))
+		}
+		ret := inf.infer(t.Return)
+		for _, b := range t.Bindings {
+			inf.unbind(b.Name)
+		}
+		return ret
+	case *QuantifiedExpr:
+		for _, b := range t.Bindings {
+			inf.bind(b.Name, staticType{inf.infer(b.Expr).item, cardOne})
+		}
+		inf.infer(t.Satisfies)
+		for _, b := range t.Bindings {
+			inf.unbind(b.Name)
+		}
+		return atomicType("xs:boolean", cardOne)
+	case *IfExpr:
+		inf.infer(t.Cond)
+		a, b := inf.infer(t.Then), inf.infer(t.Else)
+		return inf.either(a, b)
+	case *LogicalExpr:
+		inf.inferList(t.Operands)
+		return atomicType("xs:boolean", cardOne)
+	case *ComparisonExpr:
+		l, r := inf.infer(t.Left), inf.infer(t.Right)
+		switch t.Op {
+		case "eq", "ne", "lt", "le", "gt", "ge", "is", "<<", ">>":
+			return atomicType("xs:boolean", cardinality{min(l.card.min, r.card.min), 1})
+		}
+		return atomicType("xs:boolean", cardOne)
+	case *StringConcatExpr:
+		inf.inferList(t.Operands)
+		return atomicType("xs:string", cardOne)
+	case *RangeExpr:
+		inf.infer(t.From)
+		inf.infer(t.To)
+		return atomicType("xs:integer", cardZeroOrMore)
+	case *AdditiveExpr:
+		return inf.arithmetic(inf.inferList(t.Operands), t.Ops)
+	case *MultiplicativeExpr:
+		return inf.arithmetic(inf.inferList(t.Operands), t.Ops)
+	case *UnionExpr:
+		ret := staticType{card: cardEmpty}
+		for _, ot := range inf.inferList(t.Operands) {
+			ret = ret.concat(ot)
+		}
+		if _, ok := ret.item.(*KindTest); !ok {
+			ret.item = nil
+		}
+		return ret
+	case *IntersectExceptExpr:
+		ts := inf.inferList(t.Operands)
+		ret := staticType{ts[0].item, ts[0].card.optional()}
+		if _, ok := ret.item.(*KindTest); !ok {
+			ret.item = nil
+		}
+		return ret
+	case *InstanceOfExpr:
+		inf.infer(t.Expr)
+		return atomicType("xs:boolean", cardOne)
+	case *CastableExpr:
+		inf.infer(t.Expr)
+		return atomicType("xs:boolean", cardOne)
+	case *TreatExpr:
+		inf.infer(t.Expr)
+		return typeOf(t.Type)
+	case *CastExpr:
+		inf.infer(t.Expr)
+		if t.Optional {
+			return atomicType(t.Type, cardZeroOrOne)
+		}
+		return atomicType(t.Type, cardOne)
+	case *UnaryExpr:
+		et := inf.infer(t.Expr)
+		if t.Op == "+" {
+			return et
+		}
+		// negation converts its operand to a double, () becomes NaN
+		return atomicType("xs:double", cardOne)
+	case *SimpleMapExpr:
+		ret := inf.infer(t.Operands[0])
+		for _, op := range t.Operands[1:] {
+			ot := inf.withContext(ret.item, op)
+			ret = staticType{ot.item, ret.card.product(ot.card)}
+		}
+		return ret
+	case *PathExpr:
+		ret := inf.context
+		if t.Root != "" {
+			ret = kindType("document-node", cardOne)
+		}
+		for i, step := range t.Steps {
+			if i > 0 && t.Seps[i-1] == "//" || i == 0 && t.Root == "//" {
+				// the descendants include text nodes, which are strings
+				ret = staticType{nil, ret.card.product(cardZeroOrMore)}
+			}
+			st := inf.withContext(ret.item, step)
+			ret = staticType{st.item, ret.card.product(st.card)}
+		}
+		return ret
+	case *AxisStep:
+		ret := inf.axisStep(t)
+		for _, p := range t.Predicates {
+			inf.withContext(ret.item, p)
+			ret.card = ret.card.optional()
+		}
+		return ret
+	case *FilterExpr:
+		base := inf.infer(t.Expr)
+		pt := inf.withContext(base.item, t.Predicate)
+		if at, ok := pt.item.(*AtomicType); ok && pt.card == cardOne && numericRank[at.Name] > 0 {
+			return staticType{base.item, cardinality{0, min(base.card.max, 1)}}
+		}
+		return staticType{base.item, base.card.optional()}
+	case *LookupExpr:
+		if t.Expr != nil {
+			inf.infer(t.Expr)
+		}
+		inf.infer(t.Key)
+		return anyType
+	case *DynamicCallExpr:
+		inf.infer(t.Func)
+		inf.inferList(t.Args)
+		return anyType
+	case *FunctionCall:
+		inf.inferList(t.Args)
+		return inf.functionType(t.Name)
+	case *ArrowExpr:
+		inf.infer(t.Expr)
+		inf.inferList(t.Args)
+		return inf.functionType(t.Function)
+	case *NamedFunctionRef:
+		return staticType{&FunctionTest{}, cardOne}
+	case *InlineFunctionExpr:
+		for _, p := range t.Params {
+			inf.bind(p.Name, paramType(p))
+		}
+		inf.infer(t.Body)
+		for _, p := range t.Params {
+			inf.unbind(p.Name)
+		}
+		return staticType{&FunctionTest{}, cardOne}
+	case *MapConstructor:
+		for _, e := range t.Entries {
+			inf.infer(e.Key)
+			inf.infer(e.Value)
+		}
+		return staticType{&MapTest{}, cardOne}
+	case *ArrayConstructor:
+		inf.inferList(t.Members)
+		return staticType{&ArrayTest{}, cardOne}
+	}
+	return anyType
+}
+
+// either is the type of an expression that returns a or b.
+func (inf *inferer) either(a, b staticType) staticType {
+	switch {
+	case a.card == cardEmpty:
+		return staticType{b.item, b.card.optional()}
+	case b.card == cardEmpty:
+		return staticType{a.item, a.card.optional()}
+	}
+	return staticType{joinItemTypes(a.item, b.item), a.card.choice(b.card)}
+}
+
+// arithmetic applies the numeric type promotion to the operands.
+func (inf *inferer) arithmetic(operands []staticType, ops []string) staticType {
+	card := cardOne
+	name := ""
+	for i, ot := range operands {
+		card.min = min(card.min, ot.card.min)
+		at, ok := ot.item.(*AtomicType)
+		if !ok || numericRank[at.Name] == 0 {
+			name = "xs:anyAtomicType"
+			continue
+		}
+		switch {
+		case name == "xs:anyAtomicType":
+		case i > 0 && ops[i-1] == "idiv":
+			name = "xs:integer"
+		case i > 0 && ops[i-1] == "div" && name == "xs:integer" && at.Name == "xs:integer":
+			name = "xs:decimal"
+		case numericRank[at.Name] > numericRank[name]:
+			name = at.Name
+		}
+	}
+	return atomicType(name, card)
+}
+
+// axisStep returns the type of a single step without predicates.
+func (inf *inferer) axisStep(step *AxisStep) staticType {
+	card := cardZeroOrMore
+	switch step.Axis {
+	case "self", "parent":
+		card = cardZeroOrOne
+	}
+	if step.Abbrev && step.Axis == "parent" {
+		return kindType("node", card)
+	}
+	switch test := step.Test.(type) {
+	case *KindTest:
+		switch {
+		case step.Axis == "attribute" && test.Kind == "node":
+			return kindType("attribute", card)
+		case test.Kind == "text" || test.Kind == "node":
+			// text nodes are returned as strings
+			return staticType{nil, card}
+		}
+		return staticType{test, card}
+	case *NameTest, *WildcardTest:
+		if step.Axis == "attribute" {
+			return kindType("attribute", card)
+		}
+		return kindType("element", card)
+	}
+	return staticType{&KindTest{Kind: "node"}, card}
+}
+
+// functionType returns the result type of a call to the named function.
+func (inf *inferer) functionType(name string) staticType {
+	if prefix, local, ok := strings.Cut(name, ":"); ok && !strings.HasPrefix(name, "Q{") {
+		switch inf.sc.Namespaces[prefix] {
+		case nsFN:
+			name = local
+		case nsXS:
+			return atomicType("xs:"+local, cardZeroOrOne)
+		default:
+			return anyType
+		}
+	} else if eqname, ok := strings.CutPrefix(name, "Q{"+nsFN+"}"); ok {
+		name = eqname
+	}
+	if t, ok := fnReturnTypes[name]; ok {
+		return t
+	}
+	return anyType
+}
+
+// paramType returns the declared type of an inline function parameter.
+func paramType(p *Param) staticType {
+	if p.Type == "" {
+		return anyType
+	}
+	tl, err := stringToTokenlist(p.Type)
+	if err != nil {
+		return anyType
+	}
+	st, err := parseSequenceType(tl)
+	if err != nil || st == nil || (!st.Empty && st.ItemType == nil) {
+		return anyType
+	}
+	return typeOf(st)
+}
+
+// typeOfSequence returns the type of a known value.
+func typeOfSequence(seq Sequence) staticType {
+	ret := staticType{card: cardEmpty}
+	for _, itm := range seq {
+		var item Node
+		switch itm.(type) {
+		case *XPathMap:
+			item = &MapTest{}
+		case *XPathArray:
+			item = &ArrayTest{}
+		case *XPathFunction:
+			item = &FunctionTest{}
+		default:
+			if id := TypeIDOf(itm); id != "unknown" {
+				item = &AtomicType{Name: id}
+			}
+		}
+		ret = ret.concat(staticType{item, cardOne})
+	}
+	return ret
+}
@@ -0,0 +1,808 @@
+package goxpath
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/speedata/goxml"
+)
+
+// iterFunc evaluates an expression lazily. It calls yield for each item of
+// the result in order and stops as soon as yield returns false. It is the
+// iter.Seq[Item] of the expression together with the error that stopped the
+// evaluation.
+type iterFunc func(ctx *Context, yield func(Item) bool) error
+
+// emptyIter yields nothing.
+func emptyIter(*Context, func(Item) bool) error {
+	return nil
+}
+
+// seqIter returns an iterFunc that evaluates ef and yields the items of the
+// result.
+func seqIter(ef EvalFunc) iterFunc {
+	return func(ctx *Context, yield func(Item) bool) error {
+		seq, err := ef(ctx)
+		if err != nil {
+			return err
+		}
+		for _, itm := range seq {
+			if !yield(itm) {
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// countingIter returns it with the yielded items counted towards
+// Limits.MaxItems, like compile does for the expressions that create items.
+func countingIter(it iterFunc, err error) (iterFunc, error) {
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		st := ctx.eval
+		if st == nil {
+			return it(ctx, yield)
+		}
+		var limitErr error
+		err := it(ctx, func(itm Item) bool {
+			if limitErr = st.produced(1); limitErr != nil {
+				return false
+			}
+			return yield(itm)
+		})
+		if limitErr != nil {
+			return limitErr
+		}
+		return err
+	}, nil
+}
+
+// run calls it and reports whether yield has stopped the iteration.
+func (it iterFunc) run(ctx *Context, yield func(Item) bool) (bool, error) {
+	stopped := false
+	err := it(ctx, func(itm Item) bool {
+		if !yield(itm) {
+			stopped = true
+		}
+		return !stopped
+	})
+	return stopped, err
+}
+
+// collect evaluates it and returns all items.
+func (it iterFunc) collect(ctx *Context) (Sequence, error) {
+	seq := Sequence{}
+	err := it(ctx, func(itm Item) bool {
+		seq = append(seq, itm)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+// first evaluates it until the first item and returns that item.
+func (it iterFunc) first(ctx *Context) (Item, bool, error) {
+	var first Item
+	found := false
+	err := it(ctx, func(itm Item) bool {
+		first, found = itm, true
+		return false
+	})
+	return first, found, err
+}
+
+// compileIter compiles n into a lazy evaluation function. Path expressions,
+// ranges, filters, simple maps and for, let and if expressions produce their
+// items one by one; all other expressions are evaluated completely and then
+// yield the items of their result.
+func compileIter(n Node) (iterFunc, error) {
+	if n == nil {
+		return emptyIter, nil
+	}
+	pos := n.Pos()
+	it, err := compileIterNode(n)
+	if err != nil {
+		return nil, staticError(err, pos)
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		if ctx.eval != nil {
+			if err := ctx.eval.check(); err != nil {
+				return errorAt(err, pos)
+			}
+		}
+		return errorAt(it(ctx, yield), pos)
+	}, nil
+}
+
+func compileIterNode(n Node) (iterFunc, error) {
+	switch t := n.(type) {
+	case *ParenExpr:
+		if t.Expr == nil {
+			return emptyIter, nil
+		}
+		return compileIter(t.Expr)
+	case *SequenceExpr:
+		return countingIter(iterSequenceExpr(t))
+	case *RangeExpr:
+		return countingIter(iterRangeExpr(t))
+	case *FilterExpr:
+		if !containsLast(t.Predicate) {
+			return iterFilterExpr(t)
+		}
+	case *AxisStep:
+		return countingIter(iterAxisStep(t))
+	case *PathExpr:
+		return iterPathExpr(t)
+	case *SimpleMapExpr:
+		return iterSimpleMapExpr(t)
+	case *ForExpr:
+		if len(t.Bindings) == 1 {
+			return countingIter(iterForExpr(t))
+		}
+	case *LetExpr:
+		return iterLetExpr(t)
+	case *IfExpr:
+		return iterIfExpr(t)
+	}
+	ef, err := compile(n)
+	if err != nil {
+		return nil, err
+	}
+	return seqIter(ef), nil
+}
+
+func compileIterList(nodes []Node) ([]iterFunc, error) {
+	its := make([]iterFunc, len(nodes))
+	for i, n := range nodes {
+		it, err := compileIter(n)
+		if err != nil {
+			return nil, err
+		}
+		its[i] = it
+	}
+	return its, nil
+}
+
+// containsLast reports whether n calls last(). Such expressions need the
+// size of the context and can't be evaluated lazily.
+func containsLast(n Node) bool {
+	found := false
+	Inspect(n, func(n Node) bool {
+		if isFunctionCall(n, "last") {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func iterSequenceExpr(n *SequenceExpr) (iterFunc, error) {
+	its, err := compileIterList(n.Items)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		saveContext := ctx.sequence
+		for _, it := range its {
+			ctx.sequence = saveContext
+			if stopped, err := it.run(ctx, yield); stopped || err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func iterRangeExpr(n *RangeExpr) (iterFunc, error) {
+	efs, err := compileList([]Node{n.From, n.To})
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		startF, endF, ok, err := rangeBounds(ctx, efs[0], efs[1])
+		if err != nil || !ok {
+			return err
+		}
+		start, end := math.MinInt64, math.MaxInt64
+		if startF > math.MinInt64 {
+			start = int(startF)
+		}
+		if endF < math.MaxInt64 {
+			end = int(endF)
+		}
+		for i := start; ; i++ {
+			if err := ctx.checkEval(); err != nil {
+				return err
+			}
+			if !yield(i) || i == end {
+				return nil
+			}
+		}
+	}, nil
+}
+
+func iterFilterExpr(n *FilterExpr) (iterFunc, error) {
+	base, err := compileIter(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	predicate, err := compile(n.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	return filterIter(base, predicate), nil
+}
+
+// filterIter returns an iterFunc that yields the items of src that satisfy
+// the predicate, with the semantics of Context.Filter. Predicates that use
+// last() must not be evaluated this way.
+func filterIter(src iterFunc, predicate EvalFunc) iterFunc {
+	return func(ctx *Context, yield func(Item) bool) error {
+		if ctx.ctxPositions != nil {
+			// explicit context positions, see Context.Current
+			seq, err := src.collect(ctx)
+			if err != nil {
+				return err
+			}
+			ctx.sequence = seq
+			if seq, err = ctx.Filter(predicate); err != nil {
+				return err
+			}
+			ctx.ctxPositions = nil
+			ctx.ctxLengths = nil
+			return seqIter(func(*Context) (Sequence, error) { return seq, nil })(ctx, yield)
+		}
+		return filterItems(ctx, src, predicate, yield)
+	}
+}
+
+// filterItems is the lazy variant of Context.Filter. A numeric predicate
+// stops the iteration as soon as the item at that position has been found.
+func filterItems(ctx *Context, src iterFunc, predicate EvalFunc, yield func(Item) bool) error {
+	pos := 0
+	numeric, target := false, 0
+	var perr error
+	err := src(ctx, func(itm Item) bool {
+		pos++
+		if numeric {
+			if pos < target {
+				return true
+			}
+			yield(itm)
+			return false
+		}
+		ctx.sequence = Sequence{itm}
+		ctx.Pos = pos
+		res, err := predicate(ctx)
+		if err != nil {
+			perr = err
+			return false
+		}
+		if pos == 1 && len(res) == 1 {
+			if f, ok := ToFloat64(res[0]); ok {
+				numeric, target = true, int(f)
+				if target == 1 {
+					yield(itm)
+				}
+				return target > 1
+			}
+		}
+		ok, err := BooleanValue(res)
+		if err != nil {
+			perr = err
+			return false
+		}
+		return !ok || yield(itm)
+	})
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+func iterAxisStep(n *AxisStep) (iterFunc, error) {
+	switch n.Axis {
+	case "child", "attribute", "descendant", "descendant-or-self":
+	default:
+		ef, err := compile(n)
+		if err != nil {
+			return nil, err
+		}
+		return seqIter(ef), nil
+	}
+	for _, p := range n.Predicates {
+		if containsLast(p) {
+			ef, err := compile(n)
+			if err != nil {
+				return nil, err
+			}
+			return seqIter(ef), nil
+		}
+	}
+	tf := compileNodeTest(n.Test)
+	if tf == nil {
+		return nil, fmt.Errorf("unknown node test %s", n.Test)
+	}
+	predicates, err := compileList(n.Predicates)
+	if err != nil {
+		return nil, err
+	}
+	axis := n.Axis
+	local, indexed := indexedName(n.Test)
+	indexed = indexed && axis != "child"
+	var it iterFunc = func(ctx *Context, yield func(Item) bool) error {
+		for _, itm := range slices.Clone(ctx.sequence) {
+			if indexed {
+				if elts, ok := ctx.indexedDescendants(itm, axis == "descendant-or-self", local, tf); ok {
+					for _, elt := range elts {
+						if !yield(elt) {
+							return nil
+						}
+					}
+					continue
+				}
+			}
+			if stopped, err := ctx.walkAxis(axis, itm, tf, yield); stopped || err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, predicate := range predicates {
+		it = filterIter(it, predicate)
+	}
+	return it, nil
+}
+
+// walkAxis calls yield for the nodes on the axis of itm that pass tf, in the
+// same order and form as the axis functions. It reports whether yield has
+// stopped the walk.
+func (ctx *Context) walkAxis(axis string, itm Item, tf testFunc, yield func(Item) bool) (bool, error) {
+	switch t := itm.(type) {
+	case *goxml.XMLDocument:
+		if axis == "descendant-or-self" {
+			return ctx.walkDescendantOrSelf(t, tf, yield)
+		}
+		for _, cld := range t.Children() {
+			if axis == "descendant" {
+				if stopped, err := ctx.walkDescendantOrSelf(cld, tf, yield); stopped || err != nil {
+					return stopped, err
+				}
+			} else if tf(ctx, cld) && !yield(cld) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *goxml.Element:
+		switch axis {
+		case "descendant-or-self":
+			return ctx.walkDescendantOrSelf(t, tf, yield)
+		case "descendant":
+			for _, cld := range t.Children() {
+				if stopped, err := ctx.walkDescendantOrSelf(cld, tf, yield); stopped || err != nil {
+					return stopped, err
+				}
+			}
+			return false, nil
+		}
+		for _, attr := range attributes(t) {
+			if tf(ctx, attr) && !yield(attr) {
+				return true, nil
+			}
+		}
+		for _, cld := range t.Children() {
+			if !tf(ctx, cld) {
+				continue
+			}
+			var next Item = cld
+			if cd, ok := cld.(goxml.CharData); ok {
+				next = cd.Contents
+			}
+			if !yield(next) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	// all other items are rare, use the axis functions
+	ctx.sequence = Sequence{itm}
+	var seq Sequence
+	var err error
+	switch axis {
+	case "descendant":
+		seq, err = ctx.descendantAxis(tf)
+	case "descendant-or-self":
+		seq, err = ctx.descendantOrSelfAxis(tf)
+	default:
+		seq, err = ctx.childAxis(tf)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, s := range seq {
+		if !yield(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// walkDescendantOrSelf is the lazy variant of descendantOrSelfAxis for a
+// single node.
+func (ctx *Context) walkDescendantOrSelf(n Item, tf testFunc, yield func(Item) bool) (bool, error) {
+	if err := ctx.checkEval(); err != nil {
+		return false, err
+	}
+	var children []goxml.XMLNode
+	switch t := n.(type) {
+	case *goxml.XMLDocument:
+		if tf(ctx, t) && !yield(t) {
+			return true, nil
+		}
+		children = t.Children()
+	case *goxml.Element:
+		if tf(ctx, t) && !yield(t) {
+			return true, nil
+		}
+		children = t.Children()
+	case goxml.CharData:
+		return tf(ctx, t) && !yield(t.Contents), nil
+	case goxml.Comment, goxml.ProcInst, goxml.NamespaceNode, *goxml.Attribute:
+		return tf(ctx, t) && !yield(t), nil
+	default:
+		return ctx.walkAxis("descendant-or-self", n, tf, yield)
+	}
+	for _, cld := range children {
+		if stopped, err := ctx.walkDescendantOrSelf(cld, tf, yield); stopped || err != nil {
+			return stopped, err
+		}
+	}
+	return false, nil
+}
+
+func iterPathExpr(n *PathExpr) (iterFunc, error) {
+	lazy := n.Root != "//"
+	for i, step := range n.Steps {
+		if _, ok := step.(*AxisStep); !ok && i > 0 && containsLast(step) {
+			lazy = false
+		}
+	}
+	if !lazy {
+		ef, err := compile(n)
+		if err != nil {
+			return nil, err
+		}
+		return seqIter(ef), nil
+	}
+	steps, err := compileIterList(n.Steps)
+	if err != nil {
+		return nil, err
+	}
+	seps := n.Seps
+	root := n.Root
+	return func(ctx *Context, yield func(Item) bool) error {
+		if root == "/" {
+			doc := ctx.Document()
+			if len(steps) == 0 {
+				yield(doc)
+				return nil
+			}
+		}
+		if len(steps) == 1 {
+			return steps[0](ctx, yield)
+		}
+		var err error
+		// positions[i] counts the context items of step i
+		positions := make([]int, len(steps))
+		// apply evaluates step i for the context item itm, next passes the
+		// result r of step i on to step i+1. Both return false to stop.
+		var apply, next func(i int, itm Item) bool
+		apply = func(i int, itm Item) bool {
+			positions[i]++
+			ctx.sequence = Sequence{itm}
+			ctx.Pos = positions[i]
+			ok := true
+			if serr := steps[i](ctx, func(r Item) bool {
+				ok = next(i, r)
+				return ok
+			}); serr != nil {
+				err = serr
+				return false
+			}
+			return ok
+		}
+		next = func(i int, r Item) bool {
+			if i == len(steps)-1 {
+				return yield(r)
+			}
+			if seps[i] != "//" {
+				return apply(i+1, r)
+			}
+			ok := true
+			if _, werr := ctx.walkAxis("descendant-or-self", r, isElement, func(d Item) bool {
+				ok = apply(i+1, d)
+				return ok
+			}); werr != nil {
+				err = werr
+				return false
+			}
+			return ok
+		}
+		if len(ctx.sequence) == 0 {
+			if serr := steps[0](ctx, func(r Item) bool { return next(0, r) }); serr != nil {
+				return serr
+			}
+			return err
+		}
+		items := slices.Clone(ctx.sequence)
+		for _, itm := range items {
+			ctx.size = len(items)
+			if !apply(0, itm) {
+				break
+			}
+		}
+		return err
+	}, nil
+}
+
+func iterSimpleMapExpr(n *SimpleMapExpr) (iterFunc, error) {
+	for _, op := range n.Operands[1:] {
+		if containsLast(op) {
+			ef, err := compile(n)
+			if err != nil {
+				return nil, err
+			}
+			return seqIter(ef), nil
+		}
+	}
+	its, err := compileIterList(n.Operands)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		saveSeq, savePos, saveSize := ctx.sequence, ctx.Pos, ctx.size
+		defer func() {
+			ctx.sequence, ctx.Pos, ctx.size = saveSeq, savePos, saveSize
+		}()
+		var err error
+		// positions[i] counts the context items of operand i, starting
+		// at 0 like the eager evaluation
+		positions := make([]int, len(its))
+		var next func(i int, itm Item) bool
+		next = func(i int, itm Item) bool {
+			if i == len(its)-1 {
+				return yield(itm)
+			}
+			ctx.sequence = Sequence{itm}
+			ctx.Pos = positions[i+1]
+			positions[i+1]++
+			ok := true
+			if oerr := its[i+1](ctx, func(r Item) bool {
+				ok = next(i+1, r)
+				return ok
+			}); oerr != nil {
+				err = oerr
+				return false
+			}
+			return ok
+		}
+		if oerr := its[0](ctx, func(r Item) bool { return next(0, r) }); oerr != nil {
+			return oerr
+		}
+		return err
+	}, nil
+}
+
+func iterForExpr(n *ForExpr) (iterFunc, error) {
+	binding, err := compileIter(n.Bindings[0].Expr)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := compileIter(n.Return)
+	if err != nil {
+		return nil, err
+	}
+	varname := n.Bindings[0].Name
+	return func(ctx *Context, yield func(Item) bool) error {
+		oldValue := ctx.vars[varname]
+		defer func() { ctx.vars[varname] = oldValue }()
+		var err error
+		berr := binding(CopyContext(ctx), func(itm Item) bool {
+			value := Sequence{itm}
+			ctx.vars[varname] = value
+			ctx.sequence = Sequence{itm}
+			stopped := false
+			stopped, err = ret.run(ctx, func(r Item) bool {
+				// the consumer is outside of the scope of the variable
+				ctx.vars[varname] = oldValue
+				ok := yield(r)
+				ctx.vars[varname] = value
+				return ok
+			})
+			return !stopped && err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return berr
+	}, nil
+}
+
+func iterLetExpr(n *LetExpr) (iterFunc, error) {
+	varnames := make([]string, len(n.Bindings))
+	efs := make([]EvalFunc, len(n.Bindings))
+	for i, b := range n.Bindings {
+		ef, err := compileBinding(b)
+		if err != nil {
+			return nil, err
+		}
+		varnames[i], efs[i] = b.Name, ef
+	}
+	ret, err := compileIter(n.Return)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		oldValues := make([]Sequence, len(varnames))
+		for i, name := range varnames {
+			oldValues[i] = ctx.vars[name]
+		}
+		restore := func() {
+			for i, name := range varnames {
+				ctx.vars[name] = oldValues[i]
+			}
+		}
+		defer restore()
+		values := make([]Sequence, len(varnames))
+		for i, ef := range efs {
+			val, err := ef(ctx)
+			if err != nil {
+				return err
+			}
+			ctx.vars[varnames[i]] = val
+			values[i] = val
+		}
+		return ret(ctx, func(r Item) bool {
+			// the consumer is outside of the scope of the variables
+			restore()
+			ok := yield(r)
+			for i, name := range varnames {
+				ctx.vars[name] = values[i]
+			}
+			return ok
+		})
+	}, nil
+}
+
+func iterIfExpr(n *IfExpr) (iterFunc, error) {
+	cond, err := compile(n.Cond)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := compileIterList([]Node{n.Then, n.Else})
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *Context, yield func(Item) bool) error {
+		res, err := cond(ctx)
+		if err != nil {
+			return err
+		}
+		bv, err := BooleanValue(res)
+		if err != nil {
+			return err
+		}
+		if bv {
+			return branches[0](ctx, yield)
+		}
+		return branches[1](ctx, yield)
+	}, nil
+}
+
+// firstItemFunctions are the functions of one argument that only need the
+// first item of the argument.
+var firstItemFunctions = map[string]bool{
+	"empty":  true,
+	"exists": true,
+	"head":   true,
+}
+
+// compileFirstItemCall compiles a call of one of the firstItemFunctions. The
+// argument is evaluated until its first item unless the name refers to a
+// different function at evaluation time, callFn then gets the complete
+// argument.
+func compileFirstItemCall(arg Node, prefix, local string, callFn func(*Context, []Sequence) (Sequence, error)) (EvalFunc, error) {
+	argIter, err := compileIter(arg)
+	if err != nil {
+		return nil, err
+	}
+	builtin := selectOverload(xpathfunctions[nsFN+" "+local], 1)
+	ef := func(ctx *Context) (Sequence, error) {
+		saveContext := ctx.sequence
+		ns := nsFN
+		if prefix != "" {
+			ns = ctx.Namespaces[prefix]
+		}
+		if ns != nsFN || ctx.lookupFunction(ns, local, 1) != builtin {
+			seq, err := argIter.collect(ctx)
+			if err != nil {
+				return nil, err
+			}
+			ctx.sequence = saveContext
+			return callFn(ctx, []Sequence{seq})
+		}
+		itm, found, err := argIter.first(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ctx.sequence = saveContext
+		switch local {
+		case "exists":
+			return Sequence{found}, nil
+		case "empty":
+			return Sequence{!found}, nil
+		}
+		if !found {
+			return Sequence{}, nil
+		}
+		return Sequence{itm}, nil
+	}
+	return ef, nil
+}
+
+// compileLazyQuantified compiles a quantified expression with a single
+// binding. The binding is evaluated lazily and the evaluation stops at the
+// first item that decides the result.
+func compileLazyQuantified(n *QuantifiedExpr) (EvalFunc, error) {
+	binding, err := compileIter(n.Bindings[0].Expr)
+	if err != nil {
+		return nil, err
+	}
+	satisfies, err := compile(n.Satisfies)
+	if err != nil {
+		return nil, err
+	}
+	varname := n.Bindings[0].Name
+	some := n.Quantifier == "some"
+	ef := func(ctx *Context) (Sequence, error) {
+		oldValue := ctx.vars[varname]
+		defer func() { ctx.vars[varname] = oldValue }()
+		// some is false and every is true unless an item decides otherwise
+		result := !some
+		var err error
+		berr := binding(CopyContext(ctx), func(itm Item) bool {
+			ctx.vars[varname] = Sequence{itm}
+			ctx.sequence = Sequence{itm}
+			var seq Sequence
+			if seq, err = satisfies(ctx); err != nil {
+				return false
+			}
+			for _, sitm := range seq {
+				var bv bool
+				if bv, err = BooleanValue(Sequence{sitm}); err != nil {
+					return false
+				}
+				if bv == some {
+					result = some
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if berr != nil {
+			return nil, berr
+		}
+		ctx.sequence = Sequence{result}
+		return ctx.sequence, nil
+	}
+	return ef, nil
+}
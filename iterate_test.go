@@ -0,0 +1,191 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+func TestLazyEvaluation(t *testing.T) {
+	testdata := []struct {
+		input  string
+		output Sequence
+	}{
+		{`(1 to 1000000000)[1]`, Sequence{1}},
+		{`(1 to 1000000000)[. > 4][2]`, Sequence{6}},
+		{`head(1 to 1000000000)`, Sequence{1}},
+		{`exists(1 to 1000000000)`, Sequence{true}},
+		{`empty(1 to 1000000000)`, Sequence{false}},
+		{`some $x in 1 to 1000000000 satisfies $x = 3`, Sequence{true}},
+		{`every $x in 1 to 1000000000 satisfies $x < 3`, Sequence{false}},
+		{`(for $i in 1 to 1000000000 return $i * 2)[3]`, Sequence{6}},
+		{`exists(//sub)`, Sequence{true}},
+		{`empty(//nothing)`, Sequence{true}},
+		{`string(head(//sub)/@foo)`, Sequence{"baz"}},
+		{`fn:exists(())`, Sequence{false}},
+		{`count(/root/(sub, other))`, Sequence{5}},
+		{`some $s in //sub satisfies $s/@foo = 'bar'`, Sequence{true}},
+		{`every $s in //sub satisfies $s/@foo = 'bar'`, Sequence{false}},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		seq, err := np.Evaluate(td.input)
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s took %s", td.input, d)
+		}
+		if len(seq) != len(td.output) {
+			t.Errorf("%s = %v, want %v", td.input, seq, td.output)
+			continue
+		}
+		for i := range seq {
+			if !itemsEqual(seq[i], td.output[i]) {
+				t.Errorf("%s = %v, want %v", td.input, seq, td.output)
+				break
+			}
+		}
+	}
+}
+
+func TestLazySameResult(t *testing.T) {
+	for _, expr := range []string{
+		`/root/sub/@foo`,
+		`//subsub`,
+		`//sub[@foo = 'bar'][2]/@self`,
+		`/root//sub/@p`,
+		`/root/*[2]!local-name()`,
+		`/root/a/sub[last()]/@p`,
+		`(//sub)[2]/@foo`,
+		`//text()[normalize-space()]`,
+		`(1 to 10)[. mod 3 = 0]`,
+		`(1 to 10)[position() > 7]`,
+		`(5, 'a', 3)[2]`,
+		`(1 to 5)[.]`,
+		`(1 to 5) ! (. * position())`,
+		`for $a in /root/a return $a/sub/@p`,
+		`let $s := //sub return $s[2]/@foo`,
+		`if (//sub) then 1 to 3 else ()`,
+		`/root/a/sub/../@*`,
+		`/root/descendant-or-self::node()/@foo`,
+		`/root/(sub, other)/@foo`,
+	} {
+		tree, err := ParseAST(expr)
+		if err != nil {
+			t.Errorf("ParseAST(%q): %s", expr, err)
+			continue
+		}
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ef, err := CompileAST(tree)
+		if err != nil {
+			t.Errorf("CompileAST(%q): %s", expr, err)
+			continue
+		}
+		it, err := compileIter(tree)
+		if err != nil {
+			t.Errorf("compileIter(%q): %s", expr, err)
+			continue
+		}
+		np.Ctx.Document()
+		want, err := ef(np.Ctx)
+		if err != nil {
+			t.Errorf("evaluate %q: %s", expr, err)
+			continue
+		}
+		np.Ctx.Document()
+		got, err := it.collect(np.Ctx)
+		if err != nil {
+			t.Errorf("evaluate %q lazily: %s", expr, err)
+			continue
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: lazy result %v, want %v", expr, got, want)
+			continue
+		}
+		for i := range got {
+			if !itemsEqual(got[i], want[i]) {
+				t.Errorf("%s: lazy result %v, want %v", expr, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestEvaluateIter(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, errf := np.EvaluateIter(`1 to 1000000000`)
+	sum := 0
+	for itm := range seq {
+		sum += itm.(int)
+		if itm.(int) == 4 {
+			break
+		}
+	}
+	if err = errf(); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 10 {
+		t.Errorf("sum = %d, want 10", sum)
+	}
+
+	seq, errf = np.EvaluateIter(`/root/sub/@foo`)
+	var foos []string
+	for itm := range seq {
+		foos = append(foos, itm.(*goxml.Attribute).Value)
+	}
+	if err = errf(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(foos, ","); got != "baz,bar,bar" {
+		t.Errorf("@foo = %s, want baz,bar,bar", got)
+	}
+
+	seq, errf = np.EvaluateIter(`(1, 2, 1 div 0)`)
+	n := 0
+	for range seq {
+		n++
+	}
+	if code, _ := XPathErrorCode(errf()); code != "FOAR0001" {
+		t.Errorf("error code = %q, want FOAR0001 (%v)", code, errf())
+	}
+
+	if seq, errf = np.EvaluateIter(`1 + ;`); errf() != nil {
+		t.Errorf("EvaluateIter reported an error before the iteration")
+	}
+	for range seq {
+		t.Errorf("EvaluateIter of a syntax error yielded an item")
+	}
+	if code, _ := XPathErrorCode(errf()); code != "XPST0003" {
+		t.Errorf("error code = %q, want XPST0003 (%v)", code, errf())
+	}
+
+	expr := MustCompile(`//sub[@foo = $v]`, &StaticContext{Variables: map[string]Sequence{"v": {"bar"}}})
+	seq, errf = expr.EvaluateIter(np.Ctx)
+	n = 0
+	for range seq {
+		n++
+	}
+	if err = errf(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%s yielded %d items, want 2", expr, n)
+	}
+	if _, ok := np.Ctx.vars["v"]; ok {
+		t.Errorf("the variable $v is still bound after the iteration")
+	}
+}
@@ -335,7 +335,7 @@ func xmlToJSONTextContent(elt *goxml.Element) string {
 
 // xmlToJSONGetAttr returns the value of the named attribute, or "".
 func xmlToJSONGetAttr(elt *goxml.Element, name string) string {
-	for _, attr := range elt.Attributes() {
+	for _, attr := range attributes(elt) {
 		if attr.Name == name {
 			return attr.Value
 		}
@@ -0,0 +1,253 @@
+package goxpath
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"sync"
+
+	"github.com/speedata/goxml"
+)
+
+// keyDefinition is a key declared with DefineKey. The hash tables of the
+// documents are built on first use and shared by the copies of the context.
+type keyDefinition struct {
+	match     *Expression
+	use       *Expression
+	collation Collation
+	mu        sync.Mutex
+	tables    map[*goxml.XMLDocument]map[any][]goxml.XMLNode
+}
+
+// DefineKey declares the key name for fn:key, like xsl:key in XSLT. The
+// nodes of a document that match the pattern match, for example item,
+// chapter/section or @id, are indexed by the atomized values of the
+// expression use, evaluated with the node as the context item. Strings are
+// compared with the given collation, or with the default collation of ctx if
+// collation is empty. The index of a document is built the first time
+// fn:key is called for it; the document must not be changed afterwards.
+// Defining a key again replaces the previous definition. Keys defined on a
+// copy of the context are not visible in ctx and the other copies.
+func (ctx *Context) DefineKey(name, match, use, collation string) error {
+	sc := NewStaticContext()
+	maps.Copy(sc.Namespaces, ctx.Namespaces)
+	// a node matches the pattern if it is selected by //(pattern)
+	matchExpr, err := Compile("//("+match+")", sc)
+	if err != nil {
+		return err
+	}
+	useExpr, err := Compile(use, sc)
+	if err != nil {
+		return err
+	}
+	coll := ctx.Collation()
+	if collation != "" {
+		if coll, err = ResolveCollation(collation); err != nil {
+			return err
+		}
+	}
+	// the copies of the context share the map, so it is replaced, not changed
+	keys := maps.Clone(ctx.keys)
+	if keys == nil {
+		keys = make(map[string]*keyDefinition)
+	}
+	keys[name] = &keyDefinition{
+		match:     matchExpr,
+		use:       useExpr,
+		collation: coll,
+		tables:    make(map[*goxml.XMLDocument]map[any][]goxml.XMLNode),
+	}
+	ctx.keys = keys
+	return nil
+}
+
+// table returns the hash table of the key for doc and builds it if
+// necessary.
+func (kd *keyDefinition) table(ctx *Context, doc *goxml.XMLDocument) (map[any][]goxml.XMLNode, error) {
+	kd.mu.Lock()
+	tbl, ok := kd.tables[doc]
+	kd.mu.Unlock()
+	if ok {
+		return tbl, nil
+	}
+	matched, err := kd.evaluate(kd.match, ctx, doc, doc)
+	if err != nil {
+		return nil, err
+	}
+	tbl = make(map[any][]goxml.XMLNode)
+	for _, itm := range matched {
+		n, ok := itm.(goxml.XMLNode)
+		if !ok {
+			return nil, NewXPathError("XPTY0019", fmt.Sprintf("key pattern selects %T, expected nodes", itm))
+		}
+		values, err := kd.evaluate(kd.use, ctx, doc, n)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[any]bool)
+		for _, v := range atomizeSequence(values) {
+			k, ok := keyValue(v, kd.collation)
+			if !ok || seen[k] {
+				continue
+			}
+			seen[k] = true
+			tbl[k] = append(tbl[k], n)
+		}
+	}
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	// another goroutine might have been faster
+	if cur, ok := kd.tables[doc]; ok {
+		return cur, nil
+	}
+	kd.tables[doc] = tbl
+	return tbl, nil
+}
+
+// evaluate runs e with itm as the context item and doc as the root. The
+// evaluation counts against the limits of the running evaluation of ctx.
+func (kd *keyDefinition) evaluate(e *Expression, ctx *Context, doc *goxml.XMLDocument, itm Item) (Sequence, error) {
+	frame, err := e.enter(context.Background(), ctx)
+	if err != nil {
+		return nil, err
+	}
+	frame.eval = ctx.eval
+	frame.currentTime = ctx.currentTime
+	frame.xmldoc = doc
+	frame.sequence = Sequence{itm}
+	frame.ctxPositions = nil
+	frame.ctxLengths = nil
+	frame.Pos = 1
+	frame.size = 1
+	seq, err := e.eval(frame)
+	return seq, errorIn(err, e.source)
+}
+
+// keyValue returns the hash key of an atomic value. Values that are equal
+// by the eq operator have the same key. NaN has no key.
+func keyValue(itm Item, coll Collation) (any, bool) {
+	switch v := itm.(type) {
+	case string:
+		return "\x00s" + coll.Key(v), true
+	case XSString:
+		return "\x00s" + coll.Key(v.V), true
+	case XSUntypedAtomic:
+		return "\x00s" + coll.Key(string(v)), true
+	case XSAnyURI:
+		return "\x00s" + coll.Key(string(v)), true
+	case XSDateTime, XSDate, XSTime:
+		// the same key as in maps
+		return mapKey(v), true
+	}
+	if f, ok := ToFloat64(itm); ok {
+		if math.IsNaN(f) {
+			return nil, false
+		}
+		return f, true
+	}
+	return fmt.Sprintf("%T\x00%v", itm, itm), true
+}
+
+// rootOf returns the outermost ancestor of n.
+func rootOf(n goxml.XMLNode) goxml.XMLNode {
+	for {
+		var parent goxml.XMLNode
+		switch t := n.(type) {
+		case *goxml.Element:
+			parent = t.Parent
+		case *goxml.Attribute:
+			parent = t.Parent
+		case goxml.Attribute:
+			parent = t.Parent
+		}
+		if parent == nil {
+			return n
+		}
+		n = parent
+	}
+}
+
+// isAncestorOrSelf reports whether a is n or an ancestor of n.
+func isAncestorOrSelf(a, n goxml.XMLNode) bool {
+	for n != nil {
+		if n == a {
+			return true
+		}
+		switch t := n.(type) {
+		case *goxml.Element:
+			n = t.Parent
+		case *goxml.Attribute:
+			n = t.Parent
+		case goxml.Attribute:
+			n = t.Parent
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// fnKey implements key($name, $value, $top): the nodes with a key value
+// equal to one of the values, in document order. The document of the
+// context item is searched if $top is not given.
+func fnKey(ctx *Context, args []Sequence) (Sequence, error) {
+	name, err := StringValue(args[0])
+	if err != nil {
+		return nil, err
+	}
+	kd, ok := ctx.keys[name]
+	if !ok {
+		return nil, NewXPathError("XTDE1260", fmt.Sprintf("key %q is not defined", name))
+	}
+	var top goxml.XMLNode
+	if len(args) > 2 {
+		if len(args[2]) != 1 {
+			return nil, NewXPathError("XPTY0004", "key: the third argument must be a single node")
+		}
+		if top, ok = args[2][0].(goxml.XMLNode); !ok {
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("key: expected a node, got %T", args[2][0]))
+		}
+	} else if len(ctx.sequence) == 0 && ctx.xmldoc != nil {
+		top = ctx.xmldoc
+	} else {
+		itm, err := ctx.contextItem()
+		if err != nil {
+			return nil, err
+		}
+		if top, ok = itm.(goxml.XMLNode); !ok {
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("key: context item is not a node but %T", itm))
+		}
+	}
+	doc, ok := rootOf(top).(*goxml.XMLDocument)
+	if !ok {
+		return nil, NewXPathError("XTDE1270", "key: the tree is not rooted at a document node")
+	}
+	if len(args) < 3 {
+		top = doc
+	}
+	tbl, err := kd.table(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	var nodes goxml.SortByDocumentOrder
+	for _, v := range atomizeSequence(args[1]) {
+		k, ok := keyValue(v, kd.collation)
+		if !ok {
+			continue
+		}
+		for _, n := range tbl[k] {
+			if top == doc || isAncestorOrSelf(top, n) {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	if len(nodes) > 1 {
+		nodes = nodes.SortAndEliminateDuplicates()
+	}
+	seq := make(Sequence, len(nodes))
+	for i, n := range nodes {
+		seq[i] = n
+	}
+	return seq, nil
+}
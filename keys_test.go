@@ -0,0 +1,128 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/speedata/goxml"
+)
+
+func TestKey(t *testing.T) {
+	data := `<shop>
+	<item id="a1" cat="book tool"><name>Hammer</name><price>10</price></item>
+	<item id="b2" cat="book"><name>hammer</name><price>10.0</price></item>
+	<section><item id="c3" cat="food"><name>Bread</name><price>2</price></item></section>
+	<order ref="b2"/><order ref="a1"/>
+</shop>`
+	other, err := goxml.Parse(strings.NewReader(`<shop><item id="a1" cat="other"/></shop>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`string(key('id', 'b2')/name)`, "hammer", ""},
+		{`count(key('id', 'x'))`, "0", ""},
+		{`string-join(key('id', ('c3', 'a1', 'c3'))/@id, ' ')`, "a1 c3", ""},
+		{`string-join(key('id', //order/@ref)/@id, ' ')`, "a1 b2", ""},
+		{`string-join(key('cat', 'book')/@id, ' ')`, "a1 b2", ""},
+		{`string-join(key('cat', 'tool')/@id, ' ')`, "a1", ""},
+		{`string-join(key('name', 'HAMMER')/@id, ' ')`, "a1 b2", ""},
+		{`string-join(key('price', 10)/@id, ' ')`, "a1 b2", ""},
+		{`count(key('price', '10'))`, "0", ""},
+		{`string-join(key('cat', 'book', /shop/section)/@id, ' ')`, "", ""},
+		{`string-join(key('cat', 'food', /shop/section)/@id, ' ')`, "c3", ""},
+		{`string-join(key('section', 'c3')/@id, ' ')`, "c3", ""},
+		{`string(key('attr', 'b2')/..)`, "hammer10.0", ""},
+		{`//order[1]/key('id', @ref)/name/string()`, "hammer", ""},
+		{`string(key('id', 'a1', doc('urn:other'))/@cat)`, "other", ""},
+		{`doc('urn:other')/key('id', 'a1')/@cat = 'other'`, "true", ""},
+		{`string-join((/shop/item[1], doc('urn:other')/shop/item)[let $k := key('id', 'a1') return $k/@cat = 'other']/@id, ' ')`, "a1", ""},
+		{`string-join((//order, doc('urn:other')/shop/item)[let $k := key('id', 'b2') return exists($k)]/@ref, ' ')`, "b2 a1", ""},
+		{`string-join(key('day', xs:date('1500-01-01'))/@id, ' ')`, "a1", ""},
+		{`string-join(key('day', xs:date('2500-01-01Z'))/@id, ' ')`, "b2", ""},
+		{`string-join(key('day', xs:date('2500-01-01'))/@id, ' ')`, "c3", ""},
+		{`string-join((/shop/item[1], doc('urn:other')/shop/item)[key('id', 'a1')/@cat = 'other']/@cat, ' ')`, "other", ""},
+		{`string-join((/shop/item[1], doc('urn:other')/shop/item)[. is key('id', @id)]/@cat, ' ')`, "book tool other", ""},
+		{`count((//order, doc('urn:other')//item)[position() > 1][key('id', 'a1')/@cat = 'other'])`, "1", ""},
+		{`key('missing', 'a1')`, "", "XTDE1260"},
+		{`key('id', 'a1', 1)`, "", "XPTY0004"},
+		{`1 ! key('id', 'a1')`, "", "XPTY0004"},
+		{`string-join((/shop/item, doc('urn:other')/shop/item) ! string(key('id', 'a1')/@cat), ' ')`, "book tool book tool other", ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Documents = map[string]*goxml.XMLDocument{"urn:other": other}
+		for _, def := range [][4]string{
+			{"id", "item", "@id", ""},
+			{"cat", "item", "tokenize(@cat)", ""},
+			{"name", "item", "name", HTMLAsciiCaseInsensitiveURI},
+			{"price", "item", "xs:decimal(price)", ""},
+			{"section", "section/item", "@id", ""},
+			{"attr", "@id", ".", ""},
+			{"day", "item", "if (@id = 'a1') then xs:date('1500-01-01') else if (@id = 'b2') then xs:date('2500-01-01Z') else xs:date('2500-01-01')", ""},
+		} {
+			if err := np.Ctx.DefineKey(def[0], def[1], def[2], def[3]); err != nil {
+				t.Fatalf("DefineKey(%q): %s", def[0], err)
+			}
+		}
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = np.Ctx.DefineKey("bad", "item[", "@id", ""); err == nil {
+		t.Errorf("DefineKey with an invalid pattern succeeded")
+	}
+	if err = np.Ctx.DefineKey("bad", "item", "@id", "http://example.com/unknown"); err == nil {
+		t.Errorf("DefineKey with an unknown collation succeeded")
+	}
+	if err = np.Ctx.DefineKey("id", "item", "@id", ""); err != nil {
+		t.Fatal(err)
+	}
+	// the table is built once and used by copies of the context
+	if _, err = np.Evaluate(`key('id', 'a1')`); err != nil {
+		t.Fatal(err)
+	}
+	kd := np.Ctx.keys["id"]
+	if len(kd.tables) != 1 {
+		t.Errorf("key table built for %d documents, want 1", len(kd.tables))
+	}
+	cp := CopyContext(np.Ctx)
+	if cp.keys["id"] != kd {
+		t.Errorf("CopyContext does not share the key definitions")
+	}
+	// keys defined on a copy are not visible in the original
+	if err = cp.DefineKey("cat", "item", "@cat", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = cp.DefineKey("id", "item", "name", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := np.Ctx.keys["cat"]; ok {
+		t.Errorf("key defined on a copy is visible in the original")
+	}
+	if np.Ctx.keys["id"] != kd {
+		t.Errorf("key redefined on a copy changes the original")
+	}
+}
@@ -0,0 +1,250 @@
+package goxpath
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sync"
+)
+
+// FunctionLibrary is a set of XPath functions. A Context or an Expression
+// with a library resolves function calls in the library instead of in the
+// globally registered functions, so the functions available to an
+// expression can differ between the tenants of a service without affecting
+// other goroutines.
+//
+// A library can extend other libraries. Its own functions take precedence
+// over those of the libraries it extends, and a function removed from it is
+// hidden even if an extended library has it. All methods are safe for
+// concurrent use, except on the library returned by DefaultFunctions.
+type FunctionLibrary struct {
+	mu      sync.RWMutex
+	funcs   map[string][]*Function // overloads ordered by MinArg
+	removed map[string]bool
+	parents []*FunctionLibrary
+	allow   func(*Function) bool // filters the functions of the parents
+}
+
+// defaultLibrary holds the built-in functions and the functions registered
+// with RegisterFunction.
+var defaultLibrary = &FunctionLibrary{funcs: xpathfunctions}
+
+// DefaultFunctions returns the library of the built-in functions and the
+// functions registered with RegisterFunction and RegisterGoFunc. It is used
+// when neither the Context nor the Expression has a library of its own.
+// Changing it is equivalent to calling RegisterFunction and must not happen
+// while expressions are evaluated.
+func DefaultFunctions() *FunctionLibrary {
+	return defaultLibrary
+}
+
+// NewFunctionLibrary returns an empty library that extends the given
+// libraries. Functions are looked up in the extended libraries in order.
+//
+//	lib := goxpath.NewFunctionLibrary(goxpath.DefaultFunctions())
+//	lib.Register(&goxpath.Function{Name: "tenant", Namespace: ns, F: ...})
+func NewFunctionLibrary(extends ...*FunctionLibrary) *FunctionLibrary {
+	return &FunctionLibrary{
+		funcs:   make(map[string][]*Function),
+		parents: slices.Clone(extends),
+	}
+}
+
+// Register adds f to the library. Functions with the same namespace and
+// name are overloads if they accept different numbers of arguments. A
+// function with the same name that accepts one of the numbers of arguments
+// of f, also one of an extended library, is replaced. After Remove, the
+// functions of the extended libraries stay hidden. f is not changed; if its
+// arity is taken from the signature, the library holds a copy.
+func (l *FunctionLibrary) Register(f *Function) {
+	f = f.withArity()
+	key := f.Namespace + " " + f.Name
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.funcs[key] = addOverload(l.funcs[key], f)
+}
+
+// RegisterGoFunc adds the Go function fn as the XPath function name in the
+// namespace ns to the library. See GoFunction for the supported signatures.
+func (l *FunctionLibrary) RegisterGoFunc(ns, name string, fn any) error {
+	f, err := GoFunction(ns, name, fn)
+	if err != nil {
+		return err
+	}
+	l.Register(f)
+	return nil
+}
+
+// Remove removes all overloads of the function from the library. Functions
+// of an extended library with the same namespace and name are hidden as
+// well, also after the function is registered in l again.
+func (l *FunctionLibrary) Remove(ns, name string) {
+	key := ns + " " + name
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.funcs, key)
+	if l.removed == nil {
+		l.removed = make(map[string]bool)
+	}
+	l.removed[key] = true
+}
+
+// Restrict returns a library that extends l but only contains the functions
+// of l for which allow returns true. Functions registered in l later are
+// subject to the same restriction, functions registered in the returned
+// library are not.
+//
+//	safe := goxpath.DefaultFunctions().Restrict(func(f *goxpath.Function) bool {
+//		return f.Name != "doc" && f.Name != "environment-variable"
+//	})
+func (l *FunctionLibrary) Restrict(allow func(*Function) bool) *FunctionLibrary {
+	r := NewFunctionLibrary(l)
+	r.allow = allow
+	return r
+}
+
+// Lookup returns the function namespace:name or nil if the library does not
+// contain it. If the function is overloaded, one of the overloads is
+// returned, see LookupArity.
+func (l *FunctionLibrary) Lookup(ns, name string) *Function {
+	return l.lookup(ns+" "+name, -1)
+}
+
+// LookupArity returns the overload of the function namespace:name that
+// accepts arity arguments or nil if there is none.
+func (l *FunctionLibrary) LookupArity(ns, name string, arity int) *Function {
+	return l.lookup(ns+" "+name, arity)
+}
+
+// lookup returns the function for the key namespace+" "+name that accepts
+// arity arguments. A negative arity accepts any function.
+func (l *FunctionLibrary) lookup(key string, arity int) *Function {
+	if l == defaultLibrary {
+		return selectOverload(xpathfunctions[key], arity)
+	}
+	l.mu.RLock()
+	f := selectOverload(l.funcs[key], arity)
+	removed := l.removed[key]
+	l.mu.RUnlock()
+	if f != nil {
+		return f
+	}
+	if removed {
+		return nil
+	}
+	for _, p := range l.parents {
+		if f = p.lookup(key, arity); f != nil {
+			if l.allow != nil && !l.allow(f) {
+				return nil
+			}
+			return f
+		}
+	}
+	return nil
+}
+
+// Functions returns all functions of the library ordered by namespace, name
+// and number of arguments.
+func (l *FunctionLibrary) Functions() []*Function {
+	keys := make(map[string]bool)
+	l.keys(keys)
+	var fns []*Function
+	for key := range keys {
+		fns = append(fns, l.overloads(key)...)
+	}
+	sortFunctions(fns)
+	return fns
+}
+
+// keys adds the keys of all functions of l and the extended libraries to
+// keys.
+func (l *FunctionLibrary) keys(keys map[string]bool) {
+	for _, p := range l.parents {
+		p.keys(keys)
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for key := range l.funcs {
+		keys[key] = true
+	}
+}
+
+// overloads returns the overloads of the function with the given key that
+// are visible in l.
+func (l *FunctionLibrary) overloads(key string) []*Function {
+	l.mu.RLock()
+	fns := slices.Clone(l.funcs[key])
+	removed := l.removed[key]
+	l.mu.RUnlock()
+	if removed || l == defaultLibrary {
+		return fns
+	}
+	for _, p := range l.parents {
+		for _, f := range p.overloads(key) {
+			if l.allow != nil && !l.allow(f) || slices.ContainsFunc(fns, f.overlaps) {
+				continue
+			}
+			fns = append(fns, f)
+		}
+	}
+	return fns
+}
+
+// functionMap returns the functions keyed by namespace+" "+name.
+func functionMap(fns []*Function) map[string][]*Function {
+	m := make(map[string][]*Function, len(fns))
+	for _, f := range fns {
+		key := f.Namespace + " " + f.Name
+		m[key] = addOverload(m[key], f.withArity())
+	}
+	return m
+}
+
+// addOverload returns a copy of fns with f added, replacing the functions
+// that accept one of the numbers of arguments f accepts. The result is
+// ordered by MinArg.
+func addOverload(fns []*Function, f *Function) []*Function {
+	ret := make([]*Function, 0, len(fns)+1)
+	for _, g := range fns {
+		if !g.overlaps(f) {
+			ret = append(ret, g)
+		}
+	}
+	ret = append(ret, f)
+	slices.SortFunc(ret, func(a, b *Function) int { return cmp.Compare(a.MinArg, b.MinArg) })
+	return ret
+}
+
+// selectOverload returns the function of fns that accepts arity arguments,
+// or the first one if arity is negative.
+func selectOverload(fns []*Function, arity int) *Function {
+	for _, f := range fns {
+		if arity < 0 || f.acceptsArity(arity) {
+			return f
+		}
+	}
+	return nil
+}
+
+// overlaps reports whether f and g accept a common number of arguments.
+func (f *Function) overlaps(g *Function) bool {
+	fmin, fmax := f.arityRange()
+	gmin, gmax := g.arityRange()
+	return fmin <= gmax && gmin <= fmax
+}
+
+// arityRange returns the smallest and the largest number of arguments f
+// accepts.
+func (f *Function) arityRange() (int, int) {
+	lo, hi := max(f.MinArg, 0), f.MaxArg
+	if hi < 0 {
+		hi = math.MaxInt
+	}
+	return lo, hi
+}
+
+func sortFunctions(fns []*Function) {
+	slices.SortFunc(fns, func(a, b *Function) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name), cmp.Compare(a.MinArg, b.MinArg))
+	})
+}
@@ -0,0 +1,241 @@
+package goxpath
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFunctionLibrary(t *testing.T) {
+	const ns = "urn:goxpath:test:library"
+	tenant := NewFunctionLibrary(DefaultFunctions())
+	tenant.Register(&Function{Name: "tenant", Namespace: ns, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		return Sequence{"a"}, nil
+	}})
+	tenant.Register(&Function{Name: "upper-case", Namespace: nsFN, MinArg: 1, MaxArg: 1, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		return Sequence{"upper"}, nil
+	}})
+	if err := tenant.RegisterGoFunc(ns, "twice", func(i int) int { return 2 * i }); err != nil {
+		t.Fatal(err)
+	}
+	restricted := tenant.Restrict(func(f *Function) bool { return f.Name != "lower-case" })
+	restricted.Remove(nsFN, "string-length")
+
+	testdata := []struct {
+		lib    *FunctionLibrary
+		input  string
+		output string
+		code   string
+	}{
+		{nil, `t:tenant()`, "", "XPST0017"},
+		{nil, `upper-case('a')`, "A", ""},
+		{tenant, `t:tenant()`, "a", ""},
+		{tenant, `t:twice(/root/@one)`, "2", ""},
+		{tenant, `upper-case('a')`, "upper", ""},
+		{tenant, `concat(upper-case('a'), '!')`, "upper!", ""},
+		{tenant, `string-length(upper-case('a')) + 1`, "6", ""},
+		{tenant, `lower-case('A')`, "a", ""},
+		{tenant, `function-lookup(xs:QName('fn:upper-case'), 1)('a')`, "upper", ""},
+		{restricted, `t:tenant()`, "a", ""},
+		{restricted, `upper-case('a')`, "upper", ""},
+		{restricted, `lower-case('A')`, "", "XPST0017"},
+		{restricted, `string-length('abc')`, "", "XPST0017"},
+		{restricted, `empty(function-lookup(xs:QName('fn:lower-case'), 1))`, "true", ""},
+		{restricted, `count((1, 2))`, "2", ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Namespaces["t"] = ns
+		np.Ctx.Library = td.lib
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	if f := restricted.Lookup(nsFN, "lower-case"); f != nil {
+		t.Errorf("restricted.Lookup(lower-case) = %s", f)
+	}
+	if f := DefaultFunctions().Lookup(ns, "tenant"); f != nil {
+		t.Errorf("DefaultFunctions().Lookup(tenant) = %s", f)
+	}
+	fns := restricted.Functions()
+	names := make(map[string]bool)
+	for i, f := range fns {
+		if i > 0 && (fns[i-1].Namespace > f.Namespace || fns[i-1].Namespace == f.Namespace && fns[i-1].Name > f.Name) {
+			t.Fatalf("Functions is not sorted: %s before %s", fns[i-1], f)
+		}
+		names[f.Name] = true
+	}
+	for name, want := range map[string]bool{"tenant": true, "count": true, "lower-case": false, "string-length": false} {
+		if names[name] != want {
+			t.Errorf("Functions contains %s: %t, want %t", name, names[name], want)
+		}
+	}
+}
+
+func TestFunctionLibraryExpression(t *testing.T) {
+	const ns = "urn:goxpath:test:library"
+	lib := NewFunctionLibrary(DefaultFunctions())
+	lib.Register(&Function{Name: "answer", Namespace: ns, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		return Sequence{42}, nil
+	}})
+	sc := NewStaticContext()
+	sc.Namespaces["t"] = ns
+	if _, err := Compile(`t:answer()`, sc); err == nil {
+		t.Errorf("Compile(t:answer()) without library succeeded")
+	}
+	sc.Library = lib
+	expr, err := Compile(`t:answer() + string-length('ab')`, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := expr.Evaluate(np.Ctx)
+	if err != nil || len(seq) != 1 || !itemsEqual(seq[0], 44) {
+		t.Errorf("t:answer() + 2 = %v, %v, want 44", seq, err)
+	}
+	if np.Ctx.Library != nil {
+		t.Errorf("Evaluate did not restore the library of the context")
+	}
+	sc.Library = lib.Restrict(func(f *Function) bool { return f.Name != "string-length" })
+	if _, err = Compile(`string-length('ab')`, sc); err == nil {
+		t.Errorf("Compile(string-length()) with a restricted library succeeded")
+	}
+}
+
+func TestFunctionOverloads(t *testing.T) {
+	const ns = "urn:goxpath:test:overloads"
+	one := &Function{Name: "f", Namespace: ns, Signature: MustParseSignature(`(xs:string) as xs:string`),
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			return Sequence{"one:" + args[0][0].(string)}, nil
+		}}
+	two := &Function{Name: "f", Namespace: ns, Signature: MustParseSignature(`(xs:integer, xs:integer) as xs:string`),
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			return Sequence{"two"}, nil
+		}}
+	RegisterFunction(one)
+	RegisterFunction(two)
+	RegisterFunction(&Function{Name: "f", Namespace: ns, MinArg: 2, MaxArg: 2, DynamicCallError: "XPDY0050",
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			return Sequence{"two:" + itemStringvalue(args[0][0]) + itemStringvalue(args[1][0])}, nil
+		}})
+	lib := NewFunctionLibrary(DefaultFunctions())
+	lib.Register(&Function{Name: "f", Namespace: ns, MinArg: 1, MaxArg: 1,
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			return Sequence{"tenant"}, nil
+		}})
+	// registering after Remove keeps the overloads of DefaultFunctions hidden
+	masked := NewFunctionLibrary(DefaultFunctions())
+	masked.Remove(ns, "f")
+	masked.Register(&Function{Name: "f", Namespace: ns, MinArg: 1, MaxArg: 1,
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			return Sequence{"masked"}, nil
+		}})
+
+	testdata := []struct {
+		lib    *FunctionLibrary
+		input  string
+		output string
+		code   string
+	}{
+		{nil, `o:f('a')`, "one:a", ""},
+		{nil, `o:f(1, 2)`, "two:12", ""},
+		{nil, `o:f(1)`, "", "XPTY0004"},
+		{nil, `o:f()`, "", "XPST0017"},
+		{nil, `o:f(1, 2, 3)`, "", "XPST0017"},
+		{nil, `o:f#1('b')`, "one:b", ""},
+		{nil, `o:f#1(1)`, "", "XPTY0004"},
+		{nil, `o:f#2(1, 2)`, "", "XPDY0050"},
+		{nil, `o:f#3`, "", "XPST0017"},
+		{nil, `function-arity(o:f#2)`, "2", ""},
+		{nil, `function-lookup(QName('` + ns + `', 'f'), 1)('c')`, "one:c", ""},
+		{nil, `function-lookup(QName('` + ns + `', 'f'), 2)(1, 2)`, "", "XPDY0050"},
+		{nil, `empty(function-lookup(QName('` + ns + `', 'f'), 3))`, "true", ""},
+		{nil, `Q{` + ns + `}f(3, 4)`, "two:34", ""},
+		{lib, `o:f('a')`, "tenant", ""},
+		{lib, `o:f(1, 2)`, "two:12", ""},
+		{masked, `o:f('a')`, "masked", ""},
+		{masked, `o:f(1, 2)`, "", "XPST0017"},
+		{masked, `empty(function-lookup(QName('` + ns + `', 'f'), 2))`, "true", ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Namespaces["o"] = ns
+		np.Ctx.Library = td.lib
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := np.Ctx.LookupFunctionArity(ns, "f", 1); f == nil || f.Signature != one.Signature {
+		t.Errorf("LookupFunctionArity(f, 1) = %v, want %s", f, one)
+	}
+	if one.MinArg != 0 || one.MaxArg != 0 {
+		t.Errorf("RegisterFunction changed the arity of f to %d-%d", one.MinArg, one.MaxArg)
+	}
+	if f := np.Ctx.LookupFunctionArity(ns, "f", 2); f == nil || f == two || f.DynamicCallError != "XPDY0050" {
+		t.Errorf("LookupFunctionArity(f, 2) = %v, want the last registration", f)
+	}
+	if f := np.Ctx.LookupFunctionArity(ns, "f", 3); f != nil {
+		t.Errorf("LookupFunctionArity(f, 3) = %s", f)
+	}
+	count := 0
+	for _, f := range RegisteredFunctions() {
+		if f.Namespace == ns {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Errorf("RegisteredFunctions contains %d overloads of f, want 2", count)
+	}
+	if fns := lib.Functions(); !slices.ContainsFunc(fns, func(f *Function) bool { return f.Namespace == ns && f.MinArg == 2 }) {
+		t.Errorf("lib.Functions() does not contain f#2")
+	}
+	if fns := masked.Functions(); slices.ContainsFunc(fns, func(f *Function) bool { return f.Namespace == ns && f.MinArg == 2 }) {
+		t.Errorf("masked.Functions() contains the removed f#2")
+	}
+
+	sc := NewStaticContext()
+	sc.Namespaces["o"] = ns
+	if _, err = Compile(`o:f('a') || o:f(1, 2)`, sc); err != nil {
+		t.Errorf("Compile(o:f#1, o:f#2): %s", err)
+	}
+	if _, err = Compile(`o:f(1, 2, 3)`, sc); err == nil {
+		t.Errorf("Compile(o:f(1, 2, 3)) succeeded")
+	}
+}
@@ -0,0 +1,162 @@
+package goxpath
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Limits restricts the resources that a single evaluation may use. A zero
+// field means no limit. An evaluation that exceeds a limit fails with an
+// XPathError:
+//
+//	GOXP0001  the context.Context passed to EvaluateContext was cancelled or its deadline passed
+//	GOXP0002  a sequence has more than MaxSequenceLength items
+//	GOXP0003  function items are nested deeper than MaxRecursionDepth
+//	GOXP0004  more than MaxItems items were produced
+//
+// Limits are enforced by the Evaluate methods of Parser and Expression, not
+// when an EvalFunc is called directly.
+type Limits struct {
+	// MaxSequenceLength is the maximum number of items in the result of a
+	// subexpression.
+	MaxSequenceLength int
+	// MaxRecursionDepth is the maximum number of nested calls of inline
+	// functions.
+	MaxRecursionDepth int
+	// MaxItems is the maximum number of items that the evaluation may
+	// create in total. Items are counted where they are created: by steps,
+	// ranges, for expressions and sequence construction.
+	MaxItems int
+}
+
+// evalState holds the state of one evaluation that is shared by all copies
+// of the context. Parallel iterations get a fork with a depth of their own.
+type evalState struct {
+	ctx    context.Context
+	done   <-chan struct{}
+	limits Limits
+	items  *atomic.Int64
+	depth  int
+}
+
+// fork returns the state for a parallel iteration of the evaluation.
+func (st *evalState) fork() *evalState {
+	if st == nil {
+		return nil
+	}
+	forked := *st
+	return &forked
+}
+
+// beginEval prepares the frame ctx for an evaluation that can be cancelled
+// with c and is restricted by ctx.Limits.
+func (ctx *Context) beginEval(c context.Context) error {
+	if err := c.Err(); err != nil {
+		return cancelError(c)
+	}
+	if c.Done() == nil && ctx.Limits == (Limits{}) {
+		ctx.eval = nil
+	} else {
+		ctx.eval = &evalState{ctx: c, done: c.Done(), limits: ctx.Limits, items: new(atomic.Int64)}
+	}
+	return nil
+}
+
+func cancelError(c context.Context) error {
+	return NewXPathError("GOXP0001", fmt.Sprintf("evaluation aborted: %s", c.Err()))
+}
+
+// check returns an error if the evaluation has been cancelled.
+func (st *evalState) check() error {
+	if st.done == nil {
+		return nil
+	}
+	select {
+	case <-st.done:
+		return cancelError(st.ctx)
+	default:
+		return nil
+	}
+}
+
+// checkLength returns an error if a result of n items would exceed the
+// limits.
+func (st *evalState) checkLength(n int) error {
+	if err := st.checkSequenceLength(n); err != nil {
+		return err
+	}
+	if max := st.limits.MaxItems; max > 0 && int(st.items.Load())+n > max {
+		return NewXPathError("GOXP0004", fmt.Sprintf("evaluation exceeds the limit of %d items", max))
+	}
+	return nil
+}
+
+// checkSequenceLength returns an error if a result of n items is longer
+// than MaxSequenceLength.
+func (st *evalState) checkSequenceLength(n int) error {
+	if max := st.limits.MaxSequenceLength; max > 0 && n > max {
+		return NewXPathError("GOXP0002", fmt.Sprintf("sequence of %d items exceeds the limit of %d items", n, max))
+	}
+	return nil
+}
+
+// produced accounts for a result of n items.
+func (st *evalState) produced(n int) error {
+	if err := st.checkLength(n); err != nil {
+		return err
+	}
+	st.items.Add(int64(n))
+	return nil
+}
+
+// checkEval returns an error if the evaluation has been cancelled. It is
+// used in loops that do not evaluate subexpressions, such as axis walks.
+func (ctx *Context) checkEval() error {
+	if ctx.eval == nil {
+		return nil
+	}
+	return ctx.eval.check()
+}
+
+// checkEvery is checkEval for the i-th iteration of a tight loop. It only
+// looks at the state every 1024 iterations.
+func (ctx *Context) checkEvery(i int) error {
+	if ctx.eval == nil || i&1023 != 0 {
+		return nil
+	}
+	return ctx.eval.check()
+}
+
+// checkLength returns an error if a sequence of n items would exceed the
+// limits. It is used before large sequences are allocated.
+func (ctx *Context) checkLength(n int) error {
+	if ctx.eval == nil {
+		return nil
+	}
+	return ctx.eval.checkLength(n)
+}
+
+// enterCall records the call of a function item and returns an error if the
+// calls are nested too deeply. Each successful call must be paired with
+// leaveCall.
+func (ctx *Context) enterCall() error {
+	st := ctx.eval
+	if st == nil {
+		return nil
+	}
+	if err := st.check(); err != nil {
+		return err
+	}
+	if max := st.limits.MaxRecursionDepth; max > 0 && st.depth >= max {
+		return NewXPathError("GOXP0003", fmt.Sprintf("function calls nested deeper than %d levels", max))
+	}
+	st.depth++
+	return nil
+}
+
+func (ctx *Context) leaveCall() {
+	if ctx.eval != nil {
+		ctx.eval.depth--
+	}
+}
@@ -0,0 +1,93 @@
+package goxpath
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateContext(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = np.EvaluateContext(ctx, `count(//sub)`); err == nil {
+		t.Fatal("EvaluateContext with a cancelled context succeeded")
+	}
+	if code, _ := XPathErrorCode(err); code != "GOXP0001" {
+		t.Errorf("error code = %q, want GOXP0001 (%s)", code, err)
+	}
+
+	// $big is bound beforehand, so the loops and functions themselves must
+	// notice the deadline
+	big := make(Sequence, 2000000)
+	for i := range big {
+		big[i] = len(big) - i
+	}
+	np.SetVariable("big", big)
+	for _, expr := range []string{
+		`sum((1 to 5000000) ! (for $i in 1 to 100 return $i))`,
+		`string-join($big ! 'x')`,
+		`count(for $i in $big return 1)`,
+		`count($big[. mod 2 = 0])`,
+		`some $i in $big satisfies $i < 0`,
+		`count(sort($big))`,
+		`count(reverse(($big, $big, $big, $big, $big)))`,
+		`count(1 to 9000000)`,
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		_, err = np.EvaluateContext(ctx, expr)
+		cancel()
+		if code, _ := XPathErrorCode(err); code != "GOXP0001" {
+			t.Errorf("%s: error code = %q, want GOXP0001 (%v)", expr, code, err)
+		}
+		// generous, so that the test passes with the race detector
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: evaluation took %s after the deadline", expr, d)
+		}
+	}
+
+	seq, err := np.EvaluateContext(context.Background(), `count(//sub)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seq) != 1 || !itemsEqual(seq[0], 7) {
+		t.Errorf("count(//sub) = %v, want 7", seq)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	testdata := []struct {
+		input  string
+		limits Limits
+		code   string
+	}{
+		{`count(1 to 1000)`, Limits{MaxSequenceLength: 100}, "GOXP0002"},
+		{`count((1 to 10) ! (1 to 20))`, Limits{MaxSequenceLength: 100}, "GOXP0002"},
+		{`count((1 to 10) ! (1 to 20))`, Limits{MaxSequenceLength: 200}, ""},
+		{`let $f := function($f, $n) { if ($n = 0) then 0 else $f($f, $n - 1) } return $f($f, 100)`, Limits{MaxRecursionDepth: 50}, "GOXP0003"},
+		{`let $f := function($f, $n) { if ($n = 0) then 0 else $f($f, $n - 1) } return $f($f, 10)`, Limits{MaxRecursionDepth: 50}, ""},
+		{`sum((1 to 100) ! (1 to 100))`, Limits{MaxItems: 5000}, "GOXP0004"},
+		{`sum((1 to 10) ! (1 to 10))`, Limits{MaxItems: 5000}, ""},
+		{`count((1 to 10)[. > 0][. > 0])`, Limits{MaxItems: 11}, ""},
+		{`count((1 to 10)[. > 0][. > 0])`, Limits{MaxItems: 9}, "GOXP0004"},
+		{`count(((1 to 60), (1 to 60)))`, Limits{MaxSequenceLength: 100}, "GOXP0002"},
+		{`count(((1 to 60), (1 to 30)))`, Limits{MaxSequenceLength: 100}, ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Limits = td.limits
+		_, err = np.Evaluate(td.input)
+		code, _ := XPathErrorCode(err)
+		if code != td.code {
+			t.Errorf("%s: error code = %q, want %q (%v)", td.input, code, td.code, err)
+		}
+	}
+}
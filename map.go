@@ -1,6 +1,10 @@
 package goxpath
 
-import "fmt"
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
 
 const nsMap = "http://www.w3.org/2005/xpath-functions/map"
 
@@ -10,22 +14,124 @@ type MapEntry struct {
 	Value Sequence
 }
 
-// XPathMap represents an XPath 3.1 map.
+// XPathMap represents an XPath 3.1 map. Entries holds the entries in the
+// order in which the keys were added. Keys are compared by the rules of
+// op:same-key: 1 and 1.0 are the same key, 1 and "1" are not.
+//
+// The maps created by this package are immutable and indexed by a hash of
+// the keys. Put and Remove return a new map that shares the index and, for
+// a new key, the entries with the original, so building a map entry by entry
+// takes linear time. Replacing or removing a key copies the entries. The
+// entries of such a map must not be changed. A map built with a composite
+// literal is searched linearly until it is extended with Put or Remove.
 type XPathMap struct {
 	Entries []MapEntry
+	index   *hamtNode     // the keys with their insertion numbers
+	orders  []uint64      // the insertion numbers of Entries, ascending
+	used    *atomic.Int64 // the length in use of the arrays behind Entries and orders
 }
 
-// Get looks up a key in the map by comparing string values.
+// NewXPathMap returns a map with the given entries. If several entries have
+// the same key, the last value is used.
+func NewXPathMap(entries ...MapEntry) *XPathMap {
+	m := &XPathMap{}
+	for _, e := range entries {
+		m = m.Put(e.Key, e.Value)
+	}
+	return m
+}
+
+// isIndexed reports whether the index of m covers Entries.
+func (m *XPathMap) isIndexed() bool {
+	return len(m.orders) == len(m.Entries) && (m.index != nil || len(m.Entries) == 0)
+}
+
+// indexed returns m if it is indexed and an indexed copy of m otherwise.
+func (m *XPathMap) indexed() *XPathMap {
+	if m.isIndexed() {
+		return m
+	}
+	return NewXPathMap(m.Entries...)
+}
+
+// find returns the position of the key in Entries.
+func (m *XPathMap) find(hash uint64, key any) (int, bool) {
+	e := m.index.get(hash, key, 0)
+	if e == nil {
+		return 0, false
+	}
+	return slices.BinarySearch(m.orders, e.order)
+}
+
+// Get returns the value of the entry with the given key.
 func (m *XPathMap) Get(key Item) (Sequence, bool) {
-	keyStr := itemStringvalue(key)
-	for _, entry := range m.Entries {
-		if itemStringvalue(entry.Key) == keyStr {
-			return entry.Value, true
+	k := mapKey(key)
+	if !m.isIndexed() {
+		var val Sequence
+		found := false
+		for _, entry := range m.Entries {
+			if mapKey(entry.Key) == k {
+				val, found = entry.Value, true
+			}
 		}
+		return val, found
+	}
+	if i, ok := m.find(hashMapKey(k), k); ok {
+		return m.Entries[i].Value, true
 	}
 	return nil, false
 }
 
+// Put returns a map with the key set to value. A new key is added after the
+// existing entries, an existing key keeps its position.
+func (m *XPathMap) Put(key Item, value Sequence) *XPathMap {
+	m = m.indexed()
+	k := mapKey(key)
+	hash := hashMapKey(k)
+	entry := MapEntry{Key: key, Value: value}
+	n := len(m.Entries)
+	if i, ok := m.find(hash, k); ok {
+		entries := slices.Clone(m.Entries)
+		entries[i] = entry
+		return &XPathMap{Entries: entries, index: m.index, orders: slices.Clip(m.orders)}
+	}
+	var order uint64
+	if n > 0 {
+		order = m.orders[n-1] + 1
+	}
+	index, _ := m.index.put(hash, &hamtEntry{key: k, order: order}, 0)
+	// The first map that grows into the free capacity of the arrays claims
+	// it, the others copy.
+	if m.used != nil && n < cap(m.Entries) && n < cap(m.orders) && m.used.CompareAndSwap(int64(n), int64(n+1)) {
+		return &XPathMap{Entries: append(m.Entries, entry), index: index, orders: append(m.orders, order), used: m.used}
+	}
+	used := new(atomic.Int64)
+	used.Store(int64(n + 1))
+	return &XPathMap{
+		Entries: append(slices.Clip(m.Entries), entry),
+		index:   index,
+		orders:  append(slices.Clip(m.orders), order),
+		used:    used,
+	}
+}
+
+// Remove returns a map without the entry with the given key.
+func (m *XPathMap) Remove(key Item) *XPathMap {
+	m = m.indexed()
+	k := mapKey(key)
+	hash := hashMapKey(k)
+	i, ok := m.find(hash, k)
+	if !ok {
+		return m
+	}
+	index, _ := m.index.remove(hash, k, 0)
+	return &XPathMap{
+		Entries: slices.Delete(slices.Clone(m.Entries), i, i+1),
+		index:   index,
+		orders:  slices.Delete(slices.Clone(m.orders), i, i+1),
+	}
+}
+
 // Keys returns all keys in the map as a Sequence.
 func (m *XPathMap) Keys() Sequence {
 	seq := make(Sequence, len(m.Entries))
@@ -111,42 +217,20 @@ func fnMapPut(ctx *Context, args []Sequence) (Sequence, error) {
 	if len(args[1]) != 1 {
 		return nil, fmt.Errorf("map:put expects a single key as second argument")
 	}
-	key := args[1][0]
-	value := args[2]
-
-	// Create a new map with the entry added/replaced
-	keyStr := itemStringvalue(key)
-	newEntries := make([]MapEntry, 0, len(m.Entries)+1)
-	replaced := false
-	for _, entry := range m.Entries {
-		if itemStringvalue(entry.Key) == keyStr {
-			newEntries = append(newEntries, MapEntry{Key: key, Value: value})
-			replaced = true
-		} else {
-			newEntries = append(newEntries, entry)
-		}
-	}
-	if !replaced {
-		newEntries = append(newEntries, MapEntry{Key: key, Value: value})
-	}
-	return Sequence{&XPathMap{Entries: newEntries}}, nil
+	return Sequence{m.Put(args[1][0], args[2])}, nil
 }
 
 func fnMapMerge(ctx *Context, args []Sequence) (Sequence, error) {
 	// args[0] is a sequence of maps
 	result := &XPathMap{}
-	seen := make(map[string]bool)
-
 	for _, itm := range args[0] {
 		m, ok := itm.(*XPathMap)
 		if !ok {
 			return nil, fmt.Errorf("map:merge expects a sequence of maps, got %T", itm)
 		}
 		for _, entry := range m.Entries {
-			keyStr := itemStringvalue(entry.Key)
-			if !seen[keyStr] {
-				seen[keyStr] = true
-				result.Entries = append(result.Entries, entry)
+			if !result.Contains(entry.Key) {
+				result = result.Put(entry.Key, entry.Value)
 			}
 		}
 	}
@@ -164,7 +248,7 @@ func init() {
 		if len(args[0]) != 1 {
 			return nil, fmt.Errorf("map:entry: key must be a single item")
 		}
-		return Sequence{&XPathMap{Entries: []MapEntry{{Key: args[0][0], Value: args[1]}}}}, nil
+		return Sequence{NewXPathMap(MapEntry{Key: args[0][0], Value: args[1]})}, nil
 	}, MinArg: 2, MaxArg: 2})
 	RegisterFunction(&Function{Name: "remove", Namespace: nsMap, F: func(ctx *Context, args []Sequence) (Sequence, error) {
 		if len(args[0]) != 1 {
@@ -174,18 +258,10 @@ func init() {
 		if !ok {
 			return nil, fmt.Errorf("map:remove: first argument must be a map")
 		}
-		// Collect keys to remove
-		removeKeys := make(map[string]bool)
 		for _, key := range args[1] {
-			removeKeys[itemStringvalue(key)] = true
-		}
-		var newEntries []MapEntry
-		for _, entry := range m.Entries {
-			if !removeKeys[itemStringvalue(entry.Key)] {
-				newEntries = append(newEntries, entry)
-			}
+			m = m.Remove(key)
 		}
-		return Sequence{&XPathMap{Entries: newEntries}}, nil
+		return Sequence{m}, nil
 	}, MinArg: 2, MaxArg: 2})
 	RegisterFunction(&Function{Name: "find", Namespace: nsMap, F: func(ctx *Context, args []Sequence) (Sequence, error) {
 		if len(args[1]) != 1 {
@@ -139,6 +139,107 @@ func TestMapFunctions(t *testing.T) {
 	}
 }
 
+func TestMapSameKey(t *testing.T) {
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`map:size(map:put(map { 1: 'a' }, '1', 'b'))`, "2", ""},
+		{`map:contains(map { '1': 'a' }, 1)`, "false", ""},
+		{`map { 1: 'a' }(1.0)`, "a", ""},
+		{`map { 1: 'a' }(xs:double(1))`, "a", ""},
+		{`map { 1.5: 'a' }(xs:float(1.5))`, "a", ""},
+		{`map { xs:double('NaN'): 'nan' }(xs:double('NaN'))`, "nan", ""},
+		{`map { xs:anyURI('urn:x'): 'uri' }('urn:x')`, "uri", ""},
+		{`map { true(): 'yes' }(true())`, "yes", ""},
+		{`map:contains(map { true(): 'yes' }, 'true')`, "false", ""},
+		{`map { xs:dateTime('2024-01-01T12:00:00Z'): 'x' }(xs:dateTime('2024-01-01T13:00:00+01:00'))`, "x", ""},
+		{`map:contains(map { xs:dateTime('2024-01-01T12:00:00Z'): 'x' }, adjust-dateTime-to-timezone(xs:dateTime('2024-01-01T12:00:00Z'), ()))`, "false", ""},
+		{`map:size(map:put(map { xs:dateTime('2024-01-01T12:00:00Z'): 'x' }, adjust-dateTime-to-timezone(xs:dateTime('2024-01-01T12:00:00Z'), ()), 'y'))`, "2", ""},
+		{`map { xs:dateTime('2020-01-01T00:00:00'): 'x' }(xs:dateTime('2020-01-01T00:00:00'))`, "x", ""},
+		{`map:size(map:put(map { xs:date('2020-01-01Z'): 1 }, xs:date('2020-01-01'), 2))`, "2", ""},
+		{`map { xs:date('2024-01-01'): 'd' }(xs:date('2024-01-01'))`, "d", ""},
+		{`string-join(map:keys(map:put(map:put(map { 'b': 1, 'a': 2 }, 'c', 3), 'b', 4)), ' ')`, "b a c", ""},
+		{`map:put(map { 'b': 1, 'a': 2 }, 'b', 4)('b')`, "4", ""},
+		{`string-join(map:keys(map:remove(map { 'a': 1, 'b': 2, 'c': 3 }, 'b')), ' ')`, "a c", ""},
+		{`map:size(map:remove(map { 'a': 1 }, ('a', 'x')))`, "0", ""},
+		{`map:merge((map { 1: 'a' }, map { 1.0: 'b', 2: 'c' }))(1)`, "a", ""},
+		{`map:size(fold-left(1 to 2000, map { }, function($m, $i) { map:put($m, $i, $i * 2) }))`, "2000", ""},
+		{`fold-left(1 to 2000, map { }, function($m, $i) { map:put($m, $i, $i * 2) })(1234)`, "2468", ""},
+		{`map { 1: 'a', 1.0: 'b' }`, "", "XQDY0137"},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+}
+
+func TestXPathMapPersistent(t *testing.T) {
+	const n = 5000
+	var versions []*XPathMap
+	m := &XPathMap{}
+	for i := range n {
+		m = m.Put(i, Sequence{i})
+		if i%1000 == 0 {
+			versions = append(versions, m)
+		}
+	}
+	if m.Size() != n {
+		t.Fatalf("Size() = %d, want %d", m.Size(), n)
+	}
+	for i, v := range versions {
+		if got := v.Size(); got != i*1000+1 {
+			t.Errorf("old version %d has %d entries, want %d", i, got, i*1000+1)
+		}
+		if v.Contains(i*1000 + 1) {
+			t.Errorf("old version %d contains a later key", i)
+		}
+	}
+	// remove the even keys and check the order of the rest
+	r := m
+	for i := 0; i < n; i += 2 {
+		r = r.Remove(XSInteger{V: i})
+	}
+	if r.Size() != n/2 || m.Size() != n {
+		t.Fatalf("sizes after Remove = %d and %d, want %d and %d", r.Size(), m.Size(), n/2, n)
+	}
+	for i, e := range r.Entries {
+		if want := 2*i + 1; e.Key != want {
+			t.Fatalf("Entries[%d].Key = %v, want %d", i, e.Key, want)
+		}
+	}
+	// maps derived from the same map do not see each other's new keys
+	a, b := m.Put("a", Sequence{1}), m.Put("b", Sequence{2})
+	if a.Contains("b") || b.Contains("a") || a.Entries[n].Key != "a" || b.Entries[n].Key != "b" {
+		t.Errorf("Put on the same map: %v and %v", a.Entries[n], b.Entries[n])
+	}
+	if r.Remove("missing") != r {
+		t.Errorf("Remove of a missing key returned a new map")
+	}
+	for i := range n {
+		if got := r.Contains(float64(i)); got != (i%2 == 1) {
+			t.Fatalf("Contains(%d) = %t", i, got)
+		}
+	}
+}
+
 func TestArrayFunctions(t *testing.T) {
 	testdata := []struct {
 		input  string
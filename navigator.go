@@ -2,10 +2,23 @@ package goxpath
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/speedata/goxml"
 )
 
+// attributesMu serializes the calls of goxml's Element.Attributes, which
+// builds the attribute list on first use, so that concurrent evaluations on
+// one document don't race.
+var attributesMu sync.Mutex
+
+// attributes returns the attributes of elt.
+func attributes(elt *goxml.Element) []*goxml.Attribute {
+	attributesMu.Lock()
+	defer attributesMu.Unlock()
+	return elt.Attributes()
+}
+
 func (ctx *Context) childAxis(tf testFunc) (Sequence, error) {
 	var seq Sequence
 	for _, n := range ctx.sequence {
@@ -17,7 +30,7 @@ func (ctx *Context) childAxis(tf testFunc) (Sequence, error) {
 				}
 			}
 		case *goxml.Element:
-			for _, cld := range t.Attributes() {
+			for _, cld := range attributes(t) {
 				if tf(ctx, cld) {
 					seq = append(seq, cld)
 				}
@@ -66,6 +79,9 @@ func (ctx *Context) childAxis(tf testFunc) (Sequence, error) {
 }
 
 func (ctx *Context) descendantOrSelfAxis(tf testFunc) (Sequence, error) {
+	if err := ctx.checkEval(); err != nil {
+		return nil, err
+	}
 	var seq Sequence
 	for _, n := range ctx.sequence {
 		switch t := n.(type) {
@@ -135,40 +151,30 @@ func (ctx *Context) descendantOrSelfAxis(tf testFunc) (Sequence, error) {
 }
 
 func (ctx *Context) descendantAxis(tf testFunc) (Sequence, error) {
+	if err := ctx.checkEval(); err != nil {
+		return nil, err
+	}
 	var seq Sequence
 	for _, n := range ctx.sequence {
 		switch t := n.(type) {
-		case *goxml.XMLDocument:
-			for _, cld := range t.Children() {
-				copysequence := ctx.sequence
-				ctx.sequence = Sequence{cld}
-				s, err := ctx.descendantAxis(tf)
-				if err != nil {
-					return nil, err
-				}
-				for _, itm := range s {
-					seq = append(seq, itm)
-				}
-				ctx.sequence = copysequence
-				if tf(ctx, cld) {
-					seq = append(seq, cld)
-				}
+		case *goxml.XMLDocument, *goxml.Element:
+			// The descendants of a node are the descendant-or-self
+			// nodes of its children, in document order.
+			var children []goxml.XMLNode
+			if doc, ok := t.(*goxml.XMLDocument); ok {
+				children = doc.Children()
+			} else {
+				children = t.(*goxml.Element).Children()
 			}
-		case *goxml.Element:
-			for _, cld := range t.Children() {
+			for _, cld := range children {
 				copysequence := ctx.sequence
 				ctx.sequence = Sequence{cld}
-				s, err := ctx.descendantAxis(tf)
+				s, err := ctx.descendantOrSelfAxis(tf)
 				if err != nil {
 					return nil, err
 				}
-				for _, itm := range s {
-					seq = append(seq, itm)
-				}
+				seq = append(seq, s...)
 				ctx.sequence = copysequence
-				if tf(ctx, cld) {
-					seq = append(seq, cld)
-				}
 			}
 		case goxml.CharData:
 			if tf(ctx, t) {
@@ -357,3 +363,66 @@ func (ctx *Context) precedingAxis(tf testFunc) (Sequence, error) {
 	}
 	return ctx.sequence, nil
 }
+
+// selectOnAxis returns the first node, or the last node if last is set, on
+// the child, descendant or descendant-or-self axis of the context items that
+// passes the element test tf. Unlike the axis functions it stops at the first
+// match. itm is nil if no node matches. ok is false if a context item is not
+// a document or an element, the whole axis has to be computed then.
+func (ctx *Context) selectOnAxis(axis string, tf testFunc, last bool) (itm Item, ok bool) {
+	for _, c := range ctx.sequence {
+		switch c.(type) {
+		case *goxml.XMLDocument, *goxml.Element:
+		default:
+			return nil, false
+		}
+	}
+	deep := axis != "child"
+	orSelf := axis == "descendant-or-self"
+	items := ctx.sequence
+	for i := range items {
+		if last {
+			i = len(items) - 1 - i
+		}
+		var found goxml.XMLNode
+		switch t := items[i].(type) {
+		case *goxml.XMLDocument:
+			found = ctx.findNode(t.Children(), deep, tf, last)
+		case *goxml.Element:
+			if orSelf && !last && tf(ctx, t) {
+				return t, true
+			}
+			found = ctx.findNode(t.Children(), deep, tf, last)
+			if found == nil && orSelf && last && tf(ctx, t) {
+				found = t
+			}
+		}
+		if found != nil {
+			return found, true
+		}
+	}
+	return nil, true
+}
+
+// findNode returns the first (or last) node of nodes and, if deep is set,
+// their descendants in document order that passes tf.
+func (ctx *Context) findNode(nodes []goxml.XMLNode, deep bool, tf testFunc, last bool) goxml.XMLNode {
+	for i := range nodes {
+		if last {
+			i = len(nodes) - 1 - i
+		}
+		n := nodes[i]
+		if !last && tf(ctx, n) {
+			return n
+		}
+		if elt, ok := n.(*goxml.Element); ok && deep {
+			if found := ctx.findNode(elt.Children(), deep, tf, last); found != nil {
+				return found
+			}
+		}
+		if last && tf(ctx, n) {
+			return n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,696 @@
+package goxpath
+
+import "strings"
+
+// optimize returns a rewritten copy of the expression tree n that yields the
+// same result with less work:
+//
+//   - constant subexpressions such as 1 + 2 or concat('a', 'b') are folded
+//     into literals,
+//   - //x is turned into /descendant::x, which does not need to visit every
+//     node twice,
+//   - let bindings that do not depend on the loop variables or the focus are
+//     hoisted out of for expressions and predicates,
+//   - [position() = 1] and [position() = last()] are normalized to [1] and
+//     [last()], which the compiler evaluates without filtering every item.
+//
+// n is not modified, subtrees are shared where possible. sc is the static
+// context of the expression or nil; functions declared there are never
+// folded because they may shadow built-in functions.
+func optimize(n Node, sc *StaticContext) Node {
+	o := &optimizer{shadowed: make(map[string]bool)}
+	if sc != nil {
+		for _, f := range sc.Functions {
+			if f.Namespace == nsFN {
+				o.shadowed[f.Name] = true
+			}
+		}
+	}
+	return o.rewrite(n)
+}
+
+type optimizer struct {
+	shadowed map[string]bool
+}
+
+// foldableFunctions are the functions without side effects and without
+// dependencies on the dynamic context (other than the arguments) that can be
+// evaluated at compile time.
+var foldableFunctions = map[string]bool{
+	"abs":                  true,
+	"boolean":              true,
+	"ceiling":              true,
+	"codepoint-equal":      true,
+	"codepoints-to-string": true,
+	"concat":               true,
+	"count":                true,
+	"empty":                true,
+	"encode-for-uri":       true,
+	"escape-html-uri":      true,
+	"exactly-one":          true,
+	"exists":               true,
+	"false":                true,
+	"floor":                true,
+	"head":                 true,
+	"insert-before":        true,
+	"iri-to-uri":           true,
+	"lower-case":           true,
+	"normalize-space":      true,
+	"normalize-unicode":    true,
+	"not":                  true,
+	"number":               true,
+	"one-or-more":          true,
+	"remove":               true,
+	"reverse":              true,
+	"round":                true,
+	"round-half-to-even":   true,
+	"string":               true,
+	"string-join":          true,
+	"string-length":        true,
+	"string-to-codepoints": true,
+	"subsequence":          true,
+	"substring":            true,
+	"tail":                 true,
+	"translate":            true,
+	"true":                 true,
+	"upper-case":           true,
+	"zero-or-one":          true,
+}
+
+func (o *optimizer) list(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	ret := make([]Node, len(nodes))
+	for i, n := range nodes {
+		ret[i] = o.rewrite(n)
+	}
+	return ret
+}
+
+func (o *optimizer) bindings(bindings []*Binding) []*Binding {
+	ret := make([]*Binding, len(bindings))
+	for i, b := range bindings {
+		ret[i] = &Binding{Name: b.Name, Expr: o.rewrite(b.Expr), lazy: b.lazy}
+	}
+	return ret
+}
+
+func (o *optimizer) rewrite(n Node) Node {
+	switch t := n.(type) {
+	case *SequenceExpr:
+		c := *t
+		c.Items = o.list(t.Items)
+		return &c
+	case *ParenExpr:
+		if t.Expr == nil {
+			return t
+		}
+		e := o.rewrite(t.Expr)
+		if lit, ok := e.(*Literal); ok {
+			return lit
+		}
+		c := *t
+		c.Expr = e
+		return &c
+	case *ForExpr:
+		c := *t
+		c.Bindings = o.bindings(t.Bindings)
+		c.Return = o.rewrite(t.Return)
+		return hoistFromFor(&c)
+	case *LetExpr:
+		c := *t
+		c.Bindings = o.bindings(t.Bindings)
+		c.Return = o.rewrite(t.Return)
+		return &c
+	case *QuantifiedExpr:
+		c := *t
+		c.Bindings = o.bindings(t.Bindings)
+		c.Satisfies = o.rewrite(t.Satisfies)
+		return &c
+	case *IfExpr:
+		c := *t
+		c.Cond, c.Then, c.Else = o.rewrite(t.Cond), o.rewrite(t.Then), o.rewrite(t.Else)
+		if lit, ok := c.Cond.(*Literal); ok {
+			if b, ok := lit.Value.(bool); ok {
+				if b {
+					return c.Then
+				}
+				return c.Else
+			}
+		}
+		return &c
+	case *LogicalExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		return &c
+	case *ComparisonExpr:
+		c := *t
+		c.Left, c.Right = o.rewrite(t.Left), o.rewrite(t.Right)
+		if isNumericLiteral(c.Left) && isNumericLiteral(c.Right) && c.Op != "is" && c.Op != "<<" && c.Op != ">>" {
+			return fold(&c)
+		}
+		return &c
+	case *StringConcatExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		if allConstant(c.Operands) {
+			return fold(&c)
+		}
+		return &c
+	case *RangeExpr:
+		c := *t
+		c.From, c.To = o.rewrite(t.From), o.rewrite(t.To)
+		return &c
+	case *AdditiveExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		if allNumericLiterals(c.Operands) {
+			return fold(&c)
+		}
+		return &c
+	case *MultiplicativeExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		if allNumericLiterals(c.Operands) {
+			return fold(&c)
+		}
+		return &c
+	case *UnionExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		return &c
+	case *IntersectExceptExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		return &c
+	case *InstanceOfExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		return &c
+	case *TreatExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		return &c
+	case *CastableExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		return &c
+	case *CastExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		return &c
+	case *ArrowExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		c.Args = o.list(t.Args)
+		return &c
+	case *UnaryExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		if isNumericLiteral(c.Expr) {
+			return fold(&c)
+		}
+		return &c
+	case *SimpleMapExpr:
+		c := *t
+		c.Operands = o.list(t.Operands)
+		return &c
+	case *PathExpr:
+		c := *t
+		c.Steps = o.list(t.Steps)
+		c.Seps = append([]string(nil), t.Seps...)
+		rewriteDescendant(&c)
+		return hoistFromPath(&c)
+	case *AxisStep:
+		c := *t
+		c.Predicates = o.list(t.Predicates)
+		for i, p := range c.Predicates {
+			c.Predicates[i] = normalizePositional(p)
+		}
+		return hoistFromStep(&c)
+	case *FilterExpr:
+		c := *t
+		c.Expr = o.rewrite(t.Expr)
+		c.Predicate = normalizePositional(o.rewrite(t.Predicate))
+		return hoistFromFilter(&c)
+	case *LookupExpr:
+		c := *t
+		if t.Expr != nil {
+			c.Expr = o.rewrite(t.Expr)
+		}
+		return &c
+	case *DynamicCallExpr:
+		c := *t
+		c.Func = o.rewrite(t.Func)
+		c.Args = o.list(t.Args)
+		return &c
+	case *FunctionCall:
+		c := *t
+		c.Args = o.list(t.Args)
+		if foldableFunctions[t.Name] && !o.shadowed[t.Name] && allConstant(c.Args) &&
+			(len(c.Args) > 0 || t.Name == "true" || t.Name == "false") {
+			return fold(&c)
+		}
+		return &c
+	case *InlineFunctionExpr:
+		c := *t
+		c.Body = o.rewrite(t.Body)
+		return &c
+	case *MapConstructor:
+		c := *t
+		c.Entries = make([]*MapConstructorEntry, len(t.Entries))
+		for i, e := range t.Entries {
+			c.Entries[i] = &MapConstructorEntry{Key: o.rewrite(e.Key), Value: o.rewrite(e.Value)}
+		}
+		return &c
+	case *ArrayConstructor:
+		c := *t
+		c.Members = o.list(t.Members)
+		return &c
+	}
+	return n
+}
+
+// fold evaluates the constant expression n and returns the result as a
+// literal. If the evaluation fails, the error is left to the runtime and n is
+// returned unchanged. Results that cannot be written as a single literal are
+// not folded either.
+//
+// The functions called in n are the built-in ones, but the context of the
+// evaluation may resolve them differently, see FunctionLibrary. A literal
+// folded from function calls therefore remembers n and the compiler falls
+// back to it in that case.
+func fold(n Node) Node {
+	ef, err := compile(n)
+	if err != nil {
+		return n
+	}
+	seq, err := ef(NewContext(nil))
+	if err != nil {
+		return n
+	}
+	calls := len(foldedFunctions(n)) > 0
+	switch len(seq) {
+	case 0:
+		if !calls {
+			return setPos(&ParenExpr{}, n.Pos())
+		}
+	case 1:
+		switch seq[0].(type) {
+		case string, int, float64, bool, XSInteger, XSDouble, XSFloat, XSDecimal:
+			lit := &Literal{Value: seq[0]}
+			if calls {
+				lit.from = n
+			}
+			return setPos(lit, n.Pos())
+		}
+	}
+	return n
+}
+
+// foldedCall is the name and the number of arguments of a function call.
+type foldedCall struct {
+	name  string
+	arity int
+}
+
+// foldedFunctions returns the built-in functions called in the constant
+// expression n.
+func foldedFunctions(n Node) map[foldedCall]*Function {
+	fns := make(map[foldedCall]*Function)
+	var collect func(Node) bool
+	collect = func(n Node) bool {
+		switch t := n.(type) {
+		case *FunctionCall:
+			if foldableFunctions[t.Name] {
+				arity := len(t.Args)
+				fns[foldedCall{t.Name, arity}] = selectOverload(xpathfunctions[nsFN+" "+t.Name], arity)
+			}
+		case *Literal:
+			if t.from != nil {
+				Inspect(t.from, collect)
+			}
+		}
+		return true
+	}
+	Inspect(n, collect)
+	return fns
+}
+
+// compileFoldedLiteral returns the value of a literal that was folded from
+// function calls, unless ctx resolves one of the functions to something else
+// than the built-in function. Then the original expression is evaluated.
+func compileFoldedLiteral(lit *Literal) (EvalFunc, error) {
+	original, err := compile(lit.from)
+	if err != nil {
+		return nil, err
+	}
+	fns := foldedFunctions(lit.from)
+	val := lit.Value
+	return func(ctx *Context) (Sequence, error) {
+		if ctx.functions != nil || ctx.Library != nil {
+			for call, fn := range fns {
+				if ctx.lookupFunction(nsFN, call.name, call.arity) != fn {
+					return original(ctx)
+				}
+			}
+		}
+		return Sequence{val}, nil
+	}, nil
+}
+
+func isNumericLiteral(n Node) bool {
+	if lit, ok := n.(*Literal); ok {
+		switch lit.Value.(type) {
+		case int, XSInteger, XSDouble, XSFloat, XSDecimal:
+			return true
+		}
+	}
+	return false
+}
+
+func allNumericLiterals(nodes []Node) bool {
+	for _, n := range nodes {
+		if !isNumericLiteral(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// isConstant reports whether n is a literal or a sequence of literals.
+func isConstant(n Node) bool {
+	switch t := n.(type) {
+	case *Literal:
+		return true
+	case *ParenExpr:
+		return t.Expr == nil || isConstant(t.Expr)
+	case *SequenceExpr:
+		return allConstant(t.Items)
+	}
+	return false
+}
+
+func allConstant(nodes []Node) bool {
+	for _, n := range nodes {
+		if !isConstant(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteDescendant replaces a // separator followed by a child step without
+// predicates by a / separator and a descendant step. The leading // of a path
+// is only rewritten if the path has a single step, since the result of the
+// other steps is sorted into document order by the leading //.
+func rewriteDescendant(p *PathExpr) {
+	for i, step := range p.Steps {
+		var sep *string
+		switch {
+		case i == 0 && p.Root == "//" && len(p.Steps) == 1:
+			sep = &p.Root
+		case i > 0 && p.Seps[i-1] == "//":
+			sep = &p.Seps[i-1]
+		default:
+			continue
+		}
+		as, ok := step.(*AxisStep)
+		if !ok || as.Axis != "child" || as.Abbrev || len(as.Predicates) > 0 {
+			continue
+		}
+		c := *as
+		c.Axis = "descendant"
+		p.Steps[i] = &c
+		*sep = "/"
+	}
+}
+
+// normalizePositional turns the predicates position() = 1 and position() =
+// last() into their short forms [1] and [last()].
+func normalizePositional(pred Node) Node {
+	cmp, ok := pred.(*ComparisonExpr)
+	if !ok || (cmp.Op != "=" && cmp.Op != "eq") || !isFunctionCall(cmp.Left, "position") {
+		return pred
+	}
+	if lit, ok := cmp.Right.(*Literal); ok && lit.Value == 1 {
+		return setPos(&Literal{Value: 1}, cmp.Pos())
+	}
+	if isFunctionCall(cmp.Right, "last") {
+		return cmp.Right
+	}
+	return pred
+}
+
+func isFunctionCall(n Node, name string) bool {
+	fc, ok := n.(*FunctionCall)
+	return ok && len(fc.Args) == 0 && (fc.Name == name || fc.Name == "fn:"+name)
+}
+
+// positionalPredicate reports whether pred is [1] or [last()] and which one.
+func positionalPredicate(pred Node) (last bool, ok bool) {
+	if lit, isLit := pred.(*Literal); isLit && lit.Value == 1 {
+		return false, true
+	}
+	if isFunctionCall(pred, "last") {
+		return true, true
+	}
+	return false, false
+}
+
+// hoistFromFor moves the leading bindings of a let expression in the return
+// clause of f in front of f if they don't depend on the variables of f. Like
+// all hoisted bindings they are evaluated lazily.
+func hoistFromFor(f *ForExpr) Node {
+	let, ok := f.Return.(*LetExpr)
+	if !ok {
+		return f
+	}
+	bound := make(map[string]bool)
+	var outer []Node
+	for _, b := range f.Bindings {
+		bound[b.Name] = true
+		outer = append(outer, b.Expr)
+	}
+	n := hoistable(let, bound, outer)
+	if n == 0 {
+		return f
+	}
+	c := *f
+	c.Return = letRest(let, n)
+	return setPos(&LetExpr{Bindings: lazyBindings(let.Bindings[:n]), Return: &c}, let.Pos())
+}
+
+// hoistFromFilter moves the leading bindings of a let expression used as
+// predicate in front of the filter expression.
+func hoistFromFilter(f *FilterExpr) Node {
+	let, ok := f.Predicate.(*LetExpr)
+	if !ok {
+		return f
+	}
+	n := hoistable(let, nil, []Node{f.Expr})
+	if n == 0 {
+		return f
+	}
+	c := *f
+	c.Predicate = letRest(let, n)
+	return setPos(&LetExpr{Bindings: lazyBindings(let.Bindings[:n]), Return: &c}, let.Pos())
+}
+
+// hoistFromStep moves the leading bindings of let expressions used as
+// predicates of the step in front of the step.
+func hoistFromStep(s *AxisStep) Node {
+	var hoisted []*Binding
+	for i, p := range s.Predicates {
+		let, ok := p.(*LetExpr)
+		if !ok {
+			continue
+		}
+		others := make([]Node, 0, len(s.Predicates)+len(hoisted))
+		for j, q := range s.Predicates {
+			if j != i {
+				others = append(others, q)
+			}
+		}
+		for _, b := range hoisted {
+			others = append(others, b.Expr, &VarRef{Name: b.Name})
+		}
+		n := hoistable(let, nil, others)
+		if n == 0 {
+			continue
+		}
+		hoisted = append(hoisted, let.Bindings[:n]...)
+		s.Predicates[i] = letRest(let, n)
+	}
+	if len(hoisted) == 0 {
+		return s
+	}
+	return setPos(&LetExpr{Bindings: lazyBindings(hoisted), Return: s}, s.Pos())
+}
+
+// hoistFromPath pulls let expressions that have been hoisted out of the steps
+// of p further up in front of the whole path, so that they are evaluated once
+// and not for every context item of the step.
+func hoistFromPath(p *PathExpr) Node {
+	var hoisted []*Binding
+	for i, step := range p.Steps {
+		let, ok := step.(*LetExpr)
+		if !ok {
+			continue
+		}
+		others := make([]Node, 0, len(p.Steps)+len(hoisted))
+		for j, s := range p.Steps {
+			if j != i {
+				others = append(others, s)
+			}
+		}
+		for _, b := range hoisted {
+			others = append(others, b.Expr, &VarRef{Name: b.Name})
+		}
+		if hoistable(let, nil, others) < len(let.Bindings) {
+			continue
+		}
+		hoisted = append(hoisted, let.Bindings...)
+		p.Steps[i] = let.Return
+	}
+	if len(hoisted) == 0 {
+		return p
+	}
+	return setPos(&LetExpr{Bindings: lazyBindings(hoisted), Return: p}, p.Pos())
+}
+
+// hoistable returns the number of leading bindings of let that can be moved
+// in front of an expression that binds the variables in bound and evaluates
+// the expressions in others within the scope of the moved bindings. The
+// bindings must not depend on the focus or the variables in bound, and the
+// moved variable names must not be used in others.
+func hoistable(let *LetExpr, bound map[string]bool, others []Node) int {
+	used := make(map[string]bool)
+	for _, o := range others {
+		varRefs(o, used)
+	}
+	for i, b := range let.Bindings {
+		refs := varRefs(b.Expr, make(map[string]bool))
+		if bound[b.Name] || used[b.Name] || !focusIndependent(b.Expr) {
+			return i
+		}
+		for name := range refs {
+			if bound[name] {
+				return i
+			}
+		}
+	}
+	return len(let.Bindings)
+}
+
+// lazyBindings returns copies of the bindings that are evaluated when the
+// variable is first read. A binding moved out of a loop must not be evaluated
+// if the loop body never runs, as it might fail or be expensive.
+func lazyBindings(bindings []*Binding) []*Binding {
+	ret := make([]*Binding, len(bindings))
+	for i, b := range bindings {
+		ret[i] = &Binding{Name: b.Name, Expr: b.Expr, lazy: true}
+	}
+	return ret
+}
+
+// letRest returns let without its first n bindings.
+func letRest(let *LetExpr, n int) Node {
+	if n == len(let.Bindings) {
+		return let.Return
+	}
+	c := *let
+	c.Bindings = let.Bindings[n:]
+	return &c
+}
+
+// varRefs adds the names of all variables referenced in n to names.
+func varRefs(n Node, names map[string]bool) map[string]bool {
+	if n == nil {
+		return names
+	}
+	Inspect(n, func(n Node) bool {
+		switch t := n.(type) {
+		case *VarRef:
+			names[t.Name] = true
+		case *ForExpr:
+			for _, b := range t.Bindings {
+				names[b.Name] = true
+			}
+		case *LetExpr:
+			for _, b := range t.Bindings {
+				names[b.Name] = true
+			}
+		case *QuantifiedExpr:
+			for _, b := range t.Bindings {
+				names[b.Name] = true
+			}
+		case *InlineFunctionExpr:
+			for _, p := range t.Params {
+				names[p.Name] = true
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// contextFunctions are the functions that use the focus or the static
+// context when called with arguments.
+var contextFunctions = map[string]bool{
+	"position":        true,
+	"last":            true,
+	"lang":            true,
+	"id":              true,
+	"idref":           true,
+	"element-with-id": true,
+	"key":             true,
+	"function-lookup": true,
+}
+
+// focusIndependent reports whether the result of n does not depend on the
+// context item, position or size. Rooted paths only depend on the document.
+func focusIndependent(n Node) bool {
+	ok := true
+	var inspect func(Node) bool
+	inspect = func(n Node) bool {
+		if !ok {
+			return false
+		}
+		switch t := n.(type) {
+		case *ContextItemExpr, *AxisStep, *NamedFunctionRef, *InlineFunctionExpr, *DynamicCallExpr:
+			ok = false
+		case *PathExpr:
+			if t.Root == "" {
+				ok = false
+			}
+			return false
+		case *FilterExpr:
+			Inspect(t.Expr, inspect)
+			return false
+		case *SimpleMapExpr:
+			Inspect(t.Operands[0], inspect)
+			return false
+		case *LookupExpr:
+			if t.Expr == nil {
+				ok = false
+			}
+		case *FunctionCall:
+			if len(t.Args) == 0 && t.Name != "true" && t.Name != "false" || contextFunctions[t.Name] || hasPrefix(t.Name) {
+				ok = false
+			}
+		case *ArrowExpr:
+			if contextFunctions[t.Function] || hasPrefix(t.Function) {
+				ok = false
+			}
+		}
+		return ok
+	}
+	Inspect(n, inspect)
+	return ok
+}
+
+func hasPrefix(name string) bool {
+	return strings.ContainsAny(name, ":{")
+}
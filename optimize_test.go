@@ -0,0 +1,151 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	testdata := []struct {
+		input  string
+		output string
+	}{
+		{`1 + 2`, `3`},
+		{`(1 + 2) * 3`, `9`},
+		{`10 idiv 3 - 1`, `2`},
+		{`1 div 0`, `1 div 0`},
+		{`concat('a', 'b')`, `'ab'`},
+		{`'a' || upper-case('b') || 1`, `'aB1'`},
+		{`string-join(('a', 'b'), '-')`, `'a-b'`},
+		{`string-length()`, `string-length()`},
+		{`2 > 1`, `true()`},
+		{`if (1 = 1) then 'a' else 'b'`, `'a'`},
+		{`//sub`, `/descendant::sub`},
+		{`//sub/@foo`, `//child::sub/@foo`},
+		{`/root//sub`, `/child::root/descendant::sub`},
+		{`/root//sub[1]`, `/child::root//child::sub[1]`},
+		{`sub[position() = 1]`, `child::sub[1]`},
+		{`(//sub)[position() = last()]`, `(/descendant::sub)[last()]`},
+		{`for $i in 1 to 3 return let $c := count(//sub) return $i + $c`,
+			`let $c := count(/descendant::sub) return for $i in 1 to 3 return $i + $c`},
+		{`for $i in 1 to 3 return let $c := $i * 2 return $c`,
+			`for $i in 1 to 3 return let $c := $i * 2 return $c`},
+		{`for $i in 1 to 3 return let $c := count(.) return $c`,
+			`for $i in 1 to 3 return let $c := count(.) return $c`},
+		{`/root/sub[let $m := max((1, 2)) return @foo = $m]`,
+			`let $m := max((1, 2)) return /child::root/child::sub[@foo = $m]`},
+		{`/root/sub[let $n := string(@foo) return $n = 'bar']`,
+			`/child::root/child::sub[let $n := string(@foo) return $n = 'bar']`},
+		{`$seq[let $x := abs($y) return . = $x]`, `let $x := abs($y) return $seq[. = $x]`},
+		{`$x[let $x := abs($y) return . = $x]`, `$x[let $x := abs($y) return . = $x]`},
+		{`//sub[let $k := key('k', 'v') return . = $k]`, `//child::sub[let $k := key('k', 'v') return . = $k]`},
+	}
+	for _, td := range testdata {
+		n, err := ParseAST(td.input)
+		if err != nil {
+			t.Errorf("ParseAST(%q): %s", td.input, err)
+			continue
+		}
+		if got := optimize(n, nil).String(); got != td.output {
+			t.Errorf("optimize(%q) = %q, want %q", td.input, got, td.output)
+		}
+		if got := n.String(); strings.Contains(td.input, "//") && !strings.Contains(got, "//") {
+			t.Errorf("optimize(%q) modified the original tree: %q", td.input, got)
+		}
+	}
+}
+
+func TestOptimizeSameResult(t *testing.T) {
+	for _, expr := range []string{
+		`//sub/@foo`,
+		`//subsub`,
+		`//*!local-name()`,
+		`count(//text())`,
+		`/root//subsub`,
+		`/root/a//sub/@p`,
+		`(//sub)[1]/@foo`,
+		`(//sub)[last()]/@p`,
+		`(//nothing)[1]`,
+		`/root/sub[1]/@foo`,
+		`/root/sub[last()]/@foo`,
+		`/root/sub[last()][1]/@foo`,
+		`/root/descendant::sub[1]/@foo`,
+		`/root/descendant::sub[last()]/@p`,
+		`/root/descendant-or-self::*[1]!local-name()`,
+		`/root/descendant-or-self::*[last()]!local-name()`,
+		`/root/a/descendant::sub[1]/@p`,
+		`/root/a/sub[last()]/@p`,
+		`(/root/sub/@foo)[last()]`,
+		`(/root/sub)[position() = 1]/@foo`,
+		`for $a in /root/a return let $n := count(//sub) return $a/sub[1]/@p || $n`,
+		`/root/sub[let $f := 'bar' return @foo = $f]/@attr`,
+		`(1 to 5)[let $m := max((2, 3)) return . > $m]`,
+		`concat('a', 'b') || 1 + 2`,
+		`for $x in () return let $y := 1 div 0 return $y`,
+		`/root/nothing[let $y := 1 div 0 return . = $y]`,
+		`for $x in (1, 2) return let $y := $x, $z := count(//sub) return $y + $z`,
+	} {
+		tree, err := ParseAST(expr)
+		if err != nil {
+			t.Errorf("ParseAST(%q): %s", expr, err)
+			continue
+		}
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results [2]Sequence
+		for i, n := range []Node{tree, optimize(tree, nil)} {
+			ef, err := CompileAST(n)
+			if err != nil {
+				t.Errorf("CompileAST(%q): %s", n, err)
+				continue
+			}
+			np.Ctx.Document()
+			if results[i], err = ef(np.Ctx); err != nil {
+				t.Errorf("evaluate %q: %s", n, err)
+			}
+		}
+		if got, want := results[1], results[0]; len(got) != len(want) {
+			t.Errorf("%s: optimized result %v, want %v", expr, got, want)
+		} else {
+			for i := range got {
+				if !itemsEqual(got[i], want[i]) {
+					t.Errorf("%s: optimized result %v, want %v", expr, got, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Hoisted bindings are evaluated on first use, so errors are raised only
+// where the unoptimized expression raises them.
+func TestOptimizeHoistedErrors(t *testing.T) {
+	for _, expr := range []string{
+		`for $x in 1 to 2 return let $y := 1 div 0 return $y`,
+		`/root/sub[let $y := 1 div 0 return . = $y]`,
+	} {
+		tree, err := ParseAST(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt := optimize(tree, nil)
+		if _, ok := opt.(*LetExpr); !ok {
+			t.Errorf("%s: binding not hoisted: %s", expr, opt)
+		}
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ef, err := CompileAST(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Document()
+		_, err = ef(np.Ctx)
+		if code, _ := XPathErrorCode(err); code != "FOAR0001" {
+			t.Errorf("%s: error code %q, want FOAR0001 (%v)", expr, code, err)
+		}
+	}
+}
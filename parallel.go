@@ -0,0 +1,101 @@
+package goxpath
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// parallel reports whether a loop over n items should be evaluated in
+// parallel.
+func (ctx *Context) parallel(n int) bool {
+	return ctx.Parallelism > 1 && n > 1
+}
+
+// workerFrame returns the frame of a goroutine that evaluates iterations of
+// a loop in ctx. It has its own focus, variable bindings and recursion depth
+// and sees the same current dateTime as ctx. Loops inside the iterations run
+// sequentially.
+func (ctx *Context) workerFrame() *Context {
+	frame := ctx.newFrame()
+	frame.currentTime = ctx.currentTime
+	frame.eval = ctx.eval.fork()
+	frame.Parallelism = 0
+	return frame
+}
+
+// parallelEach calls f for the indexes 0 to n-1 on up to ctx.Parallelism
+// goroutines and returns the results in the order of the indexes. Each
+// goroutine passes a frame of its own to f. If f fails for several indexes,
+// the error of the smallest index is returned, as if the loop had run
+// sequentially. Indexes after a failed one are skipped.
+func (ctx *Context) parallelEach(n int, f func(frame *Context, i int) (Sequence, error)) ([]Sequence, error) {
+	// the iterations must see the same current dateTime
+	ctx.CurrentTime()
+	results := make([]Sequence, n)
+	errs := make([]error, n)
+	var next atomic.Int64
+	var failed atomic.Int64 // smallest failed index
+	failed.Store(int64(n))
+	var wg sync.WaitGroup
+	for range min(ctx.Parallelism, n) {
+		wg.Add(1)
+		go func(frame *Context) {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= n || int64(i) > failed.Load() {
+					return
+				}
+				seq, err := f(frame, i)
+				if err != nil {
+					errs[i] = err
+					for {
+						cur := failed.Load()
+						if int64(i) >= cur || failed.CompareAndSwap(cur, int64(i)) {
+							break
+						}
+					}
+					continue
+				}
+				results[i] = seq
+			}
+		}(ctx.workerFrame())
+	}
+	wg.Wait()
+	if i := failed.Load(); i < int64(n) {
+		return nil, errs[i]
+	}
+	return results, nil
+}
+
+// parallelFilter is Filter for the items from index start on, evaluated in
+// parallel.
+func (ctx *Context) parallelFilter(filter EvalFunc, items Sequence, positions, lengths []int, start int) (Sequence, error) {
+	keep, err := ctx.parallelEach(len(items)-start, func(frame *Context, i int) (Sequence, error) {
+		i += start
+		frame.sequence = Sequence{items[i]}
+		frame.Pos = positions[i]
+		if len(lengths) > i {
+			frame.size = lengths[i]
+		} else {
+			frame.size = 1
+		}
+		predicate, err := filter(frame)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := BooleanValue(predicate)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return Sequence{items[i]}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result Sequence
+	for _, seq := range keep {
+		result = append(result, seq...)
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package goxpath
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParallel(t *testing.T) {
+	const ns = "urn:goxpath:test:parallel"
+	var workerCalls atomic.Int64
+	lib := NewFunctionLibrary(DefaultFunctions())
+	lib.Register(&Function{Name: "render", Namespace: ns, MinArg: 1, MaxArg: 1, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		if ctx.Parallelism == 0 {
+			// loops in the iterations of a parallel loop are sequential
+			workerCalls.Add(1)
+		}
+		s, err := StringValue(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return Sequence{"<" + s + ">"}, nil
+	}})
+	lib.Register(&Function{Name: "fail", Namespace: ns, MinArg: 1, MaxArg: 1, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		s, _ := StringValue(args[0])
+		return nil, NewXPathError("TEST"+s, "failed at "+s)
+	}})
+
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`string-join((1 to 100) ! string(. * 2), ',')`, "", ""},
+		{`string-join(//sub ! p:render(.), '')`, "", ""},
+		{`string-join(for $i in 1 to 50, $j in ('a', 'b') return $j || $i, ' ')`, "", ""},
+		{`string-join(for $s in //sub return p:render($s), '')`, "", ""},
+		{`string-join((1 to 200)[. mod 7 = 0], ',')`, "", ""},
+		{`string-join((1 to 200)[3], ',')`, "3", ""},
+		{`string-join((1 to 200)[last()], ',')`, "200", ""},
+		{`count(//*[position() > 1][@*])`, "", ""},
+		{`sum(for $i in 1 to 100 return (1 to $i)[. mod 2 = 0] ! (. * $i))`, "", ""},
+		{`string(current-dateTime()) = (1 to 20) ! string(current-dateTime())`, "true", ""},
+		{`(1 to 100) ! (if (. = (40, 17)) then p:fail(string(.)) else .)`, "", "TEST17"},
+		{`for $i in 1 to 100 return if ($i > 30) then p:fail(string($i)) else $i`, "", "TEST31"},
+		{`(1 to 100)[if (. >= 60) then p:fail(string(.)) else true()]`, "", "TEST60"},
+	}
+	for _, td := range testdata {
+		var results [2]string
+		for i, parallelism := range []int{0, 4} {
+			np, err := NewParser(strings.NewReader(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			np.Ctx.Namespaces["p"] = ns
+			np.Ctx.Library = lib
+			np.Ctx.Parallelism = parallelism
+			s, err := np.EvaluateString(td.input)
+			if td.code != "" {
+				if code, _ := XPathErrorCode(err); code != td.code {
+					t.Errorf("%s (parallelism %d): error code %q, want %q (%v)", td.input, parallelism, code, td.code, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s (parallelism %d): %s", td.input, parallelism, err)
+				continue
+			}
+			results[i] = s
+		}
+		if results[0] != results[1] {
+			t.Errorf("%s = %q in parallel, want %q", td.input, results[1], results[0])
+		}
+		if td.output != "" && results[1] != td.output {
+			t.Errorf("%s = %q, want %q", td.input, results[1], td.output)
+		}
+	}
+
+	// the iterations run in the frames of the workers
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.Ctx.Namespaces["p"] = ns
+	np.Ctx.Library = lib
+	np.Ctx.Parallelism = 4
+	workerCalls.Store(0)
+	if _, err = np.Evaluate(`(1 to 100) ! p:render(.)`); err != nil {
+		t.Fatal(err)
+	}
+	if n := workerCalls.Load(); n != 100 {
+		t.Errorf("p:render was called %d times in a worker frame, want 100", n)
+	}
+}
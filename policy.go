@@ -0,0 +1,104 @@
+package goxpath
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Policy restricts the access of an expression to resources outside of the
+// context: the files and URIs read by fn:doc, fn:doc-available,
+// fn:unparsed-text, fn:unparsed-text-lines, fn:unparsed-text-available and
+// fn:json-doc, and the environment variables of fn:environment-variable and
+// fn:available-environment-variables.
+//
+// A nil Policy allows everything. Use StrictPolicy for expressions from
+// untrusted sources.
+type Policy struct {
+	// DenyResources denies reading any resource.
+	DenyResources bool
+	// AllowedSchemes lists the URI schemes that may be read, for example
+	// "file". References without a scheme are files. If empty, all schemes
+	// are allowed.
+	AllowedSchemes []string
+	// AllowedRoots lists the directories files may be read from. A file is
+	// allowed if it is in one of the directories or below, after resolving
+	// "..", symbolic links and the base URI. If empty, all files are
+	// allowed.
+	AllowedRoots []string
+	// DenyEnvironment hides all environment variables.
+	DenyEnvironment bool
+	// AllowedEnvironmentVariables lists the names of the environment
+	// variables that are visible. If empty, all variables are visible.
+	AllowedEnvironmentVariables []string
+}
+
+// StrictPolicy returns a policy that denies reading resources and hides the
+// environment variables.
+func StrictPolicy() *Policy {
+	return &Policy{DenyResources: true, DenyEnvironment: true}
+}
+
+// checkResource returns an error with the given code if the policy of ctx
+// does not allow reading the resource at uri, which is resolved against the
+// base URI.
+func (ctx *Context) checkResource(code, uri string) error {
+	p := ctx.Policy
+	if p == nil {
+		return nil
+	}
+	if p.DenyResources {
+		return NewXPathError(code, fmt.Sprintf("access to %q denied by policy", uri))
+	}
+	scheme := "file"
+	if hasScheme(uri) {
+		scheme, _, _ = strings.Cut(strings.ToLower(uri), ":")
+	}
+	if len(p.AllowedSchemes) > 0 && !slices.Contains(p.AllowedSchemes, scheme) {
+		return NewXPathError(code, fmt.Sprintf("access to %q denied by policy: scheme %q is not allowed", uri, scheme))
+	}
+	if scheme != "file" || len(p.AllowedRoots) == 0 {
+		return nil
+	}
+	path, _ := filePath(uri)
+	path = realPath(path)
+	for _, root := range p.AllowedRoots {
+		rel, err := filepath.Rel(realPath(root), path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return NewXPathError(code, fmt.Sprintf("access to %q denied by policy: outside of the allowed directories", uri))
+}
+
+// realPath returns the absolute path of path with symbolic links resolved as
+// far as the file exists.
+func realPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real
+	}
+	// resolve the existing part so that a link can't be used to escape
+	dir, file := filepath.Split(abs)
+	if dir = filepath.Clean(dir); dir != abs {
+		return filepath.Join(realPath(dir), file)
+	}
+	return abs
+}
+
+// environmentAllowed reports whether the policy of ctx allows reading the
+// environment variable name.
+func (ctx *Context) environmentAllowed(name string) bool {
+	p := ctx.Policy
+	if p == nil {
+		return true
+	}
+	if p.DenyEnvironment {
+		return false
+	}
+	return len(p.AllowedEnvironmentVariables) == 0 || slices.Contains(p.AllowedEnvironmentVariables, name)
+}
@@ -0,0 +1,102 @@
+package goxpath
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{allowed, outside} {
+		if err := os.WriteFile(filepath.Join(dir, "d.xml"), []byte(`<d>x</d>`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "t.json"), []byte(`{"a": 1}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOXPATH_POLICY_PUBLIC", "public")
+	t.Setenv("GOXPATH_POLICY_SECRET", "secret")
+
+	inAllowed := filepath.Join(allowed, "d.xml")
+	inOutside := filepath.Join(outside, "d.xml")
+	roots := &Policy{AllowedRoots: []string{allowed}, AllowedEnvironmentVariables: []string{"GOXPATH_POLICY_PUBLIC"}}
+	testdata := []struct {
+		policy *Policy
+		input  string
+		output string
+		code   string
+	}{
+		{nil, `string(doc('` + inOutside + `'))`, "x", ""},
+		{nil, `environment-variable('GOXPATH_POLICY_SECRET')`, "secret", ""},
+		{StrictPolicy(), `doc('` + inAllowed + `')`, "", "FODC0002"},
+		{StrictPolicy(), `doc-available('` + inAllowed + `')`, "false", ""},
+		{StrictPolicy(), `unparsed-text('` + inAllowed + `')`, "", "FOUT1170"},
+		{StrictPolicy(), `unparsed-text-lines('` + inAllowed + `')`, "", "FOUT1170"},
+		{StrictPolicy(), `unparsed-text-available('` + inAllowed + `')`, "false", ""},
+		{StrictPolicy(), `json-doc('` + filepath.Join(allowed, "t.json") + `')`, "", "FOUT1170"},
+		{StrictPolicy(), `empty(environment-variable('GOXPATH_POLICY_PUBLIC'))`, "true", ""},
+		{StrictPolicy(), `empty(available-environment-variables())`, "true", ""},
+		{roots, `string(doc('` + inAllowed + `'))`, "x", ""},
+		{roots, `string(doc('file://` + filepath.ToSlash(inAllowed) + `'))`, "x", ""},
+		{roots, `doc('file://` + filepath.ToSlash(inOutside) + `')`, "", "FODC0002"},
+		{roots, `unparsed-text('` + inAllowed + `')`, "<d>x</d>", ""},
+		{roots, `json-doc('` + filepath.Join(allowed, "t.json") + `')?a`, "1", ""},
+		{roots, `doc('` + inOutside + `')`, "", "FODC0002"},
+		{roots, `doc('` + filepath.Join(allowed, "..", filepath.Base(outside), "d.xml") + `')`, "", "FODC0002"},
+		{roots, `doc('` + filepath.Join(allowed, "link", "d.xml") + `')`, "", "FODC0002"},
+		{roots, `unparsed-text-available('` + inOutside + `')`, "false", ""},
+		{roots, `environment-variable('GOXPATH_POLICY_PUBLIC')`, "public", ""},
+		{roots, `empty(environment-variable('GOXPATH_POLICY_SECRET'))`, "true", ""},
+		{roots, `available-environment-variables()`, "GOXPATH_POLICY_PUBLIC", ""},
+		{&Policy{AllowedSchemes: []string{"http"}}, `doc('` + inAllowed + `')`, "", "FODC0002"},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Policy = td.policy
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	// a document read by one context is not available to a copy whose
+	// policy denies it, although the copies share the document cache
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = np.Evaluate(`doc('` + inOutside + `')`); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []*Policy{StrictPolicy(), roots} {
+		cp := CopyContext(np.Ctx)
+		cp.Policy = policy
+		np.Ctx = cp
+		if _, err = np.Evaluate(`doc('` + inOutside + `')`); err == nil {
+			t.Errorf("cached document read from a copy with a denying policy")
+		}
+		if s, err := np.EvaluateString(`doc-available('` + inOutside + `')`); err != nil || s != "false" {
+			t.Errorf("doc-available of a cached document denied by policy = %q, %v", s, err)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/speedata/goxml"
 )
 
 // TestConcurrentEvaluate verifies that the expression cache does not cause data
@@ -44,3 +46,158 @@ func TestConcurrentEvaluate(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// TestSharedContext evaluates expressions on one parser from several
+// goroutines at once. Each evaluation runs in its own frame, so the results
+// must not depend on the other evaluations and the context must stay
+// unchanged.
+func TestSharedContext(t *testing.T) {
+	const goroutines = 8
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.SetVariable("n", Sequence{2})
+	np.Ctx.Documents = map[string]*goxml.XMLDocument{"urn:doc": np.XMLDocument()}
+	np.Ctx.SetContextSequence(Sequence{np.XMLDocument()})
+	expr, err := Compile(`count($sub) + $n`, &StaticContext{Variables: map[string]Sequence{"sub": {1, 2, 3}, "n": nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		input  string
+		output string
+	}{
+		{`count(/root/sub)`, "3"},
+		{`string(/root/sub[@foo='bar'][1]/@foo)`, "bar"},
+		{`/root/sub[2]/position()`, "1"},
+		{`string-join(for $i in 1 to 3 return string($i * $n), ',')`, "2,4,6"},
+		{`count(/root/sub[last()])`, "1"},
+		{`let $x := /root/sub return count($x[position() > 1])`, "2"},
+		{`count(doc('urn:doc')//sub) = count(//sub)`, "true"},
+		{`sum((1 to 100)[. mod 2 = 0])`, "2550"},
+		{`string(current-dateTime()) = string(current-dateTime())`, "true"},
+	}
+	want := make([]string, len(testdata))
+	for i, td := range testdata {
+		if want[i], err = np.EvaluateString(td.input); err != nil {
+			t.Fatal(err)
+		}
+		if want[i] != td.output {
+			t.Fatalf("%s = %q, want %q", td.input, want[i], td.output)
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				for j, td := range testdata {
+					s, err := np.EvaluateString(td.input)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if s != want[j] {
+						t.Errorf("%s = %q, want %q", td.input, s, want[j])
+					}
+				}
+				seq, err := expr.Evaluate(np.Ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if s, _ := StringValue(seq); s != "5" {
+					t.Errorf("count($sub) + $n = %q, want 5", s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := np.Ctx.GetContextSequence(); len(got) != 1 {
+		t.Errorf("context sequence changed to %d items", len(got))
+	}
+}
+
+// TestSharedEvaluateInto fills structs from one parser on several goroutines.
+// The field expressions are evaluated in frames of their own.
+func TestSharedEvaluateInto(t *testing.T) {
+	type sub struct {
+		Foo  string `xpath:"@foo"`
+		Pos  int    `xpath:"position()"`
+		Text string `xpath:"string(.)"`
+	}
+	const goroutines = 8
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []sub
+	if err = np.EvaluateInto(`/root/sub`, &want); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				var subs []sub
+				if err := np.EvaluateInto(`/root/sub`, &subs); err != nil {
+					t.Error(err)
+					return
+				}
+				if len(subs) != len(want) {
+					t.Errorf("got %d subs, want %d", len(subs), len(want))
+					return
+				}
+				for j := range subs {
+					if subs[j] != want[j] {
+						t.Errorf("subs[%d] = %+v, want %+v", j, subs[j], want[j])
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := np.Ctx.GetContextSequence(); len(got) != 0 {
+		t.Errorf("context sequence changed to %d items", len(got))
+	}
+}
+
+// TestSharedStaticContext compiles expressions with one static context on
+// several goroutines. The functions of the context must not be changed.
+func TestSharedStaticContext(t *testing.T) {
+	const goroutines = 8
+	fn := &Function{Name: "twice", Namespace: "urn:t", Signature: MustParseSignature(`(xs:integer) as xs:integer`),
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			return Sequence{args[0][0].(int) * 2}, nil
+		}}
+	sc := NewStaticContext()
+	sc.Namespaces["t"] = "urn:t"
+	sc.Functions = []*Function{fn}
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				e, err := Compile(`t:twice(21)`, sc)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				seq, err := e.Evaluate(NewContext(nil))
+				if err != nil || len(seq) != 1 || !itemsEqual(seq[0], 42) {
+					t.Errorf("t:twice(21) = %v, %v", seq, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if fn.MinArg != 0 || fn.MaxArg != 0 {
+		t.Errorf("Compile changed the arity of the function to %d-%d", fn.MinArg, fn.MaxArg)
+	}
+}
@@ -0,0 +1,280 @@
+package goxpath
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ResourceResolver opens the resources read by fn:doc, fn:doc-available,
+// fn:unparsed-text, fn:unparsed-text-lines, fn:unparsed-text-available and
+// fn:json-doc. The URI passed to Resolve is already resolved against the base
+// URI of the context.
+type ResourceResolver interface {
+	// Resolve returns the content and the media type of the resource at
+	// uri. The media type may be empty if it is unknown. If the resolver
+	// does not know the resource, the error wraps fs.ErrNotExist.
+	Resolve(uri string) (io.ReadCloser, string, error)
+}
+
+// ResolverFunc is a function that implements ResourceResolver.
+type ResolverFunc func(uri string) (io.ReadCloser, string, error)
+
+// Resolve calls f(uri).
+func (f ResolverFunc) Resolve(uri string) (io.ReadCloser, string, error) {
+	return f(uri)
+}
+
+// DefaultResolver is used by contexts without a resolver. It reads data:
+// URIs and local files.
+var DefaultResolver ResourceResolver = MultiResolver{DataResolver{}, FileResolver{}}
+
+// MultiResolver asks each resolver in turn and returns the first resource
+// found.
+type MultiResolver []ResourceResolver
+
+// Resolve returns the resource of the first resolver that knows uri.
+func (m MultiResolver) Resolve(uri string) (io.ReadCloser, string, error) {
+	for _, r := range m {
+		rc, mediaType, err := r.Resolve(uri)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return rc, mediaType, err
+		}
+	}
+	return nil, "", notExist(uri)
+}
+
+// FileResolver reads local files. It accepts file: URIs and paths without a
+// scheme.
+type FileResolver struct{}
+
+// Resolve opens the file at uri.
+func (FileResolver) Resolve(uri string) (io.ReadCloser, string, error) {
+	name, ok := filePath(uri)
+	if !ok {
+		return nil, "", notExist(uri)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mediaTypeByName(name), nil
+}
+
+// FSResolver reads the resources from a file system such as an embed.FS or
+// an fstest.MapFS. It accepts file: URIs and paths without a scheme; leading
+// slashes are ignored.
+type FSResolver struct {
+	FS fs.FS
+}
+
+// Resolve opens the file at uri in r.FS.
+func (r FSResolver) Resolve(uri string) (io.ReadCloser, string, error) {
+	name, ok := filePath(uri)
+	if !ok {
+		return nil, "", notExist(uri)
+	}
+	name = strings.TrimLeft(path.Clean(filepath.ToSlash(name)), "/")
+	if name == "" {
+		name = "."
+	}
+	f, err := r.FS.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mediaTypeByName(name), nil
+}
+
+// MapResolver serves resources from memory. The keys are the URIs, the
+// values the contents of the resources.
+type MapResolver map[string]string
+
+// Resolve returns the content stored for uri.
+func (m MapResolver) Resolve(uri string) (io.ReadCloser, string, error) {
+	content, ok := m[uri]
+	if !ok {
+		return nil, "", notExist(uri)
+	}
+	return io.NopCloser(strings.NewReader(content)), mediaTypeByName(uri), nil
+}
+
+// DataResolver decodes data: URIs (RFC 2397) such as
+// "data:text/plain;base64,SGVsbG8=".
+type DataResolver struct{}
+
+// Resolve returns the data contained in uri.
+func (DataResolver) Resolve(uri string) (io.ReadCloser, string, error) {
+	rest, ok := cutPrefixFold(uri, "data:")
+	if !ok {
+		return nil, "", notExist(uri)
+	}
+	header, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, "", fmt.Errorf("invalid data URI: missing comma")
+	}
+	header, isBase64 := strings.CutSuffix(header, ";base64")
+	if header == "" || strings.HasPrefix(header, ";") {
+		header = "text/plain" + header
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid data URI: %w", err)
+	}
+	var content []byte
+	if isBase64 {
+		decoded, err := url.PathUnescape(data)
+		if err == nil {
+			content, err = base64.StdEncoding.DecodeString(decoded)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid data URI: %w", err)
+		}
+	} else {
+		decoded, err := url.PathUnescape(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid data URI: %w", err)
+		}
+		content = []byte(decoded)
+	}
+	return io.NopCloser(bytes.NewReader(content)), mediaType, nil
+}
+
+// resolver returns the resolver of ctx or the DefaultResolver.
+func (ctx *Context) resolver() ResourceResolver {
+	if ctx.Resolver != nil {
+		return ctx.Resolver
+	}
+	return DefaultResolver
+}
+
+// resolveURI resolves the reference ref against the static base URI of ctx.
+func (ctx *Context) resolveURI(ref string) string {
+	return resolveReference(ctx.staticBaseURI(), ref)
+}
+
+// resolveReference resolves the reference ref against base. A base URI
+// without a scheme is a file name.
+func resolveReference(base, ref string) string {
+	if hasScheme(ref) || base == "" {
+		return ref
+	}
+	if hasScheme(base) {
+		bu, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		ru, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return bu.ResolveReference(ru).String()
+	}
+	if filepath.IsAbs(ref) {
+		return ref
+	}
+	resolved := filepath.Join(filepath.Dir(base), ref)
+	if strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, string(filepath.Separator)) {
+		// keep directories such as xml:base="chapters/" usable as a base
+		resolved += string(filepath.Separator)
+	}
+	return resolved
+}
+
+// openResource checks the policy of ctx and opens the resource at the
+// resolved uri. Errors get the given code.
+func (ctx *Context) openResource(code, uri string) (io.ReadCloser, string, error) {
+	return ctx.openResourceWith(ctx.resolver(), code, uri)
+}
+
+// openResourceWith is like openResource but reads the resource with r.
+func (ctx *Context) openResourceWith(r ResourceResolver, code, uri string) (io.ReadCloser, string, error) {
+	if err := ctx.checkResource(code, uri); err != nil {
+		return nil, "", err
+	}
+	rc, mediaType, err := r.Resolve(uri)
+	if err != nil {
+		return nil, "", NewXPathError(code, fmt.Sprintf("cannot read %q: %v", uri, err))
+	}
+	return rc, mediaType, nil
+}
+
+// readResource returns the content of the resource at the resolved uri.
+func (ctx *Context) readResource(code, uri string) ([]byte, error) {
+	rc, _, err := ctx.openResource(code, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, NewXPathError(code, fmt.Sprintf("cannot read %q: %v", uri, err))
+	}
+	return data, nil
+}
+
+// resourceAvailable reports whether the resource at the resolved uri can be
+// opened.
+func (ctx *Context) resourceAvailable(uri string) bool {
+	rc, _, err := ctx.openResource("FODC0002", uri)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
+// hasScheme reports whether uri starts with a URI scheme. Single letters are
+// Windows drive letters.
+func hasScheme(uri string) bool {
+	scheme, _, ok := strings.Cut(uri, ":")
+	if !ok || len(scheme) < 2 {
+		return false
+	}
+	for i, r := range scheme {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// filePath returns the file name of a file: URI or a reference without a
+// scheme.
+func filePath(uri string) (string, bool) {
+	if !hasScheme(uri) {
+		return uri, true
+	}
+	u, err := url.Parse(uri)
+	if err != nil || !strings.EqualFold(u.Scheme, "file") {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+func mediaTypeByName(name string) string {
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	return mediaType
+}
+
+func notExist(uri string) error {
+	return &fs.PathError{Op: "resolve", Path: uri, Err: fs.ErrNotExist}
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
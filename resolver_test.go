@@ -0,0 +1,123 @@
+package goxpath
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestResourceResolver(t *testing.T) {
+	mapfs := fstest.MapFS{
+		"a.xml":       {Data: []byte(`<a>fs</a>`)},
+		"dir/t.txt":   {Data: []byte("one\ntwo")},
+		"dir/j.json":  {Data: []byte(`{"n": 2}`)},
+		"dir/sub.xml": {Data: []byte(`<sub/>`)},
+	}
+	web := MapResolver{
+		"http://example.com/x/b.xml": `<b>web</b>`,
+		"c.txt":                      "memory",
+	}
+	testdata := []struct {
+		resolver ResourceResolver
+		base     string
+		input    string
+		output   string
+		code     string
+	}{
+		{FSResolver{mapfs}, "", `string(doc('a.xml'))`, "fs", ""},
+		{FSResolver{mapfs}, "", `string(doc('/a.xml'))`, "fs", ""},
+		{FSResolver{mapfs}, "", `string(doc('file:///a.xml'))`, "fs", ""},
+		{FSResolver{mapfs}, "dir/base.xml", `local-name(doc('sub.xml')/*)`, "sub", ""},
+		{FSResolver{mapfs}, "", `unparsed-text('dir/t.txt')`, "one\ntwo", ""},
+		{FSResolver{mapfs}, "", `count(unparsed-text-lines('dir/t.txt'))`, "2", ""},
+		{FSResolver{mapfs}, "", `json-doc('dir/j.json')?n`, "2", ""},
+		{FSResolver{mapfs}, "", `doc-available('a.xml')`, "true", ""},
+		{FSResolver{mapfs}, "", `doc-available('missing.xml')`, "false", ""},
+		{FSResolver{mapfs}, "", `unparsed-text-available('dir/t.txt')`, "true", ""},
+		{FSResolver{mapfs}, "", `unparsed-text-available('t.txt')`, "false", ""},
+		{FSResolver{mapfs}, "", `doc('missing.xml')`, "", "FODC0002"},
+		{FSResolver{mapfs}, "", `unparsed-text('missing.txt')`, "", "FOUT1170"},
+		{FSResolver{mapfs}, "", `json-doc('missing.json')`, "", "FOUT1170"},
+		{FSResolver{mapfs}, "", `unparsed-text('http://example.com/x/b.xml')`, "", "FOUT1170"},
+		{web, "http://example.com/x/base.xml", `string(doc('b.xml'))`, "web", ""},
+		{web, "http://example.com/y/", `string(doc('../x/b.xml'))`, "web", ""},
+		{web, "", `unparsed-text('c.txt')`, "memory", ""},
+		{nil, "", `unparsed-text('data:,Hello%20World')`, "Hello World", ""},
+		{nil, "", `unparsed-text('data:text/plain;base64,SGk=')`, "Hi", ""},
+		{nil, "", `json-doc('data:application/json,{"a":[1,2]}')?a?2`, "2", ""},
+		{nil, "", `string(doc('data:application/xml,<a>data</a>'))`, "data", ""},
+		{nil, "", `unparsed-text('data:;base64,***')`, "", "FOUT1170"},
+		{MultiResolver{web, FSResolver{mapfs}}, "", `unparsed-text('c.txt') || string(doc('a.xml'))`, "memoryfs", ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Resolver = td.resolver
+		if td.base != "" {
+			np.Ctx.Store = map[any]any{"baseURI": td.base}
+		}
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.Ctx.Policy = StrictPolicy()
+	if _, err = np.Evaluate(`unparsed-text('data:,x')`); err == nil {
+		t.Errorf("StrictPolicy allows data: URIs")
+	}
+}
+
+func TestResolverMediaType(t *testing.T) {
+	var requested string
+	fn := ResolverFunc(func(uri string) (io.ReadCloser, string, error) {
+		requested = uri
+		return io.NopCloser(strings.NewReader("x")), "text/x-test", nil
+	})
+	for _, td := range []struct {
+		resolver  ResourceResolver
+		uri       string
+		mediaType string
+	}{
+		{DataResolver{}, "data:,x", "text/plain"},
+		{DataResolver{}, "data:application/json;charset=utf-8,{}", "application/json"},
+		{MapResolver{"a.json": "{}"}, "a.json", "application/json"},
+		{FSResolver{fstest.MapFS{"d/a.json": {}}}, "file:///d/a.json", "application/json"},
+		{fn, "urn:x", "text/x-test"},
+	} {
+		rc, mediaType, err := td.resolver.Resolve(td.uri)
+		if err != nil {
+			t.Errorf("Resolve(%q): %s", td.uri, err)
+			continue
+		}
+		rc.Close()
+		if mediaType != td.mediaType {
+			t.Errorf("Resolve(%q) media type = %q, want %q", td.uri, mediaType, td.mediaType)
+		}
+	}
+	if requested != "urn:x" {
+		t.Errorf("ResolverFunc got %q, want urn:x", requested)
+	}
+	if _, _, err := (MultiResolver{DataResolver{}, MapResolver{}}).Resolve("a.xml"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("MultiResolver.Resolve(unknown) = %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,359 @@
+package goxpath
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+// EvaluateString evaluates the XPath expression and returns the string value
+// of the result. An empty result gives the empty string, a result with more
+// than one item is an error (XPTY0004).
+func (xp *Parser) EvaluateString(xpath string) (string, error) {
+	seq, err := xp.Evaluate(xpath)
+	if err != nil {
+		return "", err
+	}
+	if err = zeroOrOne(seq); err != nil {
+		return "", err
+	}
+	return StringValue(seq)
+}
+
+// EvaluateBool evaluates the XPath expression and returns the effective
+// boolean value of the result, as used by if and predicates.
+func (xp *Parser) EvaluateBool(xpath string) (bool, error) {
+	seq, err := xp.Evaluate(xpath)
+	if err != nil {
+		return false, err
+	}
+	return BooleanValue(seq)
+}
+
+// EvaluateFloat evaluates the XPath expression and returns the result cast to
+// xs:double. The result must be exactly one item (XPTY0004) that can be cast
+// to a number (FORG0001).
+func (xp *Parser) EvaluateFloat(xpath string) (float64, error) {
+	seq, err := xp.Evaluate(xpath)
+	if err != nil {
+		return 0, err
+	}
+	if err = exactlyOne(seq); err != nil {
+		return 0, err
+	}
+	return floatValue(seq[0])
+}
+
+// EvaluateInt evaluates the XPath expression and returns the result cast to
+// xs:integer. The result must be exactly one item (XPTY0004) that can be
+// cast to an integer (FORG0001, FOCA0003). A number with a fractional part
+// is an error (XPTY0004).
+func (xp *Parser) EvaluateInt(xpath string) (int, error) {
+	seq, err := xp.Evaluate(xpath)
+	if err != nil {
+		return 0, err
+	}
+	if err = exactlyOne(seq); err != nil {
+		return 0, err
+	}
+	return intValue(seq[0])
+}
+
+// EvaluateNodes evaluates the XPath expression and returns the nodes of the
+// result. Atomic values in the result are an error (XPTY0004).
+func (xp *Parser) EvaluateNodes(xpath string) ([]goxml.XMLNode, error) {
+	seq, err := xp.Evaluate(xpath)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]goxml.XMLNode, 0, len(seq))
+	for _, itm := range seq {
+		n, ok := itm.(goxml.XMLNode)
+		if !ok {
+			return nil, NewXPathError("XPTY0004", fmt.Sprintf("expected nodes, got %s", describeItem(itm)))
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// EvaluateInto evaluates the XPath expression and stores the result in the
+// value pointed to by v. The result is converted depending on the type of v:
+//
+//   - string, bool, integer and floating point types take the string value
+//     or the value cast to xs:boolean, xs:integer or xs:double of a single
+//     item. An empty result leaves the zero value.
+//   - time.Time takes an xs:dateTime, xs:date or xs:time or a string that
+//     can be cast to xs:dateTime.
+//   - Sequence takes the whole result, any and other interface types a
+//     single item.
+//   - A pointer is nil for an empty result and points to the converted value
+//     otherwise.
+//   - A slice takes one element per item.
+//   - A map takes the entries of a single XPathMap. Two keys that convert
+//     to the same Go value are an error (XPTY0004).
+//   - A struct is filled from a single item: each field with an xpath tag
+//     is set to the result of the tag's expression, evaluated with the item
+//     as the context item. Fields without a tag or with the tag "-" are
+//     skipped.
+//
+// For example
+//
+//	type Item struct {
+//		ID    string   `xpath:"@id"`
+//		Title string   `xpath:"title"`
+//		Tags  []string `xpath:"tag"`
+//	}
+//	var items []Item
+//	err := xp.EvaluateInto("/catalog/item", &items)
+//
+// A result with too many items or an item that can't be converted is an
+// error (XPTY0004 or the error of the failing cast) that names the field.
+func (xp *Parser) EvaluateInto(xpath string, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("EvaluateInto needs a non-nil pointer, got %T", v)
+	}
+	seq, err := xp.Evaluate(xpath)
+	if err != nil {
+		return err
+	}
+	return xp.bind(seq, rv.Elem(), "")
+}
+
+var (
+	sequenceType = reflect.TypeFor[Sequence]()
+	timeType     = reflect.TypeFor[time.Time]()
+)
+
+// bind stores seq in v. path is the field path of v used in error messages.
+func (xp *Parser) bind(seq Sequence, v reflect.Value, path string) error {
+	fail := func(err error) error {
+		return fieldError(path, err)
+	}
+	if v.Type() == sequenceType {
+		v.Set(reflect.ValueOf(seq))
+		return nil
+	}
+	if len(seq) == 1 && seq[0] != nil && reflect.TypeOf(seq[0]).AssignableTo(v.Type()) {
+		v.Set(reflect.ValueOf(seq[0]))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), len(seq), len(seq))
+		for i, itm := range seq {
+			if err := xp.bind(Sequence{itm}, s.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.Pointer:
+		if len(seq) == 0 {
+			v.SetZero()
+			return nil
+		}
+		p := reflect.New(v.Type().Elem())
+		if err := xp.bind(seq, p.Elem(), path); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+
+	if err := zeroOrOne(seq); err != nil {
+		return fail(err)
+	}
+	if len(seq) == 0 {
+		v.SetZero()
+		return nil
+	}
+	itm := seq[0]
+	if v.Type() == timeType {
+		t, err := timeValue(itm)
+		if err != nil {
+			return fail(err)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(itemStringvalue(itm))
+	case reflect.Bool:
+		b, err := xsBoolean(nil, []Sequence{seq})
+		if err != nil {
+			return fail(err)
+		}
+		v.SetBool(b[0].(bool))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := intValue(itm)
+		if err != nil {
+			return fail(err)
+		}
+		if v.OverflowInt(int64(i)) {
+			return fail(NewXPathError("FOCA0003", fmt.Sprintf("%d does not fit into %s", i, v.Type())))
+		}
+		v.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := intValue(itm)
+		if err != nil {
+			return fail(err)
+		}
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return fail(NewXPathError("FOCA0003", fmt.Sprintf("%d does not fit into %s", i, v.Type())))
+		}
+		v.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		f, err := floatValue(itm)
+		if err != nil {
+			return fail(err)
+		}
+		v.SetFloat(f)
+	case reflect.Map:
+		m, ok := itm.(*XPathMap)
+		if !ok {
+			return fail(NewXPathError("XPTY0004", fmt.Sprintf("expected a map, got %s", describeItem(itm))))
+		}
+		mv := reflect.MakeMapWithSize(v.Type(), m.Size())
+		for _, entry := range m.Entries {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := xp.bind(Sequence{entry.Key}, key, path); err != nil {
+				return err
+			}
+			if mv.MapIndex(key).IsValid() {
+				return fail(NewXPathError("XPTY0004", fmt.Sprintf("map has more than one key that converts to %v", key)))
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := xp.bind(entry.Value, val, fmt.Sprintf("%s[%s]", path, itemStringvalue(entry.Key))); err != nil {
+				return err
+			}
+			mv.SetMapIndex(key, val)
+		}
+		v.Set(mv)
+	case reflect.Struct:
+		return xp.bindStruct(itm, v, path)
+	default:
+		return fail(NewXPathError("XPTY0004", fmt.Sprintf("cannot store %s in a value of type %s", describeItem(itm), v.Type())))
+	}
+	return nil
+}
+
+// bindStruct fills the tagged fields of v with the results of their
+// expressions, evaluated with itm as the context item.
+func (xp *Parser) bindStruct(itm Item, v reflect.Value, path string) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		expr, ok := field.Tag.Lookup("xpath")
+		if !ok || expr == "-" || !field.IsExported() {
+			continue
+		}
+		fieldPath := field.Name
+		if path != "" {
+			fieldPath = path + "." + field.Name
+		}
+		// evaluate in a frame of its own, xp.Ctx may be shared
+		evaler, err := xp.cached(expr)
+		if err != nil {
+			return fieldError(fieldPath, err)
+		}
+		seq, err := xp.run(context.Background(), expr, evaler, itm)
+		if err != nil {
+			return fieldError(fieldPath, err)
+		}
+		if err = xp.bind(seq, v.Field(i), fieldPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldError prefixes the message of err with the field path.
+func fieldError(path string, err error) error {
+	if path == "" {
+		return err
+	}
+	if xe, ok := err.(*XPathError); ok {
+		cp := *xe
+		cp.Description = path + ": " + xe.Description
+		return &cp
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+func exactlyOne(seq Sequence) error {
+	if len(seq) != 1 {
+		return NewXPathError("XPTY0004", fmt.Sprintf("expected exactly one item, got %d", len(seq)))
+	}
+	return nil
+}
+
+func zeroOrOne(seq Sequence) error {
+	if len(seq) > 1 {
+		return NewXPathError("XPTY0004", fmt.Sprintf("expected at most one item, got %d", len(seq)))
+	}
+	return nil
+}
+
+func floatValue(itm Item) (float64, error) {
+	d, err := xsDouble(nil, []Sequence{{itm}})
+	if err != nil {
+		return 0, err
+	}
+	return float64(d[0].(XSDouble)), nil
+}
+
+func intValue(itm Item) (int, error) {
+	if f, ok := ToFloat64(itm); ok {
+		if math.IsInf(f, 0) || math.Abs(f) >= 1<<63 {
+			return 0, NewXPathError("FOCA0003", fmt.Sprintf("%v is outside the range of xs:integer", f))
+		}
+		if f != math.Trunc(f) {
+			return 0, NewXPathError("XPTY0004", fmt.Sprintf("%v is not an integer", f))
+		}
+	}
+	i, err := xsInteger(nil, []Sequence{{itm}})
+	if err != nil {
+		return 0, err
+	}
+	return i[0].(int), nil
+}
+
+func timeValue(itm Item) (time.Time, error) {
+	switch t := itm.(type) {
+	case XSDateTime:
+		return time.Time(t), nil
+	case XSDate:
+		return time.Time(t), nil
+	case XSTime:
+		return time.Time(t), nil
+	}
+	dt, err := xsDateTime(nil, []Sequence{{itm}})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Time(dt[0].(XSDateTime)), nil
+}
+
+// describeItem returns the XPath type of itm for error messages.
+func describeItem(itm Item) string {
+	switch itm.(type) {
+	case goxml.XMLNode:
+		return "a node"
+	case *XPathMap:
+		return "a map"
+	case *XPathArray:
+		return "an array"
+	}
+	if t := TypeIDOf(itm); t != "unknown" {
+		return t
+	}
+	return fmt.Sprintf("a value of type %T", itm)
+}
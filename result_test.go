@@ -0,0 +1,152 @@
+package goxpath
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+func TestEvaluateTyped(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := np.EvaluateString(`/root/sub[2]`); err != nil || s != "sub2" {
+		t.Errorf("EvaluateString = %q, %v, want sub2", s, err)
+	}
+	if s, err := np.EvaluateString(`/root/@nothing`); err != nil || s != "" {
+		t.Errorf("EvaluateString(empty) = %q, %v, want empty string", s, err)
+	}
+	if _, err := np.EvaluateString(`/root/sub`); err == nil {
+		t.Errorf("EvaluateString of three items succeeded")
+	}
+	if b, err := np.EvaluateBool(`/root/sub[@foo = 'bar']`); err != nil || !b {
+		t.Errorf("EvaluateBool = %t, %v, want true", b, err)
+	}
+	if f, err := np.EvaluateFloat(`/root/sub[1] div 2`); err != nil || f != 61.5 {
+		t.Errorf("EvaluateFloat = %g, %v, want 61.5", f, err)
+	}
+	if _, err := np.EvaluateFloat(`/root/sub[2]`); err == nil {
+		t.Errorf("EvaluateFloat('sub2') succeeded")
+	}
+	if i, err := np.EvaluateInt(`count(//sub)`); err != nil || i != 7 {
+		t.Errorf("EvaluateInt = %d, %v, want 7", i, err)
+	}
+	if i, err := np.EvaluateInt(`/root/@one`); err != nil || i != 1 {
+		t.Errorf("EvaluateInt(@one) = %d, %v, want 1", i, err)
+	}
+	for _, expr := range []string{`1.5`, `xs:double('NaN')`, `/root/sub[1] div 2`} {
+		if _, err := np.EvaluateInt(expr); err == nil {
+			t.Errorf("EvaluateInt(%s) succeeded", expr)
+		} else if code, _ := XPathErrorCode(err); code != "XPTY0004" {
+			t.Errorf("EvaluateInt(%s) error code = %q, want XPTY0004 (%v)", expr, code, err)
+		}
+	}
+	_, err = np.EvaluateInt(`()`)
+	if code, _ := XPathErrorCode(err); code != "XPTY0004" {
+		t.Errorf("EvaluateInt(()) error code = %q, want XPTY0004 (%v)", code, err)
+	}
+	for _, expr := range []string{`1e20`, `-1e19`, `xs:double('INF')`, `xs:float('-INF')`} {
+		_, err = np.EvaluateInt(expr)
+		if code, _ := XPathErrorCode(err); code != "FOCA0003" {
+			t.Errorf("EvaluateInt(%s) error code = %q, want FOCA0003 (%v)", expr, code, err)
+		}
+	}
+	nodes, err := np.EvaluateNodes(`//subsub`)
+	if err != nil || len(nodes) != 3 {
+		t.Errorf("EvaluateNodes = %v, %v, want 3 nodes", nodes, err)
+	}
+	if _, err := np.EvaluateNodes(`(//subsub, 1)`); err == nil {
+		t.Errorf("EvaluateNodes with an integer succeeded")
+	}
+}
+
+func TestEvaluateInto(t *testing.T) {
+	type sub struct {
+		Foo     string   `xpath:"@foo"`
+		Text    string   `xpath:"."`
+		Attrs   int      `xpath:"count(@*)"`
+		Self    *string  `xpath:"@self"`
+		Subsub  []string `xpath:"subsub"`
+		Skipped string
+		Ignored string `xpath:"-"`
+	}
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subs []sub
+	if err = np.EvaluateInto(`/root/sub`, &subs); err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 3 {
+		t.Fatalf("got %d subs, want 3", len(subs))
+	}
+	if s := subs[0]; s.Foo != "baz" || s.Text != "123" || s.Attrs != 2 || s.Self != nil || len(s.Subsub) != 0 {
+		t.Errorf("subs[0] = %+v", s)
+	}
+	if s := subs[2]; s.Self == nil || *s.Self != "sub3" || len(s.Subsub) != 1 || s.Subsub[0] != "subsub" {
+		t.Errorf("subs[2] = %+v", s)
+	}
+
+	var m map[string]int
+	if err = np.EvaluateInto(`map { 'a': 1, 'b': 2 }`, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["a"] != 1 || m["b"] != 2 {
+		t.Errorf("map = %v", m)
+	}
+	err = np.EvaluateInto(`map { 1: 1, '1': 2 }`, &m)
+	if code, _ := XPathErrorCode(err); code != "XPTY0004" {
+		t.Errorf("EvaluateInto(map with keys 1 and '1') error code = %q, want XPTY0004 (%v)", code, err)
+	}
+
+	var rec struct {
+		Name  string    `xpath:"?name"`
+		Born  time.Time `xpath:"?born"`
+		Score float64   `xpath:"?score"`
+		Ok    bool      `xpath:"?ok"`
+	}
+	if err = np.EvaluateInto(`map { 'name': 'x', 'born': xs:date('2001-02-03'), 'score': 1.5, 'ok': 'true' }`, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Name != "x" || rec.Born.Year() != 2001 || rec.Score != 1.5 || !rec.Ok {
+		t.Errorf("record = %+v", rec)
+	}
+
+	var elt *goxml.Element
+	if err = np.EvaluateInto(`/root`, &elt); err != nil || elt == nil || elt.Name != "root" {
+		t.Errorf("EvaluateInto(*goxml.Element) = %v, %v", elt, err)
+	}
+	var seq Sequence
+	if err = np.EvaluateInto(`1 to 3`, &seq); err != nil || len(seq) != 3 {
+		t.Errorf("EvaluateInto(Sequence) = %v, %v", seq, err)
+	}
+
+	var bad []struct {
+		Foo int `xpath:"@foo"`
+	}
+	err = np.EvaluateInto(`/root/sub`, &bad)
+	if err == nil || !strings.Contains(err.Error(), "[0].Foo") {
+		t.Errorf("EvaluateInto with a type mismatch: error %v, want an error naming [0].Foo", err)
+	}
+	var one struct {
+		Sub string `xpath:"sub"`
+	}
+	err = np.EvaluateInto(`/root`, &one)
+	if code, _ := XPathErrorCode(err); code != "XPTY0004" {
+		t.Errorf("EvaluateInto with a cardinality mismatch: error code %q, want XPTY0004 (%v)", code, err)
+	}
+	var big struct {
+		N int64 `xpath:"xs:double('1e19')"`
+	}
+	err = np.EvaluateInto(`/root`, &big)
+	if code, _ := XPathErrorCode(err); code != "FOCA0003" {
+		t.Errorf("EvaluateInto with a double outside the int64 range: error code %q, want FOCA0003 (%v)", code, err)
+	}
+	if err = np.EvaluateInto(`1`, one); err == nil {
+		t.Errorf("EvaluateInto with a non-pointer succeeded")
+	}
+}
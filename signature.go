@@ -0,0 +1,338 @@
+package goxpath
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Signature declares the types of the parameters and of the result of a
+// Function. When a function with a signature is called, each argument is
+// converted to its parameter type with the function conversion rules of
+// XPath: for atomic types the argument is atomized, xs:untypedAtomic values
+// are cast to the parameter type, integers and decimals are promoted to
+// xs:float and xs:double and xs:anyURI to xs:string. An argument that does
+// not match its type after the conversion and a result that does not match
+// Result are errors (XPTY0004).
+type Signature struct {
+	// Params are the types of the parameters. If the function accepts an
+	// unlimited number of arguments (MaxArg -1), the last type applies to
+	// all remaining arguments.
+	Params []*SequenceType
+	// Result is the type of the result, nil means item()*.
+	Result *SequenceType
+
+	once   sync.Once
+	params []typeMatcher
+	result typeMatcher
+}
+
+// ParseSignature parses a signature in the form used in the XPath function
+// catalog, for example "(xs:string, xs:integer?) as xs:string". The result
+// type is optional.
+func ParseSignature(s string) (*Signature, error) {
+	tl, err := stringToTokenlist(s)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := parseSignature(tl)
+	if err != nil {
+		return nil, staticError(err, tl.errorPosition())
+	}
+	return sig, nil
+}
+
+// MustParseSignature is like ParseSignature but panics if the signature
+// cannot be parsed.
+func MustParseSignature(s string) *Signature {
+	sig, err := ParseSignature(s)
+	if err != nil {
+		panic(fmt.Sprintf("goxpath: ParseSignature(%q): %s", s, err))
+	}
+	return sig
+}
+
+func parseSignature(tl *Tokenlist) (*Signature, error) {
+	sig := &Signature{}
+	if err := tl.skipType(tokOpenParen); err != nil {
+		return nil, fmt.Errorf("'(' expected in signature")
+	}
+	for !tl.nexttokIsTyp(tokCloseParen) {
+		st, err := parseSignatureType(tl)
+		if err != nil {
+			return nil, err
+		}
+		sig.Params = append(sig.Params, st)
+		if !tl.nexttokIsTyp(tokComma) {
+			break
+		}
+		tl.read()
+	}
+	if err := tl.skipType(tokCloseParen); err != nil {
+		return nil, fmt.Errorf("')' expected in signature")
+	}
+	if tl.nexttokIsValue("as") {
+		tl.read()
+		st, err := parseSignatureType(tl)
+		if err != nil {
+			return nil, err
+		}
+		sig.Result = st
+	}
+	if _, err := tl.peek(); err == nil {
+		return nil, fmt.Errorf("unexpected text after signature")
+	}
+	return sig, nil
+}
+
+func parseSignatureType(tl *Tokenlist) (*SequenceType, error) {
+	st, err := parseSequenceType(tl)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Empty && st.ItemType == nil {
+		return nil, fmt.Errorf("unknown item type")
+	}
+	if err := checkAtomicType(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// String returns the signature in the form accepted by ParseSignature.
+func (s *Signature) String() string {
+	params := make([]string, len(s.Params))
+	for i, p := range s.Params {
+		params[i] = p.String()
+	}
+	str := "(" + strings.Join(params, ", ") + ")"
+	if s.Result != nil {
+		str += " as " + s.Result.String()
+	}
+	return str
+}
+
+// typeMatcher converts a value to a sequence type and reports whether the
+// value matches.
+type typeMatcher struct {
+	st      *SequenceType
+	test    testFunc
+	atomic  string // the name of an atomic item type such as xs:integer
+	convert bool   // apply the function conversion rules
+}
+
+func newTypeMatcher(st *SequenceType, convert bool) typeMatcher {
+	m := typeMatcher{st: st}
+	if st == nil || st.Empty {
+		return m
+	}
+	m.test = compileSequenceType(st)
+	if at, ok := st.ItemType.(*AtomicType); ok {
+		m.atomic = at.Name
+		m.convert = convert
+	}
+	return m
+}
+
+// match converts seq and returns an error if the result does not match the
+// type.
+func (m typeMatcher) match(ctx *Context, seq Sequence) (Sequence, error) {
+	st := m.st
+	if st == nil {
+		return seq, nil
+	}
+	if st.Empty {
+		if len(seq) > 0 {
+			return nil, fmt.Errorf("expected empty-sequence(), got %d items", len(seq))
+		}
+		return seq, nil
+	}
+	if m.convert {
+		atomized := atomizeSequence(seq)
+		converted := make(Sequence, len(atomized))
+		for i, itm := range atomized {
+			var err error
+			if converted[i], err = convertAtomic(ctx, itm, m.atomic); err != nil {
+				return nil, err
+			}
+		}
+		seq = converted
+	}
+	switch st.Occurrence {
+	case "":
+		if len(seq) != 1 {
+			return nil, fmt.Errorf("expected %s, got %d items", st, len(seq))
+		}
+	case "?":
+		if len(seq) > 1 {
+			return nil, fmt.Errorf("expected %s, got %d items", st, len(seq))
+		}
+	case "+":
+		if len(seq) == 0 {
+			return nil, fmt.Errorf("expected %s, got an empty sequence", st)
+		}
+	}
+	for _, itm := range seq {
+		if m.test != nil && !m.test(ctx, itm) {
+			return nil, fmt.Errorf("expected %s, got %s", st, describeItem(itm))
+		}
+	}
+	return seq, nil
+}
+
+// convertAtomic casts an xs:untypedAtomic value to the atomic type and
+// applies numeric and URI promotion.
+func convertAtomic(ctx *Context, itm Item, atomic string) (Item, error) {
+	switch t := itm.(type) {
+	case XSUntypedAtomic:
+		target := strings.TrimPrefix(atomic, "xs:")
+		switch target {
+		case "untypedAtomic", "anyAtomicType":
+			return itm, nil
+		case "numeric":
+			target = "double"
+		}
+		cast := getfunction(nsXS, target)
+		if cast == nil {
+			return itm, nil
+		}
+		seq, err := cast.F(ctx, []Sequence{{t}})
+		if err != nil {
+			return nil, err
+		}
+		if len(seq) == 1 {
+			return seq[0], nil
+		}
+	case int, XSInteger, XSDecimal:
+		f, _ := ToFloat64(t)
+		switch atomic {
+		case "xs:double":
+			return XSDouble(f), nil
+		case "xs:float":
+			return XSFloat(f), nil
+		}
+	case XSFloat:
+		if atomic == "xs:double" {
+			return XSDouble(t), nil
+		}
+	case XSAnyURI:
+		if atomic == "xs:string" {
+			return string(t), nil
+		}
+	}
+	return itm, nil
+}
+
+func (s *Signature) compile() {
+	s.once.Do(func() {
+		s.params = make([]typeMatcher, len(s.Params))
+		for i, p := range s.Params {
+			s.params[i] = newTypeMatcher(p, true)
+		}
+		s.result = newTypeMatcher(s.Result, false)
+	})
+}
+
+// call converts the arguments, calls f and checks the result.
+func (f *Function) call(ctx *Context, args []Sequence) (Sequence, error) {
+	sig := f.Signature
+	if sig == nil {
+		return f.F(ctx, args)
+	}
+	sig.compile()
+	if len(sig.params) > 0 {
+		converted := make([]Sequence, len(args))
+		for i, arg := range args {
+			var err error
+			m := sig.params[min(i, len(sig.params)-1)]
+			if converted[i], err = m.match(ctx, arg); err != nil {
+				return nil, signatureError(err, fmt.Sprintf("argument %d of %s()", i+1, f.Name))
+			}
+		}
+		args = converted
+	}
+	seq, err := f.F(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if seq, err = sig.result.match(ctx, seq); err != nil {
+		return nil, signatureError(err, fmt.Sprintf("result of %s()", f.Name))
+	}
+	return seq, nil
+}
+
+// signatureError turns an error of a type conversion into an XPathError.
+// Errors of a cast keep their code.
+func signatureError(err error, what string) error {
+	if _, ok := err.(*XPathError); !ok {
+		err = NewXPathError("XPTY0004", err.Error())
+	}
+	return fieldError(what, err)
+}
+
+// acceptsArity reports whether f can be called with n arguments.
+func (f *Function) acceptsArity(n int) bool {
+	return (f.MinArg <= 0 || n >= f.MinArg) && (f.MaxArg < 0 || n <= f.MaxArg)
+}
+
+// withArity returns f or, if the arity of f is taken from its signature, a
+// copy of f with MinArg and MaxArg set. The functions of a StaticContext
+// belong to the caller and may be shared by concurrent calls of Compile, so
+// they are never changed.
+func (f *Function) withArity() *Function {
+	if f.Signature == nil || f.MinArg != 0 || f.MaxArg != 0 {
+		return f
+	}
+	g := *f
+	g.setArityFromSignature()
+	return &g
+}
+
+// setArityFromSignature sets MinArg and MaxArg to the number of parameters
+// of the signature if neither is set.
+func (f *Function) setArityFromSignature() {
+	if f.Signature != nil && f.MinArg == 0 && f.MaxArg == 0 {
+		f.MinArg, f.MaxArg = len(f.Signature.Params), len(f.Signature.Params)
+	}
+}
+
+// String returns the name of the function in the form Q{namespace}name
+// followed by the signature or, if there is none, the number of arguments
+// such as #2, #1-3 or #2-*.
+func (f *Function) String() string {
+	name := "Q{" + f.Namespace + "}" + f.Name
+	if f.Signature != nil {
+		return name + f.Signature.String()
+	}
+	switch {
+	case f.MaxArg < 0:
+		return fmt.Sprintf("%s#%d-*", name, f.MinArg)
+	case f.MinArg == f.MaxArg:
+		return fmt.Sprintf("%s#%d", name, f.MinArg)
+	}
+	return fmt.Sprintf("%s#%d-%d", name, f.MinArg, f.MaxArg)
+}
+
+// LookupFunction returns the function that a call of namespace:name resolves
+// to in ctx, or nil if there is none. Functions of the static context of the
+// expression being evaluated take precedence over ctx.Library. If the
+// function is overloaded, one of the overloads is returned, see
+// LookupFunctionArity.
+func (ctx *Context) LookupFunction(namespace, name string) *Function {
+	return ctx.lookupFunction(namespace, name, -1)
+}
+
+// LookupFunctionArity returns the overload of namespace:name that a call
+// with arity arguments resolves to in ctx, or nil if there is none.
+func (ctx *Context) LookupFunctionArity(namespace, name string, arity int) *Function {
+	if arity < 0 {
+		return nil
+	}
+	return ctx.lookupFunction(namespace, name, arity)
+}
+
+// RegisteredFunctions returns all registered functions ordered by namespace,
+// name and number of arguments.
+func RegisteredFunctions() []*Function {
+	return defaultLibrary.Functions()
+}
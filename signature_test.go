@@ -0,0 +1,158 @@
+package goxpath
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseSignature(t *testing.T) {
+	testdata := []struct {
+		input  string
+		output string
+	}{
+		{`()`, `()`},
+		{`() as xs:string`, `() as xs:string`},
+		{`(xs:string, xs:integer?) as xs:string*`, `(xs:string, xs:integer?) as xs:string*`},
+		{`(item()*, node()) as empty-sequence()`, `(item()*, node()) as empty-sequence()`},
+		{`(map(*), element(a)+)`, `(map(*), element(a)+)`},
+	}
+	for _, td := range testdata {
+		sig, err := ParseSignature(td.input)
+		if err != nil {
+			t.Errorf("ParseSignature(%q): %s", td.input, err)
+			continue
+		}
+		if got := sig.String(); got != td.output {
+			t.Errorf("ParseSignature(%q) = %q, want %q", td.input, got, td.output)
+		}
+	}
+	for _, input := range []string{`xs:string`, `(xs:string`, `(xs:nosuchtype)`, `() as`, `() xs:string`} {
+		if _, err := ParseSignature(input); err == nil {
+			t.Errorf("ParseSignature(%q) succeeded", input)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	const ns = "urn:goxpath:test:signature"
+	describe := func(ctx *Context, args []Sequence) (Sequence, error) {
+		var parts []string
+		for _, arg := range args {
+			for _, itm := range arg {
+				parts = append(parts, fmt.Sprintf("%s(%s)", TypeIDOf(itm), itemStringvalue(itm)))
+			}
+		}
+		return Sequence{strings.Join(parts, " ")}, nil
+	}
+	RegisterFunction(&Function{Name: "types", Namespace: ns, F: describe,
+		Signature: MustParseSignature(`(xs:double, xs:integer?, xs:string*) as xs:string`)})
+	RegisterFunction(&Function{Name: "variadic", Namespace: ns, F: describe, MinArg: 1, MaxArg: -1,
+		Signature: MustParseSignature(`(xs:float)`)})
+	RegisterFunction(&Function{Name: "bad-result", Namespace: ns, F: func(ctx *Context, args []Sequence) (Sequence, error) {
+		return Sequence{1, 2}, nil
+	}, Signature: MustParseSignature(`() as xs:integer`)})
+
+	testdata := []struct {
+		input  string
+		output string
+		code   string
+	}{
+		{`s:types(1, 2, 'a')`, "xs:double(1) xs:integer(2) xs:string(a)", ""},
+		{`s:types(xs:float(1.5), (), ())`, "xs:double(1.5)", ""},
+		{`s:types(/root/@one, /root/@one, (/root/sub[2], xs:anyURI('u')))`, "xs:double(1) xs:integer(1) xs:string(sub2) xs:string(u)", ""},
+		{`s:variadic(1, 2, /root/@one)`, "xs:float(1) xs:float(2) xs:float(1)", ""},
+		{`s:types('1', (), ())`, "", "XPTY0004"},
+		{`s:types(1, (1, 2), ())`, "", "XPTY0004"},
+		{`s:types(1, 2.5, ())`, "", "XPTY0004"},
+		{`s:types(/root/sub[2], (), ())`, "", "FORG0001"},
+		{`s:types(1, 2)`, "", "XPST0017"},
+		{`s:bad-result()`, "", "XPTY0004"},
+		{`function-lookup(QName('` + ns + `', 'types'), 3)(1, 2, 'a')`, "xs:double(1) xs:integer(2) xs:string(a)", ""},
+		{`function-lookup(QName('` + ns + `', 'types'), 3)('x', 2, 'a')`, "", "XPTY0004"},
+		{`s:types#3(1, (), 'b')`, "xs:double(1) xs:string(b)", ""},
+		{`s:types#3('x', (), 'b')`, "", "XPTY0004"},
+		{`empty(function-lookup(QName('` + ns + `', 'types'), 2))`, "true", ""},
+		{`function-arity(function-lookup(QName('` + ns + `', 'variadic'), 4))`, "4", ""},
+		{`empty(function-lookup(xs:QName('fn:concat'), 1))`, "true", ""},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Ctx.Namespaces["s"] = ns
+		s, err := np.EvaluateString(td.input)
+		if td.code != "" {
+			if code, _ := XPathErrorCode(err); code != td.code {
+				t.Errorf("%s: error code %q, want %q (%v)", td.input, code, td.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+}
+
+func TestFunctionIntrospection(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, td := range []struct {
+		ns, name, output string
+	}{
+		{nsFN, "concat", "Q{" + nsFN + "}concat#2-*"},
+		{nsFN, "substring", "Q{" + nsFN + "}substring#2-3"},
+		{nsFN, "count", "Q{" + nsFN + "}count#1"},
+	} {
+		f := np.Ctx.LookupFunction(td.ns, td.name)
+		if f == nil {
+			t.Errorf("LookupFunction(%s) = nil", td.name)
+			continue
+		}
+		if got := f.String(); got != td.output {
+			t.Errorf("LookupFunction(%s).String() = %q, want %q", td.name, got, td.output)
+		}
+	}
+	if f := np.Ctx.LookupFunction(nsFN, "no-such-function"); f != nil {
+		t.Errorf("LookupFunction(no-such-function) = %s", f)
+	}
+
+	fns := RegisteredFunctions()
+	found := false
+	for i, f := range fns {
+		if i > 0 && (fns[i-1].Namespace > f.Namespace || fns[i-1].Namespace == f.Namespace && fns[i-1].Name > f.Name) {
+			t.Fatalf("RegisteredFunctions is not sorted: %s before %s", fns[i-1], f)
+		}
+		found = found || f.Namespace == nsFN && f.Name == "count"
+	}
+	if !found {
+		t.Errorf("RegisteredFunctions does not contain fn:count")
+	}
+
+	sc := NewStaticContext()
+	sc.Namespaces["l"] = "urn:goxpath:test:local"
+	sc.Functions = []*Function{{Name: "twice", Namespace: "urn:goxpath:test:local",
+		Signature: MustParseSignature(`(xs:integer) as xs:integer`),
+		F: func(ctx *Context, args []Sequence) (Sequence, error) {
+			i, err := ToXSInteger(args[0][0])
+			return Sequence{i * 2}, err
+		}}}
+	expr, err := Compile(`l:twice(/root/@one)`, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := expr.Evaluate(np.Ctx)
+	if err != nil || len(seq) != 1 || !itemsEqual(seq[0], 2) {
+		t.Errorf("l:twice(@one) = %v, %v, want 2", seq, err)
+	}
+	if _, err = Compile(`l:twice(1, 2)`, sc); err == nil {
+		t.Errorf("Compile(l:twice(1, 2)) succeeded")
+	}
+}
@@ -3,9 +3,11 @@ package goxpath
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type tokenType int
@@ -82,6 +84,7 @@ func (tt tokenType) String() string {
 type token struct {
 	Value any
 	Typ   tokenType
+	Pos   Position
 }
 
 func (tok *token) isNCName() bool {
@@ -136,6 +139,64 @@ type Tokenlist struct {
 	pos           int
 	toks          tokens
 	attributeMode bool // for Name Test
+	lines         *lineTable
+	furthest      int // index of the furthest token looked at
+}
+
+// lineTable maps byte offsets in an expression to line and column numbers.
+type lineTable struct {
+	src   string
+	lines []int // offsets of the line starts
+}
+
+func newLineTable(src string) *lineTable {
+	lt := &lineTable{src: src, lines: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lt.lines = append(lt.lines, i+1)
+		}
+	}
+	return lt
+}
+
+func (lt *lineTable) position(offset int) Position {
+	if lt == nil {
+		return Position{}
+	}
+	i := sort.SearchInts(lt.lines, offset+1) - 1
+	return Position{
+		Offset: offset,
+		Line:   i + 1,
+		Column: utf8.RuneCountInString(lt.src[lt.lines[i]:offset]) + 1,
+	}
+}
+
+// errorPosition returns the position of the furthest token the parser has
+// looked at, which is where a syntax error is reported.
+func (tl *Tokenlist) errorPosition() Position {
+	if tl.furthest < len(tl.toks) {
+		return tl.toks[tl.furthest].Pos
+	}
+	if tl.lines == nil {
+		return Position{}
+	}
+	return tl.lines.position(len(tl.lines.src))
+}
+
+// lastPosition returns the position of the token that has been read last.
+func (tl *Tokenlist) lastPosition() Position {
+	if tl.pos > 0 {
+		return tl.toks[tl.pos-1].Pos
+	}
+	return tl.position()
+}
+
+// position returns the position of the next token.
+func (tl *Tokenlist) position() Position {
+	if tl.pos < len(tl.toks) {
+		return tl.toks[tl.pos].Pos
+	}
+	return tl.errorPosition()
 }
 
 func (tl *Tokenlist) nexttokIsTyp(typ tokenType) bool {
@@ -215,6 +276,7 @@ func (tl *Tokenlist) readNexttokIfIsOneOfValueAndType(val []string, typ tokenTyp
 }
 
 func (tl *Tokenlist) peek() (*token, error) {
+	tl.furthest = max(tl.furthest, tl.pos)
 	if len(tl.toks) == tl.pos {
 		return nil, io.EOF
 	}
@@ -222,6 +284,7 @@ func (tl *Tokenlist) peek() (*token, error) {
 }
 
 func (tl *Tokenlist) read() (*token, error) {
+	tl.furthest = max(tl.furthest, tl.pos)
 	if len(tl.toks) == tl.pos {
 		return nil, io.EOF
 	}
@@ -379,7 +442,8 @@ func getQName(sr *strings.Reader) (string, error) {
 
 // getEQName reads the rest of an EQName after "Q{" has been consumed.
 // It reads the namespace URI up to "}", then the local name.
-// Returns "namespace}localname" as the token value.
+// Returns "namespace}localname" as the token value, or "namespace}*" for
+// the wildcard Q{namespace}*.
 func getEQName(sr *strings.Reader) (string, error) {
 	var ns []rune
 	for {
@@ -392,6 +456,12 @@ func getEQName(sr *strings.Reader) (string, error) {
 		}
 		ns = append(ns, r)
 	}
+	if r, _, err := sr.ReadRune(); err == nil {
+		if r == '*' {
+			return string(ns) + "}*", nil
+		}
+		sr.UnreadRune()
+	}
 	localName, err := getQName(sr)
 	if err != nil {
 		return "", err
@@ -402,6 +472,31 @@ func getEQName(sr *strings.Reader) (string, error) {
 	return string(ns) + "}" + localName, nil
 }
 
+// readWildcardLocalName reads ":local" after a "*" and returns the local
+// name. If the input does not continue with a colon and a name, nothing is
+// read and the result is empty.
+func readWildcardLocalName(sr *strings.Reader) string {
+	r, _, err := sr.ReadRune()
+	if err != nil {
+		return ""
+	}
+	if r != ':' {
+		sr.UnreadRune()
+		return ""
+	}
+	next, _, err := sr.ReadRune()
+	if err == nil {
+		sr.UnreadRune()
+	}
+	if err != nil || !unicode.IsLetter(next) && next != '_' {
+		// put back the colon
+		sr.Seek(-1, io.SeekCurrent)
+		return ""
+	}
+	local, _ := getQName(sr)
+	return local
+}
+
 func getDelimitedString(sr *strings.Reader) (string, error) {
 	var str []rune
 	delim, _, err := sr.ReadRune()
@@ -478,9 +573,25 @@ func getComment(sr *strings.Reader) (string, error) {
 }
 
 func stringToTokenlist(str string) (*Tokenlist, error) {
+	lines := newLineTable(str)
+	toks, start, err := tokenize(str, lines)
+	if err != nil {
+		return nil, staticError(err, lines.position(start))
+	}
+	return &Tokenlist{toks: toks, lines: lines}, nil
+}
+
+// tokenize splits str into tokens. On error it returns the offset of the
+// token that could not be read.
+func tokenize(str string, lines *lineTable) ([]token, int, error) {
 	var tokens []token
+	var start int
+	add := func(value any, typ tokenType) {
+		tokens = append(tokens, token{Value: value, Typ: typ, Pos: lines.position(start)})
+	}
 	sr := strings.NewReader(str)
 	for {
+		start = int(sr.Size()) - sr.Len()
 		r, _, err := sr.ReadRune()
 		if err == io.EOF {
 			break
@@ -490,116 +601,123 @@ func stringToTokenlist(str string) (*Tokenlist, error) {
 		}
 		if '0' <= r && r <= '9' {
 			sr.UnreadRune()
-			tokens = append(tokens, token{getNum(sr), tokNumber})
+			add(getNum(sr), tokNumber)
 		} else if r == '.' {
 			nextRune, _, err := sr.ReadRune()
 			if err == io.EOF {
-				tokens = append(tokens, token{".", tokOperator})
+				add(".", tokOperator)
 				break
 			}
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			if '0' <= nextRune && nextRune <= '9' {
 				// Put back the digit, then parse number starting with "."
 				sr.UnreadRune()
-				tokens = append(tokens, token{getNumWithPrefix(".", sr), tokNumber})
+				add(getNumWithPrefix(".", sr), tokNumber)
 			} else if nextRune == '.' {
-				tokens = append(tokens, token{"..", tokOperator})
+				add("..", tokOperator)
 			} else {
 				sr.UnreadRune()
-				tokens = append(tokens, token{".", tokOperator})
+				add(".", tokOperator)
+			}
+		} else if r == '*' {
+			// *:local is a wildcard for any namespace
+			if local := readWildcardLocalName(sr); local != "" {
+				add("*:"+local, tokOperator)
+			} else {
+				add("*", tokOperator)
 			}
-		} else if r == '+' || r == '-' || r == '*' || r == '?' || r == '@' || r == '#' {
-			tokens = append(tokens, token{string(r), tokOperator})
+		} else if r == '+' || r == '-' || r == '?' || r == '@' || r == '#' {
+			add(string(r), tokOperator)
 		} else if r == '=' {
 			nextRune, _, err := sr.ReadRune()
 			if err == io.EOF {
-				tokens = append(tokens, token{"=", tokOperator})
+				add("=", tokOperator)
 				break
 			}
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			if nextRune == '>' {
-				tokens = append(tokens, token{"=>", tokOperator})
+				add("=>", tokOperator)
 			} else {
-				tokens = append(tokens, token{"=", tokOperator})
+				add("=", tokOperator)
 				sr.UnreadRune()
 			}
 		} else if r == '|' {
 			nextRune, _, err := sr.ReadRune()
 			if err == io.EOF {
-				tokens = append(tokens, token{"|", tokOperator})
+				add("|", tokOperator)
 				break
 			}
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			if nextRune == '|' {
-				tokens = append(tokens, token{"||", tokOperator})
+				add("||", tokOperator)
 			} else {
-				tokens = append(tokens, token{"|", tokOperator})
+				add("|", tokOperator)
 				sr.UnreadRune()
 			}
 		} else if r == ',' {
-			tokens = append(tokens, token{string(r), tokComma})
+			add(string(r), tokComma)
 		} else if r == '>' || r == '<' {
 			nextRune, _, err := sr.ReadRune()
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			if nextRune == '=' || nextRune == r {
-				tokens = append(tokens, token{string(r) + string(nextRune), tokOperator})
+				add(string(r)+string(nextRune), tokOperator)
 			} else {
-				tokens = append(tokens, token{string(r), tokOperator})
+				add(string(r), tokOperator)
 				sr.UnreadRune()
 			}
 		} else if r == '!' {
 			nextRune, _, err := sr.ReadRune()
 			if err != nil {
 				// standalone ! at end of input
-				tokens = append(tokens, token{"!", tokOperator})
+				add("!", tokOperator)
 				break
 			}
 			if nextRune == '=' {
-				tokens = append(tokens, token{"!=", tokOperator})
+				add("!=", tokOperator)
 			} else {
-				tokens = append(tokens, token{"!", tokOperator})
+				add("!", tokOperator)
 				sr.UnreadRune()
 			}
 		} else if r == '/' || r == ':' {
 			nextRune, _, err := sr.ReadRune()
 			if err == io.EOF {
-				tokens = append(tokens, token{string(r), tokOperator})
+				add(string(r), tokOperator)
 				break
 			}
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			if nextRune == r {
-				tokens = append(tokens, token{string(r) + string(r), tokOperator})
+				add(string(r)+string(r), tokOperator)
 			} else {
-				tokens = append(tokens, token{string(r), tokOperator})
+				add(string(r), tokOperator)
 				sr.UnreadRune()
 			}
 		} else if r == '[' {
-			tokens = append(tokens, token{r, tokOpenBracket})
+			add(r, tokOpenBracket)
 		} else if r == ']' {
-			tokens = append(tokens, token{r, tokCloseBracket})
+			add(r, tokCloseBracket)
 		} else if r == '$' {
 			qname, err := getQName(sr)
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
-			tokens = append(tokens, token{qname, tokVarname})
+			add(qname, tokVarname)
 		} else if unicode.IsSpace(r) {
 			// ignore whitespace
 		} else if unicode.IsLetter(r) {
 			sr.UnreadRune()
 			word, err := getQName(sr)
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			// Check for EQName: Q{namespace}localname
 			if word == "Q" {
@@ -607,9 +725,9 @@ func stringToTokenlist(str string) (*Tokenlist, error) {
 				if err == nil && nextRune == '{' {
 					eqname, err := getEQName(sr)
 					if err != nil {
-						return nil, err
+						return nil, start, err
 					}
-					tokens = append(tokens, token{eqname, tokEQName})
+					add(eqname, tokEQName)
 					continue
 				}
 				if err == nil {
@@ -618,53 +736,55 @@ func stringToTokenlist(str string) (*Tokenlist, error) {
 			}
 			nextRune, _, err := sr.ReadRune()
 			if err == io.EOF {
-				tokens = append(tokens, token{word, tokQName})
+				add(word, tokQName)
 				break
 			}
 			if nextRune == ':' {
-				tokens = append(tokens, token{strings.TrimSuffix(word, ":"), tokDoubleColon})
+				add(strings.TrimSuffix(word, ":"), tokDoubleColon)
+			} else if nextRune == '*' && strings.HasSuffix(word, ":") {
+				// prefix:* is a wildcard for any local name
+				add(word+"*", tokOperator)
 			} else {
 				sr.UnreadRune()
-				tokens = append(tokens, token{word, tokQName})
+				add(word, tokQName)
 			}
 
 		} else if r == '\'' || r == '"' {
 			sr.UnreadRune()
 			str, err := getDelimitedString(sr)
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
-			tokens = append(tokens, token{str, tokString})
+			add(str, tokString)
 		} else if r == '(' {
 			nextRune, _, err := sr.ReadRune()
 			if err == io.EOF {
 				// what should we do?
-				return nil, fmt.Errorf("parse error, unbalanced ( at end")
+				return nil, start, fmt.Errorf("parse error, unbalanced ( at end")
 			}
 			if err != nil {
-				return nil, err
+				return nil, start, err
 			}
 			if nextRune == ':' {
 				_, err := getComment(sr)
 				if err != nil {
-					return nil, err
+					return nil, start, err
 				}
 				// comments are ignored
 				// tokens = append(tokens, token{cmt, TokAny})
 			} else {
 				sr.UnreadRune()
-				tokens = append(tokens, token{r, tokOpenParen})
+				add(r, tokOpenParen)
 			}
 		} else if r == ')' {
-			tokens = append(tokens, token{r, tokCloseParen})
+			add(r, tokCloseParen)
 		} else if r == '{' {
-			tokens = append(tokens, token{r, tokOpenBrace})
+			add(r, tokOpenBrace)
 		} else if r == '}' {
-			tokens = append(tokens, token{r, tokCloseBrace})
+			add(r, tokCloseBrace)
 		} else {
-			return nil, fmt.Errorf("Invalid char for xpath expression %q", string(r))
+			return nil, start, fmt.Errorf("Invalid char for xpath expression %q", string(r))
 		}
 	}
-	tl := Tokenlist{pos: 0, toks: tokens}
-	return &tl, nil
+	return tokens, start, nil
 }
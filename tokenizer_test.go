@@ -10,7 +10,7 @@ func TestNCName(t *testing.T) {
 		input  token
 		output bool
 	}{
-		{token{tokNumber, 1}, false},
+		{token{Value: tokNumber, Typ: 1}, false},
 	}
 	for _, td := range testdata {
 		got := td.input.isNCName()
@@ -73,7 +73,7 @@ func TestGetAxis(t *testing.T) {
 		input  string
 		output []token
 	}{
-		{`child::sub`, []token{{"child", tokDoubleColon}, {"sub", tokQName}}},
+		{`child::sub`, []token{{Value: "child", Typ: tokDoubleColon}, {Value: "sub", Typ: tokQName}}},
 	}
 	for _, td := range testdata {
 		toklist, err := stringToTokenlist(td.input)
@@ -107,24 +107,24 @@ func TestOperator(t *testing.T) {
 		input  string
 		output []token
 	}{
-		{`< (:comment (:nested :) :) `, []token{{`<`, tokOperator}}},
-		{`"hello"`, []token{{"hello", tokString}}},
-		{`'hello'`, []token{{"hello", tokString}}},
-		{`< `, []token{{`<`, tokOperator}}},
-		{`<= `, []token{{`<=`, tokOperator}}},
-		{`> `, []token{{`>`, tokOperator}}},
-		{`>= `, []token{{`>=`, tokOperator}}},
-		{`!= `, []token{{`!=`, tokOperator}}},
-		{`<< `, []token{{`<<`, tokOperator}}},
-		{`>> `, []token{{`>>`, tokOperator}}},
-		{`/ `, []token{{`/`, tokOperator}}},
-		{`// `, []token{{`//`, tokOperator}}},
-		{`: `, []token{{`:`, tokOperator}}},
-		{`:: `, []token{{`::`, tokOperator}}},
-		{`.`, []token{{`.`, tokOperator}}},
-		{`(1,2)`, []token{{'(', tokOpenParen}, {1.0, tokNumber}, {`,`, tokComma}, {2.0, tokNumber}, {')', tokCloseParen}}},
-		{`$hello`, []token{{"hello", tokVarname}}},
-		{`a("a",'/')`, []token{{"a", tokQName}, {'(', tokOpenParen}, {"a", tokString}, {`,`, tokComma}, {"/", tokString}, {')', tokCloseParen}}},
+		{`< (:comment (:nested :) :) `, []token{{Value: `<`, Typ: tokOperator}}},
+		{`"hello"`, []token{{Value: "hello", Typ: tokString}}},
+		{`'hello'`, []token{{Value: "hello", Typ: tokString}}},
+		{`< `, []token{{Value: `<`, Typ: tokOperator}}},
+		{`<= `, []token{{Value: `<=`, Typ: tokOperator}}},
+		{`> `, []token{{Value: `>`, Typ: tokOperator}}},
+		{`>= `, []token{{Value: `>=`, Typ: tokOperator}}},
+		{`!= `, []token{{Value: `!=`, Typ: tokOperator}}},
+		{`<< `, []token{{Value: `<<`, Typ: tokOperator}}},
+		{`>> `, []token{{Value: `>>`, Typ: tokOperator}}},
+		{`/ `, []token{{Value: `/`, Typ: tokOperator}}},
+		{`// `, []token{{Value: `//`, Typ: tokOperator}}},
+		{`: `, []token{{Value: `:`, Typ: tokOperator}}},
+		{`:: `, []token{{Value: `::`, Typ: tokOperator}}},
+		{`.`, []token{{Value: `.`, Typ: tokOperator}}},
+		{`(1,2)`, []token{{Value: '(', Typ: tokOpenParen}, {Value: 1.0, Typ: tokNumber}, {Value: `,`, Typ: tokComma}, {Value: 2.0, Typ: tokNumber}, {Value: ')', Typ: tokCloseParen}}},
+		{`$hello`, []token{{Value: "hello", Typ: tokVarname}}},
+		{`a("a",'/')`, []token{{Value: "a", Typ: tokQName}, {Value: '(', Typ: tokOpenParen}, {Value: "a", Typ: tokString}, {Value: `,`, Typ: tokComma}, {Value: "/", Typ: tokString}, {Value: ')', Typ: tokCloseParen}}},
 	}
 	for _, td := range testdata {
 		toklist, err := stringToTokenlist(td.input)
@@ -152,3 +152,25 @@ func TestOperator(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenPosition(t *testing.T) {
+	toklist, err := stringToTokenlist("a + \n\t$bär || 'x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Position{
+		{Offset: 0, Line: 1, Column: 1},
+		{Offset: 2, Line: 1, Column: 3},
+		{Offset: 6, Line: 2, Column: 2},
+		{Offset: 12, Line: 2, Column: 7},
+		{Offset: 15, Line: 2, Column: 10},
+	}
+	if len(toklist.toks) != len(expected) {
+		t.Fatalf("len(toks) = %d, want %d", len(toklist.toks), len(expected))
+	}
+	for i, tok := range toklist.toks {
+		if tok.Pos != expected[i] {
+			t.Errorf("position of %v = %+v, want %+v", tok, tok.Pos, expected[i])
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package goxpath
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+// ToXDM converts a Go value to an XPath sequence:
+//
+//   - nil and nil pointers become the empty sequence, a Sequence is
+//     returned unchanged and values that are already items (nodes, maps,
+//     arrays, strings, booleans and the XS types) become a sequence of one
+//     item.
+//   - Go integers become xs:integer with the matching subtype (int32 is
+//     xs:int, uint8 is xs:unsignedByte and so on), float32 becomes
+//     xs:float and float64 xs:double.
+//   - time.Time becomes xs:dateTime, time.Duration xs:dayTimeDuration and
+//     []byte xs:base64Binary.
+//   - Other slices and arrays become an XPathArray, maps an XPathMap with
+//     the keys in ascending order.
+//   - Structs become an XPathMap with an entry per exported field. The key
+//     is the field name or the name in the xdm tag, fields tagged with
+//     `xdm:"-"` are skipped and `xdm:"name,omitempty"` skips zero values.
+//
+// The elements, keys, values and fields of slices, maps and structs are
+// converted by the same rules.
+//
+// Other values such as channels and functions are an error (XPTY0004).
+func ToXDM(v any) (Sequence, error) {
+	switch t := v.(type) {
+	case nil:
+		return Sequence{}, nil
+	case Sequence:
+		return t, nil
+	case time.Time:
+		return Sequence{XSDateTime(t)}, nil
+	case time.Duration:
+		return Sequence{monthsAndSecondsToDuration(0, t.Seconds())}, nil
+	case []byte:
+		return Sequence{XSBase64Binary(base64.StdEncoding.EncodeToString(t))}, nil
+	case string, bool, XSInteger, XSDouble, XSFloat, XSDecimal, XSString,
+		XSAnyURI, XSUntypedAtomic, XSHexBinary, XSBase64Binary, XSDate, XSDateTime, XSTime,
+		XSDuration, XSGYear, XSGMonth, XSGDay, XSGYearMonth, XSGMonthDay, XSQName,
+		*XPathMap, *XPathArray, *XPathFunction, goxml.XMLNode:
+		return Sequence{t}, nil
+	}
+	return toXDM(reflect.ValueOf(v))
+}
+
+func toXDM(v reflect.Value) (Sequence, error) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return Sequence{}, nil
+		}
+		return ToXDM(v.Elem().Interface())
+	case reflect.String:
+		return Sequence{v.String()}, nil
+	case reflect.Bool:
+		return Sequence{v.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Sequence{XSInteger{V: int(v.Int()), Subtype: goIntSubtype[v.Kind()]}}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return nil, NewXPathError("FOAR0002", fmt.Sprintf("%d exceeds the range of xs:integer", u))
+		}
+		return Sequence{XSInteger{V: int(u), Subtype: goIntSubtype[v.Kind()]}}, nil
+	case reflect.Float32:
+		return Sequence{XSFloat(v.Float())}, nil
+	case reflect.Float64:
+		return Sequence{XSDouble(v.Float())}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return Sequence{&XPathArray{}}, nil
+		}
+		arr := &XPathArray{Members: make([]Sequence, v.Len())}
+		for i := range v.Len() {
+			member, err := nestedToXDM(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			arr.Members[i] = member
+		}
+		return Sequence{arr}, nil
+	case reflect.Map:
+		var entries []MapEntry
+		for iter := v.MapRange(); iter.Next(); {
+			key, err := nestedToXDM(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			if len(key) != 1 {
+				return nil, NewXPathError("XPTY0004", fmt.Sprintf("map key %v is not a single atomic value", iter.Key()))
+			}
+			value, err := nestedToXDM(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, MapEntry{Key: key[0], Value: value})
+		}
+		slices.SortFunc(entries, func(a, b MapEntry) int {
+			if fa, ok := ToFloat64(a.Key); ok {
+				if fb, ok := ToFloat64(b.Key); ok {
+					return cmp.Compare(fa, fb)
+				}
+			}
+			return strings.Compare(itemStringvalue(a.Key), itemStringvalue(b.Key))
+		})
+		return Sequence{NewXPathMap(entries...)}, nil
+	case reflect.Struct:
+		m := &XPathMap{}
+		t := v.Type()
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, omitempty := xdmFieldName(field)
+			if name == "" || (omitempty && v.Field(i).IsZero()) {
+				continue
+			}
+			value, err := nestedToXDM(v.Field(i))
+			if err != nil {
+				return nil, fieldError(field.Name, err)
+			}
+			m = m.Put(name, value)
+		}
+		return Sequence{m}, nil
+	}
+	return nil, NewXPathError("XPTY0004", fmt.Sprintf("cannot convert a value of type %s to an XDM value", v.Type()))
+}
+
+// nestedToXDM converts an element, map entry or field of a value. It goes
+// through ToXDM, so time.Time, time.Duration, []byte and Sequence are
+// converted like values on the top level.
+func nestedToXDM(v reflect.Value) (Sequence, error) {
+	if !v.IsValid() {
+		return Sequence{}, nil
+	}
+	if !v.CanInterface() {
+		return toXDM(v)
+	}
+	return ToXDM(v.Interface())
+}
+
+// goIntSubtype maps the Go integer kinds to the xs:integer subtype with the
+// same range.
+var goIntSubtype = map[reflect.Kind]IntSubtype{
+	reflect.Int:     IntInteger,
+	reflect.Int8:    IntByte,
+	reflect.Int16:   IntShort,
+	reflect.Int32:   IntInt,
+	reflect.Int64:   IntLong,
+	reflect.Uint:    IntUnsignedLong,
+	reflect.Uint8:   IntUnsignedByte,
+	reflect.Uint16:  IntUnsignedShort,
+	reflect.Uint32:  IntUnsignedInt,
+	reflect.Uint64:  IntUnsignedLong,
+	reflect.Uintptr: IntUnsignedLong,
+}
+
+// xdmFieldName returns the map key of a struct field for ToXDM. The name is
+// empty if the field is skipped.
+func xdmFieldName(field reflect.StructField) (string, bool) {
+	tag, ok := field.Tag.Lookup("xdm")
+	if !ok {
+		return field.Name, false
+	}
+	if tag == "-" {
+		return "", false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, opts == "omitempty"
+}
+
+// FromXDM converts an XPath sequence to a Go value. The empty sequence
+// becomes nil, a single item is converted on its own and longer sequences
+// become a []any with one element per item. Items are converted as follows:
+//
+//   - strings, xs:anyURI and xs:untypedAtomic become string, booleans
+//     bool, integers int, xs:float float32 and the other numbers float64.
+//   - xs:dateTime, xs:date and xs:time become time.Time, day-time durations
+//     time.Duration and xs:base64Binary []byte.
+//   - Maps become map[string]any keyed by the string value of the keys,
+//     arrays []any. A map with two keys of the same string value, such as
+//     1 and '1', is an error (XPTY0004).
+//   - Nodes, durations with years or months and other items are returned
+//     unchanged.
+func FromXDM(seq Sequence) (any, error) {
+	switch len(seq) {
+	case 0:
+		return nil, nil
+	case 1:
+		return fromXDMItem(seq[0])
+	}
+	values := make([]any, len(seq))
+	for i, itm := range seq {
+		v, err := fromXDMItem(itm)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func fromXDMItem(itm Item) (any, error) {
+	switch t := itm.(type) {
+	case XSString:
+		return t.V, nil
+	case XSAnyURI:
+		return string(t), nil
+	case XSUntypedAtomic:
+		return string(t), nil
+	case XSInteger:
+		return t.V, nil
+	case XSDouble:
+		return float64(t), nil
+	case XSDecimal:
+		return float64(t), nil
+	case XSFloat:
+		return float32(t), nil
+	case XSDateTime:
+		return time.Time(t), nil
+	case XSDate:
+		return time.Time(t), nil
+	case XSTime:
+		return time.Time(t), nil
+	case XSDuration:
+		if t.Years != 0 || t.Months != 0 {
+			return t, nil
+		}
+		return time.Duration(math.Round(durationToSeconds(t) * float64(time.Second))), nil
+	case XSBase64Binary:
+		b, err := base64.StdEncoding.DecodeString(string(t))
+		if err != nil {
+			return nil, NewXPathError("FORG0001", fmt.Sprintf("invalid xs:base64Binary value: %s", err))
+		}
+		return b, nil
+	case *XPathMap:
+		m := make(map[string]any, t.Size())
+		for _, entry := range t.Entries {
+			v, err := FromXDM(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+			key := itemStringvalue(entry.Key)
+			if _, ok := m[key]; ok {
+				return nil, NewXPathError("XPTY0004", fmt.Sprintf("map has more than one key with the string value %q", key))
+			}
+			m[key] = v
+		}
+		return m, nil
+	case *XPathArray:
+		a := make([]any, len(t.Members))
+		for i, member := range t.Members {
+			v, err := FromXDM(member)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = v
+		}
+		return a, nil
+	}
+	return itm, nil
+}
+
+// SetVariableValue converts v with ToXDM and binds the result to the
+// variable name.
+func (xp *Parser) SetVariableValue(name string, v any) error {
+	seq, err := ToXDM(v)
+	if err != nil {
+		return err
+	}
+	xp.SetVariable(name, seq)
+	return nil
+}
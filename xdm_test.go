@@ -0,0 +1,158 @@
+package goxpath
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToXDM(t *testing.T) {
+	type address struct {
+		City string `xdm:"city"`
+		Zip  string `xdm:"zip,omitempty"`
+	}
+	type person struct {
+		Name    string `xdm:"name"`
+		Age     int    `xdm:"age"`
+		Secret  string `xdm:"-"`
+		Address *address
+		Tags    []string `xdm:"tags"`
+	}
+	type record struct {
+		Born    time.Time
+		Timeout time.Duration
+		Data    []byte
+		Extra   Sequence
+		Times   []time.Time
+		Waits   map[string]time.Duration
+	}
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	born := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for name, v := range map[string]any{
+		"str":   "hello",
+		"int":   42,
+		"small": int8(-3),
+		"uint":  uint16(7),
+		"float": 1.5,
+		"time":  born,
+		"dur":   90 * time.Minute,
+		"ints":  []int{1, 2, 3},
+		"map":   map[string]int{"b": 2, "a": 1},
+		"bytes": []byte("hi"),
+		"nil":   nil,
+		"person": person{Name: "Ann", Age: 33, Secret: "x", Address: &address{City: "Berlin"},
+			Tags: []string{"a", "b"}},
+		"record": record{Born: born, Timeout: 2 * time.Second, Data: []byte("hi"), Extra: Sequence{1, 2},
+			Times: []time.Time{born}, Waits: map[string]time.Duration{"short": time.Minute}},
+	} {
+		if err = np.SetVariableValue(name, v); err != nil {
+			t.Fatalf("SetVariableValue(%s): %s", name, err)
+		}
+	}
+	testdata := []struct {
+		input  string
+		output string
+	}{
+		{`$str`, "hello"},
+		{`$int instance of xs:integer`, "true"},
+		{`$int + 1`, "43"},
+		{`$small instance of xs:byte`, "true"},
+		{`$uint instance of xs:unsignedShort`, "true"},
+		{`$float instance of xs:double`, "true"},
+		{`year-from-dateTime($time)`, "2001"},
+		{`minutes-from-duration($dur)`, "30"},
+		{`string($dur)`, "PT1H30M"},
+		{`array:size($ints)`, "3"},
+		{`$ints(2)`, "2"},
+		{`string-join(map:keys($map), ',')`, "a,b"},
+		{`$map?b`, "2"},
+		{`string($bytes)`, "aGk="},
+		{`empty($nil)`, "true"},
+		{`$person?name || ' ' || $person?age`, "Ann 33"},
+		{`map:contains($person, 'Secret')`, "false"},
+		{`$person?Address?city`, "Berlin"},
+		{`map:contains($person?Address, 'zip')`, "false"},
+		{`$person?tags?2`, "b"},
+		{`$record?Born instance of xs:dateTime`, "true"},
+		{`year-from-dateTime($record?Born)`, "2001"},
+		{`$record?Timeout instance of xs:dayTimeDuration`, "true"},
+		{`string($record?Timeout)`, "PT2S"},
+		{`$record?Data instance of xs:base64Binary`, "true"},
+		{`string($record?Data)`, "aGk="},
+		{`count($record?Extra)`, "2"},
+		{`$record?Times?1 instance of xs:dateTime`, "true"},
+		{`string($record?Waits?short)`, "PT1M"},
+	}
+	for _, td := range testdata {
+		s, err := np.EvaluateString(td.input)
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		if s != td.output {
+			t.Errorf("%s = %q, want %q", td.input, s, td.output)
+		}
+	}
+	if _, err = ToXDM(make(chan int)); err == nil {
+		t.Errorf("ToXDM(chan) succeeded")
+	}
+}
+
+func TestFromXDM(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		input  string
+		output any
+	}{
+		{`()`, nil},
+		{`'a'`, "a"},
+		{`1 + 2`, 3},
+		{`xs:float(1.5)`, float32(1.5)},
+		{`xs:double(2.5)`, 2.5},
+		{`(1, 'a')`, []any{1, "a"}},
+		{`[1, (2, 3)]`, []any{1, []any{2, 3}}},
+		{`map { 'a': 1, 'b': [true()] }`, map[string]any{"a": 1, "b": []any{true}}},
+		{`xs:dayTimeDuration('PT1H30M')`, 90 * time.Minute},
+		{`xs:dateTime('2001-02-03T04:05:06Z')`, time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)},
+		{`xs:base64Binary('aGk=')`, []byte("hi")},
+	}
+	for _, td := range testdata {
+		seq, err := np.Evaluate(td.input)
+		if err != nil {
+			t.Errorf("%s: %s", td.input, err)
+			continue
+		}
+		got, err := FromXDM(seq)
+		if err != nil {
+			t.Errorf("FromXDM(%s): %s", td.input, err)
+			continue
+		}
+		if tm, ok := got.(time.Time); ok {
+			if !tm.Equal(td.output.(time.Time)) {
+				t.Errorf("FromXDM(%s) = %v, want %v", td.input, got, td.output)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, td.output) {
+			t.Errorf("FromXDM(%s) = %#v, want %#v", td.input, got, td.output)
+		}
+	}
+
+	for _, input := range []string{`map { 1: 'a', '1': 'b' }`, `[map { true(): 1, 'true': 2 }]`} {
+		seq, err := np.Evaluate(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = FromXDM(seq)
+		if code, _ := XPathErrorCode(err); code != "XPTY0004" {
+			t.Errorf("FromXDM(%s) error code = %q, want XPTY0004 (%v)", input, code, err)
+		}
+	}
+}
@@ -1,27 +1,31 @@
 package goxpath
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"maps"
 	"math"
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/speedata/goxml"
 	"golang.org/x/net/html"
 )
 
-var exprCache sync.Map // cached parsed XPath expressions: string → EvalFunc
-
 // ErrSequence is raised when a sequence of items is not allowed as an argument.
 var ErrSequence = fmt.Errorf("a sequence with more than one item is not allowed here")
 
 // Context is needed for variables, namespaces and XML navigation.
+//
+// Each evaluation runs in a frame of its own (see newFrame), so a Context can
+// be shared by goroutines that evaluate expressions concurrently as long as
+// it is not modified at the same time. Functions that write to Store must
+// synchronize themselves.
 type Context struct {
 	Namespaces     map[string]string // Storage for (private) name spaces
 	Store          map[any]any       // Store can be used for private variables accessible in functions
@@ -34,11 +38,62 @@ type Context struct {
 	size           int
 	xmldoc         *goxml.XMLDocument
 	decimalFormats map[string]*DecimalFormat
-	currentTime    *time.Time // cached per-evaluation, set on first access
+	currentTime    *time.Time                // cached per-evaluation, set on first access
+	functions      map[string][]*Function    // functions of the static context, see Expression
+	collections    map[string]*Collection    // see SetCollection
+	keys           map[string]*keyDefinition // see DefineKey
+	eval           *evalState                // cancellation and limits of the running evaluation
+	// Limits restricts the resources used by Evaluate and EvaluateContext.
+	Limits Limits
+	// IndexDocuments builds an index of the element and attribute names of
+	// each document the first time a descendant axis with a name test is
+	// evaluated on it, see BuildIndex.
+	IndexDocuments bool
+	// Parallelism is the number of goroutines that evaluate the iterations
+	// of simple map expressions (!), for expressions and predicates. The
+	// results keep their order and the error of the first failing
+	// iteration is returned. Values below 2 evaluate sequentially. The
+	// functions called by the expressions must be safe for concurrent use.
+	Parallelism int
+	// Library contains the functions that can be called. If nil, the
+	// functions registered with RegisterFunction are used.
+	Library *FunctionLibrary
+	// Policy restricts the access to files and environment variables. If
+	// nil, everything is allowed.
+	Policy *Policy
+	// Resolver opens the resources read by fn:doc, fn:unparsed-text and
+	// fn:json-doc. If nil, DefaultResolver is used.
+	Resolver ResourceResolver
 	// DefaultCollation is the static default collation, used by string operators
 	// and by string functions when no explicit collation argument is supplied.
 	// If nil, the Unicode codepoint collation is used.
 	DefaultCollation Collation
+	// BaseURI is the static base URI. Relative URIs passed to fn:doc,
+	// fn:unparsed-text and similar functions are resolved against it, and
+	// fn:static-base-uri returns it. If empty, Store["baseURI"] is used.
+	BaseURI string
+	// ImplicitTimezone is used for values without a timezone and by
+	// fn:implicit-timezone. If nil, the local timezone is used.
+	ImplicitTimezone *time.Location
+	// CurrentDateTime overrides the value of fn:current-dateTime and the
+	// related functions. If zero, the time of the evaluation is used.
+	CurrentDateTime time.Time
+	// DefaultLanguage is returned by fn:default-language. If empty, "en"
+	// is used.
+	DefaultLanguage string
+	// DefaultCalendar is the calendar of fn:format-date, fn:format-dateTime
+	// and fn:format-time when no calendar argument is given, for example
+	// "AD". If empty, "ISO" is used.
+	DefaultCalendar string
+	// DefaultPlace is the place of fn:format-date, fn:format-dateTime and
+	// fn:format-time when no place argument is given. An IANA time zone
+	// name such as "Europe/Berlin" adjusts the formatted value to that zone.
+	DefaultPlace string
+	// Documents are the available documents, keyed by their absolute URIs.
+	// fn:doc returns these documents without reading a resource.
+	Documents map[string]*goxml.XMLDocument
+	docs      *documentCache // read by fn:doc and fn:collection
+	indexes   *indexes       // name indexes of the documents, see BuildIndex
 }
 
 // Collation returns the static default collation, falling back to the
@@ -55,18 +110,82 @@ func (ctx *Context) Collation() Collation {
 // The time is cached on first access and reused for all subsequent calls.
 func (ctx *Context) CurrentTime() time.Time {
 	if ctx.currentTime == nil {
-		t := currentTimeGetter()
+		t := ctx.CurrentDateTime
+		if t.IsZero() {
+			t = currentTimeGetter()
+		}
+		if ctx.ImplicitTimezone != nil {
+			t = t.In(ctx.ImplicitTimezone)
+		}
+		t = t.In(fixedZone(t))
 		ctx.currentTime = &t
 	}
 	return *ctx.currentTime
 }
 
+// implicitTimezone returns the implicit timezone of ctx as the fixed offset
+// that fn:implicit-timezone reports.
+func (ctx *Context) implicitTimezone() *time.Location {
+	return fixedZone(ctx.CurrentTime())
+}
+
+// withImplicitTimezone returns itm with the implicit timezone if it is a
+// date or time without a timezone, and itm otherwise.
+func (ctx *Context) withImplicitTimezone(itm Item) Item {
+	switch v := itm.(type) {
+	case XSDateTime:
+		if !hasTimezone(time.Time(v)) {
+			return XSDateTime(inTimezone(time.Time(v), ctx.implicitTimezone()))
+		}
+	case XSDate:
+		if !hasTimezone(time.Time(v)) {
+			return XSDate(inTimezone(time.Time(v), ctx.implicitTimezone()))
+		}
+	case XSTime:
+		if !hasTimezone(time.Time(v)) {
+			return XSTime(inTimezone(time.Time(v), ctx.implicitTimezone()))
+		}
+	}
+	return itm
+}
+
+// staticBaseURI returns BaseURI or, for compatibility, Store["baseURI"].
+func (ctx *Context) staticBaseURI() string {
+	if ctx.BaseURI != "" {
+		return ctx.BaseURI
+	}
+	base, _ := ctx.Store["baseURI"].(string)
+	return base
+}
+
+// documentURI returns the URI of the document d if it is an available
+// document, has been read by fn:doc or fn:collection or is the document of
+// the context.
+func (ctx *Context) documentURI(d *goxml.XMLDocument) string {
+	for uri, doc := range ctx.Documents {
+		if doc == d {
+			return uri
+		}
+	}
+	if ctx.docs != nil {
+		if uri, ok := ctx.docs.uri(d); ok {
+			return uri
+		}
+	}
+	if d == ctx.xmldoc {
+		return ctx.staticBaseURI()
+	}
+	return ""
+}
+
 // NewContext returns a context from the xml document
 func NewContext(doc *goxml.XMLDocument) *Context {
 	ctx := &Context{
 		xmldoc:     doc,
 		vars:       make(map[string]Sequence),
 		Namespaces: make(map[string]string),
+		docs:       newDocumentCache(),
+		indexes:    newIndexes(),
 	}
 	ctx.Namespaces["fn"] = nsFN
 	ctx.Namespaces["xs"] = nsXS
@@ -80,16 +199,35 @@ func NewContext(doc *goxml.XMLDocument) *Context {
 // changed without changing the original context.
 func CopyContext(cur *Context) *Context {
 	ctx := &Context{
-		xmldoc:       cur.xmldoc,
-		vars:         maps.Clone(cur.vars),
-		Namespaces:   maps.Clone(cur.Namespaces),
-		Store:        maps.Clone(cur.Store),
-		sequence:     cur.sequence,
-		currentItem:  cur.currentItem,
-		Pos:          cur.Pos,
+		xmldoc:           cur.xmldoc,
+		vars:             maps.Clone(cur.vars),
+		Namespaces:       maps.Clone(cur.Namespaces),
+		Store:            maps.Clone(cur.Store),
+		sequence:         cur.sequence,
+		currentItem:      cur.currentItem,
+		Pos:              cur.Pos,
 		ctxLengths:       slices.Clone(cur.ctxLengths),
 		ctxPositions:     slices.Clone(cur.ctxPositions),
 		DefaultCollation: cur.DefaultCollation,
+		functions:        cur.functions,
+		collections:      cur.collections,
+		keys:             cur.keys,
+		eval:             cur.eval,
+		Limits:           cur.Limits,
+		Parallelism:      cur.Parallelism,
+		IndexDocuments:   cur.IndexDocuments,
+		indexes:          cur.indexes,
+		Library:          cur.Library,
+		Policy:           cur.Policy,
+		Resolver:         cur.Resolver,
+		BaseURI:          cur.BaseURI,
+		ImplicitTimezone: cur.ImplicitTimezone,
+		CurrentDateTime:  cur.CurrentDateTime,
+		DefaultLanguage:  cur.DefaultLanguage,
+		DefaultCalendar:  cur.DefaultCalendar,
+		DefaultPlace:     cur.DefaultPlace,
+		Documents:        cur.Documents,
+		docs:             cur.docs,
 	}
 	return ctx
 }
@@ -113,6 +251,42 @@ func (ctx *Context) ResetFrom(src *Context) {
 	ctx.ctxLengths = append(ctx.ctxLengths[:0], src.ctxLengths...)
 	ctx.ctxPositions = append(ctx.ctxPositions[:0], src.ctxPositions...)
 	ctx.DefaultCollation = src.DefaultCollation
+	ctx.functions = src.functions
+	ctx.collections = src.collections
+	ctx.keys = src.keys
+	ctx.eval = src.eval
+	ctx.Limits = src.Limits
+	ctx.Parallelism = src.Parallelism
+	ctx.IndexDocuments = src.IndexDocuments
+	ctx.indexes = src.indexes
+	ctx.Library = src.Library
+	ctx.Policy = src.Policy
+	ctx.Resolver = src.Resolver
+	ctx.BaseURI = src.BaseURI
+	ctx.ImplicitTimezone = src.ImplicitTimezone
+	ctx.CurrentDateTime = src.CurrentDateTime
+	ctx.DefaultLanguage = src.DefaultLanguage
+	ctx.DefaultCalendar = src.DefaultCalendar
+	ctx.DefaultPlace = src.DefaultPlace
+	ctx.Documents = src.Documents
+	ctx.docs = src.docs
+}
+
+// newFrame returns the context for one evaluation in ctx. The frame shares
+// the document, the namespaces, the functions and the settings with ctx but
+// has its own focus and variable bindings, so the axis steps and variable
+// bindings of the evaluation do not change ctx.
+func (ctx *Context) newFrame() *Context {
+	frame := *ctx
+	frame.vars = maps.Clone(ctx.vars)
+	if frame.vars == nil {
+		frame.vars = make(map[string]Sequence)
+	}
+	frame.ctxPositions = slices.Clone(ctx.ctxPositions)
+	frame.ctxLengths = slices.Clone(ctx.ctxLengths)
+	frame.currentTime = nil
+	frame.eval = nil
+	return &frame
 }
 
 // SetContextSequence sets the context sequence and returns the previous one.
@@ -122,6 +296,18 @@ func (ctx *Context) SetContextSequence(seq Sequence) Sequence {
 	return oldCtx
 }
 
+// contextItem returns the context item. Within a path, a predicate or a
+// simple map the context sequence holds just the current item.
+func (ctx *Context) contextItem() (Item, error) {
+	switch len(ctx.sequence) {
+	case 0:
+		return nil, NewXPathError("XPDY0002", "context item is absent")
+	case 1:
+		return ctx.sequence[0], nil
+	}
+	return nil, NewXPathError("XPTY0004", fmt.Sprintf("the context is a sequence of %d items, not a single item", len(ctx.sequence)))
+}
+
 // GetContextSequence returns the current context.
 func (ctx *Context) GetContextSequence() Sequence {
 	return ctx.sequence
@@ -259,16 +445,69 @@ func returnProcessingInstructionNameTest(name string) func(*Context, Item) bool
 }
 
 func returnAttributeNameTest(name string) func(*Context, Item) bool {
+	if eqname, ok := strings.CutPrefix(name, "Q{"); ok {
+		ns, localName, _ := strings.Cut(eqname, "}")
+		return func(ctx *Context, itm Item) bool {
+			if attr, ok := itm.(*goxml.Attribute); ok {
+				return attr.Name == localName && attr.Namespace == ns
+			}
+			return false
+		}
+	}
+	prefix, localName, prefixed := strings.Cut(name, ":")
 	return func(ctx *Context, itm Item) bool {
 		if attr, ok := itm.(*goxml.Attribute); ok {
 			if attr.Name == name {
 				return true
 			}
+			return prefixed && attr.Name == localName && attr.Namespace != "" && attr.Namespace == ctx.Namespaces[prefix]
 		}
 		return false
 	}
 }
 
+// returnWildcardTest creates a test function for the wildcards *,
+// prefix:*, *:localname and Q{namespace}* on elements or attributes.
+func returnWildcardTest(name string, attribute bool) func(*Context, Item) bool {
+	var prefix, ns, localName string
+	hasNS := false
+	switch {
+	case strings.HasPrefix(name, "*:"):
+		localName = name[2:]
+	case strings.HasPrefix(name, "Q{"):
+		ns, hasNS = strings.TrimSuffix(name[2:], "}*"), true
+	case strings.HasSuffix(name, ":*"):
+		prefix = strings.TrimSuffix(name, ":*")
+	}
+	return func(ctx *Context, itm Item) bool {
+		var local, itmNS string
+		switch t := itm.(type) {
+		case *goxml.Element:
+			if attribute {
+				return false
+			}
+			local, itmNS = t.Name, t.Namespaces[t.Prefix]
+		case *goxml.Attribute:
+			if !attribute {
+				return false
+			}
+			local, itmNS = t.Name, t.Namespace
+		default:
+			return false
+		}
+		if localName != "" && local != localName {
+			return false
+		}
+		if prefix != "" {
+			return itmNS == ctx.Namespaces[prefix]
+		}
+		if hasNS {
+			return itmNS == ns
+		}
+		return true
+	}
+}
+
 // returnElementEQNameTest creates a test function for element(Q{namespace}localname).
 // The eqname format is "namespace}localname".
 func returnElementEQNameTest(eqname string) func(*Context, Item) bool {
@@ -333,6 +572,18 @@ func (ctx *Context) Filter(filter EvalFunc) (Sequence, error) {
 	copyContext := ctx.sequence
 
 	for i, itm := range copyContext {
+		if i == 1 && ctx.parallel(len(copyContext)-1) {
+			// the first item has shown that the predicate is not numeric
+			rest, err := ctx.parallelFilter(filter, copyContext, positions, lengths, i)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, rest...)
+			break
+		}
+		if err := ctx.checkEval(); err != nil {
+			return nil, err
+		}
 		ctx.sequence = Sequence{itm}
 		ctx.Pos = positions[i]
 		if len(lengths) > i {
@@ -604,8 +855,8 @@ func formatXSDateTime(t time.Time) string {
 		frac := strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
 		base += frac
 	}
-	if offset == 0 && t.Location() == time.UTC {
-		return base + "Z"
+	if !hasTimezone(t) {
+		return base
 	}
 	return base + formatTimezone(offset)
 }
@@ -633,13 +884,10 @@ func formatXSTime(t time.Time) string {
 		frac := strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
 		base += frac
 	}
-	if offset == 0 && t.Location() == time.UTC {
-		return base + "Z"
-	}
-	if t.Location() != time.UTC {
-		return base + formatTimezone(offset)
+	if !hasTimezone(t) {
+		return base
 	}
-	return base
+	return base + formatTimezone(offset)
 }
 
 func formatTimezone(offsetSec int) string {
@@ -1250,7 +1498,7 @@ func doCompare(op string, lhs EvalFunc, rhs EvalFunc) (EvalFunc, error) {
 		}
 		for _, leftitem := range left {
 			for _, rightitem := range right {
-				ok, err := compareFunc(op, leftitem, rightitem)
+				ok, err := compareFunc(op, ctx.withImplicitTimezone(leftitem), ctx.withImplicitTimezone(rightitem))
 				if err != nil {
 					return nil, err
 				}
@@ -1414,84 +1662,70 @@ func StringValue(s Sequence) (string, error) {
 }
 
 // [2] Expr ::= ExprSingle ("," ExprSingle)*
-func parseExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "2 parseExpr")
-	var efs []EvalFunc
+	pos := tl.position()
+	var items []Node
 	for {
-		ef, err := parseExprSingle(tl)
+		n, err := parseExprSingle(tl)
 		if err != nil {
 			leaveStep(tl, "2 parseExpr (err)")
 			return nil, err
 		}
-		if ef != nil {
-			efs = append(efs, ef)
+		if n != nil {
+			items = append(items, n)
 		}
 		if !tl.nexttokIsTyp(tokComma) {
 			break
 		}
 		tl.read() // comma
 	}
-	if len(efs) == 1 {
+	if len(items) == 1 {
 		leaveStep(tl, "2 parseExpr (one ExprSingle)")
-		return efs[0], nil
+		return items[0], nil
 	}
 	// more than one ExprSingle
-
-	f := func(ctx *Context) (Sequence, error) {
-		var ret Sequence
-		for _, ef := range efs {
-			seq, err := ef(ctx)
-			if err != nil {
-				return nil, err
-			}
-			ret = append(ret, seq...)
-		}
-
-		return ret, nil
-	}
 	leaveStep(tl, "2 parseExpr")
-	return f, nil
+	return setPos(&SequenceExpr{Items: items}, pos), nil
 }
 
 // [3] ExprSingle ::= ForExpr | QuantifiedExpr | IfExpr | OrExpr
-func parseExprSingle(tl *Tokenlist) (EvalFunc, error) {
+func parseExprSingle(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "3 parseExprSingle")
-	var ef EvalFunc
+	var n Node
 	var err error
 	if op, ok := tl.readNexttokIfIsOneOfValue([]string{"for", "some", "every", "if", "let"}); ok {
 		switch op {
 		case "for":
-			ef, err = parseForExpr(tl)
+			n, err = parseForExpr(tl)
 		case "some", "every":
 			tl.unread()
-			ef, err = parseQuantifiedExpr(tl)
+			n, err = parseQuantifiedExpr(tl)
 		case "if":
 			leaveStep(tl, "3 parseExprSingle")
-			ef, err = parseIfExpr(tl)
+			n, err = parseIfExpr(tl)
 		case "let":
-			ef, err = parseLetExpr(tl)
+			n, err = parseLetExpr(tl)
 		}
 		leaveStep(tl, "3 parseExprSingle")
-		return ef, err
+		return n, err
 	}
 
-	ef, err = parseOrExpr(tl)
+	n, err = parseOrExpr(tl)
 	if err != nil {
 		leaveStep(tl, "3 parseExprSingle (err)")
 		return nil, err
 	}
 	leaveStep(tl, "3 parseExprSingle")
-	return ef, nil
+	return n, nil
 }
 
 // [4] ForExpr ::= SimpleForClause "return" ExprSingle
 // [5] SimpleForClause ::= "for" "$" VarName "in" ExprSingle ("," "$" VarName "in" ExprSingle)*
-func parseForExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseForExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "4 parseForExpr")
-	var ef EvalFunc
-	var efs []EvalFunc
-	var err error
-	var varnames []string
+	pos := tl.lastPosition() // "for"
+	var bindings []*Binding
 
 	for {
 		vartoken, err := tl.read()
@@ -1499,9 +1733,8 @@ func parseForExpr(tl *Tokenlist) (EvalFunc, error) {
 			leaveStep(tl, "4 parseForExpr (err)")
 			return nil, err
 		}
-		if vn, ok := vartoken.Value.(string); ok {
-			varnames = append(varnames, vn)
-		} else {
+		vn, ok := vartoken.Value.(string)
+		if !ok {
 			leaveStep(tl, "4 parseForExpr (err)")
 			return nil, fmt.Errorf("variable name not a string")
 		}
@@ -1509,11 +1742,12 @@ func parseForExpr(tl *Tokenlist) (EvalFunc, error) {
 			leaveStep(tl, "4 parseForExpr (err)")
 			return nil, err
 		}
-		if ef, err = parseExprSingle(tl); err != nil {
+		n, err := parseExprSingle(tl)
+		if err != nil {
 			leaveStep(tl, "4 parseForExpr (err)")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		bindings = append(bindings, &Binding{Name: vn, Expr: n})
 		if tl.nexttokIsTyp(tokQName) && tl.nexttokIsValue("return") {
 			tl.read()
 			break
@@ -1524,86 +1758,22 @@ func parseForExpr(tl *Tokenlist) (EvalFunc, error) {
 		}
 	}
 
-	evalseq, err := parseExprSingle(tl)
+	ret, err := parseExprSingle(tl)
 	if err != nil {
 		leaveStep(tl, "4 parseForExpr (err)")
 		return nil, err
 	}
-
-	ret := func(ctx *Context) (Sequence, error) {
-		var s Sequence
-		var err error
-
-		sequences := []Sequence{}
-		for _, ef := range efs {
-			newcontext := CopyContext(ctx)
-			s, err = ef(newcontext)
-			if err != nil {
-				leaveStep(tl, "4 parseForExpr (err)")
-				return nil, err
-			}
-			sequences = append(sequences, s)
-		}
-		// go recursively through all variable combinations
-		var f func([]string, []Sequence, *Context) (Sequence, error)
-		f = func(varnames []string, sequences []Sequence, ctx *Context) (Sequence, error) {
-			seq := Sequence{}
-			varname := varnames[0]
-			sequence := sequences[0]
-
-			for _, itm := range sequence {
-				ctx.vars[varname] = Sequence{itm}
-				ctx.sequence = Sequence{itm}
-
-				if len(varnames) > 1 {
-					s, err := f(varnames[1:], sequences[1:], ctx)
-					if err != nil {
-						return nil, err
-					}
-					for _, sitm := range s {
-						seq = append(seq, sitm)
-					}
-				} else {
-					s, err := evalseq(ctx)
-					if err != nil {
-						return nil, err
-					}
-					for _, sitm := range s {
-						seq = append(seq, sitm)
-					}
-				}
-			}
-			return seq, nil
-		}
-		var oldValues []Sequence
-		for _, vn := range varnames {
-			oldValues = append(oldValues, ctx.vars[vn])
-		}
-		seq, err := f(varnames, sequences, ctx)
-		if err != nil {
-			return nil, err
-		}
-		for i, vn := range varnames {
-			ctx.vars[vn] = oldValues[i]
-		}
-		ctx.sequence = seq
-		return seq, nil
-	}
 	leaveStep(tl, "4 parseForExpr")
-	return ret, nil
+	return setPos(&ForExpr{Bindings: bindings, Return: ret}, pos), nil
 }
 
 // [11] LetExpr ::= SimpleLetClause "return" ExprSingle
 // [12] SimpleLetClause ::= "let" SimpleLetBinding ("," SimpleLetBinding)*
 // [13] SimpleLetBinding ::= "$" VarName ":=" ExprSingle
-func parseLetExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseLetExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "11 parseLetExpr")
-
-	type letBinding struct {
-		varname string
-		expr    EvalFunc
-	}
-	var bindings []letBinding
+	pos := tl.lastPosition() // "let"
+	var bindings []*Binding
 
 	for {
 		// Read $VarName
@@ -1623,11 +1793,11 @@ func parseLetExpr(tl *Tokenlist) (EvalFunc, error) {
 		}
 
 		// Read value expression
-		valEf, err := parseExprSingle(tl)
+		val, err := parseExprSingle(tl)
 		if err != nil {
 			return nil, err
 		}
-		bindings = append(bindings, letBinding{varname: varname, expr: valEf})
+		bindings = append(bindings, &Binding{Name: varname, Expr: val})
 
 		// Check for comma (more bindings) or "return"
 		if tl.nexttokIsValue("return") {
@@ -1646,52 +1816,25 @@ func parseLetExpr(tl *Tokenlist) (EvalFunc, error) {
 	}
 
 	// Read return expression
-	returnEf, err := parseExprSingle(tl)
+	ret, err := parseExprSingle(tl)
 	if err != nil {
 		leaveStep(tl, "11 parseLetExpr")
 		return nil, err
 	}
-	if returnEf == nil {
+	if ret == nil {
 		leaveStep(tl, "11 parseLetExpr")
 		return nil, fmt.Errorf("expected expression after 'return' in let expression")
 	}
 
-	ef := func(ctx *Context) (Sequence, error) {
-		// Save old variable values
-		oldValues := make(map[string]Sequence, len(bindings))
-		for _, b := range bindings {
-			oldValues[b.varname] = ctx.vars[b.varname]
-		}
-		// Bind new values
-		for _, b := range bindings {
-			val, err := b.expr(ctx)
-			if err != nil {
-				// Restore
-				for _, b2 := range bindings {
-					ctx.vars[b2.varname] = oldValues[b2.varname]
-				}
-				return nil, err
-			}
-			ctx.vars[b.varname] = val
-		}
-		// Evaluate return expression
-		result, err := returnEf(ctx)
-		// Restore old values
-		for _, b := range bindings {
-			ctx.vars[b.varname] = oldValues[b.varname]
-		}
-		return result, err
-	}
-
 	leaveStep(tl, "11 parseLetExpr")
-	return ef, nil
+	return setPos(&LetExpr{Bindings: bindings, Return: ret}, pos), nil
 }
 
 // [6] QuantifiedExpr ::= ("some" | "every") "$" VarName "in" ExprSingle ("," "$" VarName "in" ExprSingle)* "satisfies" ExprSingle
-func parseQuantifiedExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseQuantifiedExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "6 parseQuantifiedExpr")
-	var efs []EvalFunc
-	var varnames []string
+	pos := tl.position()
+	var bindings []*Binding
 
 	someEvery, ok := tl.readNexttokIfIsOneOfValueAndType([]string{"some", "every"}, tokQName)
 	if !ok {
@@ -1710,7 +1853,6 @@ func parseQuantifiedExpr(tl *Tokenlist) (EvalFunc, error) {
 			leaveStep(tl, "6 parseQuantifiedExpr (err)")
 			return nil, err
 		}
-		varnames = append(varnames, vartok.Value.(string))
 
 		got, ok := tl.readNexttokIfIsOneOfValueAndType([]string{"in"}, tokQName)
 		if !ok {
@@ -1718,12 +1860,12 @@ func parseQuantifiedExpr(tl *Tokenlist) (EvalFunc, error) {
 			return nil, fmt.Errorf("'in' expected, got %s", got)
 		}
 
-		ef, err := parseExprSingle(tl)
+		n, err := parseExprSingle(tl)
 		if err != nil {
 			leaveStep(tl, "6 parseQuantifiedExpr (err)")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		bindings = append(bindings, &Binding{Name: vartok.Value.(string), Expr: n})
 
 		_, ok = tl.readNexttokIfIsOneOfValueAndType([]string{"satisfies"}, tokQName)
 		if ok {
@@ -1737,106 +1879,22 @@ func parseQuantifiedExpr(tl *Tokenlist) (EvalFunc, error) {
 
 	}
 
-	var err error
-	var lastEf EvalFunc
-	lastEf, err = parseExprSingle(tl)
+	satisfies, err := parseExprSingle(tl)
 	if err != nil {
 		leaveStep(tl, "6 parseQuantifiedExpr (err)")
 		return nil, err
 	}
 
-	evaler := func(ctx *Context) (Sequence, error) {
-		var s Sequence
-		var err error
-		sequences := []Sequence{}
-		for _, ef := range efs {
-			newcontext := CopyContext(ctx)
-			s, err = ef(newcontext)
-			if err != nil {
-				return nil, err
-			}
-			sequences = append(sequences, s)
-		}
-		// go recursively through all variable combinations
-		var f func([]string, []Sequence, *Context) (Sequence, error)
-		f = func(varnames []string, sequences []Sequence, ctx *Context) (Sequence, error) {
-			seq := Sequence{}
-			varname := varnames[0]
-			sequence := sequences[0]
-
-			for _, itm := range sequence {
-				ctx.vars[varname] = Sequence{itm}
-				ctx.sequence = Sequence{itm}
-				if len(varnames) > 1 {
-					s, err := f(varnames[1:], sequences[1:], ctx)
-					if err != nil {
-						return nil, err
-					}
-					for _, sitm := range s {
-						seq = append(seq, sitm)
-					}
-				} else {
-					s, err := lastEf(ctx)
-					if err != nil {
-						return nil, err
-					}
-					for _, sitm := range s {
-						seq = append(seq, sitm)
-					}
-				}
-			}
-			return seq, nil
-		}
-		var oldValues []Sequence
-		for _, vn := range varnames {
-			oldValues = append(oldValues, ctx.vars[vn])
-		}
-		seq, err := f(varnames, sequences, ctx)
-		if err != nil {
-			return nil, err
-		}
-		for i, vn := range varnames {
-			ctx.vars[vn] = oldValues[i]
-		}
-
-		if someEvery == "some" {
-			for _, itm := range seq {
-				bv, err := BooleanValue(Sequence{itm})
-				if err != nil {
-					return nil, err
-				}
-				if bv {
-					ctx.sequence = Sequence{true}
-					goto done
-				}
-			}
-			ctx.sequence = Sequence{false}
-		} else {
-			for _, itm := range seq {
-				bv, err := BooleanValue(Sequence{itm})
-				if err != nil {
-					return nil, err
-				}
-				if !bv {
-					ctx.sequence = Sequence{false}
-					goto done
-				}
-			}
-			ctx.sequence = Sequence{true}
-		}
-	done:
-		return ctx.sequence, nil
-	}
-
 	leaveStep(tl, "6 parseQuantifiedExpr")
-	return evaler, nil
+	return setPos(&QuantifiedExpr{Quantifier: someEvery, Bindings: bindings, Satisfies: satisfies}, pos), nil
 }
 
 // [7] IfExpr ::= "if" "(" Expr ")" "then" ExprSingle "else" ExprSingle
-func parseIfExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseIfExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "7 parseIfExpr")
+	pos := tl.lastPosition() // "if"
 	var err error
-	var boolEval, thenpart, elsepart EvalFunc
+	var cond, thenpart, elsepart Node
 
 	if err = tl.skipType(tokOpenParen); err != nil {
 		leaveStep(tl, "7 parseIfExpr")
@@ -1845,11 +1903,11 @@ func parseIfExpr(tl *Tokenlist) (EvalFunc, error) {
 		}
 		return nil, fmt.Errorf("open parenthesis expected, found EOF")
 	}
-	if boolEval, err = parseExpr(tl); err != nil {
+	if cond, err = parseExpr(tl); err != nil {
 		leaveStep(tl, "7 parseIfExpr")
 		return nil, err
 	}
-	if boolEval == nil {
+	if cond == nil {
 		leaveStep(tl, "7 parseIfExpr")
 		return nil, fmt.Errorf("expected condition expression in if")
 	}
@@ -1882,142 +1940,88 @@ func parseIfExpr(tl *Tokenlist) (EvalFunc, error) {
 		return nil, fmt.Errorf("expected expression after 'else'")
 	}
 
-	f := func(ctx *Context) (Sequence, error) {
-		res, err := boolEval(ctx)
-		if err != nil {
-			return nil, err
-		}
-		bv, err := BooleanValue(res)
-		if err != nil {
-			return nil, err
-		}
-		if bv {
-			return thenpart(ctx)
-		}
-		return elsepart(ctx)
-	}
 	leaveStep(tl, "7 parseIfExpr")
-	return f, nil
+	return setPos(&IfExpr{Cond: cond, Then: thenpart, Else: elsepart}, pos), nil
 }
 
 // [8] OrExpr ::= AndExpr ( "or" AndExpr )*
-func parseOrExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseOrExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "8 parseOrExpr")
-	var efs []EvalFunc
+	var pos Position // first "or"
+	var operands []Node
 	for {
-		ef, err := parseAndExpr(tl)
+		n, err := parseAndExpr(tl)
 		if err != nil {
 			leaveStep(tl, "8 parseOrExpr")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		operands = append(operands, n)
 		if !tl.nexttokIsValue("or") {
 			break
 		}
+		if len(operands) == 1 {
+			pos = tl.position()
+		}
 		tl.read()
 	}
 
-	if len(efs) == 1 {
-		leaveStep(tl, "8 parseOrExpr (#efs = 1)")
-		return efs[0], nil
-	}
-	var ef EvalFunc
-	ef = func(ctx *Context) (Sequence, error) {
-		for _, ef := range efs {
-			s, err := ef(ctx)
-			if err != nil {
-				return nil, err
-			}
-
-			b, err := BooleanValue(s)
-			if err != nil {
-				return nil, err
-			}
-			if b {
-				return Sequence{true}, nil
-			}
-
-		}
-		return Sequence{false}, nil
+	if len(operands) == 1 {
+		leaveStep(tl, "8 parseOrExpr (#operands = 1)")
+		return operands[0], nil
 	}
-
 	leaveStep(tl, "8 parseOrExpr")
-	return ef, nil
+	return setPos(&LogicalExpr{Op: "or", Operands: operands}, pos), nil
 }
 
 // [9] AndExpr ::= ComparisonExpr ( "and" ComparisonExpr )*
-func parseAndExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseAndExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "9 parseAndExpr")
-	var efs []EvalFunc
+	var pos Position // first "and"
+	var operands []Node
 	for {
-		ef, err := parseComparisonExpr(tl)
+		n, err := parseComparisonExpr(tl)
 		if err != nil {
 			leaveStep(tl, "9 parseAndExpr")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		operands = append(operands, n)
 		if !tl.nexttokIsValue("and") {
 			break
 		}
+		if len(operands) == 1 {
+			pos = tl.position()
+		}
 		tl.read() // and
 	}
-	if len(efs) == 1 {
-		leaveStep(tl, "9 parseAndExpr (#efs == 1)")
-		return efs[0], nil
-	}
-
-	ef := func(ctx *Context) (Sequence, error) {
-		for _, ef := range efs {
-			s, err := ef(ctx)
-			if err != nil {
-				return nil, err
-			}
-
-			b, err := BooleanValue(s)
-			if err != nil {
-				return nil, err
-			}
-			if !b {
-				return Sequence{false}, nil
-			}
-
-		}
-		return Sequence{true}, nil
+	if len(operands) == 1 {
+		leaveStep(tl, "9 parseAndExpr (#operands == 1)")
+		return operands[0], nil
 	}
-
 	leaveStep(tl, "9 parseAndExpr")
-	return ef, nil
+	return setPos(&LogicalExpr{Op: "and", Operands: operands}, pos), nil
 }
 
 // [10] ComparisonExpr ::= StringConcatExpr ( (ValueComp | GeneralComp| NodeComp) StringConcatExpr )?
 // [23] ValueComp ::= "eq" | "ne" | "lt" | "le" | "gt" | "ge"
 // [22] GeneralComp ::= "=" | "!=" | "<" | "<=" | ">" | ">="
 // [24] NodeComp ::= "is" | "<<" | ">>"
-func parseComparisonExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseComparisonExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "10 parseComparisonExpr")
-	var lhs, rhs EvalFunc
+	var lhs, rhs Node
 	var err error
 	if lhs, err = parseStringConcatExpr(tl); err != nil {
 		leaveStep(tl, "10 parseComparisonExpr")
 		return nil, err
 	}
 
-	if op, ok := tl.readNexttokIfIsOneOfValue([]string{"=", "<", ">", "<=", ">=", "!=", "eq", "ne", "lt", "le", "gt", "ge"}); ok {
-		if rhs, err = parseStringConcatExpr(tl); err != nil {
-			leaveStep(tl, "10 parseComparisonExpr")
-			return nil, err
-		}
-		leaveStep(tl, "10 parseComparisonExpr")
-		return doCompare(op, lhs, rhs)
-	}
-
-	if op, ok := tl.readNexttokIfIsOneOfValue([]string{"is", "<<", ">>"}); ok {
+	pos := tl.position()
+	if op, ok := tl.readNexttokIfIsOneOfValue([]string{"=", "<", ">", "<=", ">=", "!=", "eq", "ne", "lt", "le", "gt", "ge", "is", "<<", ">>"}); ok {
 		if rhs, err = parseStringConcatExpr(tl); err != nil {
 			leaveStep(tl, "10 parseComparisonExpr")
 			return nil, err
 		}
 		leaveStep(tl, "10 parseComparisonExpr")
-		return doCompareNode(op, lhs, rhs)
+		return setPos(&ComparisonExpr{Op: op, Left: lhs, Right: rhs}, pos), nil
 	}
 
 	leaveStep(tl, "10 parseComparisonExpr")
@@ -2025,625 +2029,274 @@ func parseComparisonExpr(tl *Tokenlist) (EvalFunc, error) {
 }
 
 // StringConcatExpr ::= RangeExpr ( "||" RangeExpr )*
-func parseStringConcatExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseStringConcatExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "10a parseStringConcatExpr")
-	var efs []EvalFunc
+	var pos Position // first "||"
+	var operands []Node
 	for {
-		ef, err := parseRangeExpr(tl)
+		n, err := parseRangeExpr(tl)
 		if err != nil {
 			leaveStep(tl, "10a parseStringConcatExpr (err)")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		operands = append(operands, n)
+		opPos := tl.position()
 		if _, ok := tl.readNexttokIfIsOneOfValue([]string{"||"}); !ok {
 			break
 		}
-	}
-
-	if len(efs) == 1 {
-		leaveStep(tl, "10a parseStringConcatExpr (#efs = 1)")
-		return efs[0], nil
-	}
-
-	ef := func(ctx *Context) (Sequence, error) {
-		var sb strings.Builder
-		for _, ef := range efs {
-			s, err := ef(ctx)
-			if err != nil {
-				return nil, err
-			}
-			sv, err := StringValue(s)
-			if err != nil {
-				return nil, err
-			}
-			sb.WriteString(sv)
+		if len(operands) == 1 {
+			pos = opPos
 		}
-		return Sequence{sb.String()}, nil
 	}
 
+	if len(operands) == 1 {
+		leaveStep(tl, "10a parseStringConcatExpr (#operands = 1)")
+		return operands[0], nil
+	}
 	leaveStep(tl, "10a parseStringConcatExpr")
-	return ef, nil
+	return setPos(&StringConcatExpr{Operands: operands}, pos), nil
 }
 
 // [11] RangeExpr ::= AdditiveExpr ( "to" AdditiveExpr )?
-func parseRangeExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseRangeExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "11 parseRangeExpr")
-	var ef EvalFunc
-	var efs []EvalFunc
-	var err error
+	var pos Position // "to"
+	var operands []Node
 	for {
-		ef, err = parseAdditiveExpr(tl)
+		n, err := parseAdditiveExpr(tl)
 		if err != nil {
 			leaveStep(tl, "11 parseRangeExpr (err)")
 			return nil, err
 		}
-		efs = append(efs, ef)
-		if _, ok := tl.readNexttokIfIsOneOfValue([]string{"to"}); ok {
-			// good, just add the next func to the efs slice
-		} else {
+		operands = append(operands, n)
+		opPos := tl.position()
+		if _, ok := tl.readNexttokIfIsOneOfValue([]string{"to"}); !ok {
 			break
 		}
-	}
-	if len(efs) == 1 {
-		leaveStep(tl, "11 parseRangeExpr (#efs = 1)")
-		return efs[0], nil
-	}
-
-	retf := func(ctx *Context) (Sequence, error) {
-		lhs, err := efs[0](ctx)
-		if err != nil {
-			return nil, err
-		}
-		rhs, err := efs[1](ctx)
-		if err != nil {
-			return nil, err
-		}
-		lhsNum, err := NumberValue(lhs)
-		if err != nil {
-			return nil, err
-		}
-		rhsNum, err := NumberValue(rhs)
-		if err != nil {
-			return nil, err
-		}
-		// Per XPath spec: if either is NaN or Inf, or lhs > rhs, return empty
-		if math.IsNaN(lhsNum) || math.IsNaN(rhsNum) || math.IsInf(lhsNum, 0) || math.IsInf(rhsNum, 0) {
-			return Sequence{}, nil
-		}
-		startF := math.Round(lhsNum)
-		endF := math.Round(rhsNum)
-		if startF > endF {
-			return Sequence{}, nil
-		}
-		// Guard against extremely large ranges
-		if endF-startF > 10_000_000 {
-			return nil, fmt.Errorf("range too large: %v to %v", startF, endF)
-		}
-		start := int(startF)
-		end := int(endF)
-		// Guard against int overflow: if start or end is at MaxInt64,
-		// the loop increment would overflow
-		if start == math.MaxInt64 || end == math.MaxInt64 {
-			if start == end {
-				return Sequence{start}, nil
-			}
-			return nil, fmt.Errorf("range too large: integer overflow")
-		}
-		count := end - start + 1
-		seq := make(Sequence, 0, count)
-		for i := start; i <= end; i++ {
-			seq = append(seq, i)
+		if len(operands) == 1 {
+			pos = opPos
 		}
-		return seq, nil
+	}
+	if len(operands) == 1 {
+		leaveStep(tl, "11 parseRangeExpr (#operands = 1)")
+		return operands[0], nil
 	}
 	leaveStep(tl, "11 parseRangeExpr")
-	return retf, nil
+	return setPos(&RangeExpr{From: operands[0], To: operands[1]}, pos), nil
 }
 
 // [12] AdditiveExpr ::= MultiplicativeExpr ( ("+" | "-") MultiplicativeExpr )*
-func parseAdditiveExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseAdditiveExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "12 parseAdditiveExpr")
-	var efs []EvalFunc
+	var pos Position // first operator
+	var operands []Node
 	var operator []string
-	var ef EvalFunc
-	var err error
 	for {
-		ef, err = parseMultiplicativeExpr(tl)
+		n, err := parseMultiplicativeExpr(tl)
 		if err != nil {
 			leaveStep(tl, "12 parseAdditiveExpr")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		operands = append(operands, n)
+		opPos := tl.position()
 		if op, ok := tl.readNexttokIfIsOneOfValue([]string{"+", "-"}); ok {
+			if len(operator) == 0 {
+				pos = opPos
+			}
 			operator = append(operator, op)
 		} else {
 			break
 		}
 	}
-	if len(efs) == 1 {
+	if len(operands) == 1 {
 		leaveStep(tl, "12 parseAdditiveExpr")
-		return efs[0], nil
-	}
-	ef = func(ctx *Context) (Sequence, error) {
-		savedSeq := ctx.sequence
-		s, err := efs[0](ctx)
-		if err != nil {
-			return nil, err
-		}
-		if len(s) == 0 {
-			return Sequence{}, nil
-		}
-
-		// Check if we're dealing with durations or date/time types
-		result := s[0]
-		for i := 1; i < len(efs); i++ {
-			ctx.sequence = savedSeq
-			s2, err := efs[i](ctx)
-			if err != nil {
-				return nil, err
-			}
-			if len(s2) == 0 {
-				return Sequence{}, nil
-			}
-			op := operator[i-1]
-			res, err := addItems(result, s2[0], op)
-			if err != nil {
-				return nil, err
-			}
-			result = res
-		}
-		return Sequence{result}, nil
+		return operands[0], nil
 	}
 	leaveStep(tl, "12 parseAdditiveExpr")
-	return ef, nil
+	return setPos(&AdditiveExpr{Operands: operands, Ops: operator}, pos), nil
 }
 
 // [13] MultiplicativeExpr ::=  UnionExpr ( ("*" | "div" | "idiv" | "mod") UnionExpr )*
-func parseMultiplicativeExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseMultiplicativeExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "13 parseMultiplicativeExpr")
 
-	var efs []EvalFunc
+	var pos Position // first operator
+	var operands []Node
 	var operator []string
-	var ef EvalFunc
-	var err error
 	for {
-		ef, err = parseUnionExpr(tl)
+		n, err := parseUnionExpr(tl)
 		if err != nil {
 			leaveStep(tl, "13 parseMultiplicativeExpr")
 			return nil, err
 		}
-		if ef == nil {
-			if len(efs) == 0 {
+		if n == nil {
+			if len(operands) == 0 {
 				return nil, nil
 			}
+			// drop the dangling operator
+			operator = operator[:len(operands)-1]
 			break
 		}
-		efs = append(efs, ef)
+		operands = append(operands, n)
+		opPos := tl.position()
 		if op, ok := tl.readNexttokIfIsOneOfValue([]string{"*", "div", "idiv", "mod"}); ok {
+			if len(operator) == 0 {
+				pos = opPos
+			}
 			operator = append(operator, op)
 		} else {
 			break
 		}
 	}
-	if len(efs) == 1 {
+	if len(operands) == 1 {
 		leaveStep(tl, "13 parseMultiplicativeExpr")
-		return efs[0], nil
+		return operands[0], nil
 	}
 
-	ef = func(ctx *Context) (Sequence, error) {
-		savedSeq := ctx.sequence
-		s, err := efs[0](ctx)
+	leaveStep(tl, "13 parseMultiplicativeExpr")
+	return setPos(&MultiplicativeExpr{Operands: operands, Ops: operator}, pos), nil
+}
+
+// [14] UnionExpr ::= IntersectExceptExpr ( ("union" | "|") IntersectExceptExpr )*
+func parseUnionExpr(tl *Tokenlist) (Node, error) {
+	enterStep(tl, "14 parseUnionExpr")
+	var pos Position // first operator
+	var operands []Node
+
+	for {
+		n, err := parseIntersectExceptExpr(tl)
 		if err != nil {
+			leaveStep(tl, "14 parseUnionExpr")
 			return nil, err
 		}
-		if len(s) == 0 {
-			return Sequence{}, nil
+		operands = append(operands, n)
+		opPos := tl.position()
+		if _, found := tl.readNexttokIfIsOneOfValue([]string{"union", "|"}); !found {
+			break
+		}
+		if len(operands) == 1 {
+			pos = opPos
 		}
+	}
 
-		// Check for duration types in first operand
-		if dur, ok := s[0].(XSDuration); ok {
-			result := dur
-			for i := 1; i < len(efs); i++ {
-				ctx.sequence = savedSeq
-				s2, err := efs[i](ctx)
-				if err != nil {
-					return nil, err
-				}
-				if len(s2) == 0 {
-					return Sequence{}, nil
-				}
-				op := operator[i-1]
-				// Duration * number, Duration div number, Duration div Duration
-				if dur2, ok := s2[0].(XSDuration); ok && op == "div" {
-					// Duration div Duration = number
-					a := durationToSeconds(result)
-					b := durationToSeconds(dur2)
-					if b == 0 {
-						return nil, NewXPathError("FODT0002", "division by zero-duration")
-					}
-					return Sequence{a / b}, nil
-				}
-				flt, err := NumberValue(Sequence{s2[0]})
-				if err != nil {
-					return nil, err
-				}
-				ms := durationToMonthsAndSeconds(result)
-				switch op {
-				case "*":
-					ms.months = int(math.Round(float64(ms.months) * flt))
-					ms.seconds = ms.seconds * flt
-				case "div":
-					if flt == 0 {
-						return nil, NewXPathError("FODT0002", "division by zero")
-					}
-					ms.months = int(math.Round(float64(ms.months) / flt))
-					ms.seconds = ms.seconds / flt
-				}
-				result = monthsAndSecondsToDuration(ms.months, ms.seconds)
-			}
-			return Sequence{result}, nil
-		}
-
-		// Check if second operand is duration (number * Duration)
-		if len(efs) == 2 && operator[0] == "*" {
-			ctx.sequence = savedSeq
-			s2, err := efs[1](ctx)
-			if err != nil {
-				return nil, err
-			}
-			if len(s2) > 0 {
-				if dur, ok := s2[0].(XSDuration); ok {
-					flt, err := NumberValue(s)
-					if err != nil {
-						return nil, err
-					}
-					ms := durationToMonthsAndSeconds(dur)
-					ms.months = int(math.Round(float64(ms.months) * flt))
-					ms.seconds = ms.seconds * flt
-					return Sequence{monthsAndSecondsToDuration(ms.months, ms.seconds)}, nil
-				}
-			}
-		}
-
-		sum, err := NumberValue(s)
-		if err != nil {
-			return nil, err
-		}
-		resultType := NumericType(s[0])
-		for i := 1; i < len(efs); i++ {
-			ctx.sequence = savedSeq
-			s2, err := efs[i](ctx)
-			if err != nil {
-				return nil, err
-			}
-			if len(s2) == 0 {
-				return Sequence{}, nil
-			}
-			flt, err := NumberValue(s2)
-			opType := PromoteNumeric(resultType, NumericType(s2[0]))
-			switch operator[i-1] {
-			case "*":
-				sum *= flt
-				resultType = opType
-			case "div":
-				// div always produces at least decimal
-				if opType < NumDecimal {
-					opType = NumDecimal
-				}
-				// Division by zero raises FOAR0001 for integer/decimal operands.
-				// For float/double, Go produces ±Inf which is correct per spec.
-				if flt == 0 && opType <= NumDecimal {
-					return nil, NewXPathError("FOAR0001", "division by zero")
-				}
-				sum /= flt
-				resultType = opType
-			case "idiv":
-				if flt == 0 {
-					return nil, NewXPathError("FOAR0002", "integer division by zero")
-				}
-				if math.IsNaN(sum) || math.IsInf(sum, 0) {
-					return nil, NewXPathError("FOAR0002", "integer division with NaN or Inf")
-				}
-				sum = math.Trunc(sum / flt)
-				resultType = NumInteger
-			case "mod":
-				sum = math.Mod(sum, flt)
-				resultType = opType
-			}
-		}
-		if resultType == NumInteger {
-			return Sequence{int(sum)}, nil
-		}
-		return Sequence{WrapNumeric(sum, resultType)}, nil
-	}
-
-	leaveStep(tl, "13 parseMultiplicativeExpr")
-	return ef, nil
-}
-
-// [14] UnionExpr ::= IntersectExceptExpr ( ("union" | "|") IntersectExceptExpr )*
-func parseUnionExpr(tl *Tokenlist) (EvalFunc, error) {
-	enterStep(tl, "14 parseUnionExpr")
-	var efs []EvalFunc
-
-	for {
-		ef, err := parseIntersectExceptExpr(tl)
-		if err != nil {
-			leaveStep(tl, "14 parseUnionExpr")
-			return nil, err
-		}
-		efs = append(efs, ef)
-		if _, found := tl.readNexttokIfIsOneOfValue([]string{"union", "|"}); !found {
-			break
-		}
-	}
-
-	if len(efs) == 1 {
+	if len(operands) == 1 {
 		leaveStep(tl, "14 parseUnionExpr")
-		return efs[0], nil
-	}
-
-	ret := func(ctx *Context) (Sequence, error) {
-		if len(efs) == 1 {
-			return efs[0](ctx)
-		}
-		// Save and restore ctx.sequence so each union branch
-		// evaluates against the original context sequence.
-		savedSeq := ctx.sequence
-		var seq Sequence
-		for _, ef := range efs {
-			ctx.sequence = savedSeq
-			efSeq, err := ef(ctx)
-			if err != nil {
-				return nil, err
-			}
-			seq = append(seq, efSeq...)
-		}
-		var nodes goxml.SortByDocumentOrder
-		for _, itm := range seq {
-			if n, ok := itm.(goxml.XMLNode); ok {
-				nodes = append(nodes, n)
-			}
-		}
-		// document order
-		nodes = nodes.SortAndEliminateDuplicates()
-		var retSeq Sequence
-		for _, itm := range nodes {
-			retSeq = append(retSeq, itm)
-		}
-		return retSeq, nil
+		return operands[0], nil
 	}
 
 	leaveStep(tl, "14 parseUnionExpr")
-	return ret, nil
+	return setPos(&UnionExpr{Operands: operands}, pos), nil
 }
 
 // [15] IntersectExceptExpr  ::= InstanceofExpr ( ("intersect" | "except") InstanceofExpr )*
-func parseIntersectExceptExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseIntersectExceptExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "15 parseIntersectExceptExpr")
-	var efs []EvalFunc
+	var operands []Node
 	var intersectExcepts []string
 	var err error
-	var ef EvalFunc
-	if ef, err = parseInstanceofExpr(tl); err != nil {
+	var n Node
+	if n, err = parseInstanceofExpr(tl); err != nil {
 		leaveStep(tl, "15 parseIntersectExceptExpr")
 		return nil, err
 	}
-	efs = append(efs, ef)
+	operands = append(operands, n)
+	var pos Position // first operator
 	for {
 		var intersectExcept string
 		var ok bool
+		if len(operands) == 1 {
+			pos = tl.position()
+		}
 		if intersectExcept, ok = tl.readNexttokIfIsOneOfValueAndType([]string{"intersect", "except"}, tokQName); !ok {
 			break
 		}
 		intersectExcepts = append(intersectExcepts, intersectExcept)
-		if ef, err = parseInstanceofExpr(tl); err != nil {
+		if n, err = parseInstanceofExpr(tl); err != nil {
 			leaveStep(tl, "15 parseIntersectExceptExpr")
 			return nil, err
 		}
-		efs = append(efs, ef)
+		operands = append(operands, n)
 	}
-	if len(efs) == 1 {
+	if len(operands) == 1 {
 		leaveStep(tl, "15 parseIntersectExceptExpr")
-		return efs[0], nil
+		return operands[0], nil
 
 	}
-	evaler := func(ctx *Context) (Sequence, error) {
-		ret := Sequence{}
-		var left Sequence
-		for i, ef := range efs {
-			newcontext := CopyContext(ctx)
-			right, err := ef(newcontext)
-			if err != nil {
-				return nil, err
-			}
-
-			var lelt, relt *goxml.Element
-			var ok, inRight bool
-			if i > 0 {
-				shouldBeInRight := intersectExcepts[i-1] == "intersect"
-				ids := map[int]bool{}
-				for _, rItem := range right {
-					if relt, ok = rItem.(*goxml.Element); !ok {
-						return nil, fmt.Errorf("FIXME: not an element")
-					}
-					ids[relt.ID] = true
-				}
-				for _, lItem := range left {
-					if lelt, ok = lItem.(*goxml.Element); !ok {
-						return nil, fmt.Errorf("FIXME: not an element")
-					}
-					if _, inRight = ids[lelt.ID]; inRight == shouldBeInRight {
-						ret = append(ret, lelt)
-					}
-				}
-			}
-			left = right
-		}
-		ctx.sequence = ret
-		return ret, nil
-	}
 	leaveStep(tl, "15 parseIntersectExceptExpr")
-	return evaler, nil
+	return setPos(&IntersectExceptExpr{Operands: operands, Ops: intersectExcepts}, pos), nil
 }
 
 // [16] InstanceofExpr ::= TreatExpr ( "instance" "of" SequenceType )?
-func parseInstanceofExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseInstanceofExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "16 parseInstanceofExpr")
-	var ef EvalFunc
-	var tf testFunc
+	var n Node
+	var st *SequenceType
 	var err error
-	if ef, err = parseTreatExpr(tl); err != nil {
+	if n, err = parseTreatExpr(tl); err != nil {
 		leaveStep(tl, "16 parseInstanceofExpr")
 		return nil, err
 	}
 
 	if tl.nexttokIsValue("instance") {
+		pos := tl.position()
 		tl.read()
 		if !tl.nexttokIsValue("of") {
 			tl.unread()
 			leaveStep(tl, "16 parseInstanceofExpr")
-			return ef, nil
+			return n, nil
 		}
 		tl.read()
 
-		if tl.readIfTokenFollow([]token{{"empty-sequence", tokQName}, {'(', tokOpenParen}, {')', tokCloseParen}}) {
-			evaler := func(ctx *Context) (Sequence, error) {
-				seq, err := ef(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return Sequence{len(seq) == 0}, nil
-			}
-			return evaler, nil
-		}
-
-		if tf, err = parseSequenceType(tl); err != nil {
+		if st, err = parseSequenceType(tl); err != nil {
 			leaveStep(tl, "16 parseInstanceofExpr")
 			return nil, err
 		}
-		var oi string
-		oi, _ = tl.readNexttokIfIsOneOfValue([]string{"*", "+", "?"})
-		inOfExpr := func(ctx *Context) (Sequence, error) {
-			seq, err := ef(ctx)
-			if err != nil {
-				return nil, err
-			}
-
-			if oi == "" && len(seq) != 1 {
-				return Sequence{false}, nil
-			}
-			if oi == "+" && len(seq) < 1 {
-				return Sequence{false}, nil
-			}
-			if oi == "?" && len(seq) > 1 {
-				return Sequence{false}, nil
-			}
-
-			if tf == nil {
-				// No type test parsed — unknown type, always false
-				return Sequence{false}, nil
-			}
-			for _, itm := range seq {
-				if !tf(ctx, itm) {
-					return Sequence{false}, nil
-				}
-			}
-
-			return Sequence{true}, nil
-		}
 		leaveStep(tl, "16 parseInstanceofExpr")
-		return inOfExpr, nil
+		return setPos(&InstanceOfExpr{Expr: n, Type: st}, pos), nil
 	}
 
 	leaveStep(tl, "16 parseInstanceofExpr")
-	return ef, nil
+	return n, nil
 }
 
 // [17] TreatExpr ::= CastableExpr ( "treat" "as" SequenceType )?
-func parseTreatExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseTreatExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "17 parseTreatExpr")
-	var ef EvalFunc
-	ef, err := parseCastableExpr(tl)
+	n, err := parseCastableExpr(tl)
 	if err != nil {
 		leaveStep(tl, "17 parseTreatExpr")
 		return nil, err
 	}
 	var ok bool
+	pos := tl.position()
 	if _, ok = tl.readNexttokIfIsOneOfValueAndType([]string{"treat"}, tokQName); ok {
 		if err = tl.skipNCName("as"); err != nil {
 			leaveStep(tl, "17 parseTreatExpr")
 			return nil, err
 		}
-
-		if tl.readIfTokenFollow([]token{{"empty-sequence", tokQName}, {'(', tokOpenParen}, {')', tokCloseParen}}) {
-			evaler := func(ctx *Context) (Sequence, error) {
-				seq, err := ef(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return Sequence{len(seq) == 0}, nil
-			}
-			return evaler, nil
-		}
-
-		tf, err := parseSequenceType(tl)
+		st, err := parseSequenceType(tl)
 		if err != nil {
 			return nil, err
 		}
-		// Read optional occurrence indicator
-		var oi string
-		oi, _ = tl.readNexttokIfIsOneOfValue([]string{"*", "+", "?"})
-		baseEf := ef
-		ef = func(ctx *Context) (Sequence, error) {
-			seq, err := baseEf(ctx)
-			if err != nil {
-				return nil, err
-			}
-			// Check cardinality
-			switch oi {
-			case "":
-				if len(seq) != 1 {
-					return nil, NewXPathError("XPDY0050", fmt.Sprintf("treat as requires exactly one item, got %d", len(seq)))
-				}
-			case "+":
-				if len(seq) < 1 {
-					return nil, NewXPathError("XPDY0050", "treat as requires at least one item, got empty")
-				}
-			case "?":
-				if len(seq) > 1 {
-					return nil, NewXPathError("XPDY0050", fmt.Sprintf("treat as requires at most one item, got %d", len(seq)))
-				}
-			}
-			// Check type if tf is available
-			if tf != nil {
-				for _, itm := range seq {
-					if !tf(ctx, itm) {
-						return nil, NewXPathError("XPDY0050", "item does not match required type")
-					}
-				}
-			}
-			return seq, nil
-		}
 		leaveStep(tl, "17 parseTreatExpr")
-		return ef, nil
+		return setPos(&TreatExpr{Expr: n, Type: st}, pos), nil
 	}
 
 	leaveStep(tl, "17 parseTreatExpr")
-	return ef, nil
+	return n, nil
 }
 
 // [18] CastableExpr ::= CastExpr ( "castable" "as" SingleType )?
-func parseCastableExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseCastableExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "18 parseCastableExpr")
-	var ef EvalFunc
-	ef, err := parseCastExpr(tl)
+	n, err := parseCastExpr(tl)
 	if err != nil {
 		leaveStep(tl, "18 parseCastableExpr")
 		return nil, err
 	}
 
 	var ok bool
+	pos := tl.position()
 	if _, ok = tl.readNexttokIfIsOneOfValueAndType([]string{"castable"}, tokQName); ok {
 		if err = tl.skipNCName("as"); err != nil {
 			leaveStep(tl, "18 parseCastableExpr")
@@ -2654,7 +2307,11 @@ func parseCastableExpr(tl *Tokenlist) (EvalFunc, error) {
 			leaveStep(tl, "18 parseCastableExpr")
 			return nil, fmt.Errorf("expected type name after 'castable as'")
 		}
-		typName := typTok.Value.(string)
+		typName, ok := typeTokenName(typTok)
+		if !ok {
+			leaveStep(tl, "18 parseCastableExpr")
+			return nil, fmt.Errorf("expected type name after 'castable as'")
+		}
 		// XPST0080: static error for abstract types
 		switch typName {
 		case "xs:NOTATION", "xs:anyAtomicType", "xs:anySimpleType":
@@ -2664,62 +2321,18 @@ func parseCastableExpr(tl *Tokenlist) (EvalFunc, error) {
 		if _, optOk := tl.readNexttokIfIsOneOfValueAndType([]string{"?"}, tokOperator); optOk {
 			optional = true
 		}
-		baseEf := ef
-		ef = func(ctx *Context) (Sequence, error) {
-			seq, err := baseEf(ctx)
-			if err != nil {
-				return nil, err
-			}
-			if len(seq) == 0 {
-				return Sequence{optional}, nil
-			}
-			if len(seq) > 1 {
-				return Sequence{false}, nil
-			}
-			item := seq[0]
-			// Check type compatibility
-			sourceType := TypeIDOf(item)
-			if !castAllowed(sourceType, typName) {
-				return Sequence{false}, nil
-			}
-			// XPST0080: cannot cast to abstract types
-			switch typName {
-			case "xs:NOTATION", "xs:anyAtomicType", "xs:anySimpleType":
-				return Sequence{false}, nil
-			}
-			// Try the actual cast — if it succeeds, castable is true
-			castPrefix := ""
-			castLocal := typName
-			if before, after, ok0 := strings.Cut(typName, ":"); ok0 {
-				castPrefix = before
-				castLocal = after
-			}
-			castNS := nsFN
-			if castPrefix != "" {
-				if ns, nsOk := ctx.Namespaces[castPrefix]; nsOk {
-					castNS = ns
-				}
-			}
-			fn := getfunction(castNS, castLocal)
-			if fn != nil {
-				_, castErr := fn.F(ctx, []Sequence{{item}})
-				return Sequence{castErr == nil}, nil
-			}
-			return Sequence{false}, nil
-		}
 		leaveStep(tl, "18 parseCastableExpr")
-		return ef, nil
+		return setPos(&CastableExpr{Expr: n, Type: typName, Optional: optional}, pos), nil
 	}
 
 	leaveStep(tl, "18 parseCastableExpr")
-	return ef, nil
+	return n, nil
 }
 
 // [19] CastExpr ::= ArrowExpr ( "cast" "as" SingleType )?
-func parseCastExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseCastExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "19 parseCastExpr")
-	var ef EvalFunc
-	ef, err := parseArrowExpr(tl)
+	n, err := parseArrowExpr(tl)
 	if err != nil {
 		leaveStep(tl, "19 parseCastExpr")
 		return nil, err
@@ -2727,6 +2340,7 @@ func parseCastExpr(tl *Tokenlist) (EvalFunc, error) {
 
 	// Check for "cast as <type>"
 	if tl.nexttokIsValue("cast") {
+		pos := tl.position()
 		tl.read() // consume "cast"
 		if !tl.nexttokIsValue("as") {
 			leaveStep(tl, "19 parseCastExpr")
@@ -2738,7 +2352,11 @@ func parseCastExpr(tl *Tokenlist) (EvalFunc, error) {
 			leaveStep(tl, "19 parseCastExpr")
 			return nil, fmt.Errorf("expected type name after 'cast as'")
 		}
-		typName := typTok.Value.(string)
+		typName, ok := typeTokenName(typTok)
+		if !ok {
+			leaveStep(tl, "19 parseCastExpr")
+			return nil, fmt.Errorf("expected type name after 'cast as'")
+		}
 		// XPST0080: static error for abstract types
 		switch typName {
 		case "xs:NOTATION", "xs:anyAtomicType", "xs:anySimpleType":
@@ -2749,123 +2367,24 @@ func parseCastExpr(tl *Tokenlist) (EvalFunc, error) {
 		if _, ok := tl.readNexttokIfIsOneOfValueAndType([]string{"?"}, tokOperator); ok {
 			optional = true
 		}
-		baseEf := ef
-		ef = func(ctx *Context) (Sequence, error) {
-			seq, err := baseEf(ctx)
-			if err != nil {
-				return nil, err
-			}
-			if len(seq) == 0 {
-				if optional {
-					return Sequence{}, nil
-				}
-				return nil, NewXPathError("XPTY0004", fmt.Sprintf("empty sequence cannot be cast to %s", typName))
-			}
-			// Reject invalid cast target types
-			switch typName {
-			case "xs:NOTATION", "xs:anyAtomicType", "xs:anySimpleType":
-				return nil, NewXPathError("XPST0080", fmt.Sprintf("cannot cast to %s", typName))
-			}
-			item := seq[0]
-			// Validate cast compatibility
-			sourceType := TypeIDOf(item)
-			if !castAllowed(sourceType, typName) {
-				return nil, NewXPathError("XPTY0004", fmt.Sprintf("cannot cast %s to %s", sourceType, typName))
-			}
-			switch typName {
-			case "xs:integer", "xs:int",
-				"xs:long", "xs:short", "xs:byte",
-				"xs:unsignedLong", "xs:unsignedInt", "xs:unsignedShort", "xs:unsignedByte",
-				"xs:nonPositiveInteger", "xs:nonNegativeInteger",
-				"xs:negativeInteger", "xs:positiveInteger":
-				// Route through registered constructor to get correct subtype tag
-				castLocal := typName[3:] // strip "xs:"
-				fn := getfunction(nsXS, castLocal)
-				if fn != nil {
-					return fn.F(ctx, []Sequence{{item}})
-				}
-				return xsInteger(ctx, []Sequence{{item}})
-			case "xs:double":
-				return xsDouble(ctx, []Sequence{{item}})
-			case "xs:float":
-				return xsFloat(ctx, []Sequence{{item}})
-			case "xs:decimal":
-				return xsDecimal(ctx, []Sequence{{item}})
-			case "xs:string", "xs:normalizedString", "xs:token",
-				"xs:language", "xs:NMTOKEN", "xs:Name", "xs:NCName",
-				"xs:ID", "xs:IDREF", "xs:ENTITY",
-				"xs:anyURI", "xs:untypedAtomic",
-				"xs:hexBinary", "xs:base64Binary":
-				// Route through registered constructor for correct type tag
-				castLocal := typName[3:] // strip "xs:"
-				fn := getfunction(nsXS, castLocal)
-				if fn != nil {
-					return fn.F(ctx, []Sequence{{item}})
-				}
-				sv, err := StringValue(Sequence{item})
-				if err != nil {
-					return nil, err
-				}
-				return Sequence{sv}, nil
-			case "xs:boolean":
-				// Handle numeric → boolean: 0/NaN → false, other → true
-				if f, ok := ToFloat64(item); ok {
-					return Sequence{f != 0 && !math.IsNaN(f)}, nil
-				}
-				if b, ok := item.(bool); ok {
-					return Sequence{b}, nil
-				}
-				// xs:boolean cast uses XML Schema lexical rules
-				sv, err := StringValue(Sequence{item})
-				if err != nil {
-					return nil, err
-				}
-				sv = strings.TrimSpace(sv)
-				switch sv {
-				case "true", "1":
-					return Sequence{true}, nil
-				case "false", "0":
-					return Sequence{false}, nil
-				default:
-					return nil, NewXPathError("FORG0001", fmt.Sprintf("cannot cast %q to xs:boolean", sv))
-				}
-			default:
-				// Try calling the XSD constructor function
-				castPrefix := ""
-				castLocal := typName
-				if before, after, ok := strings.Cut(typName, ":"); ok {
-					castPrefix = before
-					castLocal = after
-				}
-				castNS := nsFN
-				if castPrefix != "" {
-					if ns, ok := ctx.Namespaces[castPrefix]; ok {
-						castNS = ns
-					}
-				}
-				fn := getfunction(castNS, castLocal)
-				if fn != nil {
-					return fn.F(ctx, []Sequence{{item}})
-				}
-				return nil, NewXPathError("XPTY0004", fmt.Sprintf("unsupported cast type %s", typName))
-			}
-		}
+		n = setPos(&CastExpr{Expr: n, Type: typName, Optional: optional}, pos)
 	}
 
 	leaveStep(tl, "19 parseCastExpr")
-	return ef, nil
+	return n, nil
 }
 
 // [29] ArrowExpr ::= UnaryExpr ("=>" ArrowFunctionSpecifier ArgumentList)*
-func parseArrowExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseArrowExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "29 parseArrowExpr")
-	ef, err := parseUnaryExpr(tl)
+	n, err := parseUnaryExpr(tl)
 	if err != nil {
 		leaveStep(tl, "29 parseArrowExpr")
 		return nil, err
 	}
 
 	for {
+		pos := tl.position()
 		if _, ok := tl.readNexttokIfIsOneOfValueAndType([]string{"=>"}, tokOperator); !ok {
 			break
 		}
@@ -2888,14 +2407,14 @@ func parseArrowExpr(tl *Tokenlist) (EvalFunc, error) {
 			leaveStep(tl, "29 parseArrowExpr")
 			return nil, fmt.Errorf("'(' expected after arrow function name")
 		}
-		var argEfs []EvalFunc
+		var args []Node
 		if !tl.nexttokIsTyp(tokCloseParen) {
 			for {
-				argEf, err := parseExprSingle(tl)
+				arg, err := parseExprSingle(tl)
 				if err != nil {
 					return nil, err
 				}
-				argEfs = append(argEfs, argEf)
+				args = append(args, arg)
 				if !tl.nexttokIsTyp(tokComma) {
 					break
 				}
@@ -2905,44 +2424,17 @@ func parseArrowExpr(tl *Tokenlist) (EvalFunc, error) {
 		if err := tl.skipType(tokCloseParen); err != nil {
 			return nil, fmt.Errorf("')' expected in arrow function arguments")
 		}
-
-		baseEf := ef
-		capturedName := fnName
-		capturedArgEfs := argEfs
-		ef = func(ctx *Context) (Sequence, error) {
-			// Evaluate the left-hand side (becomes first argument)
-			leftSeq, err := baseEf(ctx)
-			if err != nil {
-				return nil, err
-			}
-			// Evaluate additional arguments
-			allArgs := make([]Sequence, 1+len(capturedArgEfs))
-			allArgs[0] = leftSeq
-			for i, argEf := range capturedArgEfs {
-				argSeq, err := argEf(ctx)
-				if err != nil {
-					return nil, err
-				}
-				allArgs[i+1] = argSeq
-			}
-			// Resolve function name and call
-			fnPrefix := ""
-			fnLocalName := capturedName
-			if before, after, ok := strings.Cut(capturedName, ":"); ok {
-				fnPrefix = before
-				fnLocalName = after
-			}
-			return callFunctionResolved(fnPrefix, fnLocalName, allArgs, ctx)
-		}
+		n = setPos(&ArrowExpr{Expr: n, Function: fnName, Args: args}, pos)
 	}
 
 	leaveStep(tl, "29 parseArrowExpr")
-	return ef, nil
+	return n, nil
 }
 
 // [20] UnaryExpr ::= ("-" | "+")* ValueExpr
-func parseUnaryExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseUnaryExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "20 parseUnaryExpr")
+	pos := tl.position()
 	var hasOP bool
 	mult := 1
 	for {
@@ -2965,96 +2457,59 @@ func parseUnaryExpr(tl *Tokenlist) (EvalFunc, error) {
 		leaveStep(tl, "20 parseUnaryExpr")
 		return pv, nil
 	}
-	var ef EvalFunc
-	ef = func(ctx *Context) (Sequence, error) {
-		if mult == -1 {
-			seq, err := pv(ctx)
-			if err != nil {
-				return nil, err
-			}
-			flt, err := NumberValue(seq)
-			if err != nil {
-				return nil, err
-			}
-			return Sequence{flt * -1}, nil
-		}
-		return pv(ctx)
+	op := "+"
+	if mult == -1 {
+		op = "-"
 	}
-
 	leaveStep(tl, "20 parseUnaryExpr")
-	return ef, nil
+	return setPos(&UnaryExpr{Op: op, Expr: pv}, pos), nil
 }
 
 // [21] SimpleMapExpr ::= PathExpr ("!" PathExpr)*
-func parseSimpleMapExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseSimpleMapExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "21 parseSimpleMapExpr")
-	var efs []EvalFunc
-	ef, err := parsePathExpr(tl)
+	var operands []Node
+	n, err := parsePathExpr(tl)
 	if err != nil {
 		leaveStep(tl, "21 parseSimpleMapExpr")
 		return nil, err
 	}
-	if ef == nil {
+	if n == nil {
 		leaveStep(tl, "21 parseSimpleMapExpr (nil)")
 		return nil, nil
 	}
-	efs = append(efs, ef)
+	operands = append(operands, n)
+	var pos Position // first "!"
 	for {
+		opPos := tl.position()
 		if _, ok := tl.readNexttokIfIsOneOfValueAndType([]string{"!"}, tokOperator); !ok {
 			break
 		}
-		ef2, err := parsePathExpr(tl)
+		if len(operands) == 1 {
+			pos = opPos
+		}
+		n2, err := parsePathExpr(tl)
 		if err != nil {
 			leaveStep(tl, "21 parseSimpleMapExpr")
 			return nil, err
 		}
-		if ef2 == nil {
+		if n2 == nil {
 			return nil, fmt.Errorf("expected expression after '!'")
 		}
-		efs = append(efs, ef2)
+		operands = append(operands, n2)
 	}
-	if len(efs) == 1 {
+	if len(operands) == 1 {
 		leaveStep(tl, "21 parseSimpleMapExpr")
-		return efs[0], nil
-	}
-	mapEf := func(ctx *Context) (Sequence, error) {
-		result, err := efs[0](ctx)
-		if err != nil {
-			return nil, err
-		}
-		for _, stepEf := range efs[1:] {
-			var newResult Sequence
-			saveSeq := ctx.SetContextSequence(result)
-			savePos := ctx.Pos
-			saveSize := ctx.Size()
-			ctx.SetSize(len(result))
-			for pos, item := range result {
-				ctx.Pos = pos
-				ctx.SetContextSequence(Sequence{item})
-				seq, err := stepEf(ctx)
-				if err != nil {
-					ctx.SetContextSequence(saveSeq)
-					ctx.Pos = savePos
-					ctx.SetSize(saveSize)
-					return nil, err
-				}
-				newResult = append(newResult, seq...)
-			}
-			ctx.SetContextSequence(saveSeq)
-			ctx.Pos = savePos
-			ctx.SetSize(saveSize)
-			result = newResult
-		}
-		return result, nil
+		return operands[0], nil
 	}
 	leaveStep(tl, "21 parseSimpleMapExpr")
-	return mapEf, nil
+	return setPos(&SimpleMapExpr{Operands: operands}, pos), nil
 }
 
 // [25] PathExpr ::= ("/" RelativePathExpr?) | ("//" RelativePathExpr) | RelativePathExpr
-func parsePathExpr(tl *Tokenlist) (EvalFunc, error) {
+func parsePathExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "25 parsePathExpr")
-	var rpe EvalFunc
+	pos := tl.position()
 	var op string
 	var hasOP bool
 	op, hasOP = tl.readNexttokIfIsOneOfValueAndType([]string{"/", "//"}, tokOperator)
@@ -3064,57 +2519,22 @@ func parsePathExpr(tl *Tokenlist) (EvalFunc, error) {
 		if errors.Is(err, io.EOF) {
 			// EOF is not an error
 			leaveStep(tl, "25 parsePathExpr (EOF)")
-			return func(ctx *Context) (Sequence, error) {
-				return Sequence{ctx.Document()}, nil
-			}, nil
+			return setPos(&PathExpr{Root: "/"}, pos), nil
 		}
 		leaveStep(tl, "25 parsePathExpr (err)")
 		return nil, err
 	}
 
 	if hasOP {
-		fn := func(ctx *Context) (Sequence, error) {
-			ctx.Document()
-			if op == "//" {
-				ctx.descendantOrSelfAxis(isNode)
-			}
-			if rpe == nil {
-				if op == "/" {
-					return Sequence{ctx.Document()}, nil
-				}
-				return nil, fmt.Errorf("unexpected end of path expression after '//'")
-			}
-			seq, err := rpe(ctx)
-			if err != nil {
-				return nil, err
-			}
-			// For "//" paths, sort result in document order and
-			// eliminate duplicates (XPath spec §3.3.2).
-			// Only sort when all items are XMLNodes with unique non-zero
-			// IDs (elements/documents from parsing have those;
-			// attributes created on the fly have ID=0).
-			if op == "//" && len(seq) > 1 {
-				var nodes goxml.SortByDocumentOrder
-				canSort := true
-				for _, itm := range seq {
-					n, ok := itm.(goxml.XMLNode)
-					if !ok || n.GetID() == 0 {
-						canSort = false
-						break
-					}
-					nodes = append(nodes, n)
-				}
-				if canSort {
-					nodes = nodes.SortAndEliminateDuplicates()
-					seq = make(Sequence, len(nodes))
-					for i, n := range nodes {
-						seq[i] = n
-					}
-				}
-			}
-			return seq, nil
+		pe := setPos(&PathExpr{Root: op}, pos)
+		if rel, ok := rpe.(*PathExpr); ok {
+			pe.Steps = rel.Steps
+			pe.Seps = rel.Seps
+		} else if rpe != nil {
+			pe.Steps = []Node{rpe}
 		}
-		return fn, nil
+		leaveStep(tl, "25 parsePathExpr")
+		return pe, nil
 	}
 
 	leaveStep(tl, "25 parsePathExpr")
@@ -3122,113 +2542,77 @@ func parsePathExpr(tl *Tokenlist) (EvalFunc, error) {
 }
 
 // [26] RelativePathExpr ::= StepExpr (("/" | "//") StepExpr)*
-func parseRelativePathExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseRelativePathExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "26 parseRelativePathExpr")
-	var ef EvalFunc
-	var efs []EvalFunc
+	pos := tl.position()
+	var steps []Node
 	var ops []string
 
 	for {
-		ef, err := parseStepExpr(tl)
+		n, err := parseStepExpr(tl)
 		if err != nil {
 			leaveStep(tl, "26 parseRelativePathExpr (err)")
 			return nil, err
 		}
-		if ef == nil {
-			if len(efs) == 0 {
+		if n == nil {
+			if len(steps) == 0 {
 				return nil, nil
 			}
 			break
 		}
-		efs = append(efs, ef)
+		steps = append(steps, n)
 		if op, ok := tl.readNexttokIfIsOneOfValueAndType([]string{"/", "//"}, tokOperator); ok {
 			ops = append(ops, op)
 		} else {
 			break
 		}
 	}
-	if len(efs) == 1 {
+	if len(steps) == 1 {
 		leaveStep(tl, "26 parseRelativePathExpr (1)")
-		return efs[0], nil // just a simple StepExpr
-	}
-
-	ef = func(ctx *Context) (Sequence, error) {
-		var retseq Sequence
-		var seq Sequence
-		var err error
-		for i := 0; i < len(efs); i++ {
-			ef := efs[i]
-			retseq = retseq[:0]
-			if len(ctx.sequence) == 0 {
-				if seq, err = ef(ctx); err != nil {
-					return nil, err
-				}
-				retseq = append(retseq, seq...)
-			} else {
-				copyContext := ctx.sequence
-				ctx.size = len(copyContext)
-				for j, itm := range copyContext {
-					ctx.sequence = Sequence{itm}
-					ctx.Pos = j + 1
-					if seq, err = ef(ctx); err != nil {
-						return nil, err
-					}
-					retseq = append(retseq, seq...)
-				}
-			}
-			ctx.sequence = ctx.sequence[:0]
-			for _, itm := range retseq {
-				ctx.sequence = append(ctx.sequence, itm)
-			}
-
-			if i < len(ops) && ops[i] == "//" {
-				ctx.descendantOrSelfAxis(isElement)
-				retseq = append(retseq, ctx.sequence...)
-			}
-		}
-
-		return retseq, nil
+		return steps[0], nil // just a simple StepExpr
 	}
 
 	leaveStep(tl, "26 parseRelativePathExpr")
-	return ef, nil
+	return setPos(&PathExpr{Steps: steps, Seps: ops[:len(steps)-1]}, pos), nil
 }
 
 // [27] StepExpr := FilterExpr | AxisStep
-func parseStepExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseStepExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "27 parseStepExpr")
-	var ef EvalFunc
-	ef, err := parseFilterExpr(tl)
+	n, err := parseFilterExpr(tl)
 	if err != nil {
 		leaveStep(tl, "27 parseStepExpr (err1)")
 		return nil, err
 	}
-	if ef == nil {
-		ef, err = parseAxisStep(tl)
+	if n == nil {
+		n, err = parseAxisStep(tl)
 	}
 	if err != nil {
 		leaveStep(tl, "27 parseStepExpr (err)")
 		return nil, err
 	}
 
-	if ef == nil {
+	if n == nil {
 		return nil, nil
 	}
 	leaveStep(tl, "27 parseStepExpr")
-	return ef, nil
+	return n, nil
 }
 
 // [28] AxisStep ::= (ReverseStep | ForwardStep) PredicateList
 // [39] PredicateList ::= Predicate*
-func parseAxisStep(tl *Tokenlist) (EvalFunc, error) {
+func parseAxisStep(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "28 parseAxisStep")
-	var ef EvalFunc
+	var step *AxisStep
 	var err error
-	var predicates []EvalFunc
-	if ef, err = parseForwardStep(tl); err != nil {
+	if step, err = parseForwardStep(tl); err != nil {
 		leaveStep(tl, "28 parseAxisStep (err)")
 		return nil, err
 	}
+	if step == nil {
+		leaveStep(tl, "28 parseAxisStep (nil)")
+		return nil, nil
+	}
 	for {
 		if tl.nexttokIsTyp(tokOpenBracket) {
 			tl.read()
@@ -3237,7 +2621,7 @@ func parseAxisStep(tl *Tokenlist) (EvalFunc, error) {
 				leaveStep(tl, "28 parseAxisStep (err)")
 				return nil, err
 			}
-			predicates = append(predicates, predicate)
+			step.Predicates = append(step.Predicates, predicate)
 			err = tl.skipType(tokCloseBracket)
 			if err != nil {
 				return nil, err
@@ -3246,82 +2630,21 @@ func parseAxisStep(tl *Tokenlist) (EvalFunc, error) {
 			break
 		}
 	}
-	if len(predicates) == 0 {
-		leaveStep(tl, "28 parseAxisStep (b)")
-		return ef, nil
-	}
-	ff := func(ctx *Context) (Sequence, error) {
-		var err error
-		_, err = ef(ctx)
-		if err != nil {
-			return nil, err
-		}
-		for _, predicate := range predicates {
-			_, err = ctx.Filter(predicate)
-			if err != nil {
-				return nil, err
-			}
-			ctx.size = len(ctx.sequence)
-		}
-		return ctx.sequence, nil
-	}
-
 	leaveStep(tl, "28 parseAxisStep (b)")
-	return ff, nil
+	return step, nil
 }
 
-type axis int
-
-const (
-	axisChild axis = iota
-	axisSelf
-	axisDescendant
-	axisDescendantOrSelf
-	axisFollowing
-	axisFollowingSibling
-	axisParent
-	axisAncestor
-	axisAncestorOrSelf
-	axisPreceding
-	axisPrecedingSibling
-)
-
-func (a axis) String() string {
-	switch a {
-	case axisChild:
-		return "child"
-	case axisSelf:
-		return "self"
-	case axisDescendant:
-		return "descendant"
-	case axisDescendantOrSelf:
-		return "descendant-or-self"
-	case axisFollowing:
-		return "following"
-	case axisFollowingSibling:
-		return "following-sibling"
-	case axisParent:
-		return "parent"
-	case axisAncestor:
-		return "ancestor"
-	case axisAncestorOrSelf:
-		return "ancestor-or-self"
-	case axisPreceding:
-		return "preceding"
-	case axisPrecedingSibling:
-		return "preceding-sibling"
-
-	}
-	return ""
-}
+var axisNames = []string{"attribute", "child", "self", "descendant", "descendant-or-self",
+	"following", "following-sibling", "parent", "ancestor", "ancestor-or-self",
+	"preceding-sibling", "preceding"}
 
 // [29] ForwardStep ::= (ForwardAxis NodeTest) | AbbrevForwardStep
 // [31] AbbrevForwardStep ::= "@"? NodeTest
-func parseForwardStep(tl *Tokenlist) (EvalFunc, error) {
+func parseForwardStep(tl *Tokenlist) (*AxisStep, error) {
 	enterStep(tl, "29 parseForwardStep")
 	var err error
 
-	stepAxis := axisChild
+	step := setPos(&AxisStep{Axis: "child"}, tl.position())
 	tl.attributeMode = false
 
 	if tl.nexttokIsTyp(tokDoubleColon) {
@@ -3329,101 +2652,37 @@ func parseForwardStep(tl *Tokenlist) (EvalFunc, error) {
 		if err != nil {
 			return nil, err
 		}
-
-		switch nexttok.Value.(string) {
-		case "attribute":
+		axisName := nexttok.Value.(string)
+		if !slices.Contains(axisNames, axisName) {
+			return nil, fmt.Errorf("unknown axis %s", axisName)
+		}
+		step.Axis = axisName
+		if axisName == "attribute" {
 			tl.attributeMode = true
-		case "child":
-			stepAxis = axisChild
-		case "self":
-			stepAxis = axisSelf
-		case "descendant":
-			stepAxis = axisDescendant
-		case "descendant-or-self":
-			stepAxis = axisDescendantOrSelf
-		case "following":
-			stepAxis = axisFollowing
-		case "following-sibling":
-			stepAxis = axisFollowingSibling
-		case "parent":
-			stepAxis = axisParent
-		case "ancestor":
-			stepAxis = axisAncestor
-		case "ancestor-or-self":
-			stepAxis = axisAncestorOrSelf
-		case "preceding-sibling":
-			stepAxis = axisPrecedingSibling
-		case "preceding":
-			stepAxis = axisPreceding
-		default:
-			return nil, fmt.Errorf("unknown axis %s", nexttok.Value.(string))
 		}
 	}
 	if tl.nexttokIsValue("..") && tl.nexttokIsTyp(tokOperator) {
 		tl.read()
-		ef := func(ctx *Context) (Sequence, error) {
-			return ctx.parentAxis(isNode)
-		}
 		leaveStep(tl, "29 parseForwardStep (..)")
-		return ef, nil
+		return setPos(&AxisStep{Axis: "parent", Test: &KindTest{Kind: "node"}, Abbrev: true}, step.pos), nil
 	}
 
 	if tl.nexttokIsValue("@") {
 		tl.read() // @
 		tl.attributeMode = true
+		step.Axis = "attribute"
+		step.Abbrev = true
 	}
-	var tf testFunc
-	if tf, err = parseNodeTest(tl); err != nil {
+	if step.Test, err = parseNodeTest(tl); err != nil {
 		leaveStep(tl, "29 parseForwardStep (err)")
 		return nil, err
 	}
-	if tf == nil {
+	if step.Test == nil {
 		leaveStep(tl, "29 parseForwardStep (nil)")
 		return nil, nil
 	}
-	ret := func(ctx *Context) (Sequence, error) {
-		var ret Sequence
-		var err error
-		switch stepAxis {
-		case axisSelf:
-			// nothing
-		case axisChild:
-			_, err = ctx.childAxis(tf)
-		case axisDescendant:
-			_, err = ctx.descendantAxis(tf)
-		case axisDescendantOrSelf:
-			_, err = ctx.descendantOrSelfAxis(tf)
-		case axisFollowing:
-			_, err = ctx.followingAxis(tf)
-		case axisFollowingSibling:
-			_, err = ctx.followingSiblingAxis(tf)
-		case axisParent:
-			_, err = ctx.parentAxis(tf)
-		case axisAncestor:
-			_, err = ctx.ancestorAxis(tf)
-		case axisAncestorOrSelf:
-			_, err = ctx.ancestorOrSelfAxis(tf)
-		case axisPrecedingSibling:
-			_, err = ctx.precedingSiblingAxis(tf)
-		case axisPreceding:
-			_, err = ctx.precedingAxis(tf)
-		default:
-			return nil, fmt.Errorf("unknown axis %s", stepAxis)
-		}
-		if err != nil {
-			return nil, err
-		}
-		copyContext := ctx.sequence
-		for _, itm := range copyContext {
-			ret = append(ret, itm)
-		}
-		ctx.sequence = ret
-		ctx.size = len(ret)
-		return ret, nil
-	}
-
 	leaveStep(tl, "29 parseForwardStep")
-	return ret, nil
+	return step, nil
 }
 
 // [30] ForwardAxis ::= ("child" "::") | ("descendant" "::")| ("attribute" "::")| ("self" "::")| ("descendant-or-self" "::")| ("following-sibling" "::")| ("following" "::")| ("namespace" "::")
@@ -3431,9 +2690,10 @@ func parseForwardStep(tl *Tokenlist) (EvalFunc, error) {
 // [34] AbbrevReverseStep ::= ".."
 // [33] ReverseAxis ::= ("parent" "::") | ("ancestor" "::") | ("preceding-sibling" "::") | ("preceding" "::") | ("ancestor-or-self" "::")
 // [35] NodeTest ::= KindTest | NameTest
-func parseNodeTest(tl *Tokenlist) (testFunc, error) {
+func parseNodeTest(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "35 parseNodeTest")
-	var tf testFunc
+	pos := tl.position()
+	var kt *KindTest
 	var err error
 	if str, found := tl.readNexttokIfIsOneOfValueAndType(kindTestStrings, tokQName); found {
 		if !tl.nexttokIsTyp(tokOpenParen) {
@@ -3442,27 +2702,41 @@ func parseNodeTest(tl *Tokenlist) (testFunc, error) {
 			tl.unread()
 		} else {
 			tl.unread()
-			if tf, err = parseKindTest(tl, str); err != nil {
+			if kt, err = parseKindTest(tl, str); err != nil {
 				return nil, err
 			}
-			if tf != nil {
-				return tf, nil
+			if kt != nil {
+				return setPos(kt, pos), nil
 			}
 		}
 	}
-	if tf, err = parseNameTest(tl); err != nil {
+	n, err := parseNameTest(tl)
+	if err != nil {
 		leaveStep(tl, "35 parseNodeTest (err)")
 		return nil, err
 	}
 
 	leaveStep(tl, "35 parseNodeTest")
-	return tf, nil
+	return n, nil
 }
 
-// [36] NameTest ::= QName | Wildcard
-func parseNameTest(tl *Tokenlist) (testFunc, error) {
+// [36] NameTest ::= EQName | Wildcard
+func parseNameTest(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "36 parseNameTest")
-	var tf testFunc
+
+	if tl.nexttokIsTyp(tokEQName) {
+		n, err := tl.read()
+		if err != nil {
+			leaveStep(tl, "36 parseNameTest (err)")
+			return nil, err
+		}
+		name := tokenName(n)
+		leaveStep(tl, "36 parseNameTest")
+		if strings.HasSuffix(name, "}*") {
+			return setPos(&WildcardTest{Name: name, Attribute: tl.attributeMode}, n.Pos), nil
+		}
+		return setPos(&NameTest{Name: name, Attribute: tl.attributeMode}, n.Pos), nil
+	}
 
 	if tl.nexttokIsTyp(tokQName) {
 		n, err := tl.read()
@@ -3475,29 +2749,25 @@ func parseNameTest(tl *Tokenlist) (testFunc, error) {
 		if name, ok = n.Value.(string); !ok {
 			return nil, err
 		}
-		if tl.attributeMode {
-			tf = returnAttributeNameTest(name)
-		} else {
-			tf = returnElementNameTest(name)
-		}
-
 		leaveStep(tl, "36 parseNameTest")
-		return tf, nil
+		return setPos(&NameTest{Name: name, Attribute: tl.attributeMode}, n.Pos), nil
 	}
-	var err error
-	tf, err = parseWildCard(tl)
+	wc, err := parseWildCard(tl)
 	if err != nil {
 		leaveStep(tl, "36 parseNameTest (err)")
 		return nil, err
 	}
 	leaveStep(tl, "36 parseNameTest")
-	return tf, nil
+	if wc == nil {
+		return nil, nil
+	}
+	return wc, nil
 }
 
 // [37] Wildcard ::= "*" | (NCName ":" "*") | ("*" ":" NCName)
-func parseWildCard(tl *Tokenlist) (testFunc, error) {
+func parseWildCard(tl *Tokenlist) (*WildcardTest, error) {
 	enterStep(tl, "37 parseWildCard")
-	var tf testFunc
+	var wc *WildcardTest
 	var err error
 	var strTok *token
 	if strTok, err = tl.read(); err != nil {
@@ -3507,21 +2777,7 @@ func parseWildCard(tl *Tokenlist) (testFunc, error) {
 
 	if str, ok := strTok.Value.(string); ok {
 		if str == "*" || strings.HasPrefix(str, "*:") || strings.HasSuffix(str, ":*") {
-			if tl.attributeMode {
-				tf = func(ctx *Context, itm Item) bool {
-					if _, ok := itm.(*goxml.Attribute); ok {
-						return true
-					}
-					return false
-				}
-			} else {
-				tf = func(ctx *Context, itm Item) bool {
-					if _, ok := itm.(*goxml.Element); ok {
-						return true
-					}
-					return false
-				}
-			}
+			wc = setPos(&WildcardTest{Name: str, Attribute: tl.attributeMode}, strTok.Pos)
 		} else {
 			tl.unread()
 		}
@@ -3529,25 +2785,28 @@ func parseWildCard(tl *Tokenlist) (testFunc, error) {
 		tl.unread()
 	}
 	leaveStep(tl, "37 parseWildCard")
-	return tf, nil
+	return wc, nil
 }
 
 // [38] FilterExpr ::= PrimaryExpr PredicateList
 // [39] PredicateList ::= Predicate*
 // [40] Predicate ::= "[" Expr "]"
-func parseFilterExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseFilterExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "38 parseFilterExpr")
 
-	var ef EvalFunc
-	ef, err := parsePrimaryExpr(tl)
+	n, err := parsePrimaryExpr(tl)
 	if err != nil {
 		leaveStep(tl, "38 parseFilterExpr (err)")
 		return nil, err
 	}
+	if n == nil {
+		leaveStep(tl, "38 parseFilterExpr (nil)")
+		return nil, nil
+	}
 
 	// PostfixExpr ::= PrimaryExpr (Predicate | Lookup)*
-	modified := false
 	for {
+		pos := tl.position()
 		if tl.nexttokIsTyp(tokOpenBracket) {
 			tl.read()
 			predicate, err := parseExpr(tl)
@@ -3557,210 +2816,90 @@ func parseFilterExpr(tl *Tokenlist) (EvalFunc, error) {
 			if err = tl.skipType(tokCloseBracket); err != nil {
 				return nil, err
 			}
-			baseEf := ef
-			ef = func(ctx *Context) (Sequence, error) {
-				ctx.sequence, err = baseEf(ctx)
-				if err != nil {
-					return nil, err
-				}
-				_, err = ctx.Filter(predicate)
-				if err != nil {
-					return nil, err
-				}
-				ctx.ctxPositions = nil
-				ctx.ctxLengths = nil
-				return ctx.sequence, nil
-			}
-			modified = true
-		} else if tl.nexttokIsValue("?") {
-			tl.read() // consume ?
-			lookupEf, err := parseLookupKeySpecifier(tl)
-			if err != nil {
-				return nil, err
-			}
-			baseEf := ef
-			ef = func(ctx *Context) (Sequence, error) {
-				base, err := baseEf(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return evalLookup(ctx, base, lookupEf)
-			}
-			modified = true
-		} else if tl.nexttokIsTyp(tokOpenParen) {
-			// Dynamic function call: expr(args)
-			tl.read() // consume (
-			var argEfs []EvalFunc
-			if !tl.nexttokIsTyp(tokCloseParen) {
-				for {
-					argEf, err := parseExprSingle(tl)
-					if err != nil {
-						return nil, err
-					}
-					argEfs = append(argEfs, argEf)
-					if !tl.nexttokIsTyp(tokComma) {
-						break
-					}
-					tl.read() // consume comma
-				}
-			}
-			if err := tl.skipType(tokCloseParen); err != nil {
-				return nil, err
-			}
-			baseEf := ef
-			capturedArgEfs := argEfs
-			ef = func(ctx *Context) (Sequence, error) {
-				base, err := baseEf(ctx)
-				if err != nil {
-					return nil, err
-				}
-				if len(base) != 1 {
-					return nil, NewXPathError("XPTY0004", "dynamic function call requires single function item")
-				}
-				fn, ok := base[0].(*XPathFunction)
-				if !ok {
-					// Could be a map or array lookup
-					if m, ok := base[0].(*XPathMap); ok && len(capturedArgEfs) == 1 {
-						keySeq, err := capturedArgEfs[0](ctx)
-						if err != nil {
-							return nil, err
-						}
-						if len(keySeq) > 0 {
-							val, _ := m.Get(keySeq[0])
-							return val, nil
-						}
-						return Sequence{}, nil
-					}
-					if arr, ok := base[0].(*XPathArray); ok && len(capturedArgEfs) == 1 {
-						idxSeq, err := capturedArgEfs[0](ctx)
-						if err != nil {
-							return nil, err
-						}
-						idx, err := NumberValue(idxSeq)
-						if err != nil {
-							return nil, err
-						}
-						return arr.Get(int(idx))
-					}
-					return nil, NewXPathError("XPTY0004", fmt.Sprintf("cannot call %T as function", base[0]))
-				}
-				args := make([]Sequence, len(capturedArgEfs))
-				for i, argEf := range capturedArgEfs {
-					args[i], err = argEf(ctx)
-					if err != nil {
-						return nil, err
-					}
-				}
-				return fn.Call(ctx, args)
-			}
-			modified = true
+			n = setPos(&FilterExpr{Expr: n, Predicate: predicate}, pos)
+		} else if tl.nexttokIsValue("?") {
+			tl.read() // consume ?
+			lookup, err := parseLookupKeySpecifier(tl)
+			if err != nil {
+				return nil, err
+			}
+			lookup.Expr = n
+			n = setPos(lookup, pos)
+		} else if tl.nexttokIsTyp(tokOpenParen) {
+			// Dynamic function call: expr(args)
+			tl.read() // consume (
+			args, err := parseArgumentList(tl)
+			if err != nil {
+				return nil, err
+			}
+			if err := tl.skipType(tokCloseParen); err != nil {
+				return nil, err
+			}
+			n = setPos(&DynamicCallExpr{Func: n, Args: args}, pos)
 		} else {
 			break
 		}
 	}
-	_ = modified
 	leaveStep(tl, "38 parseFilterExpr")
-	return ef, nil
+	return n, nil
 }
 
-// parseLookupKeySpecifier parses: KeySpecifier ::= NCName | IntegerLiteral | ParenthesizedExpr | "*"
-// Returns an EvalFunc that produces the key(s) to look up, or nil for wildcard (*).
-type lookupSpec struct {
-	wildcard bool
-	ef       EvalFunc
+// parseArgumentList parses the arguments after the opening parenthesis of
+// an argument list. The closing parenthesis is left to the caller.
+func parseArgumentList(tl *Tokenlist) ([]Node, error) {
+	var args []Node
+	if !tl.nexttokIsTyp(tokCloseParen) {
+		for {
+			arg, err := parseExprSingle(tl)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !tl.nexttokIsTyp(tokComma) {
+				break
+			}
+			tl.read() // consume comma
+		}
+	}
+	return args, nil
 }
 
-func parseLookupKeySpecifier(tl *Tokenlist) (*lookupSpec, error) {
+// parseLookupKeySpecifier parses: KeySpecifier ::= NCName | IntegerLiteral | ParenthesizedExpr | "*"
+// The returned lookup has no base expression.
+func parseLookupKeySpecifier(tl *Tokenlist) (*LookupExpr, error) {
 	// Wildcard: ?*
 	if tl.nexttokIsValue("*") {
 		tl.read()
-		return &lookupSpec{wildcard: true}, nil
+		return &LookupExpr{Wildcard: true}, nil
 	}
 	// ParenthesizedExpr: ?(expr)
 	if tl.nexttokIsTyp(tokOpenParen) {
 		tl.read()
-		ef, err := parseExpr(tl)
+		n, err := parseExpr(tl)
 		if err != nil {
 			return nil, err
 		}
 		if err := tl.skipType(tokCloseParen); err != nil {
 			return nil, fmt.Errorf("')' expected in lookup expression")
 		}
-		return &lookupSpec{ef: ef}, nil
+		return &LookupExpr{Key: n}, nil
 	}
 	// IntegerLiteral
 	if tl.nexttokIsTyp(tokNumber) {
 		tok, _ := tl.read()
-		numVal := tok.Value
-		return &lookupSpec{ef: func(ctx *Context) (Sequence, error) {
-			return Sequence{numVal}, nil
-		}}, nil
+		return &LookupExpr{Key: setPos(&Literal{Value: tok.Value}, tok.Pos)}, nil
 	}
 	// NCName
 	if tl.nexttokIsTyp(tokQName) {
 		tok, _ := tl.read()
-		name := tok.Value.(string)
-		return &lookupSpec{ef: func(ctx *Context) (Sequence, error) {
-			return Sequence{name}, nil
-		}}, nil
+		return &LookupExpr{Key: setPos(&Literal{Value: tok.Value.(string)}, tok.Pos)}, nil
 	}
 	return nil, fmt.Errorf("expected key specifier after '?'")
 }
 
-// evalLookup applies a lookup operation to each item in the base sequence.
-func evalLookup(ctx *Context, base Sequence, spec *lookupSpec) (Sequence, error) {
-	var result Sequence
-	for _, item := range base {
-		switch v := item.(type) {
-		case *XPathMap:
-			if spec.wildcard {
-				for _, entry := range v.Entries {
-					result = append(result, entry.Value...)
-				}
-			} else {
-				keys, err := spec.ef(ctx)
-				if err != nil {
-					return nil, err
-				}
-				for _, key := range keys {
-					if val, ok := v.Get(key); ok {
-						result = append(result, val...)
-					}
-				}
-			}
-		case *XPathArray:
-			if spec.wildcard {
-				for _, member := range v.Members {
-					result = append(result, member...)
-				}
-			} else {
-				keys, err := spec.ef(ctx)
-				if err != nil {
-					return nil, err
-				}
-				for _, key := range keys {
-					idx, err := NumberValue(Sequence{key})
-					if err != nil {
-						return nil, err
-					}
-					member, err := v.Get(int(idx))
-					if err != nil {
-						return nil, err
-					}
-					result = append(result, member...)
-				}
-			}
-		default:
-			return nil, NewXPathError("XPTY0004", fmt.Sprintf("lookup operator requires a map or array, got %T", item))
-		}
-	}
-	return result, nil
-}
-
 // [41] PrimaryExpr ::= Literal | VarRef | ParenthesizedExpr | ContextItemExpr | FunctionCall
-func parsePrimaryExpr(tl *Tokenlist) (EvalFunc, error) {
+func parsePrimaryExpr(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "41 parsePrimaryExpr")
-	var ef EvalFunc
 
 	nexttok, err := tl.read()
 	if err != nil {
@@ -3770,144 +2909,101 @@ func parsePrimaryExpr(tl *Tokenlist) (EvalFunc, error) {
 
 	// StringLiteral
 	if nexttok.Typ == tokString {
-		ef = func(ctx *Context) (Sequence, error) {
-			return Sequence{nexttok.Value.(string)}, nil
-		}
 		leaveStep(tl, "41 parsePrimaryExpr")
-		return ef, nil
+		return setPos(&Literal{Value: nexttok.Value.(string)}, nexttok.Pos), nil
 	}
 
 	// NumericLiteral
 	if nexttok.Typ == tokNumber {
-		numVal := nexttok.Value // int, XSDecimal, or XSDouble
-		ef = func(ctx *Context) (Sequence, error) {
-			return Sequence{numVal}, nil
-		}
 		leaveStep(tl, "41 parsePrimaryExpr")
-		return ef, nil
+		return setPos(&Literal{Value: nexttok.Value}, nexttok.Pos), nil // int, XSDecimal, or XSDouble
 	}
 
 	// ParenthesizedExpr
 	if nexttok.Typ == tokOpenParen {
-		ef, err = parseParenthesizedExpr(tl)
+		n, err := parseParenthesizedExpr(tl)
 		if err != nil {
 			return nil, err
 		}
 		leaveStep(tl, "41 parsePrimaryExpr")
-		return ef, nil
+		return setPos(n, nexttok.Pos), nil
 	}
 
 	// VarRef — possibly followed by "(" for map/array/function-item call
 	if nexttok.Typ == tokVarname {
 		varname := nexttok.Value.(string)
+		varref := setPos(&VarRef{Name: varname}, nexttok.Pos)
 		if tl.nexttokIsTyp(tokOpenParen) {
 			// $var(args) — dynamic function call / map lookup / array lookup
+			pos := tl.position()
 			tl.read() // consume (
-			var argEfs []EvalFunc
-			if !tl.nexttokIsTyp(tokCloseParen) {
-				for {
-					aef, err := parseExprSingle(tl)
-					if err != nil {
-						return nil, err
-					}
-					argEfs = append(argEfs, aef)
-					if !tl.nexttokIsTyp(tokComma) {
-						break
-					}
-					tl.read() // consume comma
-				}
+			args, err := parseArgumentList(tl)
+			if err != nil {
+				return nil, err
 			}
 			if err = tl.skipType(tokCloseParen); err != nil {
 				return nil, fmt.Errorf("close paren expected after $%s(...)", varname)
 			}
-			ef = func(ctx *Context) (Sequence, error) {
-				varVal := ctx.vars[varname]
-				// Evaluate arguments
-				args := make([]Sequence, len(argEfs))
-				for i, aef := range argEfs {
-					seq, err := aef(ctx)
-					if err != nil {
-						return nil, err
-					}
-					args[i] = seq
-				}
-				if len(varVal) == 1 {
-					switch v := varVal[0].(type) {
-					case *XPathMap:
-						if len(args) == 1 && len(args[0]) > 0 {
-							val, _ := v.Get(args[0][0])
-							return val, nil
-						}
-					case *XPathArray:
-						if len(args) == 1 {
-							idx, err := NumberValue(args[0])
-							if err != nil {
-								return nil, err
-							}
-							return v.Get(int(idx))
-						}
-					case *XPathFunction:
-						return v.Call(ctx, args)
-					}
-				}
-				return nil, fmt.Errorf("$%s is not a callable function, map, or array", varname)
-			}
 			leaveStep(tl, "41 parsePrimaryExpr (var-call)")
-			return ef, nil
-		}
-		ef = func(ctx *Context) (Sequence, error) {
-			return ctx.vars[varname], nil
+			return setPos(&DynamicCallExpr{Func: varref, Args: args}, pos), nil
 		}
 		leaveStep(tl, "41 parsePrimaryExpr")
-		return ef, nil
+		return varref, nil
 	}
 
 	// Unary Lookup: ?key (operates on context item)
 	if nexttok.Typ == tokOperator && nexttok.Value.(string) == "?" {
-		spec, err := parseLookupKeySpecifier(tl)
+		lookup, err := parseLookupKeySpecifier(tl)
 		if err != nil {
 			return nil, err
 		}
-		ef = func(ctx *Context) (Sequence, error) {
-			return evalLookup(ctx, ctx.sequence, spec)
-		}
 		leaveStep(tl, "41 parsePrimaryExpr (unary-lookup)")
-		return ef, nil
+		return setPos(lookup, nexttok.Pos), nil
 	}
 
 	// Context item
 	if nexttok.Typ == tokOperator && nexttok.Value.(string) == "." {
-		ef = func(ctx *Context) (Sequence, error) {
-			return ctx.sequence, nil
-		}
 		leaveStep(tl, "41 parsePrimaryExpr")
-		return ef, nil
+		return setPos(&ContextItemExpr{}, nexttok.Pos), nil
 	}
 
 	// InlineFunctionExpr: function($x, $y) { expr }
 	if nexttok.Typ == tokQName && nexttok.Value.(string) == "function" && tl.nexttokIsTyp(tokOpenParen) {
 		tl.read() // consume (
-		var paramNames []string
+		fn := setPos(&InlineFunctionExpr{}, nexttok.Pos)
 		if !tl.nexttokIsTyp(tokCloseParen) {
 			for {
 				pTok, err := tl.read()
 				if err != nil || pTok.Typ != tokVarname {
 					return nil, fmt.Errorf("expected parameter name in inline function")
 				}
-				paramNames = append(paramNames, pTok.Value.(string))
+				param := &Param{Name: pTok.Value.(string)}
 				// Skip optional "as SequenceType"
 				if tl.nexttokIsValue("as") {
 					tl.read() // consume "as"
-					// Skip type tokens until we see , or )
+					// Skip type tokens until we see , or ) outside of
+					// the parentheses of the type
+					var typeToks []*token
+					depth := 0
 					for {
-						if tl.nexttokIsTyp(tokComma) || tl.nexttokIsTyp(tokCloseParen) {
+						if depth == 0 && (tl.nexttokIsTyp(tokComma) || tl.nexttokIsTyp(tokCloseParen)) {
 							break
 						}
-						if _, err := tl.read(); err != nil {
+						tok, err := tl.read()
+						if err != nil {
 							return nil, err
 						}
+						switch tok.Typ {
+						case tokOpenParen:
+							depth++
+						case tokCloseParen:
+							depth--
+						}
+						typeToks = append(typeToks, tok)
 					}
+					param.Type = tokensSource(typeToks)
 				}
+				fn.Params = append(fn.Params, param)
 				if !tl.nexttokIsTyp(tokComma) {
 					break
 				}
@@ -3920,144 +3016,78 @@ func parsePrimaryExpr(tl *Tokenlist) (EvalFunc, error) {
 		// Skip optional "as SequenceType"
 		if tl.nexttokIsValue("as") {
 			tl.read() // consume "as"
+			var typeToks []*token
 			for {
 				if tl.nexttokIsTyp(tokOpenBrace) {
 					break
 				}
-				if _, err := tl.read(); err != nil {
+				tok, err := tl.read()
+				if err != nil {
 					return nil, err
 				}
+				typeToks = append(typeToks, tok)
 			}
+			fn.ReturnType = tokensSource(typeToks)
 		}
 		// Parse function body: { Expr }
 		if err := tl.skipType(tokOpenBrace); err != nil {
 			return nil, fmt.Errorf("'{' expected in inline function body")
 		}
-		bodyEf, err := parseExpr(tl)
-		if err != nil {
+		if fn.Body, err = parseExpr(tl); err != nil {
 			return nil, err
 		}
 		if err := tl.skipType(tokCloseBrace); err != nil {
 			return nil, fmt.Errorf("'}' expected in inline function body")
 		}
-		capturedParams := paramNames
-		ef = func(ctx *Context) (Sequence, error) {
-			// Capture current variable scope for closure
-			closureVars := make(map[string]Sequence, len(ctx.vars))
-			maps.Copy(closureVars, ctx.vars)
-			fnRef := &XPathFunction{
-				Name:  "(anonymous)",
-				Arity: len(capturedParams),
-				Fn: func(callCtx *Context, args []Sequence) (Sequence, error) {
-					// Save current vars
-					savedVars := make(map[string]Sequence, len(callCtx.vars))
-					maps.Copy(savedVars, callCtx.vars)
-					// Apply closure vars
-					maps.Copy(callCtx.vars, closureVars)
-					// Bind parameters
-					for i, name := range capturedParams {
-						if i < len(args) {
-							callCtx.vars[name] = args[i]
-						}
-					}
-					result, err := bodyEf(callCtx)
-					// Restore vars
-					clear(callCtx.vars)
-					maps.Copy(callCtx.vars, savedVars)
-					return result, err
-				},
-			}
-			return Sequence{fnRef}, nil
-		}
 		leaveStep(tl, "41 parsePrimaryExpr (inline-func)")
-		return ef, nil
+		return fn, nil
 	}
 
 	// Map constructor: map { key: value, ... }
 	if nexttok.Typ == tokQName && nexttok.Value.(string) == "map" && tl.nexttokIsTyp(tokOpenBrace) {
 		tl.read() // consume {
-		ef, err = parseMapConstructor(tl)
+		n, err := parseMapConstructor(tl)
 		if err != nil {
 			leaveStep(tl, "41 parsePrimaryExpr (err map)")
 			return nil, err
 		}
 		leaveStep(tl, "41 parsePrimaryExpr (map)")
-		return ef, nil
+		return setPos(n, nexttok.Pos), nil
 	}
 
 	// Square array constructor: [ expr, expr, ... ]
 	if nexttok.Typ == tokOpenBracket {
-		ef, err = parseSquareArrayConstructor(tl)
+		n, err := parseSquareArrayConstructor(tl)
 		if err != nil {
 			leaveStep(tl, "41 parsePrimaryExpr (err square-array)")
 			return nil, err
 		}
 		leaveStep(tl, "41 parsePrimaryExpr (square-array)")
-		return ef, nil
+		return setPos(n, nexttok.Pos), nil
 	}
 
 	// Array constructor: array { expr, expr, ... }
 	if nexttok.Typ == tokQName && nexttok.Value.(string) == "array" && tl.nexttokIsTyp(tokOpenBrace) {
 		tl.read() // consume {
-		ef, err = parseArrayConstructor(tl)
+		n, err := parseArrayConstructor(tl)
 		if err != nil {
 			leaveStep(tl, "41 parsePrimaryExpr (err array)")
 			return nil, err
 		}
 		leaveStep(tl, "41 parsePrimaryExpr (array)")
-		return ef, nil
+		return setPos(n, nexttok.Pos), nil
 	}
 
 	// NamedFunctionRef: EQName "#" IntegerLiteral
 	if (nexttok.Typ == tokQName || nexttok.Typ == tokEQName) && tl.nexttokIsValue("#") {
-		fnFullName := nexttok.Value.(string)
 		tl.read() // consume #
 		arityTok, err := tl.read()
 		if err != nil {
 			return nil, fmt.Errorf("expected arity after '#' in function reference")
 		}
 		arityF, _ := ToFloat64(arityTok.Value)
-		arity := int(arityF)
-		var capturedNS, capturedLocal, capturedPrefix string
-		if nexttok.Typ == tokEQName {
-			// URIQualifiedName: "namespace}localname"
-			if before, after, ok := strings.Cut(fnFullName, "}"); ok {
-				capturedNS = before
-				capturedLocal = after
-			}
-		} else {
-			capturedLocal = fnFullName
-			if before, after, ok := strings.Cut(fnFullName, ":"); ok {
-				capturedPrefix = before
-				capturedLocal = after
-			}
-		}
-		capturedArity := arity
-		ef = func(ctx *Context) (Sequence, error) {
-			ns := capturedNS
-			if ns == "" {
-				ns = nsFN
-				if capturedPrefix != "" {
-					var ok bool
-					if ns, ok = ctx.Namespaces[capturedPrefix]; !ok {
-						return nil, fmt.Errorf("could not find namespace for prefix %q", capturedPrefix)
-					}
-				}
-			}
-			fn := getfunction(ns, capturedLocal)
-			if fn == nil {
-				return nil, NewXPathError("XPST0017", fmt.Sprintf("unknown function %s#%d", capturedLocal, capturedArity))
-			}
-			return Sequence{&XPathFunction{
-				Name:             capturedLocal,
-				Namespace:        ns,
-				Arity:            capturedArity,
-				Fn:               fn.F,
-				DynamicCallError: fn.DynamicCallError,
-			}}, nil
-		}
 		leaveStep(tl, "41 parsePrimaryExpr (named-func-ref)")
-		return ef, nil
+		return setPos(&NamedFunctionRef{Name: tokenName(nexttok), Arity: int(arityF)}, nexttok.Pos), nil
 	}
 
 	// FunctionCall (QName or EQName followed by "(")
@@ -4069,55 +3099,82 @@ func parsePrimaryExpr(tl *Tokenlist) (EvalFunc, error) {
 				return nil, nil
 			}
 		}
-		ef, err := parseFunctionCall(tl)
+		n, err := parseFunctionCall(tl)
 		if err != nil {
 			leaveStep(tl, "41 parsePrimaryExpr (err)")
 			return nil, err
 		}
 		leaveStep(tl, "41 parsePrimaryExpr (fc)")
-		return ef, nil
+		return n, nil
 	}
 	tl.unread()
 	leaveStep(tl, "41 parsePrimaryExpr")
 	return nil, nil
 }
 
+// tokenName returns the name of a QName or EQName token as written in the
+// source.
+func tokenName(tok *token) string {
+	name := tok.Value.(string)
+	if tok.Typ == tokEQName {
+		// URIQualifiedName: "namespace}localname"
+		return "Q{" + name
+	}
+	return name
+}
+
+// tokensSource reconstructs the source text of a list of tokens.
+func tokensSource(toks []*token) string {
+	var sb strings.Builder
+	isWord := func(tok *token) bool {
+		switch tok.Typ {
+		case tokQName, tokEQName, tokNumber, tokVarname, tokString:
+			return true
+		}
+		return false
+	}
+	for i, tok := range toks {
+		if i > 0 && (isWord(toks[i-1]) && isWord(tok) || toks[i-1].Typ == tokComma) {
+			sb.WriteString(" ")
+		}
+		switch tok.Typ {
+		case tokComma:
+			sb.WriteString(",")
+		case tokEQName, tokQName:
+			sb.WriteString(tokenName(tok))
+		case tokString:
+			sb.WriteString((&Literal{Value: tok.Value}).String())
+		case tokNumber:
+			sb.WriteString(fmt.Sprint(tok.Value))
+		default:
+			sb.WriteString(tok.String())
+		}
+	}
+	return sb.String()
+}
+
 // [46] ParenthesizedExpr ::= "(" Expr? ")"
-func parseParenthesizedExpr(tl *Tokenlist) (EvalFunc, error) {
+func parseParenthesizedExpr(tl *Tokenlist) (*ParenExpr, error) {
 	enterStep(tl, "46 parseParenthesizedExpr")
-	var exp, ef EvalFunc
-	var err error
-	exp, err = parseExpr(tl)
+	exp, err := parseExpr(tl)
 	if err != nil {
 		return nil, err
 	}
 	if err = tl.skipType(tokCloseParen); err != nil {
 		return nil, err
 	}
-	if exp == nil {
+	if seq, ok := exp.(*SequenceExpr); ok && len(seq.Items) == 0 {
 		// Empty parenthesized expression () = empty sequence
 		leaveStep(tl, "46 parseParenthesizedExpr (empty)")
-		return func(ctx *Context) (Sequence, error) {
-			return Sequence{}, nil
-		}, nil
+		return &ParenExpr{}, nil
 	}
-	ef = func(ctx *Context) (Sequence, error) {
-		seq, err := exp(ctx)
-		if err != nil {
-			return nil, err
-		}
-
-		return seq, nil
-	}
-
 	leaveStep(tl, "46 parseParenthesizedExpr")
-	return ef, nil
+	return &ParenExpr{Expr: exp}, nil
 }
 
 // [48] FunctionCall ::= QName "(" (ExprSingle ("," ExprSingle)*)? ")"
-func parseFunctionCall(tl *Tokenlist) (EvalFunc, error) {
+func parseFunctionCall(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "48 parseFunctionCall")
-	var ef EvalFunc
 
 	functionNameToken, err := tl.read()
 	if err != nil {
@@ -4126,55 +3183,23 @@ func parseFunctionCall(tl *Tokenlist) (EvalFunc, error) {
 	if err = tl.skipType(tokOpenParen); err != nil {
 		return nil, err
 	}
-	fnName, ok := functionNameToken.Value.(string)
-	if !ok {
+	if _, ok := functionNameToken.Value.(string); !ok {
 		return nil, fmt.Errorf("expected function name, got %v", functionNameToken.Value)
 	}
-	fn := fnName
-	// Pre-split function name to avoid splitting on every call.
-	var fnPrefix, fnLocalName string
-	var fnDirectNS string // set for EQName (Q{ns}local)
-	if functionNameToken.Typ == tokEQName {
-		if before, after, ok0 := strings.Cut(fn, "}"); ok0 {
-			fnDirectNS = before
-			fnLocalName = after
-		}
-	} else if before, after, ok0 := strings.Cut(fn, ":"); ok0 {
-		fnPrefix = before
-		fnLocalName = after
-	} else {
-		fnLocalName = fn
-	}
-
-	// callFn resolves the function by direct namespace or prefix
-	callFn := func(ctx *Context, arguments []Sequence) (Sequence, error) {
-		if fnDirectNS != "" {
-			fnObj := getfunction(fnDirectNS, fnLocalName)
-			if fnObj == nil {
-				return nil, fmt.Errorf("Could not find function %q in namespace %q", fnLocalName, fnDirectNS)
-			}
-			return fnObj.F(ctx, arguments)
-		}
-		return callFunctionResolved(fnPrefix, fnLocalName, arguments, ctx)
-	}
+	fc := setPos(&FunctionCall{Name: tokenName(functionNameToken)}, functionNameToken.Pos)
 
 	if tl.nexttokIsTyp(tokCloseParen) {
 		tl.read()
-		ef = func(ctx *Context) (Sequence, error) {
-			return callFn(ctx, []Sequence{})
-		}
 		leaveStep(tl, "48 parseFunctionCall (a)")
-		return ef, nil
+		return fc, nil
 	}
 
-	var efs []EvalFunc
-
 	for {
 		es, err := parseExprSingle(tl)
 		if err != nil {
 			return nil, err
 		}
-		efs = append(efs, es)
+		fc.Args = append(fc.Args, es)
 		if !tl.nexttokIsTyp(tokComma) {
 			break
 		}
@@ -4186,116 +3211,110 @@ func parseFunctionCall(tl *Tokenlist) (EvalFunc, error) {
 		return nil, fmt.Errorf("close paren expected")
 	}
 
-	// get expr single *
-	ef = func(ctx *Context) (Sequence, error) {
-		var arguments []Sequence
-		saveContext := ctx.GetContextSequence()
-		for i, es := range efs {
-			if es == nil {
-				return nil, fmt.Errorf("internal error: nil EvalFunc for argument %d of function %s:%s", i, fnPrefix, fnLocalName)
-			}
-			seq, err := es(ctx)
-			if err != nil {
-				return nil, err
-			}
-			arguments = append(arguments, seq)
-			ctx.SetContextSequence(saveContext)
-		}
-
-		return callFn(ctx, arguments)
-	}
-
 	leaveStep(tl, "48 parseFunctionCall")
-	return ef, nil
+	return fc, nil
 }
 
-// orig: [50] SequenceType ::= ("empty-sequence" "(" ")")| (ItemType OccurrenceIndicator?)
-// since empty-sequence() is implemented in 16 and 17, we can skip this here:
-// [50] SequenceType ::= ItemType OccurrenceIndicator?
-func parseSequenceType(tl *Tokenlist) (testFunc, error) {
+// [50] SequenceType ::= ("empty-sequence" "(" ")")| (ItemType OccurrenceIndicator?)
+func parseSequenceType(tl *Tokenlist) (*SequenceType, error) {
 	enterStep(tl, "50 parseSequenceType")
-	var tf testFunc
-	var err error
+	pos := tl.position()
+	if tl.readIfTokenFollow([]token{{Value: "empty-sequence", Typ: tokQName}, {Value: '(', Typ: tokOpenParen}, {Value: ')', Typ: tokCloseParen}}) {
+		leaveStep(tl, "50 parseSequenceType (empty)")
+		return setPos(&SequenceType{Empty: true}, pos), nil
+	}
 
-	tf, err = parseItemType(tl)
+	it, err := parseItemType(tl)
 	if err != nil {
 		leaveStep(tl, "50 parseSequenceType (err)")
 		return nil, err
 	}
+	st := setPos(&SequenceType{ItemType: it}, pos)
+	st.Occurrence, _ = tl.readNexttokIfIsOneOfValue([]string{"*", "+", "?"})
 
 	leaveStep(tl, "50 parseSequenceType")
-	return tf, nil
+	return st, nil
 }
 
 // [52] ItemType ::= KindTest | ("item" "(" ")") | AtomicType
-func parseItemType(tl *Tokenlist) (testFunc, error) {
+func parseItemType(tl *Tokenlist) (Node, error) {
 	enterStep(tl, "52 parseItemType")
-	var tf testFunc
-	var err error
 
 	if str, found := tl.readNexttokIfIsOneOfValueAndType(kindTestStrings, tokQName); found {
-		if tf, err = parseKindTest(tl, str); err != nil {
+		kt, err := parseKindTest(tl, str)
+		if err != nil {
 			return nil, err
 		}
-		if tf != nil {
-			return tf, nil
+		if kt != nil {
+			return kt, nil
 		}
 	}
 
 	// item() — matches any item
-	if tl.readIfTokenFollow([]token{{"item", tokQName}, {'(', tokOpenParen}, {')', tokCloseParen}}) {
-		tf = func(ctx *Context, itm Item) bool {
-			return true
-		}
+	if tl.readIfTokenFollow([]token{{Value: "item", Typ: tokQName}, {Value: '(', Typ: tokOpenParen}, {Value: ')', Typ: tokCloseParen}}) {
 		leaveStep(tl, "52 parseItemType (item)")
-		return tf, nil
+		return &AnyItemTest{}, nil
 	}
 
 	// map(*) / array(*)
-	if tl.readIfTokenFollow([]token{{"map", tokQName}, {'(', tokOpenParen}, {"*", tokOperator}, {')', tokCloseParen}}) {
-		tf = func(ctx *Context, itm Item) bool {
-			_, ok := itm.(*XPathMap)
-			return ok
-		}
+	if tl.readIfTokenFollow([]token{{Value: "map", Typ: tokQName}, {Value: '(', Typ: tokOpenParen}, {Value: "*", Typ: tokOperator}, {Value: ')', Typ: tokCloseParen}}) {
 		leaveStep(tl, "52 parseItemType (map)")
-		return tf, nil
+		return &MapTest{}, nil
 	}
-	if tl.readIfTokenFollow([]token{{"array", tokQName}, {'(', tokOpenParen}, {"*", tokOperator}, {')', tokCloseParen}}) {
-		tf = func(ctx *Context, itm Item) bool {
-			_, ok := itm.(*XPathArray)
-			return ok
-		}
+	if tl.readIfTokenFollow([]token{{Value: "array", Typ: tokQName}, {Value: '(', Typ: tokOpenParen}, {Value: "*", Typ: tokOperator}, {Value: ')', Typ: tokCloseParen}}) {
 		leaveStep(tl, "52 parseItemType (array)")
-		return tf, nil
+		return &ArrayTest{}, nil
 	}
 
 	// function(*) — matches any function
-	if tl.readIfTokenFollow([]token{{"function", tokQName}, {'(', tokOpenParen}, {"*", tokOperator}, {')', tokCloseParen}}) {
-		tf = func(ctx *Context, itm Item) bool {
-			_, ok := itm.(*XPathFunction)
-			return ok
-		}
+	if tl.readIfTokenFollow([]token{{Value: "function", Typ: tokQName}, {Value: '(', Typ: tokOpenParen}, {Value: "*", Typ: tokOperator}, {Value: ')', Typ: tokCloseParen}}) {
 		leaveStep(tl, "52 parseItemType (function)")
-		return tf, nil
+		return &FunctionTest{}, nil
 	}
 
 	// AtomicType: xs:integer, xs:string, xs:double, xs:float, xs:decimal, xs:boolean, etc.
+	// Unknown type names are reported by the static check.
 	nexttok, err := tl.peek()
-	if err == nil && nexttok.Typ == tokQName {
-		name, ok := nexttok.Value.(string)
-		if ok {
-			atomicType := resolveAtomicType(name)
-			if atomicType != "" {
-				tl.read() // consume the type name
-				tf = makeAtomicTypeTest(atomicType)
+	if err == nil {
+		if name, ok := typeTokenName(nexttok); ok {
+			tl.read() // consume the type name
+			if !tl.nexttokIsTyp(tokOpenParen) {
 				leaveStep(tl, "52 parseItemType (atomic)")
-				return tf, nil
+				return setPos(&AtomicType{Name: name}, nexttok.Pos), nil
 			}
+			tl.unread()
 		}
 	}
 
 	leaveStep(tl, "52 parseItemType")
-	return tf, nil
+	return nil, nil
+}
+
+// isAtomicTypeName reports whether local is the local name of a built-in
+// atomic type in the XML Schema namespace, including the types that are not
+// allowed as cast targets.
+func isAtomicTypeName(local string) bool {
+	switch local {
+	case "anySimpleType", "NOTATION":
+		return true
+	}
+	return resolveAtomicType("xs:"+local) != ""
+}
+
+// typeTokenName returns the type name of a QName or EQName token. EQNames
+// in the XML Schema namespace are written with the xs prefix, which is how
+// the evaluator knows the built-in types.
+func typeTokenName(tok *token) (string, bool) {
+	switch tok.Typ {
+	case tokQName:
+		return tok.Value.(string), true
+	case tokEQName:
+		if local, ok := strings.CutPrefix(tok.Value.(string), nsXS+"}"); ok {
+			return "xs:" + local, true
+		}
+		return tokenName(tok), true
+	}
+	return "", false
 }
 
 // resolveAtomicType maps XPath type names to canonical type identifiers.
@@ -4386,123 +3405,12 @@ func resolveAtomicType(name string) string {
 		return "qname"
 	case "xs:numeric":
 		return "numeric"
+	case "xs:anyAtomicType":
+		return "anyAtomicType"
 	}
 	return ""
 }
 
-// makeAtomicTypeTest creates a testFunc for an atomic type check.
-func makeAtomicTypeTest(atomicType string) testFunc {
-	// Map atomicType name to IntSubtype for integer hierarchy checks
-	intSubtypeByName := map[string]IntSubtype{
-		"integer": IntInteger, "long": IntLong, "int": IntInt,
-		"short": IntShort, "byte": IntByte,
-		"nonNegativeInteger": IntNonNegativeInteger, "unsignedLong": IntUnsignedLong,
-		"unsignedInt": IntUnsignedInt, "unsignedShort": IntUnsignedShort,
-		"unsignedByte": IntUnsignedByte, "positiveInteger": IntPositiveInteger,
-		"nonPositiveInteger": IntNonPositiveInteger, "negativeInteger": IntNegativeInteger,
-	}
-	strSubtypeByName := map[string]StrSubtype{
-		"string": StrString, "normalizedString": StrNormalizedString,
-		"token": StrToken, "language": StrLanguage, "NMTOKEN": StrNMTOKEN,
-		"Name": StrName, "NCName": StrNCName, "ID": StrID,
-		"IDREF": StrIDREF, "ENTITY": StrENTITY,
-	}
-
-	return func(ctx *Context, itm Item) bool {
-		// Integer subtype hierarchy check
-		if targetInt, ok := intSubtypeByName[atomicType]; ok {
-			if v, ok := itm.(XSInteger); ok {
-				return IntIsSubtypeOf(v.Subtype, targetInt)
-			}
-			// Bare int (from tokenizer) is xs:integer
-			if _, ok := itm.(int); ok {
-				return targetInt == IntInteger
-			}
-			return false
-		}
-
-		// String subtype hierarchy check
-		if targetStr, ok := strSubtypeByName[atomicType]; ok {
-			if v, ok := itm.(XSString); ok {
-				return StrIsSubtypeOf(v.Subtype, targetStr)
-			}
-			// Bare string (from tokenizer/literals) is xs:string
-			if _, ok := itm.(string); ok {
-				return targetStr == StrString
-			}
-			return false
-		}
-
-		switch atomicType {
-		case "double":
-			switch itm.(type) {
-			case XSDouble, float64:
-				return true
-			}
-			return false
-		case "float":
-			_, ok := itm.(XSFloat)
-			return ok
-		case "decimal":
-			// xs:decimal: XSDecimal, int, or XSInteger (integer is subtype of decimal)
-			switch itm.(type) {
-			case XSDecimal, int, XSInteger:
-				return true
-			}
-			return false
-		case "anyURI":
-			_, ok := itm.(XSAnyURI)
-			return ok
-		case "untypedAtomic":
-			_, ok := itm.(XSUntypedAtomic)
-			return ok
-		case "hexBinary":
-			_, ok := itm.(XSHexBinary)
-			return ok
-		case "base64Binary":
-			_, ok := itm.(XSBase64Binary)
-			return ok
-		case "boolean":
-			_, ok := itm.(bool)
-			return ok
-		case "numeric":
-			_, ok := ToFloat64(itm)
-			return ok
-		case "qname":
-			_, ok := itm.(XSQName)
-			return ok
-		case "dateTime":
-			_, ok := itm.(XSDateTime)
-			return ok
-		case "date":
-			_, ok := itm.(XSDate)
-			return ok
-		case "time":
-			_, ok := itm.(XSTime)
-			return ok
-		case "duration":
-			_, ok := itm.(XSDuration)
-			return ok
-		case "gYear":
-			_, ok := itm.(XSGYear)
-			return ok
-		case "gMonth":
-			_, ok := itm.(XSGMonth)
-			return ok
-		case "gDay":
-			_, ok := itm.(XSGDay)
-			return ok
-		case "gYearMonth":
-			_, ok := itm.(XSGYearMonth)
-			return ok
-		case "gMonthDay":
-			_, ok := itm.(XSGMonthDay)
-			return ok
-		}
-		return false
-	}
-}
-
 // [51] OccurrenceIndicator ::= "?" | "*" | "+"
 // [53] AtomicType ::= QName
 // [54] KindTest ::= DocumentTest|
@@ -4533,9 +3441,8 @@ func makeAtomicTypeTest(atomicType string) testFunc {
 
 var kindTestStrings = []string{"element", "node", "text", "attribute", "document-node", "schema-element", "schema-attribute", "processing-instruction", "comment"}
 
-func parseKindTest(tl *Tokenlist, name string) (testFunc, error) {
+func parseKindTest(tl *Tokenlist, name string) (*KindTest, error) {
 	enterStep(tl, "54 parseKindTest")
-	var tf testFunc
 	var err error
 	if err = tl.skipType(tokOpenParen); err != nil {
 		return nil, err
@@ -4549,55 +3456,33 @@ func parseKindTest(tl *Tokenlist, name string) (testFunc, error) {
 		if nexttok.Value == ')' {
 			tl.read()
 			leaveStep(tl, "35 parseNodeTest")
-			return isElement, nil
+			return &KindTest{Kind: name}, nil
 		} else if nexttok.Value == "*" && nexttok.Typ == tokOperator {
 			tl.read()
 			if err = tl.skipType(tokCloseParen); err != nil {
 				return nil, err
 			}
 			leaveStep(tl, "35 parseNodeTest")
-			return isElement, nil
-		} else if nexttok.Typ == tokEQName {
-			tl.read()
-			if err = tl.skipType(tokCloseParen); err != nil {
-				return nil, err
-			}
-			leaveStep(tl, "35 parseNodeTest")
-			return returnElementEQNameTest(nexttok.String()), nil
-		} else if nexttok.Typ == tokQName {
+			return &KindTest{Kind: name, Name: "*"}, nil
+		} else if nexttok.Typ == tokEQName || nexttok.Typ == tokQName {
 			tl.read()
 			if err = tl.skipType(tokCloseParen); err != nil {
 				return nil, err
 			}
 			leaveStep(tl, "35 parseNodeTest")
-			return returnElementNameTest(nexttok.String()), nil
-		}
-		if err = tl.skipType(tokCloseParen); err != nil {
-			return nil, err
+			return &KindTest{Kind: name, Name: tokenName(nexttok)}, nil
 		}
-		leaveStep(tl, "35 parseNodeTest")
-		return isElement, nil
-	case "node":
 		if err = tl.skipType(tokCloseParen); err != nil {
 			return nil, err
 		}
-		tf := func(ctx *Context, itm Item) bool {
-			return true
-		}
 		leaveStep(tl, "35 parseNodeTest")
-		return tf, nil
-	case "text":
+		return &KindTest{Kind: name}, nil
+	case "node", "text", "comment":
 		if err = tl.skipType(tokCloseParen); err != nil {
 			return nil, err
 		}
-		tf := func(ctx *Context, itm Item) bool {
-			if _, ok := itm.(goxml.CharData); ok {
-				return true
-			}
-			return false
-		}
 		leaveStep(tl, "35 parseNodeTest")
-		return tf, nil
+		return &KindTest{Kind: name}, nil
 	case "attribute":
 		nexttok, err := tl.peek()
 		if err != nil {
@@ -4606,29 +3491,22 @@ func parseKindTest(tl *Tokenlist, name string) (testFunc, error) {
 		if nexttok.Value == ')' {
 			tl.read()
 			leaveStep(tl, "35 parseNodeTest")
-			return isAttribute, nil
+			return &KindTest{Kind: name}, nil
 		} else if nexttok.Value == "*" && nexttok.Typ == tokOperator {
 			tl.read()
 			if err = tl.skipType(tokCloseParen); err != nil {
 				return nil, err
 			}
 			leaveStep(tl, "35 parseNodeTest")
-			return isAttribute, nil
+			return &KindTest{Kind: name, Name: "*"}, nil
 		} else if nexttok.Typ == tokQName {
 			tl.read()
 			if err = tl.skipType(tokCloseParen); err != nil {
 				return nil, err
 			}
 			leaveStep(tl, "35 parseNodeTest")
-			return returnAttributeNameTest(nexttok.String()), nil
+			return &KindTest{Kind: name, Name: nexttok.String()}, nil
 		}
-	case "comment":
-		if err = tl.skipType(tokCloseParen); err != nil {
-			return nil, err
-		}
-
-		leaveStep(tl, "35 parseNodeTest")
-		return isComment, nil
 	case "processing-instruction":
 		nexttok, err := tl.peek()
 		if err != nil {
@@ -4640,7 +3518,7 @@ func parseKindTest(tl *Tokenlist, name string) (testFunc, error) {
 			}
 
 			leaveStep(tl, "35 parseNodeTest")
-			return isProcessingInstruction, nil
+			return &KindTest{Kind: name}, nil
 		}
 		nexttok, err = tl.read()
 		if err != nil {
@@ -4651,7 +3529,7 @@ func parseKindTest(tl *Tokenlist, name string) (testFunc, error) {
 				return nil, err
 			}
 			leaveStep(tl, "35 parseNodeTest")
-			return returnProcessingInstructionNameTest(nexttok.String()), nil
+			return &KindTest{Kind: name, Name: nexttok.String()}, nil
 		}
 	default:
 		if err = tl.skipType(tokCloseParen); err != nil {
@@ -4661,30 +3539,23 @@ func parseKindTest(tl *Tokenlist, name string) (testFunc, error) {
 	}
 
 	leaveStep(tl, "54 parseKindTest")
-	return tf, nil
+	return nil, nil
 }
 
 // parseMapConstructor parses key:value pairs after the opening { of map { ... }.
 // The opening { has already been consumed.
-func parseMapConstructor(tl *Tokenlist) (EvalFunc, error) {
+func parseMapConstructor(tl *Tokenlist) (*MapConstructor, error) {
 	enterStep(tl, "parseMapConstructor")
-	type kvPair struct {
-		key   EvalFunc
-		value EvalFunc
-	}
-	var pairs []kvPair
+	mc := &MapConstructor{}
 
 	if tl.nexttokIsTyp(tokCloseBrace) {
 		tl.read() // consume }
-		ef := func(ctx *Context) (Sequence, error) {
-			return Sequence{&XPathMap{}}, nil
-		}
 		leaveStep(tl, "parseMapConstructor (empty)")
-		return ef, nil
+		return mc, nil
 	}
 
 	for {
-		keyEf, err := parseExprSingle(tl)
+		key, err := parseExprSingle(tl)
 		if err != nil {
 			leaveStep(tl, "parseMapConstructor (err key)")
 			return nil, err
@@ -4696,13 +3567,13 @@ func parseMapConstructor(tl *Tokenlist) (EvalFunc, error) {
 			return nil, fmt.Errorf("':' expected in map constructor, got %v", err)
 		}
 
-		valueEf, err := parseExprSingle(tl)
+		value, err := parseExprSingle(tl)
 		if err != nil {
 			leaveStep(tl, "parseMapConstructor (err value)")
 			return nil, err
 		}
 
-		pairs = append(pairs, kvPair{key: keyEf, value: valueEf})
+		mc.Entries = append(mc.Entries, &MapConstructorEntry{Key: key, Value: value})
 
 		if tl.nexttokIsTyp(tokComma) {
 			tl.read() // consume comma
@@ -4716,54 +3587,30 @@ func parseMapConstructor(tl *Tokenlist) (EvalFunc, error) {
 		return nil, fmt.Errorf("'}' expected in map constructor")
 	}
 
-	ef := func(ctx *Context) (Sequence, error) {
-		m := &XPathMap{}
-		for _, pair := range pairs {
-			keySeq, err := pair.key(ctx)
-			if err != nil {
-				return nil, err
-			}
-			if len(keySeq) != 1 {
-				return nil, fmt.Errorf("map key must be a single item")
-			}
-			valueSeq, err := pair.value(ctx)
-			if err != nil {
-				return nil, err
-			}
-			m.Entries = append(m.Entries, MapEntry{Key: keySeq[0], Value: valueSeq})
-		}
-		return Sequence{m}, nil
-	}
 	leaveStep(tl, "parseMapConstructor")
-	return ef, nil
+	return mc, nil
 }
 
-// parseArrayConstructor parses a curly array constructor: array { Expr? }.
-// The opening { has already been consumed.
-// Per XPath 3.1: each item in the evaluated sequence becomes a separate member.
 // parseSquareArrayConstructor parses: "[" (ExprSingle ("," ExprSingle)*)? "]"
 // Each expression becomes one member of the array (its value is the full sequence).
-func parseSquareArrayConstructor(tl *Tokenlist) (EvalFunc, error) {
+func parseSquareArrayConstructor(tl *Tokenlist) (*ArrayConstructor, error) {
 	enterStep(tl, "parseSquareArrayConstructor")
+	ac := &ArrayConstructor{}
 
 	// Empty array: []
 	if tl.nexttokIsTyp(tokCloseBracket) {
 		tl.read() // consume ]
-		ef := func(ctx *Context) (Sequence, error) {
-			return Sequence{&XPathArray{}}, nil
-		}
 		leaveStep(tl, "parseSquareArrayConstructor (empty)")
-		return ef, nil
+		return ac, nil
 	}
 
-	var memberEfs []EvalFunc
 	for {
-		mef, err := parseExprSingle(tl)
+		member, err := parseExprSingle(tl)
 		if err != nil {
 			leaveStep(tl, "parseSquareArrayConstructor (err)")
 			return nil, err
 		}
-		memberEfs = append(memberEfs, mef)
+		ac.Members = append(ac.Members, member)
 		if !tl.nexttokIsTyp(tokComma) {
 			break
 		}
@@ -4775,34 +3622,24 @@ func parseSquareArrayConstructor(tl *Tokenlist) (EvalFunc, error) {
 		return nil, fmt.Errorf("']' expected in square array constructor")
 	}
 
-	ef := func(ctx *Context) (Sequence, error) {
-		arr := &XPathArray{Members: make([]Sequence, len(memberEfs))}
-		for i, mef := range memberEfs {
-			seq, err := mef(ctx)
-			if err != nil {
-				return nil, err
-			}
-			arr.Members[i] = seq
-		}
-		return Sequence{arr}, nil
-	}
 	leaveStep(tl, "parseSquareArrayConstructor")
-	return ef, nil
+	return ac, nil
 }
 
-func parseArrayConstructor(tl *Tokenlist) (EvalFunc, error) {
+// parseArrayConstructor parses a curly array constructor: array { Expr? }.
+// The opening { has already been consumed.
+// Per XPath 3.1: each item in the evaluated sequence becomes a separate member.
+func parseArrayConstructor(tl *Tokenlist) (*ArrayConstructor, error) {
 	enterStep(tl, "parseArrayConstructor")
+	ac := &ArrayConstructor{Curly: true}
 
 	if tl.nexttokIsTyp(tokCloseBrace) {
 		tl.read() // consume }
-		ef := func(ctx *Context) (Sequence, error) {
-			return Sequence{&XPathArray{}}, nil
-		}
 		leaveStep(tl, "parseArrayConstructor (empty)")
-		return ef, nil
+		return ac, nil
 	}
 
-	contentEf, err := parseExpr(tl)
+	content, err := parseExpr(tl)
 	if err != nil {
 		leaveStep(tl, "parseArrayConstructor (err)")
 		return nil, err
@@ -4813,34 +3650,40 @@ func parseArrayConstructor(tl *Tokenlist) (EvalFunc, error) {
 		return nil, fmt.Errorf("'}' expected in array constructor")
 	}
 
-	ef := func(ctx *Context) (Sequence, error) {
-		seq, err := contentEf(ctx)
-		if err != nil {
-			return nil, err
-		}
-		arr := &XPathArray{Members: make([]Sequence, len(seq))}
-		for i, item := range seq {
-			arr.Members[i] = Sequence{item}
-		}
-		return Sequence{arr}, nil
-	}
+	ac.Members = []Node{content}
 	leaveStep(tl, "parseArrayConstructor")
-	return ef, nil
+	return ac, nil
 }
 
 // ParseXPath takes a previously created token list and returns a function that
 // can be used to evaluate the XPath expression in different contexts.
 func ParseXPath(tl *Tokenlist) (EvalFunc, error) {
-	ef, err := parseExpr(tl)
+	n, err := parseTokens(tl)
 	if err != nil {
 		return nil, err
 	}
-	return ef, nil
+	return CompileAST(optimize(n, nil))
+}
+
+// parseTokens parses the token list into a syntax tree. Syntax errors are
+// reported as XPST0003 at the position where the parser got stuck.
+func parseTokens(tl *Tokenlist) (Node, error) {
+	n, err := parseExpr(tl)
+	if err != nil {
+		return nil, staticError(err, tl.errorPosition())
+	}
+	if tok, err := tl.peek(); err == nil {
+		return nil, errorAt(NewXPathError("XPST0003", fmt.Sprintf("unexpected %q after the end of the expression", tokensSource([]*token{tok}))), tok.Pos)
+	}
+	return n, nil
 }
 
 // Parser contains all necessary references to the parser
 type Parser struct {
 	Ctx *Context
+	// Cache stores the parsed expressions of Evaluate. If nil, DefaultCache
+	// is used. Set it to NoCache to disable caching.
+	Cache ExpressionCache
 }
 
 // XMLDocument returns the underlying XML document
@@ -4857,22 +3700,110 @@ func (xp *Parser) SetVariable(name string, value Sequence) {
 // Parsed expressions are cached so that repeated evaluation of the same XPath
 // string avoids re-tokenizing and re-parsing.
 func (xp *Parser) Evaluate(xpath string) (Sequence, error) {
-	// Reset per-evaluation state (XPath spec: current-dateTime is stable within one evaluation)
-	xp.Ctx.currentTime = nil
+	return xp.EvaluateContext(context.Background(), xpath)
+}
 
-	if cached, ok := exprCache.Load(xpath); ok {
-		return cached.(EvalFunc)(xp.Ctx)
-	}
-	tl, err := stringToTokenlist(xpath)
+// EvaluateContext is like Evaluate but aborts the evaluation with the error
+// code GOXP0001 when ctx is cancelled or its deadline passes. The resource
+// limits in xp.Ctx.Limits apply to Evaluate and EvaluateContext.
+func (xp *Parser) EvaluateContext(ctx context.Context, xpath string) (Sequence, error) {
+	evaler, err := xp.cached(xpath)
 	if err != nil {
 		return nil, err
 	}
-	evaler, err := ParseXPath(tl)
+	return xp.run(ctx, xpath, evaler, nil)
+}
+
+// cached returns the compiled expression from the expression cache and
+// compiles it if necessary.
+func (xp *Parser) cached(xpath string) (EvalFunc, error) {
+	cache := xp.Cache
+	if cache == nil {
+		cache = DefaultCache
+	}
+	evaler, ok := cache.Get(xpath)
+	if !ok {
+		var err error
+		if evaler, err = parseString(xpath); err != nil {
+			return nil, err
+		}
+		cache.Put(xpath, evaler)
+	}
+	return evaler, nil
+}
+
+// EvaluateUncached is like Evaluate but neither consults nor fills the
+// expression cache. Use it for one-off expressions.
+func (xp *Parser) EvaluateUncached(xpath string) (Sequence, error) {
+	evaler, err := parseString(xpath)
 	if err != nil {
 		return nil, err
 	}
-	exprCache.Store(xpath, evaler)
-	return evaler(xp.Ctx)
+	return xp.run(context.Background(), xpath, evaler, nil)
+}
+
+// run evaluates the expression in a frame of xp.Ctx. If focus is not nil, it
+// is the context item of the evaluation.
+func (xp *Parser) run(ctx context.Context, xpath string, evaler EvalFunc, focus Item) (Sequence, error) {
+	// The frame has its own focus and current-dateTime, so xp.Ctx can be
+	// used by other goroutines at the same time.
+	frame := xp.Ctx.newFrame()
+	if err := frame.beginEval(ctx); err != nil {
+		return nil, err
+	}
+	if focus != nil {
+		frame.sequence = Sequence{focus}
+		frame.ctxPositions = nil
+		frame.ctxLengths = nil
+		frame.Pos = 1
+		frame.size = 1
+	}
+	seq, err := evaler(frame)
+	return seq, errorIn(err, xpath)
+}
+
+// EvaluateIter evaluates the XPath expression and returns its result as an
+// iterator. The items are computed while the iterator is consumed, so
+// `//item` or `1 to 1000000000` stop as soon as the loop over the iterator
+// ends. The function returned with the iterator reports the error that ended
+// the last iteration.
+func (xp *Parser) EvaluateIter(xpath string) (iter.Seq[Item], func() error) {
+	var iterErr error
+	it, err := parseStringIter(xpath)
+	seq := func(yield func(Item) bool) {
+		if iterErr = err; iterErr != nil {
+			return
+		}
+		frame := xp.Ctx.newFrame()
+		if err := frame.beginEval(context.Background()); err != nil {
+			iterErr = err
+			return
+		}
+		iterErr = errorIn(it(frame, yield), xpath)
+	}
+	return seq, func() error { return iterErr }
+}
+
+func parseString(xpath string) (EvalFunc, error) {
+	tl, err := stringToTokenlist(xpath)
+	if err != nil {
+		return nil, errorIn(err, xpath)
+	}
+	ef, err := ParseXPath(tl)
+	return ef, errorIn(err, xpath)
+}
+
+func parseStringIter(xpath string) (iterFunc, error) {
+	tl, err := stringToTokenlist(xpath)
+	if err != nil {
+		return nil, errorIn(err, xpath)
+	}
+	n, err := parseTokens(tl)
+	if err != nil {
+		return nil, errorIn(err, xpath)
+	}
+	it, err := compileIter(optimize(n, nil))
+	return it, errorIn(err, xpath)
 }
 
 // NewParser returns a context to be filled
@@ -59,12 +59,15 @@ func TestEval(t *testing.T) {
 		input  string
 		result Sequence
 	}{
-		{`string(xs:time("11:23:00")) `, Sequence{"11:23:00Z"}},
+		{`string(xs:time("11:23:00")) `, Sequence{"11:23:00"}},
+		{`string(xs:time("11:23:00Z")) `, Sequence{"11:23:00Z"}},
 		{`string-to-codepoints( "hellö" ) `, Sequence{104, 101, 108, 108, 246}},
 		{`codepoints-to-string( (65,33*2,67) )`, Sequence{"ABC"}},
 		{`count(/root/other | /root/other)`, Sequence{2}},
 		{`count(/root/sub | /root/other)`, Sequence{5}},
 		{`count(/root/sub | /root/other | /root/a)`, Sequence{7}},
+		{`(1, 'a') ! (. instance of xs:anyAtomicType)`, Sequence{true, true}},
+		{`/root instance of xs:anyAtomicType`, Sequence{false}},
 		{`/root/@zzz instance of attribute()+`, Sequence{false}},
 		{`/root/@foo instance of attribute()+`, Sequence{true}},
 		{`/root/sub instance of element()?`, Sequence{false}},
@@ -181,8 +184,8 @@ func TestEval(t *testing.T) {
 		{`count(/root/a/sub[1])`, Sequence{2}},
 		{`(count(/root/a/sub)[1])`, Sequence{4}},
 		{`count( (/root/a/sub)[2]) `, Sequence{1}},
-		{`count( /root/sub[position() mod 2 = 0])) `, Sequence{1}},
-		{`count( /root/sub[position() mod 2 = 1])) `, Sequence{2}},
+		{`count( /root/sub[position() mod 2 = 0]) `, Sequence{1}},
+		{`count( /root/sub[position() mod 2 = 1]) `, Sequence{2}},
 		{`contains((), "a")`, Sequence{false}},
 		{`contains("", "")`, Sequence{true}},
 		{`contains("Shakespeare", "")`, Sequence{true}},
@@ -332,8 +335,8 @@ func TestEval(t *testing.T) {
 		{`substring-before("tattoo", "attoo")  `, Sequence{"t"}},
 		{`substring-before ( "tattoo", "tatto") `, Sequence{""}},
 		{`substring-before ( (), ()) `, Sequence{""}},
-		{`tokenize("12, 16, 2", ",\s*")"`, Sequence{"12", "16", "2"}},
-		{`tokenize("abc[NL]def[XY]", "\[.*?\]")"`, Sequence{"abc", "def", ""}},
+		{`tokenize("12, 16, 2", ",\s*")`, Sequence{"12", "16", "2"}},
+		{`tokenize("abc[NL]def[XY]", "\[.*?\]")`, Sequence{"abc", "def", ""}},
 		{`tokenize("Go home, Jack!","\W+")`, Sequence{"Go", "home", "Jack", ""}},
 		{`translate("bar","abc","ABC")  `, Sequence{"BAr"}},
 		{`translate("--aaa--","abc-","ABC")  `, Sequence{"AAA"}},
@@ -348,7 +351,7 @@ func TestEval(t *testing.T) {
 		{`count(/root/sub/descendant-or-self::sub)  `, Sequence{3}},
 		{`/root/sub/text()  `, Sequence{"123", "sub2", "contents sub3"}},
 		{`count(/root/sub/descendant-or-self::text())  `, Sequence{4}},
-		{`/root/sub/descendant-or-self::text()[2])  `, Sequence{"subsub"}},
+		{`/root/sub/descendant-or-self::text()[2]  `, Sequence{"subsub"}},
 		{`(/root/*/descendant::sub/@p)[4] = "a2/2"  `, Sequence{true}},
 		{`count(/root/*/descendant::sub[1]) `, Sequence{2}},
 		{`count( /root/sub[3]/following-sibling::element() )`, Sequence{4}},
@@ -555,6 +558,12 @@ func TestNSEval(t *testing.T) {
 		{`namespace-uri-from-QName(resolve-QName("a:sub", /a:root))`, Sequence{"anamespace"}},
 		{`namespace-uri-for-prefix("a", /a:root)`, Sequence{"anamespace"}},
 		{`namespace-uri-for-prefix("xml", /a:root)`, Sequence{"http://www.w3.org/XML/1998/namespace"}},
+		{`count(/a:root/*:sub)`, Sequence{1}},
+		{`count(/a:root/*:other)`, Sequence{0}},
+		{`count(/*:root/a:*)`, Sequence{1}},
+		{`string(/Q{anamespace}root/Q{anamespace}sub)`, Sequence{"text"}},
+		{`count(/Q{anamespace}root/Q{anamespace}*)`, Sequence{1}},
+		{`count(/Q{anamespace}root/Q{other}*)`, Sequence{0}},
 	}
 	for _, td := range testdata {
 		sr := strings.NewReader(nsDoc)
@@ -592,3 +601,48 @@ func itemsEqual(a, b any) bool {
 	}
 	return false
 }
+
+func TestErrorPosition(t *testing.T) {
+	testdata := []struct {
+		input string
+		code  string
+		pos   string
+	}{
+		{`count(/root/sub) + nofn(1)`, "XPST0017", "1:20"},
+		{`/root/sub[xs:integer('x') = 1]`, "FORG0001", "1:11"},
+		{`(1,2) eq 1`, "XPTY0004", "1:7"},
+		{"for $i in 1 to 3\nreturn\n\tfoo:bar($i)", "XPST0081", "3:2"},
+		{`if (1) then`, "XPST0003", "1:12"},
+		{`1 + ;`, "XPST0003", "1:5"},
+		{`1 + 2 3`, "XPST0003", "1:7"},
+		{`(1, 2) ! (. instance of xs:nosuch)`, "XPST0051", "1:13"},
+	}
+	for _, td := range testdata {
+		np, err := NewParser(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = np.EvaluateUncached(td.input)
+		xe, ok := err.(*XPathError)
+		if !ok {
+			t.Errorf("%s: got error %v, want an XPathError", td.input, err)
+			continue
+		}
+		if xe.Code != td.code || xe.Pos.String() != td.pos || xe.Expr != td.input {
+			t.Errorf("%s: got %s at %s in %q, want %s at %s", td.input, xe.Code, xe.Pos, xe.Expr, td.code, td.pos)
+		}
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	np, err := NewParser(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	np.SetVariable("a", Sequence{1})
+	_, err = np.EvaluateUncached("1 +\n\t$a treat as xs:string")
+	expected := "XPDY0050: " + err.(*XPathError).Description + " (line 2, column 5)\n\t$a treat as xs:string\n\t   ^"
+	if got := FormatError(err); got != expected {
+		t.Errorf("FormatError() = %q, want %q", got, expected)
+	}
+}